@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+const (
+	apiKeySize = 32
+
+	// Like session fingerprints, API key IDs are a prefix of the
+	// key's hash, so that keys can be told apart and revoked without
+	// the key itself
+	apiKeyIDLen = sessionFingerprintLen
+
+	maxAPIKeyBodySize = 1 << 10
+	maxAPIKeyNameLen  = 100
+)
+
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKey is a long-lived credential standing in for a miniLock ID's
+// login, for scripts that can't log in interactively. Only the hash
+// of its secret is stored.
+type APIKey struct {
+	ID         string     `json:"id"`
+	MinilockID string     `json:"-"`
+	Name       string     `json:"name"`
+	Created    time.Time  `json:"created"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+func (key *APIKey) expired(now time.Time) bool {
+	return key.ExpiresAt != nil && !now.Before(*key.ExpiresAt)
+}
+
+// APIKeyStore stores API keys by the hash of their secrets (see
+// hashAPIKey).
+type APIKeyStore interface {
+	AddAPIKey(keyHash string, key APIKey) error
+	// GetAPIKey returns ErrAPIKeyNotFound if keyHash is unknown or
+	// has expired
+	GetAPIKey(keyHash string) (*APIKey, error)
+	APIKeys(mID string) ([]APIKey, error)
+	DeleteAPIKey(mID, id string) error
+}
+
+// newAPIKeyStore returns an APIKeyStore kept alongside the sessions in
+// m: in Redis if that's where they are, else in memory.
+func newAPIKeyStore(m Store) APIKeyStore {
+	if keys, ok := m.(APIKeyStore); ok {
+		return keys
+	}
+	return NewAPIKeyMapper()
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyMapper is an in-memory APIKeyStore.
+type APIKeyMapper struct {
+	mu   sync.Mutex
+	keys map[string]APIKey // By hash
+	now  func() time.Time
+}
+
+func NewAPIKeyMapper() *APIKeyMapper {
+	return &APIKeyMapper{keys: map[string]APIKey{}, now: time.Now}
+}
+
+func (am *APIKeyMapper) AddAPIKey(keyHash string, key APIKey) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	am.keys[keyHash] = key
+	return nil
+}
+
+func (am *APIKeyMapper) GetAPIKey(keyHash string) (*APIKey, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	key, ok := am.keys[keyHash]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	if key.expired(am.now()) {
+		delete(am.keys, keyHash)
+		return nil, ErrAPIKeyNotFound
+	}
+	return &key, nil
+}
+
+func (am *APIKeyMapper) APIKeys(mID string) ([]APIKey, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	now := am.now()
+	var keys []APIKey
+	for keyHash, key := range am.keys {
+		if key.expired(now) {
+			delete(am.keys, keyHash)
+			continue
+		}
+		if key.MinilockID == mID {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	return keys, nil
+}
+
+func (am *APIKeyMapper) DeleteAPIKey(mID, id string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	for keyHash, key := range am.keys {
+		if key.MinilockID == mID && key.ID == id {
+			delete(am.keys, keyHash)
+			return nil
+		}
+	}
+	return ErrAPIKeyNotFound
+}
+
+// APIKeyAuthenticator authenticates requests by API key, sent as
+// `Authorization: ApiKey <key>`, or in X-Api-Key if Authorization is
+// being used for HTTP Basic Auth. The identity is the key's miniLock
+// ID.
+type APIKeyAuthenticator struct {
+	keys APIKeyStore
+}
+
+func NewAPIKeyAuthenticator(keys APIKeyStore) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{keys: keys}
+}
+
+func (aa *APIKeyAuthenticator) Authenticate(req *http.Request) (string, bool, error) {
+	secret := apiKeyFromRequest(req)
+	if secret == "" {
+		return "", false, nil
+	}
+	key, err := aa.keys.GetAPIKey(hashAPIKey(secret))
+	if err == ErrAPIKeyNotFound {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return key.MinilockID, true, nil
+}
+
+func apiKeyFromRequest(req *http.Request) string {
+	auth := strings.TrimSpace(req.Header.Get("Authorization"))
+	if strings.HasPrefix(auth, "ApiKey ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "ApiKey "))
+	}
+	if auth == "" || strings.HasPrefix(auth, "Basic ") {
+		return strings.TrimSpace(req.Header.Get("X-Api-Key"))
+	}
+	return ""
+}
+
+type createAPIKeyBody struct {
+	Name      string     `json:"name"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type createAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// CreateAPIKey mints an API key for the caller's miniLock ID, named
+// and optionally expiring as the request body says, e.g.
+// {"name":"nightly backup","expires_at":"2027-01-01T00:00:00Z"}. The
+// key itself is only ever in this response. Only logged-in users can
+// mint keys, so that a leaked key can't be used to mint more.
+func CreateAPIKey(m Store, keys APIKeyStore, audit *AuditLog) func(w http.ResponseWriter, req *http.Request) {
+	return RequireAuth(NewTokenAuthenticator(m))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mID := RequestIdentity(req)
+
+		var body createAPIKeyBody
+		err := json.NewDecoder(http.MaxBytesReader(w, req.Body,
+			maxAPIKeyBodySize)).Decode(&body)
+		if err != nil {
+			WriteErrorStatus(w, "Error parsing request body", err,
+				http.StatusBadRequest)
+			return
+		}
+		if len(body.Name) > maxAPIKeyNameLen {
+			WriteErrorStatus(w, "Error: name too long", nil,
+				http.StatusBadRequest)
+			return
+		}
+		now := time.Now().UTC().Truncate(time.Second)
+		if body.ExpiresAt != nil && !body.ExpiresAt.After(now) {
+			WriteErrorStatus(w, "Error: expires_at must be in the future", nil,
+				http.StatusBadRequest)
+			return
+		}
+
+		raw := make([]byte, apiKeySize)
+		if _, err := rand.Read(raw); err != nil {
+			WriteError(w, "Error generating API key; sorry!", err)
+			return
+		}
+		secret := base64.RawURLEncoding.EncodeToString(raw)
+		keyHash := hashAPIKey(secret)
+
+		key := APIKey{
+			ID:         keyHash[:apiKeyIDLen],
+			MinilockID: mID,
+			Name:       body.Name,
+			Created:    now,
+		}
+		if body.ExpiresAt != nil {
+			expiresAt := body.ExpiresAt.UTC()
+			key.ExpiresAt = &expiresAt
+		}
+		if err := keys.AddAPIKey(keyHash, key); err != nil {
+			audit.Failure(req, "create_api_key", mID, "error saving API key")
+			WriteError(w, "Error saving API key; sorry!", err)
+			return
+		}
+		log.Infof("CreateAPIKey: `%s` created API key %s", mID, key.ID)
+		audit.Success(req, "create_api_key", mID, "created API key "+key.ID)
+
+		resp, _ := json.Marshal(createAPIKeyResponse{APIKey: key, Key: secret})
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(resp)
+	})).ServeHTTP
+}
+
+// ListAPIKeys lists the caller's unexpired API keys, without the keys
+// themselves.
+func ListAPIKeys(m Store, keys APIKeyStore) func(w http.ResponseWriter, req *http.Request) {
+	return RequireAuth(NewTokenAuthenticator(m))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		active, err := keys.APIKeys(RequestIdentity(req))
+		if err != nil {
+			WriteError(w, "Error listing API keys; sorry!", err)
+			return
+		}
+		if active == nil {
+			active = []APIKey{}
+		}
+
+		body, _ := json.Marshal(map[string]interface{}{"api_keys": active})
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(body)
+	})).ServeHTTP
+}
+
+// RevokeAPIKey revokes the caller's API key with the ID in the URL.
+func RevokeAPIKey(m Store, keys APIKeyStore, audit *AuditLog) func(w http.ResponseWriter, req *http.Request) {
+	return RequireAuth(NewTokenAuthenticator(m))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mID, id := RequestIdentity(req), mux.Vars(req)["id"]
+
+		err := keys.DeleteAPIKey(mID, id)
+		if err == ErrAPIKeyNotFound {
+			audit.Failure(req, "revoke_api_key", mID, "no such API key "+id)
+			WriteErrorStatus(w, "Error: no such API key", err,
+				http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			audit.Failure(req, "revoke_api_key", mID, "error revoking API key")
+			WriteError(w, "Error revoking API key; sorry!", err)
+			return
+		}
+		log.Infof("RevokeAPIKey: `%s` revoked API key %s", mID, id)
+		audit.Success(req, "revoke_api_key", mID, "revoked API key "+id)
+
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP
+}
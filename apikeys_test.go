@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mintTestAPIKey creates an API key via handler, authenticating with
+// authToken
+func mintTestAPIKey(t *testing.T, handler http.Handler, authToken, body string) createAPIKeyResponse {
+	req := httptest.NewRequest("POST", "/api/apikeys", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+authToken)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	var resp createAPIKeyResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestAPIKeyStoresOnlyHash(t *testing.T) {
+	m := NewMapper()
+	require.NoError(t, m.SetMinilockID("token123", "mID456"))
+	keys := NewAPIKeyMapper()
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/apikeys", CreateAPIKey(m, keys, nil)).Methods("POST")
+	resp := mintTestAPIKey(t, r, "token123",
+		`{"name":"backups","expires_at":"2999-01-01T00:00:00Z"}`)
+
+	assert.NotEmpty(t, resp.Key)
+	assert.Equal(t, "backups", resp.Name)
+	require.NotNil(t, resp.ExpiresAt)
+	assert.Equal(t, 2999, resp.ExpiresAt.Year())
+
+	require.Len(t, keys.keys, 1)
+	for keyHash, key := range keys.keys {
+		assert.Equal(t, hashAPIKey(resp.Key), keyHash)
+		assert.NotContains(t, keyHash, resp.Key)
+		assert.Equal(t, "mID456", key.MinilockID)
+		assert.Equal(t, keyHash[:apiKeyIDLen], key.ID)
+		assert.Equal(t, resp.ID, key.ID)
+		encoded, err := json.Marshal(key)
+		require.NoError(t, err)
+		assert.NotContains(t, string(encoded), resp.Key)
+	}
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	authHeaders := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authHeaders <- req.Header.Get("Authorization")
+		w.Write([]byte("[]"))
+	}))
+	defer upstream.Close()
+
+	cfg := testConfig()
+	cfg.PostgrestBaseURL = upstream.URL
+	cfg.PostgrestJWTSecret = "test secret"
+	router := mustNewRouterConfig(cfg, NewMapper())
+
+	keypair := newTestKeypair(t)
+	authToken := testLogin(t, router, keypair)
+	apiKey := mintTestAPIKey(t, router, authToken, `{"name":"importer"}`)
+	assert.Nil(t, apiKey.ExpiresAt)
+
+	// Used for PostgREST in place of a login
+	useKey := http.Header{"Authorization": {"ApiKey " + apiKey.Key}}
+	testURL(t, "GET", "/postgrest/tasks", useKey, router, http.StatusOK, "[]")
+	authHeader := <-authHeaders
+	assert.NotContains(t, authHeader, apiKey.Key)
+	claims := verifyTestJWT(t, []byte(cfg.PostgrestJWTSecret),
+		strings.TrimPrefix(authHeader, "Bearer "))
+	assert.Equal(t, testMinilockID(t, keypair), claims.MinilockID)
+
+	// ...but can't mint more keys
+	req := httptest.NewRequest("POST", "/api/apikeys", strings.NewReader(`{}`))
+	req.Header.Set("Authorization", "ApiKey "+apiKey.Key)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// Listed without the key itself
+	withToken := http.Header{"Authorization": {"Bearer " + authToken}}
+	req = httptest.NewRequest("GET", "/api/apikeys", nil)
+	req.Header = withToken
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"id":"`+apiKey.ID+`"`)
+	assert.NotContains(t, rec.Body.String(), apiKey.Key)
+
+	// Revoked
+	testURL(t, "DELETE", "/api/apikeys/"+apiKey.ID, withToken, router,
+		http.StatusOK, "")
+	testURL(t, "DELETE", "/api/apikeys/"+apiKey.ID, withToken, router,
+		http.StatusNotFound, "")
+	testURL(t, "GET", "/postgrest/tasks", useKey, router,
+		http.StatusUnauthorized, "")
+}
+
+func TestAPIKeyExpiry(t *testing.T) {
+	keys := NewAPIKeyMapper()
+	now := time.Now()
+	keys.now = func() time.Time { return now }
+
+	expiresAt := now.Add(time.Hour)
+	keyHash := hashAPIKey("secret")
+	require.NoError(t, keys.AddAPIKey(keyHash, APIKey{
+		ID: keyHash[:apiKeyIDLen], MinilockID: "mID", ExpiresAt: &expiresAt,
+	}))
+
+	aa := NewAPIKeyAuthenticator(keys)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "ApiKey secret")
+	identity, ok, err := aa.Authenticate(req)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "mID", identity)
+
+	now = expiresAt
+	_, ok, err = aa.Authenticate(req)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestCreateAPIKeyRejectsPastExpiry(t *testing.T) {
+	m := NewMapper()
+	require.NoError(t, m.SetMinilockID("token123", "mID456"))
+
+	req := httptest.NewRequest("POST", "/api/apikeys",
+		strings.NewReader(`{"expires_at":"2000-01-01T00:00:00Z"}`))
+	req.Header.Set("Authorization", "Bearer token123")
+	rec := httptest.NewRecorder()
+	CreateAPIKey(m, NewAPIKeyMapper(), nil)(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
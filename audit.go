@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// How many characters of a miniLock ID the audit log keeps; enough to
+// tell users apart without logging their full IDs
+const auditMinilockIDLen = 8
+
+// AuditLog records logins, logouts, session revocations, and requests
+// refused with a 401 or 429 (see auditRoutes), and whether they
+// succeeded, as JSON lines separate from the app log, and/or keeps the
+// latest of them in memory (see AuditTail). A nil *AuditLog records
+// nothing.
+type AuditLog struct {
+	logger         *log.Logger // nil if only kept in memory
+	tail           *auditRing  // nil if only logged
+	file           *os.File    // nil unless logged to a file
+	trustedProxies []net.IPNet
+}
+
+// AuditEvent is an event as AuditTail reports it.
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	MinilockID string    `json:"minilock_id"`
+	IP         string    `json:"ip"`
+	Result     string    `json:"result"`
+	Reason     string    `json:"reason"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+// NewAuditLog returns an AuditLog writing to cfg.AuditLog: "stdout",
+// or a file to append to until it's closed, and keeping the last
+// cfg.AuditTailSize events in memory. It returns nil if neither is
+// set.
+func NewAuditLog(cfg *Config) (*AuditLog, error) {
+	var tail *auditRing
+	if cfg.AuditTailSize > 0 {
+		tail = newAuditRing(cfg.AuditTailSize)
+	}
+
+	var out io.Writer
+	var file *os.File
+	switch cfg.AuditLog {
+	case "":
+		if tail == nil {
+			return nil, nil
+		}
+		return &AuditLog{tail: tail, trustedProxies: cfg.TrustedProxies}, nil
+	case "stdout":
+		out = os.Stdout
+	default:
+		f, err := os.OpenFile(cfg.AuditLog,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		out, file = f, f
+	}
+	a := newAuditLogTo(out, cfg.TrustedProxies)
+	a.tail = tail
+	a.file = file
+	return a, nil
+}
+
+// Close closes the file a writes to, if any. Nothing more should be
+// recorded after.
+func (a *AuditLog) Close() {
+	if a == nil || a.file == nil {
+		return
+	}
+	if err := a.file.Close(); err != nil {
+		log.Errorf("Error closing audit log: %v", err)
+	}
+}
+
+func newAuditLogTo(out io.Writer, trustedProxies []net.IPNet) *AuditLog {
+	logger := log.New()
+	logger.Out = out
+	logger.Formatter = &log.JSONFormatter{TimestampFormat: time.RFC3339Nano}
+	logger.Level = log.InfoLevel
+	return &AuditLog{logger: logger, trustedProxies: trustedProxies}
+}
+
+// Success records that mID's event (e.g., "login"), made by req,
+// succeeded, and why or how.
+func (a *AuditLog) Success(req *http.Request, event, mID, reason string) {
+	a.record(req, event, mID, "success", reason)
+}
+
+// Failure records that mID's event, made by req, failed, and why.
+func (a *AuditLog) Failure(req *http.Request, event, mID, reason string) {
+	a.record(req, event, mID, "failure", reason)
+}
+
+func (a *AuditLog) record(req *http.Request, event, mID, result, reason string) {
+	if a == nil {
+		return
+	}
+	// So that auditRoutes doesn't record the same request again
+	if audited, ok := req.Context().Value(auditedKey).(*bool); ok {
+		*audited = true
+	}
+
+	e := AuditEvent{
+		Time:       time.Now().UTC(),
+		Event:      event,
+		MinilockID: truncateMinilockID(mID),
+		IP:         clientIP(req, a.trustedProxies),
+		Result:     result,
+		Reason:     reason,
+		RequestID:  requestID(req),
+	}
+	if a.tail != nil {
+		a.tail.add(e)
+	}
+	if a.logger == nil {
+		return
+	}
+
+	fields := log.Fields{
+		"event":       e.Event,
+		"minilock_id": e.MinilockID,
+		"ip":          e.IP,
+		"result":      e.Result,
+		"reason":      e.Reason,
+	}
+	if e.RequestID != "" {
+		fields["request_id"] = e.RequestID
+	}
+	a.logger.WithFields(fields).Info("audit")
+}
+
+func truncateMinilockID(mID string) string {
+	if len(mID) <= auditMinilockIDLen {
+		return mID
+	}
+	return mID[:auditMinilockIDLen] + "..."
+}
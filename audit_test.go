@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newAuditedRouter returns a router whose audit log is written to the
+// file it also returns
+func newAuditedRouter(t *testing.T, m Store) (http.Handler, string) {
+	cfg := testConfig()
+	cfg.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+	return mustNewRouterConfig(cfg, m), cfg.AuditLog
+}
+
+func readAuditLog(t *testing.T, path string) []map[string]interface{} {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestAuditLogLogin(t *testing.T) {
+	router, path := newAuditedRouter(t, NewMapper())
+	keypair := newTestKeypair(t)
+	mID := testMinilockID(t, keypair)
+
+	testLogin(t, router, keypair)
+
+	records := readAuditLog(t, path)
+	require.Len(t, records, 1)
+	assert.Equal(t, "login", records[0]["event"])
+	assert.Equal(t, mID[:auditMinilockIDLen]+"...", records[0]["minilock_id"])
+	assert.Equal(t, "192.0.2.1", records[0]["ip"])
+	assert.Equal(t, "success", records[0]["result"])
+	assert.Equal(t, "challenge", records[0]["reason"])
+	assert.NotEmpty(t, records[0]["time"])
+}
+
+func TestAuditLogLoginFailures(t *testing.T) {
+	router, path := newAuditedRouter(t, NewMapper())
+	keypair := newTestKeypair(t)
+	mID := testMinilockID(t, keypair)
+
+	// Well-formed, but with a bad checksum, so taber.FromID rejects it
+	badID := mID[:len(mID)-1] + "1"
+	if badID == mID {
+		badID = mID[:len(mID)-1] + "2"
+	}
+	rec := postLogin(router, "application/json",
+		`{"minilock_id":"`+badID+`","nonce":"deadbeef"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	testChallenge(t, router, keypair)
+	rec = postChallengeLogin(t, router, keypair, "deadbeef")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	records := readAuditLog(t, path)
+	require.Len(t, records, 2)
+	for _, record := range records {
+		assert.Equal(t, "login", record["event"])
+		assert.Equal(t, "failure", record["result"])
+		assert.Equal(t, mID[:auditMinilockIDLen]+"...", record["minilock_id"])
+	}
+	assert.Contains(t, records[0]["reason"], "Error validating miniLock ID")
+	assert.Equal(t, ErrChallengeMismatch.Error(), records[1]["reason"])
+}
+
+func TestAuditLogLogout(t *testing.T) {
+	router, path := newAuditedRouter(t, NewMapper())
+	authToken := testLogin(t, router, newTestKeypair(t))
+
+	testURL(t, "POST", "/api/logout",
+		http.Header{"Authorization": {"Bearer " + authToken}}, router,
+		http.StatusOK, "")
+
+	records := readAuditLog(t, path)
+	require.Len(t, records, 2)
+	assert.Equal(t, "logout", records[1]["event"])
+	assert.Equal(t, "success", records[1]["result"])
+}
+
+func TestAuditLogClose(t *testing.T) {
+	cfg := testConfig()
+	cfg.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+	audit, err := NewAuditLog(cfg)
+	require.NoError(t, err)
+
+	audit.Close()
+	_, err = audit.file.WriteString("{}\n")
+	assert.True(t, errors.Is(err, os.ErrClosed), "%v", err)
+
+	// stdout is left open
+	cfg.AuditLog = "stdout"
+	audit, err = NewAuditLog(cfg)
+	require.NoError(t, err)
+	audit.Close()
+	assert.Nil(t, audit.file)
+
+	// Safe to call anyway
+	(*AuditLog)(nil).Close()
+}
+
+func TestAuditLogDisabled(t *testing.T) {
+	audit, err := NewAuditLog(testConfig())
+	require.NoError(t, err)
+	assert.Nil(t, audit)
+
+	// Safe to call anyway
+	audit.Failure(httptest.NewRequest("GET", "/", nil), "login", "", "test")
+}
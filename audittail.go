@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// How many events GET /internal/audit-tail returns unless told
+// otherwise with ?n=
+const AUDIT_TAIL_DEFAULT_N = 50
+
+const auditedKey contextKey = "audited"
+
+// auditRing keeps the last len(events) audit events, overwriting the
+// oldest once it's full.
+type auditRing struct {
+	lock   sync.Mutex
+	events []AuditEvent
+	next   int // Where the next event goes
+	full   bool
+}
+
+func newAuditRing(size int) *auditRing {
+	return &auditRing{events: make([]AuditEvent, size)}
+}
+
+func (ring *auditRing) add(e AuditEvent) {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+
+	ring.events[ring.next] = e
+	ring.next = (ring.next + 1) % len(ring.events)
+	if ring.next == 0 {
+		ring.full = true
+	}
+}
+
+// latest returns up to the last n events, newest first.
+func (ring *auditRing) latest(n int) []AuditEvent {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+
+	have := ring.next
+	if ring.full {
+		have = len(ring.events)
+	}
+	if n > have {
+		n = have
+	}
+
+	events := make([]AuditEvent, n)
+	for i := range events {
+		events[i] = ring.events[(ring.next-1-i+len(ring.events))%len(ring.events)]
+	}
+	return events
+}
+
+// AuditTail responds with the latest audit events kept in memory,
+// newest first, e.g. GET /internal/audit-tail?n=50 for the last 50
+// (AUDIT_TAIL_DEFAULT_N if n isn't given, and no more than are kept),
+// for looking into an incident without having to go find the audit
+// log. Like the log, it's as sensitive as the rest of the admin routes.
+func AuditTail(a *AuditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if a == nil || a.tail == nil {
+			WriteErrorStatus(w, "Error: audit tail disabled; set"+
+				" AUDIT_TAIL_SIZE to enable it", nil, http.StatusNotFound)
+			return
+		}
+
+		n := AUDIT_TAIL_DEFAULT_N
+		if nStr := req.URL.Query().Get("n"); nStr != "" {
+			var err error
+			n, err = strconv.Atoi(nStr)
+			if err != nil || n < 1 {
+				WriteErrorStatus(w, "Error: n must be a positive number", err,
+					http.StatusBadRequest)
+				return
+			}
+		}
+
+		body, err := json.Marshal(map[string][]AuditEvent{
+			"events": a.tail.latest(n),
+		})
+		if err != nil {
+			WriteError(w, "Error listing audit events; sorry!", err)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(body)
+	}
+}
+
+// auditRoutes wraps the handler of every route registered on r so that
+// requests refused with a 401 or a 429 (e.g., a bad auth token, or too
+// many logins) are audited too, unless the handler already audited
+// them itself (e.g., a failed login).
+func auditRoutes(r *mux.Router, a *AuditLog) {
+	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if h := route.GetHandler(); h != nil {
+			route.Handler(auditedRoute{h: h, audit: a})
+		}
+		return nil
+	})
+}
+
+// auditedRoute is a route's handler as wrapped by auditRoutes.
+type auditedRoute struct {
+	h     http.Handler
+	audit *AuditLog
+}
+
+func (ar auditedRoute) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var audited bool
+	rec := &statusRecorder{ResponseWriter: w}
+	ar.h.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(),
+		auditedKey, &audited)))
+	if audited {
+		return
+	}
+
+	reason := fmt.Sprintf("%s %s", req.Method, req.URL.Path)
+	switch rec.status {
+	case http.StatusUnauthorized:
+		ar.audit.Failure(req, "unauthorized", "", reason)
+	case http.StatusTooManyRequests:
+		ar.audit.Failure(req, "rate_limited", "", reason)
+	}
+}
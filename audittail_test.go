@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditRing(t *testing.T) {
+	ring := newAuditRing(3)
+	assert.Empty(t, ring.latest(10))
+
+	for i := 1; i <= 5; i++ {
+		ring.add(AuditEvent{Reason: fmt.Sprint(i)})
+	}
+	reasons := func(events []AuditEvent) []string {
+		var reasons []string
+		for _, e := range events {
+			reasons = append(reasons, e.Reason)
+		}
+		return reasons
+	}
+	assert.Equal(t, []string{"5", "4", "3"}, reasons(ring.latest(10)))
+	assert.Equal(t, []string{"5", "4"}, reasons(ring.latest(2)))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ring.add(AuditEvent{Reason: "concurrent"})
+			ring.latest(3)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, []string{"concurrent", "concurrent", "concurrent"},
+		reasons(ring.latest(3)))
+}
+
+// newAuditTailRouter returns a router for cfg with admin routes, and a
+// function that GETs the audit tail from it with query
+func newAuditTailRouter(t *testing.T, cfg *Config) (http.Handler, func(query string) []AuditEvent) {
+	cfg.BasicAuthUsername = "admin"
+	cfg.BasicAuthPassword = "correct horse battery staple"
+	cfg.BasicAuthRoutes = "admin"
+	router := mustNewRouterConfig(cfg, NewMapper())
+
+	return router, func(query string) []AuditEvent {
+		req := httptest.NewRequest("GET", "/internal/audit-tail"+query, nil)
+		req.SetBasicAuth(cfg.BasicAuthUsername, cfg.BasicAuthPassword)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		var body struct {
+			Events []AuditEvent `json:"events"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return body.Events
+	}
+}
+
+func auditEventSummaries(events []AuditEvent) []string {
+	var summaries []string
+	for _, e := range events {
+		summaries = append(summaries, e.Event+" "+e.Result+" "+e.Reason)
+	}
+	return summaries
+}
+
+func TestAuditTail(t *testing.T) {
+	cfg := testConfig()
+	cfg.AuditTailSize = 3
+	cfg.LoginRateLimitBurst = 2
+	router, tail := newAuditTailRouter(t, cfg)
+
+	keypair := newTestKeypair(t)
+	testLogin(t, router, keypair)
+	testURL(t, "GET", "/api/sessions", nil, router, http.StatusUnauthorized, "")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/challenge", nil))
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+
+	got := tail("")
+	assert.Equal(t, []string{
+		"rate_limited failure GET /api/challenge",
+		"unauthorized failure GET /api/sessions",
+		"login success challenge",
+	}, auditEventSummaries(got))
+	assert.Equal(t, "192.0.2.1", got[0].IP)
+	assert.False(t, got[0].Time.IsZero())
+	assert.Equal(t, truncateMinilockID(testMinilockID(t, keypair)),
+		got[2].MinilockID)
+
+	// Only the newest are kept, and only as many as asked for returned
+	testURL(t, "GET", "/internal/audit-tail", nil, router,
+		http.StatusUnauthorized, "")
+	assert.Equal(t, []string{
+		"unauthorized failure GET /internal/audit-tail",
+		"rate_limited failure GET /api/challenge",
+	}, auditEventSummaries(tail("?n=2")))
+	assert.Len(t, tail("?n=1000"), 3)
+
+	req := httptest.NewRequest("GET", "/internal/audit-tail?n=-1", nil)
+	req.SetBasicAuth(cfg.BasicAuthUsername, cfg.BasicAuthPassword)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestAuditTailFailedLogin(t *testing.T) {
+	cfg := testConfig()
+	cfg.AuditTailSize = 10
+	router, tail := newAuditTailRouter(t, cfg)
+
+	// A failed login is audited as such, not again as a 401
+	keypair := newTestKeypair(t)
+	testChallenge(t, router, keypair)
+	rec := postChallengeLogin(t, router, keypair, "deadbeef")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	assert.Equal(t, []string{"login failure " + ErrChallengeMismatch.Error()},
+		auditEventSummaries(tail("")))
+}
+
+func TestAuditTailDisabled(t *testing.T) {
+	testURL(t, "GET", "/internal/audit-tail", nil, router,
+		http.StatusNotFound, "")
+
+	rec := httptest.NewRecorder()
+	AuditTail(nil)(rec, httptest.NewRequest("GET", "/internal/audit-tail", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cryptag/minishare/miniware"
+)
+
+const authIdentityKey contextKey = "auth_identity"
+
+// How long clients are told to wait when the session store (e.g.,
+// Redis) can't be reached
+const STORE_UNAVAILABLE_RETRY_AFTER = 5 * time.Second
+
+// Authenticator is one way of telling who made a request, e.g. by
+// auth token or HTTP Basic Auth. Authenticate returns ok=false (and no
+// error) if req doesn't carry valid credentials for it, and an error
+// only if it couldn't check (e.g., the session store is down).
+type Authenticator interface {
+	Authenticate(req *http.Request) (identity string, ok bool, err error)
+}
+
+// challenger is implemented by Authenticators that can tell clients
+// how to authenticate, via WWW-Authenticate.
+type challenger interface {
+	Challenge() string
+}
+
+// RequireAuth returns middleware that only lets through requests that
+// one of authenticators, tried in order, accepts, with the identity
+// it returned in the request's context (see RequestIdentity). The
+// rest get a 401, or a 503 if an authenticator couldn't check.
+func RequireAuth(authenticators ...Authenticator) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			for _, a := range authenticators {
+				identity, ok, err := a.Authenticate(req)
+				if err != nil {
+					writeStoreUnavailable(w, miniware.AuthError, err)
+					return
+				}
+				if ok {
+					h.ServeHTTP(w, withIdentity(req, identity))
+					return
+				}
+			}
+
+			for _, a := range authenticators {
+				if c, ok := a.(challenger); ok {
+					w.Header().Add("WWW-Authenticate", c.Challenge())
+				}
+			}
+			WriteErrorStatus(w, miniware.AuthError, nil,
+				http.StatusUnauthorized)
+		})
+	}
+}
+
+// writeStoreUnavailable tells the client that its credentials couldn't
+// be checked or saved right now, rather than that they're invalid, so
+// that it retries instead of sending the user back to log in.
+func writeStoreUnavailable(w http.ResponseWriter, errStr string, err error) {
+	setStoreUnavailable(w, err)
+	WriteErrorStatus(w, errStr+"; try again shortly", err,
+		http.StatusServiceUnavailable)
+}
+
+// setStoreUnavailable logs err and tells the client when to retry,
+// ahead of a 503.
+func setStoreUnavailable(w http.ResponseWriter, err error) {
+	log.Errorf("Session store unavailable: %v", err)
+	w.Header().Set("Retry-After",
+		strconv.Itoa(int(STORE_UNAVAILABLE_RETRY_AFTER/time.Second)))
+}
+
+func withIdentity(req *http.Request, identity string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), authIdentityKey, identity))
+}
+
+// RequestIdentity returns who RequireAuth found req to be from (e.g.,
+// a miniLock ID), or "" if it wasn't authenticated.
+func RequestIdentity(req *http.Request) string {
+	identity, _ := req.Context().Value(authIdentityKey).(string)
+	return identity
+}
+
+// TokenAuthenticator authenticates requests by the auth token issued
+// at login, sent in the Authorization header (optionally prefixed with
+// "Bearer "), or in X-Auth-Token if Authorization is being used for
+// HTTP Basic Auth. The identity is the token's miniLock ID. If the
+// store is a LastSeenTracker, each use of a token is recorded.
+type TokenAuthenticator struct {
+	store Store
+}
+
+func NewTokenAuthenticator(m Store) *TokenAuthenticator {
+	return &TokenAuthenticator{store: m}
+}
+
+func (ta *TokenAuthenticator) Authenticate(req *http.Request) (string, bool, error) {
+	authToken := authTokenFromRequest(req)
+	if authToken == "" {
+		return "", false, nil
+	}
+	mID, err := ta.store.GetMinilockID(authToken)
+	if err == miniware.ErrAuthTokenNotFound || err == ErrAuthTokenExpired {
+		log.Debugf("Rejecting auth token: %v", err)
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if tracker, ok := ta.store.(*LastSeenTracker); ok {
+		tracker.Seen(authToken)
+	}
+	return mID, true, nil
+}
+
+// authTokenFromRequest returns the auth token req was made with, or
+// "" if none.
+func authTokenFromRequest(req *http.Request) string {
+	authToken := strings.TrimSpace(req.Header.Get("Authorization"))
+	if authToken == "" || strings.HasPrefix(authToken, "Basic ") {
+		authToken = strings.TrimSpace(req.Header.Get("X-Auth-Token"))
+	}
+	return strings.TrimSpace(strings.TrimPrefix(authToken, "Bearer "))
+}
+
+// BasicAuthenticator authenticates requests by HTTP Basic Auth
+// credentials. Both the username and password are always checked,
+// so a wrong username takes as long to reject as a wrong password.
+// The identity is the username.
+type BasicAuthenticator struct {
+	username, password string
+}
+
+func NewBasicAuthenticator(username, password string) *BasicAuthenticator {
+	return &BasicAuthenticator{username: username, password: password}
+}
+
+func (ba *BasicAuthenticator) Authenticate(req *http.Request) (string, bool, error) {
+	user, pass, ok := req.BasicAuth()
+	if !ok {
+		return "", false, nil
+	}
+	userOK := secureCompare(user, ba.username)
+	passOK := secureCompare(pass, ba.password)
+	if !userOK || !passOK {
+		return "", false, nil
+	}
+	return user, true, nil
+}
+
+func (ba *BasicAuthenticator) Challenge() string {
+	return `Basic realm="Restricted"`
+}
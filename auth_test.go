@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cryptag/minishare/miniware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// downStore is a session store that can't be reached while down is
+// set, e.g. Redis during an outage
+type downStore struct {
+	*Mapper
+	down bool
+}
+
+var errStoreDown = errors.New("dial tcp 10.0.0.9:6379: connection refused")
+
+func (ds *downStore) GetMinilockID(authToken string) (string, error) {
+	if ds.down {
+		return "", errStoreDown
+	}
+	return ds.Mapper.GetMinilockID(authToken)
+}
+
+func (ds *downStore) SetMinilockID(authToken, mID string) error {
+	if ds.down {
+		return errStoreDown
+	}
+	return ds.Mapper.SetMinilockID(authToken, mID)
+}
+
+func (ds *downStore) Ping() error {
+	if ds.down {
+		return errStoreDown
+	}
+	return nil
+}
+
+type failingAuthenticator struct{}
+
+func (failingAuthenticator) Authenticate(*http.Request) (string, bool, error) {
+	return "", false, errors.New("store unavailable")
+}
+
+// echoIdentity responds with the identity RequireAuth found
+var echoIdentity = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte(RequestIdentity(req)))
+})
+
+func TestRequireAuthChain(t *testing.T) {
+	m := NewMapper()
+	require.NoError(t, m.SetMinilockID("token123", "mID456"))
+
+	h := RequireAuth(NewBasicAuthenticator("admin", "hunter2"),
+		NewTokenAuthenticator(m))(echoIdentity)
+
+	serve := func(setup func(req *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		setup(req)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Basic auth fails to apply, then the token succeeds
+	rec := serve(func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer token123")
+	})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "mID456", rec.Body.String())
+
+	// Basic auth succeeds first
+	rec = serve(func(req *http.Request) { req.SetBasicAuth("admin", "hunter2") })
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "admin", rec.Body.String())
+
+	// Neither does
+	rec = serve(func(req *http.Request) {
+		req.SetBasicAuth("admin", "wrong")
+		req.Header.Set("X-Auth-Token", "revoked")
+	})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, `Basic realm="Restricted"`, rec.Header().Get("WWW-Authenticate"))
+	assert.Contains(t, rec.Body.String(), miniware.AuthError)
+}
+
+func TestRequireAuthError(t *testing.T) {
+	h := RequireAuth(failingAuthenticator{},
+		NewBasicAuthenticator("admin", "hunter2"))(echoIdentity)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("admin", "hunter2")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get("Retry-After"))
+	assert.NotContains(t, rec.Body.String(), "store unavailable")
+}
+
+func TestSessionStoreDown(t *testing.T) {
+	m := &downStore{Mapper: NewMapper()}
+	router := mustNewRouter(m)
+	keypair := newTestKeypair(t)
+	authToken := testLogin(t, router, keypair)
+	withToken := http.Header{"Authorization": {"Bearer " + authToken}}
+
+	m.down = true
+
+	// Get fails: the token may well be valid, so no 401
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/whoami", nil)
+	req.Header = withToken
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get("Retry-After"))
+	assert.NotContains(t, rec.Body.String(), "connection refused")
+
+	// Set fails
+	nonce := testChallenge(t, router, keypair)
+	rec = postChallengeLogin(t, router, keypair, nonce)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get("Retry-After"))
+
+	// Alive, but not ready
+	testURL(t, "GET", "/healthz", nil, router, http.StatusOK, "")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// Back to normal once it's back
+	m.down = false
+	testURL(t, "GET", "/api/whoami", withToken, router, http.StatusOK, "")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// How long a PostgREST upstream whose connection failed is skipped
+// for, when there are others to send requests to
+const POSTGREST_UPSTREAM_COOLDOWN = 10 * time.Second
+
+// Caps the length of the round-robin schedule
+const maxUpstreamWeight = 100
+
+// postgrestUpstream is one of the PostgREST servers we proxy to.
+type postgrestUpstream struct {
+	URL    *url.URL
+	Weight int
+
+	// Unix nanoseconds until which it's skipped, having failed
+	downUntil int64
+	// 1 if it failed its last health check (see
+	// UpstreamHealthChecker)
+	unhealthy int32
+}
+
+func (u *postgrestUpstream) up(now time.Time) bool {
+	return u.healthy() && atomic.LoadInt64(&u.downUntil) <= now.UnixNano()
+}
+
+// parsePostgrestUpstreams parses a comma-separated list of PostgREST
+// base URLs, each optionally followed by a weight, e.g.
+// "http://pg1:3000/ weight=3, http://pg2:3000/". Upstreams get
+// requests in proportion to their weights, which default to 1.
+func parsePostgrestUpstreams(baseURLs string) ([]*postgrestUpstream, error) {
+	var upstreams []*postgrestUpstream
+	for _, entry := range strings.Split(baseURLs, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+
+		u, err := parsePostgrestURL(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		upstream := &postgrestUpstream{URL: u, Weight: 1}
+		for _, param := range fields[1:] {
+			if !strings.HasPrefix(param, "weight=") {
+				return nil, fmt.Errorf("Unknown parameter `%s` for PostgREST"+
+					" upstream %s; only weight=N is allowed", param, fields[0])
+			}
+			weight, err := strconv.Atoi(strings.TrimPrefix(param, "weight="))
+			if err != nil || weight < 1 || weight > maxUpstreamWeight {
+				return nil, fmt.Errorf("Weight of PostgREST upstream %s must be"+
+					" from 1 to %d, not `%s`", fields[0], maxUpstreamWeight,
+					strings.TrimPrefix(param, "weight="))
+			}
+			upstream.Weight = weight
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("PostgREST base URL is empty")
+	}
+	return upstreams, nil
+}
+
+// balancerTransport spreads requests across several PostgREST
+// upstreams, round-robin in proportion to their weights, skipping
+// any whose connections recently failed or that failed their last
+// health check. Requests come to it addressed to the first upstream
+// (see newPostgrestProxy), and are readdressed to whichever is picked,
+// so that wrapping it in a retryTransport retries failed requests on
+// another upstream.
+type balancerTransport struct {
+	http.RoundTripper
+	primary  *url.URL
+	schedule []*postgrestUpstream // Each upstream Weight times
+	next     uint64
+	cooldown time.Duration
+	now      func() time.Time
+}
+
+func newBalancerTransport(rt http.RoundTripper, upstreams []*postgrestUpstream, cooldown time.Duration) *balancerTransport {
+	return &balancerTransport{
+		RoundTripper: rt,
+		primary:      upstreams[0].URL,
+		schedule:     weightedSchedule(upstreams),
+		cooldown:     cooldown,
+		now:          time.Now,
+	}
+}
+
+// weightedSchedule returns a round of upstreams in which each appears
+// Weight times, interleaved (as in nginx's smooth weighted
+// round-robin) so that a heavy upstream doesn't get its share all at
+// once.
+func weightedSchedule(upstreams []*postgrestUpstream) []*postgrestUpstream {
+	total := 0
+	for _, u := range upstreams {
+		total += u.Weight
+	}
+
+	var schedule []*postgrestUpstream
+	current := make([]int, len(upstreams))
+	for len(schedule) < total {
+		best := 0
+		for i, u := range upstreams {
+			current[i] += u.Weight
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, upstreams[best])
+	}
+	return schedule
+}
+
+// pick returns the next upstream in the schedule that's up, or just
+// the next one if none are, since trying beats failing outright.
+func (b *balancerTransport) pick() *postgrestUpstream {
+	now := b.now()
+	n := uint64(len(b.schedule))
+	start := atomic.AddUint64(&b.next, 1) - 1
+	for i := uint64(0); i < n; i++ {
+		if u := b.schedule[(start+i)%n]; u.up(now) {
+			return u
+		}
+	}
+	return b.schedule[start%n]
+}
+
+func (b *balancerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	upstream := b.pick()
+
+	out := req.Clone(req.Context())
+	out.URL.Scheme = upstream.URL.Scheme
+	out.URL.Host = upstream.URL.Host
+	out.URL.Path = rebasePath(req.URL.Path, b.primary.Path, upstream.URL.Path)
+	if req.URL.RawPath != "" {
+		out.URL.RawPath = rebasePath(req.URL.RawPath, b.primary.EscapedPath(),
+			upstream.URL.EscapedPath())
+	}
+
+	resp, err := b.RoundTripper.RoundTrip(out)
+	if err != nil && req.Context().Err() == nil {
+		atomic.StoreInt64(&upstream.downUntil,
+			b.now().Add(b.cooldown).UnixNano())
+		log.Warnf("PostgREST upstream %s failed; skipping it for %v: %v",
+			upstream.URL.Host, b.cooldown, err)
+	}
+	return resp, err
+}
+
+// rebasePath moves p from under the base path from to under to.
+func rebasePath(p, from, to string) string {
+	return strings.TrimSuffix(to, "/") +
+		strings.TrimPrefix(p, strings.TrimSuffix(from, "/"))
+}
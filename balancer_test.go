@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newNamedUpstream returns a PostgREST stand-in that responds with
+// name and the path it was asked for, counting its hits
+func newNamedUpstream(t *testing.T, name string) (*httptest.Server, *int32) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		fmt.Fprintf(w, "%s %s", name, req.URL.Path)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, &hits
+}
+
+func TestParsePostgrestUpstreams(t *testing.T) {
+	upstreams, err := parsePostgrestUpstreams(
+		" http://pg1:3000/ weight=3 ,https://pg2.internal/api,")
+	require.NoError(t, err)
+	require.Len(t, upstreams, 2)
+	assert.Equal(t, "http://pg1:3000/", upstreams[0].URL.String())
+	assert.Equal(t, 3, upstreams[0].Weight)
+	assert.Equal(t, "https://pg2.internal/api", upstreams[1].URL.String())
+	assert.Equal(t, 1, upstreams[1].Weight)
+
+	for _, baseURLs := range []string{"", " , ", "http://pg1:3000/, pg2:3000",
+		"http://pg1:3000/ weight=0", "http://pg1:3000/ weight=x",
+		"http://pg1:3000/ weight=101", "http://pg1:3000/ backup"} {
+		_, err := parsePostgrestUpstreams(baseURLs)
+		assert.Error(t, err, baseURLs)
+	}
+}
+
+func TestWeightedSchedule(t *testing.T) {
+	a := &postgrestUpstream{Weight: 3}
+	b := &postgrestUpstream{Weight: 1}
+	c := &postgrestUpstream{Weight: 1}
+	assert.Equal(t, []*postgrestUpstream{a, b, a, c, a},
+		weightedSchedule([]*postgrestUpstream{a, b, c}))
+}
+
+func TestPostgrestProxyBalances(t *testing.T) {
+	upstream1, hits1 := newNamedUpstream(t, "one")
+	upstream2, hits2 := newNamedUpstream(t, "two")
+
+	cfg := testConfig()
+	cfg.PostgrestBaseURL = upstream1.URL + "/," + upstream2.URL + "/v2/"
+	proxy, err := newPostgrestProxy(cfg, nil)
+	require.NoError(t, err)
+
+	bodies := map[string]int{}
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/tasks", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		bodies[rec.Body.String()]++
+	}
+	// Each under its own base path
+	assert.Equal(t, map[string]int{"one /tasks": 5, "two /v2/tasks": 5}, bodies)
+	assert.Equal(t, int32(5), atomic.LoadInt32(hits1))
+	assert.Equal(t, int32(5), atomic.LoadInt32(hits2))
+
+	// Weighted
+	atomic.StoreInt32(hits1, 0)
+	atomic.StoreInt32(hits2, 0)
+	cfg.PostgrestBaseURL = upstream1.URL + " weight=3," + upstream2.URL
+	proxy, err = newPostgrestProxy(cfg, nil)
+	require.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		testURL(t, "GET", "/tasks", nil, proxy, http.StatusOK, "")
+	}
+	assert.Equal(t, int32(6), atomic.LoadInt32(hits1))
+	assert.Equal(t, int32(2), atomic.LoadInt32(hits2))
+}
+
+func TestPostgrestProxySkipsDownedUpstream(t *testing.T) {
+	up, hits := newNamedUpstream(t, "up")
+	down, _ := newNamedUpstream(t, "down")
+	down.Close()
+
+	cfg := testConfig()
+	cfg.PostgrestBaseURL = down.URL + "," + up.URL
+	proxy, err := newPostgrestProxy(cfg, nil)
+	require.NoError(t, err)
+
+	// The first GET is sent to the downed one, then retried on the
+	// other
+	start := time.Now()
+	testURL(t, "GET", "/tasks", nil, proxy, http.StatusOK, "up /tasks")
+	assert.Equal(t, int32(1), atomic.LoadInt32(hits))
+
+	// From then on it's skipped, even for requests that can't be
+	// retried
+	for i := 0; i < 4; i++ {
+		testURL(t, "POST", "/tasks", nil, proxy, http.StatusOK, "up /tasks")
+	}
+	assert.Equal(t, int32(5), atomic.LoadInt32(hits))
+	assert.True(t, time.Since(start) < POSTGREST_UPSTREAM_COOLDOWN)
+}
+
+func TestBalancerTransportCooldown(t *testing.T) {
+	up, _ := newNamedUpstream(t, "up")
+	down, _ := newNamedUpstream(t, "down")
+	down.Close()
+
+	upstreams, err := parsePostgrestUpstreams(down.URL + "," + up.URL)
+	require.NoError(t, err)
+	b := newBalancerTransport(http.DefaultTransport, upstreams, time.Minute)
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	get := func() error {
+		req := httptest.NewRequest("GET", down.URL+"/tasks", nil)
+		req.RequestURI = ""
+		resp, err := b.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	require.Error(t, get())
+	assert.False(t, upstreams[0].up(now))
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, get())
+	}
+
+	// Tried again once the cooldown is up
+	now = now.Add(time.Minute)
+	assert.True(t, upstreams[0].up(now))
+	assert.Error(t, get())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+var ErrMinilockIDBlocked = errors.New("miniLock ID is blocked")
+
+// Blocklist is a set of miniLock IDs banned from logging in, read
+// from a file of one ID per line (blank lines and lines starting with
+// # are ignored). It can be reloaded (e.g., on SIGHUP) without
+// restarting the server; each login checks whichever list was current
+// when it arrived. A nil *Blocklist blocks no one.
+type Blocklist struct {
+	path string
+	ids  atomic.Value // map[string]bool
+}
+
+// LoadBlocklist reads the blocklist at path, or returns nil if path is
+// empty.
+func LoadBlocklist(path string) (*Blocklist, error) {
+	if path == "" {
+		return nil, nil
+	}
+	bl := &Blocklist{path: path}
+	if err := bl.Reload(); err != nil {
+		return nil, err
+	}
+	return bl, nil
+}
+
+// Reload re-reads the file, keeping the current list if that fails.
+func (bl *Blocklist) Reload() error {
+	f, err := os.Open(bl.path)
+	if err != nil {
+		return fmt.Errorf("Error opening miniLock ID blocklist: %v", err)
+	}
+	defer f.Close()
+
+	ids := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		mID := strings.TrimSpace(scanner.Text())
+		if mID == "" || strings.HasPrefix(mID, "#") {
+			continue
+		}
+		if err := validateMinilockID(mID); err != nil {
+			return fmt.Errorf("Invalid miniLock ID on line %d of %s: %v",
+				lineNum, bl.path, err)
+		}
+		ids[mID] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Error reading miniLock ID blocklist: %v", err)
+	}
+
+	bl.ids.Store(ids)
+	return nil
+}
+
+// Blocked reports whether mID is on the list.
+func (bl *Blocklist) Blocked(mID string) bool {
+	if bl == nil {
+		return false
+	}
+	return bl.ids.Load().(map[string]bool)[mID]
+}
+
+// Len returns how many miniLock IDs are on the list.
+func (bl *Blocklist) Len() int {
+	if bl == nil {
+		return 0
+	}
+	return len(bl.ids.Load().(map[string]bool))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeBlocklist(t *testing.T, path string, lines ...string) {
+	var contents string
+	for _, line := range lines {
+		contents += line + "\n"
+	}
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+}
+
+func TestLoginBlocklist(t *testing.T) {
+	blocked, allowed := newTestKeypair(t), newTestKeypair(t)
+	blockedID := testMinilockID(t, blocked)
+
+	path := filepath.Join(t.TempDir(), "blocklist")
+	writeBlocklist(t, path, "# Spammer", blockedID, "")
+	blocklist, err := LoadBlocklist(path)
+	require.NoError(t, err)
+
+	m := NewMapper()
+	cfg := testConfig()
+	cfg.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+	audit, err := NewAuditLog(cfg)
+	require.NoError(t, err)
+	defer audit.Close()
+	router, err := NewRouter(cfg, m, testServerKeys, nil, nil, nil, audit,
+		blocklist)
+	require.NoError(t, err)
+
+	rec := answerChallengeLogin(t, router, blocked)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	testChallenge(t, router, blocked)
+	rec = postChallengeLogin(t, router, blocked, "deadbeef")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// No token was ever issued
+	assert.Equal(t, 0, m.Len())
+
+	testLogin(t, router, allowed)
+	assert.Equal(t, 1, m.Len())
+
+	records := readAuditLog(t, cfg.AuditLog)
+	require.Len(t, records, 3)
+	for _, record := range records[:2] {
+		assert.Equal(t, "failure", record["result"])
+		assert.Equal(t, ErrMinilockIDBlocked.Error(), record["reason"])
+	}
+	assert.Equal(t, "success", records[2]["result"])
+}
+
+func TestLoginBlocklistReload(t *testing.T) {
+	first, second := newTestKeypair(t), newTestKeypair(t)
+	firstID, secondID := testMinilockID(t, first), testMinilockID(t, second)
+
+	path := filepath.Join(t.TempDir(), "blocklist")
+	writeBlocklist(t, path, firstID)
+	blocklist, err := LoadBlocklist(path)
+	require.NoError(t, err)
+	router, err := NewRouter(testConfig(), NewMapper(), testServerKeys, nil, nil, nil, nil,
+		blocklist)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusForbidden, answerChallengeLogin(t, router, first).Code)
+	assert.Equal(t, http.StatusOK, answerChallengeLogin(t, router, second).Code)
+
+	writeBlocklist(t, path, secondID)
+	require.NoError(t, blocklist.Reload())
+	assert.Equal(t, http.StatusOK, answerChallengeLogin(t, router, first).Code)
+	assert.Equal(t, http.StatusForbidden, answerChallengeLogin(t, router, second).Code)
+
+	// A bad list is rejected, keeping the old one
+	writeBlocklist(t, path, firstID, "not-a-minilock-id")
+	assert.Error(t, blocklist.Reload())
+	assert.Equal(t, 1, blocklist.Len())
+	assert.True(t, blocklist.Blocked(secondID))
+
+	require.NoError(t, os.Remove(path))
+	assert.Error(t, blocklist.Reload())
+	assert.True(t, blocklist.Blocked(secondID))
+}
+
+func TestLoadBlocklistDisabled(t *testing.T) {
+	blocklist, err := LoadBlocklist("")
+	require.NoError(t, err)
+	assert.Nil(t, blocklist)
+	assert.False(t, blocklist.Blocked(testMinilockID(t, newTestKeypair(t))))
+
+	_, err = LoadBlocklist(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
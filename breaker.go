@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// How a request sent through a CircuitBreaker went
+type breakerOutcome int
+
+const (
+	outcomeSuccess breakerOutcome = iota
+	outcomeFailure
+	// E.g., the client gave up, which says nothing about the upstream
+	outcomeUnknown
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// ErrCircuitOpen is returned in place of a response while a
+// CircuitBreaker is open.
+type ErrCircuitOpen struct {
+	RetryAfter time.Duration
+}
+
+func (e *ErrCircuitOpen) Error() string {
+	return fmt.Sprintf("PostgREST circuit breaker open; retry in %v", e.RetryAfter)
+}
+
+// CircuitBreaker stops sending requests to an upstream that keeps
+// failing, so that they fail fast rather than each waiting to time
+// out. Once threshold failures happen in a row, none more than window
+// after the first, it opens, rejecting everything for cooldown. Then
+// it half-opens, letting one probe request through: if that succeeds
+// it closes again, and if not it reopens for another cooldown.
+//
+// Given an UpstreamHealthChecker, it also fails fast while no
+// upstream is healthy, and half-opens as soon as one recovers.
+type CircuitBreaker struct {
+	lock sync.Mutex
+
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	health    *UpstreamHealthChecker // May be nil
+	now       func() time.Time
+
+	state        breakerState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	probing      bool
+}
+
+func NewCircuitBreaker(threshold int, window, cooldown time.Duration, health *UpstreamHealthChecker) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		health:    health,
+		now:       time.Now,
+	}
+}
+
+// State returns "closed", "open", or "half-open".
+func (cb *CircuitBreaker) State() string {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.state.String()
+}
+
+// Allow reports whether a request may be sent, or if not, how long
+// until one might be. Each allowed request must be followed by a call
+// to Done with its outcome.
+func (cb *CircuitBreaker) Allow() (ok bool, retryAfter time.Duration) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		elapsed := cb.now().Sub(cb.openedAt)
+		recovered := cb.health != nil && cb.health.RecoveredAt().After(cb.openedAt)
+		if elapsed < cb.cooldown && !recovered {
+			return false, cb.cooldown - elapsed
+		}
+		cb.setState(breakerHalfOpen)
+		cb.probing = true
+		return true, 0
+	case breakerHalfOpen:
+		if cb.probing {
+			// Should know shortly
+			return false, time.Second
+		}
+		cb.probing = true
+		return true, 0
+	}
+	if cb.health != nil && !cb.health.Healthy() {
+		return false, cb.health.interval
+	}
+	return true, 0
+}
+
+// Done records the outcome of a request Allow let through, closing or
+// reopening a half-open breaker, or counting toward opening a closed
+// one.
+func (cb *CircuitBreaker) Done(outcome breakerOutcome) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	now := cb.now()
+	if cb.state == breakerHalfOpen {
+		cb.probing = false
+		switch outcome {
+		case outcomeFailure:
+			cb.openedAt = now
+			cb.setState(breakerOpen)
+		case outcomeSuccess:
+			cb.failures = 0
+			cb.setState(breakerClosed)
+		}
+		return
+	}
+
+	if cb.state != breakerClosed {
+		return
+	}
+	if outcome == outcomeSuccess {
+		cb.failures = 0
+	}
+	if outcome != outcomeFailure {
+		return
+	}
+	if cb.failures == 0 || now.Sub(cb.firstFailure) > cb.window {
+		cb.failures, cb.firstFailure = 0, now
+	}
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.openedAt = now
+		cb.setState(breakerOpen)
+	}
+}
+
+func (cb *CircuitBreaker) setState(state breakerState) {
+	if state == cb.state {
+		return
+	}
+	log.Warnf("PostgREST circuit breaker %s -> %s", cb.state, state)
+	cb.state = state
+}
+
+// breakerTransport sends requests through a CircuitBreaker, counting
+// connection errors and 502, 503, and 504 responses as failures.
+type breakerTransport struct {
+	http.RoundTripper
+	breaker *CircuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ok, retryAfter := t.breaker.Allow()
+	if !ok {
+		return nil, &ErrCircuitOpen{RetryAfter: retryAfter}
+	}
+
+	resp, err := t.RoundTripper.RoundTrip(req)
+	switch {
+	case err != nil && req.Context().Err() != nil:
+		t.breaker.Done(outcomeUnknown)
+	case err != nil:
+		t.breaker.Done(outcomeFailure)
+	case resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusServiceUnavailable,
+		resp.StatusCode == http.StatusGatewayTimeout:
+		t.breaker.Done(outcomeFailure)
+	default:
+		t.breaker.Done(outcomeSuccess)
+	}
+	return resp, err
+}
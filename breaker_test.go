@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing int32 = 1
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("[]"))
+	}))
+	defer upstream.Close()
+
+	cfg := testConfig()
+	cfg.PostgrestBaseURL = upstream.URL
+	cfg.PostgrestBreakerThreshold = 3
+	proxy, err := newPostgrestProxy(cfg, nil)
+	require.NoError(t, err)
+
+	// Swap in a clock we control
+	rp, ok := proxy.(*httputil.ReverseProxy)
+	require.True(t, ok)
+	bt, ok := rp.Transport.(*breakerTransport)
+	require.True(t, ok)
+	breaker := bt.breaker
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+
+	// Closed: failures pass through until there are enough in a row
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "closed", breaker.State())
+		testURL(t, "GET", "/tasks", nil, proxy, http.StatusServiceUnavailable, "")
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+
+	// Open: fails fast without bothering PostgREST
+	assert.Equal(t, "open", breaker.State())
+	now = now.Add(10 * time.Second)
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/tasks", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "20", rec.Header().Get("Retry-After"))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+
+	// Half-open: one probe is let through, which fails, so it
+	// reopens
+	now = now.Add(20 * time.Second)
+	testURL(t, "GET", "/tasks", nil, proxy, http.StatusServiceUnavailable, "")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&hits))
+	assert.Equal(t, "open", breaker.State())
+
+	// Next time, PostgREST has recovered, so the probe closes it
+	atomic.StoreInt32(&failing, 0)
+	now = now.Add(cfg.PostgrestBreakerCooldown)
+	testURL(t, "GET", "/tasks", nil, proxy, http.StatusOK, "[]")
+	assert.Equal(t, "closed", breaker.State())
+	testURL(t, "GET", "/tasks", nil, proxy, http.StatusOK, "[]")
+	assert.Equal(t, int32(6), atomic.LoadInt32(&hits))
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	cb := NewCircuitBreaker(3, 10*time.Second, time.Minute, nil)
+	now := time.Now()
+	cb.now = func() time.Time { return now }
+
+	fail := func() {
+		ok, _ := cb.Allow()
+		require.True(t, ok)
+		cb.Done(outcomeFailure)
+	}
+
+	// Too spread out to count
+	fail()
+	fail()
+	now = now.Add(11 * time.Second)
+	fail()
+	assert.Equal(t, "closed", cb.State())
+
+	// A success resets the count
+	ok, _ := cb.Allow()
+	require.True(t, ok)
+	cb.Done(outcomeSuccess)
+	fail()
+	fail()
+	assert.Equal(t, "closed", cb.State())
+	fail()
+	assert.Equal(t, "open", cb.State())
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	cb := NewCircuitBreaker(1, time.Second, time.Minute, nil)
+	now := time.Now()
+	cb.now = func() time.Time { return now }
+
+	ok, _ := cb.Allow()
+	require.True(t, ok)
+	cb.Done(outcomeFailure)
+
+	now = now.Add(time.Minute)
+	ok, _ = cb.Allow()
+	require.True(t, ok)
+	assert.Equal(t, "half-open", cb.State())
+
+	// Only the one probe at a time
+	ok, retryAfter := cb.Allow()
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, retryAfter)
+
+	// A probe the client abandoned doesn't decide anything
+	cb.Done(outcomeUnknown)
+	assert.Equal(t, "half-open", cb.State())
+	ok, _ = cb.Allow()
+	require.True(t, ok)
+	cb.Done(outcomeSuccess)
+	assert.Equal(t, "closed", cb.State())
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// AUTOCERT_CACHE_TABLE holds the certs (and private keys!) cached by
+// postgrestCertCache. It lives in its own schema, served by a
+// PostgREST of its own (see db/postgrest-autocert.conf), so that the
+// public one can't reach it; NewRouter refuses to proxy it besides.
+const AUTOCERT_CACHE_TABLE = "autocert_cache"
+
+// newAutocertCache returns the autocert.Cache cfg asks for: a
+// directory (by default named after the canonical domain), or the
+// autocert_cache table via the PostgREST at
+// cfg.AutocertCachePostgrestURL so that replicas share certs that
+// survive ephemeral disks.
+func newAutocertCache(cfg *Config) (autocert.Cache, error) {
+	switch cfg.AutocertCache {
+	case "", "dir":
+		dir := cfg.AutocertCacheDir
+		if dir == "" {
+			dir = "./" + cfg.CanonicalDomain()
+		}
+		return autocert.DirCache(dir), nil
+	case "postgrest":
+		if cfg.AutocertCachePostgrestURL == "" {
+			return nil, fmt.Errorf("AUTOCERT_CACHE=postgrest needs" +
+				" AUTOCERT_CACHE_POSTGREST_URL, a PostgREST serving only" +
+				" the autocert schema")
+		}
+		if isPublicPostgrest(cfg, cfg.AutocertCachePostgrestURL) {
+			return nil, fmt.Errorf("AUTOCERT_CACHE_POSTGREST_URL `%s` is"+
+				" also in INTERNAL_POSTGREST_BASE_URL, which is proxied to"+
+				" the public; give the cert cache a PostgREST of its own",
+				cfg.AutocertCachePostgrestURL)
+		}
+		return newPostgrestCertCache(cfg.AutocertCachePostgrestURL)
+	}
+	return nil, fmt.Errorf("Unknown autocert cache `%s`; must be `dir` or `postgrest`",
+		cfg.AutocertCache)
+}
+
+// isPublicPostgrest reports whether baseURL is one of the PostgREST
+// upstreams in cfg.PostgrestBaseURL.
+func isPublicPostgrest(cfg *Config, baseURL string) bool {
+	u, err := parsePostgrestURL(baseURL)
+	if err != nil {
+		return false
+	}
+	upstreams, err := parsePostgrestUpstreams(cfg.PostgrestBaseURL)
+	if err != nil {
+		return false
+	}
+	for _, upstream := range upstreams {
+		if upstream.URL.Host == u.Host &&
+			strings.TrimSuffix(upstream.URL.Path, "/") == strings.TrimSuffix(u.Path, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// postgrestCertCache is an autocert.Cache that stores certs in
+// Postgres via PostgREST.
+type postgrestCertCache struct {
+	tableURL string
+	client   *http.Client
+}
+
+type certCacheRow struct {
+	Key  string `json:"key"`
+	Data string `json:"data"` // base64
+}
+
+func newPostgrestCertCache(baseURL string) (*postgrestCertCache, error) {
+	u, err := parsePostgrestURL(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	return &postgrestCertCache{
+		tableURL: strings.TrimSuffix(u.String(), "/") + "/" + AUTOCERT_CACHE_TABLE,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (c *postgrestCertCache) keyURL(key string) string {
+	return c.tableURL + "?key=eq." + url.QueryEscape(key)
+}
+
+func (c *postgrestCertCache) do(ctx context.Context, method, url string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("PostgREST returned %s to %s %s", resp.Status,
+			method, c.tableURL)
+	}
+	return resp, nil
+}
+
+func (c *postgrestCertCache) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := c.do(ctx, "GET", c.keyURL(key)+"&select=key,data", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var rows []certCacheRow
+	if err = json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, autocert.ErrCacheMiss
+	}
+	return base64.StdEncoding.DecodeString(rows[0].Data)
+}
+
+func (c *postgrestCertCache) Put(ctx context.Context, key string, data []byte) error {
+	body, err := json.Marshal(certCacheRow{
+		Key:  key,
+		Data: base64.StdEncoding.EncodeToString(data),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Upsert
+	header := http.Header{
+		"Content-Type": {"application/json"},
+		"Prefer":       {"resolution=merge-duplicates"},
+	}
+	resp, err := c.do(ctx, "POST", c.tableURL, body, header)
+	if err != nil {
+		return err
+	}
+	ioutil.ReadAll(resp.Body)
+	return resp.Body.Close()
+}
+
+func (c *postgrestCertCache) Delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, "DELETE", c.keyURL(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	ioutil.ReadAll(resp.Body)
+	return resp.Body.Close()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// How many times to try getting each cert ahead of time
+	CERT_PREWARM_ATTEMPTS = 5
+	// How long to wait after the first failure, doubling after each
+	// one after that
+	CERT_PREWARM_BACKOFF = 5 * time.Second
+)
+
+// PrewarmCerts gets certs for each of domains from getCert (e.g., an
+// autocert.Manager's GetCertificate) in the background, retrying with
+// backoff, so that they're cached before the first TLS handshake needs
+// them, rather than obtained during it. Call it once the server is
+// listening, so that it can answer the ACME challenge. A domain that
+// still fails is just logged to logger; its cert is obtained on demand
+// as usual.
+func PrewarmCerts(ctx context.Context, logger *log.Logger, getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error), domains []string) {
+	go func() {
+		for _, domain := range domains {
+			prewarmCert(ctx, logger, getCert, domain, CERT_PREWARM_ATTEMPTS,
+				CERT_PREWARM_BACKOFF)
+		}
+	}()
+}
+
+func prewarmCert(ctx context.Context, logger *log.Logger, getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error), domain string, attempts int, backoff time.Duration) error {
+	for attempt := 1; ; attempt++ {
+		_, err := getCert(&tls.ClientHelloInfo{ServerName: domain})
+		if err == nil {
+			logger.Infof("Cert prewarm: got cert for %s", domain)
+			return nil
+		}
+		if attempt >= attempts {
+			logger.Errorf("Cert prewarm: giving up on %s after %d attempts;"+
+				" will get it on demand: %v", domain, attempt, err)
+			return err
+		}
+		logger.Warnf("Cert prewarm: attempt %d of %d for %s failed; retrying"+
+			" in %v: %v", attempt, attempts, domain, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyCertManager fails the first `failures` times it's asked for a
+// cert, like Let's Encrypt having a bad minute
+type flakyCertManager struct {
+	failures int
+	asked    []string
+}
+
+func (m *flakyCertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.asked = append(m.asked, hello.ServerName)
+	if len(m.asked) <= m.failures {
+		return nil, errors.New("acme: urn:ietf:params:acme:error:serverInternal")
+	}
+	return &tls.Certificate{}, nil
+}
+
+func TestPrewarmCert(t *testing.T) {
+	manager := &flakyCertManager{failures: 2}
+	var out bytes.Buffer
+	logger := log.New()
+	logger.Out = &out
+	err := prewarmCert(context.Background(), logger, manager.GetCertificate,
+		"example.com", 5, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.com", "example.com", "example.com"},
+		manager.asked)
+	assert.Contains(t, out.String(), "got cert for example.com")
+
+	// Gives up eventually
+	manager = &flakyCertManager{failures: 10}
+	err = prewarmCert(context.Background(), logger, manager.GetCertificate,
+		"example.com", 3, time.Millisecond)
+	assert.Error(t, err)
+	assert.Len(t, manager.asked, 3)
+
+	// Or when shutting down
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	manager = &flakyCertManager{failures: 10}
+	err = prewarmCert(ctx, logger, manager.GetCertificate, "example.com", 3, time.Hour)
+	assert.Equal(t, context.Canceled, err)
+	assert.Len(t, manager.asked, 1)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/justinas/alice"
+)
+
+// The stages of middleware every request passes through
+const (
+	stageRecover         = "recover"
+	stageACME            = "acme"
+	stageAccessLog       = "access_log"
+	stageMetrics         = "metrics"
+	stageTracing         = "tracing"
+	stageSlowRequests    = "slow_requests"
+	stageSecurityHeaders = "security_headers"
+	stageConcurrency     = "concurrency"
+	stageMaintenance     = "maintenance"
+	stageHeaderLimit     = "header_limit"
+	stageBodyLimit       = "body_limit"
+	stageCORS            = "cors"
+)
+
+// middlewareOrder is the order those stages run in, outermost first.
+// Recovery is outermost so that it catches panics anywhere, including
+// in other middleware. ACME challenges (in production) are answered
+// before anything else gets a say. The access log wraps everything
+// after it, so that what it logs (and the request ID it assigns) covers
+// whatever they do, e.g. a 503 from the concurrency limit; so do
+// metrics and tracing. Route-level middleware, such as auth (see
+// RequireAuth), runs after all of these, just before each route's
+// handler.
+var middlewareOrder = []string{
+	stageRecover,
+	stageACME,
+	stageAccessLog,
+	stageMetrics,
+	stageTracing,
+	stageSlowRequests,
+	stageSecurityHeaders,
+	stageConcurrency,
+	stageMaintenance,
+	stageHeaderLimit,
+	stageBodyLimit,
+	stageCORS,
+}
+
+// MiddlewareChain is an http.Handler that runs a handler behind the
+// server-wide middleware, assembled in middlewareOrder however the
+// stages were set, so that adding one (e.g., in ProductionServer)
+// can't put it in the wrong place. Stages must be set before it starts
+// serving.
+type MiddlewareChain struct {
+	h      http.Handler
+	stages map[string]alice.Constructor
+	built  http.Handler
+
+	onDrain []func()
+	onClose []func()
+}
+
+func NewMiddlewareChain(h http.Handler) *MiddlewareChain {
+	return &MiddlewareChain{
+		h:      h,
+		stages: map[string]alice.Constructor{},
+		built:  h,
+	}
+}
+
+// Set makes mw the middleware for stage, replacing any already set.
+// It panics if stage isn't in middlewareOrder.
+func (mc *MiddlewareChain) Set(stage string, mw alice.Constructor) {
+	if !isMiddlewareStage(stage) {
+		panic(fmt.Sprintf("Unknown middleware stage `%s`", stage))
+	}
+	mc.stages[stage] = mw
+
+	var ordered []alice.Constructor
+	for _, name := range mc.Stages() {
+		ordered = append(ordered, mc.stages[name])
+	}
+	mc.built = alice.New(ordered...).Then(mc.h)
+}
+
+// Stages returns the stages that have been set, outermost first.
+func (mc *MiddlewareChain) Stages() []string {
+	var stages []string
+	for _, name := range middlewareOrder {
+		if _, ok := mc.stages[name]; ok {
+			stages = append(stages, name)
+		}
+	}
+	return stages
+}
+
+// OnDrain has f called when the server starts shutting down, before
+// it stops taking new requests (see serve).
+func (mc *MiddlewareChain) OnDrain(f func()) {
+	mc.onDrain = append(mc.onDrain, f)
+}
+
+// Drain calls, in order, every function passed to OnDrain.
+func (mc *MiddlewareChain) Drain() {
+	for _, f := range mc.onDrain {
+		f()
+	}
+}
+
+// OnClose has f called once the server has shut down, after the last
+// request has finished (see serve).
+func (mc *MiddlewareChain) OnClose(f func()) {
+	mc.onClose = append(mc.onClose, f)
+}
+
+// Close calls, in order, every function passed to OnClose.
+func (mc *MiddlewareChain) Close() {
+	for _, f := range mc.onClose {
+		f()
+	}
+}
+
+func (mc *MiddlewareChain) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	mc.built.ServeHTTP(w, req)
+}
+
+func isMiddlewareStage(stage string) bool {
+	for _, name := range middlewareOrder {
+		if name == stage {
+			return true
+		}
+	}
+	return false
+}
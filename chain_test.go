@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestMiddlewareChainOrder(t *testing.T) {
+	var ran []string
+	probe := func(stage string) func(http.Handler) http.Handler {
+		return func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				ran = append(ran, stage)
+				h.ServeHTTP(w, req)
+			})
+		}
+	}
+
+	chain := NewMiddlewareChain(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ran = append(ran, "handler")
+	}))
+	// Set in reverse, to show it doesn't matter
+	for i := len(middlewareOrder) - 1; i >= 0; i-- {
+		chain.Set(middlewareOrder[i], probe(middlewareOrder[i]))
+	}
+
+	chain.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, append(append([]string{}, middlewareOrder...), "handler"), ran)
+	assert.Equal(t, middlewareOrder, chain.Stages())
+
+	assert.Panics(t, func() { chain.Set("auth", probe("auth")) })
+}
+
+func TestServerChain(t *testing.T) {
+	cfg := testConfig()
+	cfg.SlowRequestThreshold = 0
+	cfg.MaxConcurrentRequests = 0
+	cfg.CORSAllowedOrigins = ""
+	srv, err := NewServer(cfg, NewMapper(), testServerKeys, nil)
+	require.NoError(t, err)
+	chain, ok := srv.Handler.(*MiddlewareChain)
+	require.True(t, ok)
+
+	// Optional stages are left out when disabled
+	assert.Equal(t, []string{stageRecover, stageAccessLog, stageMetrics,
+		stageSecurityHeaders, stageMaintenance, stageHeaderLimit,
+		stageBodyLimit}, chain.Stages())
+
+	// Auth runs inside all of them, just before the handler, so even
+	// its rejections are logged and get our headers
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/whoami", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("X-Request-Id"))
+	assert.Equal(t, "DENY", rec.Header().Get("X-Frame-Options"))
+
+	cfg.SlowRequestThreshold = time.Second
+	cfg.MaxConcurrentRequests = 10
+	cfg.CORSAllowedOrigins = "https://app.example.com"
+	cfg.OTLPEndpoint = "http://127.0.0.1:4318"
+	srv, err = NewServer(cfg, NewMapper(), testServerKeys, nil)
+	require.NoError(t, err)
+	require.NoError(t, ProductionServer(cfg, srv, &autocert.Manager{}))
+	chain = srv.Handler.(*MiddlewareChain)
+	defer chain.Close()
+
+	// Production answers ACME challenges, still inside recovery
+	assert.Equal(t, middlewareOrder, chain.Stages())
+}
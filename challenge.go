@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	minilock "github.com/cathalgarvey/go-minilock"
+	"github.com/cathalgarvey/go-minilock/taber"
+)
+
+const (
+	CHALLENGE_TTL = 1 * time.Minute
+
+	// Past this many pending challenges for one miniLock ID, the
+	// oldest is dropped to make room
+	maxPendingChallenges = 16
+
+	maxLoginBodySize = 4096
+)
+
+var (
+	ErrChallengeNotFound        = errors.New("no pending challenge; request one first")
+	ErrChallengeExpired         = errors.New("challenge expired; request a new one")
+	ErrChallengeMismatch        = errors.New("wrong challenge response")
+	ErrChallengeKeyRetired      = errors.New("challenge sent from a retired server key; request a new one")
+	ErrChallengeResponseMissing = errors.New("no challenge response; request a challenge first")
+	ErrLockedOut                = errors.New("locked out after too many failed logins")
+)
+
+// ChallengeStore holds the nonces handed out by Challenge that
+// LoginPost expects to be echoed back, proving that the client
+// holds the private key for the miniLock ID it claims.
+type ChallengeStore struct {
+	lock       sync.Mutex
+	challenges map[string][]*challenge // map[minilockID][]*challenge
+	lastSweep  time.Time
+
+	ttl time.Duration
+	now func() time.Time
+}
+
+type challenge struct {
+	nonce   string
+	expires time.Time
+	sender  []byte // Public key of the server key it was sent from
+}
+
+func NewChallengeStore(ttl time.Duration) *ChallengeStore {
+	return &ChallengeStore{
+		challenges: map[string][]*challenge{},
+		ttl:        ttl,
+		now:        time.Now,
+	}
+}
+
+// New creates a challenge for mID, to be sent from the server key
+// sender. Up to maxPendingChallenges others pending for mID stay
+// valid, so that someone else requesting a challenge for it can't
+// cancel the one its owner is answering.
+func (cs *ChallengeStore) New(mID string, sender *taber.Keys) (nonce string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce = hex.EncodeToString(b)
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	now := cs.now()
+	cs.sweep(now)
+
+	var pending []*challenge
+	for _, c := range cs.challenges[mID] {
+		if now.Before(c.expires) {
+			pending = append(pending, c)
+		}
+	}
+	pending = append(pending,
+		&challenge{nonce: nonce, expires: now.Add(cs.ttl),
+			sender: sender.Public})
+	if len(pending) > maxPendingChallenges {
+		pending = pending[len(pending)-maxPendingChallenges:]
+	}
+	cs.challenges[mID] = pending
+	return nonce, nil
+}
+
+// sweep forgets the miniLock IDs whose challenges have all expired,
+// at most once per ttl, so that handing out challenges to many IDs
+// doesn't mean walking every one of them each time. Must be called
+// with cs.lock held.
+func (cs *ChallengeStore) sweep(now time.Time) {
+	if now.Sub(cs.lastSweep) < cs.ttl {
+		return
+	}
+	cs.lastSweep = now
+
+	for id, pending := range cs.challenges {
+		// The newest is last
+		if !now.Before(pending[len(pending)-1].expires) {
+			delete(cs.challenges, id)
+		}
+	}
+}
+
+// Verify checks nonce against mID's pending challenges. The one it
+// answers is used up, successfully or not (if it has expired, or was
+// sent from a server key that keys no longer trusts); a nonce that
+// answers none of them leaves them all pending.
+func (cs *ChallengeStore) Verify(mID, nonce string, keys *ServerKeys) error {
+	cs.lock.Lock()
+	pending, ok := cs.challenges[mID]
+	var c *challenge
+	for i := range pending {
+		if secureCompare(nonce, pending[i].nonce) {
+			c = pending[i]
+			pending = append(pending[:i:i], pending[i+1:]...)
+			break
+		}
+	}
+	if c != nil {
+		if len(pending) == 0 {
+			delete(cs.challenges, mID)
+		} else {
+			cs.challenges[mID] = pending
+		}
+	}
+	cs.lock.Unlock()
+
+	if !ok {
+		return ErrChallengeNotFound
+	}
+	if c == nil {
+		return ErrChallengeMismatch
+	}
+	if !cs.now().Before(c.expires) {
+		return ErrChallengeExpired
+	}
+	if !keys.Trusts(c.sender) {
+		return ErrChallengeKeyRetired
+	}
+	return nil
+}
+
+// Challenge responds with a fresh nonce encrypted from the current
+// server key to the miniLock ID in the X-Minilock-Id header, to be
+// decrypted and sent back to LoginPost.
+func Challenge(cs *ChallengeStore, keys *ServerKeys) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		mID, keypair, err := parseMinilockID(req)
+		if err != nil {
+			writeMinilockIDError(w, err)
+			return
+		}
+
+		sender := keys.Current()
+		nonce, err := cs.New(mID, sender)
+		if err != nil {
+			WriteError(w, "Error generating challenge; sorry!", err)
+			return
+		}
+
+		encNonce, err := minilock.EncryptFileContents("type:challenge",
+			[]byte(nonce), sender, keypair)
+		if err != nil {
+			WriteError(w, "Error encrypting challenge to you; sorry!", err)
+			return
+		}
+
+		w.Write(encNonce)
+	}
+}
+
+// challengeLogin issues an auth token to mID only if it isn't blocked
+// and nonce is the decrypted contents of the response from Challenge,
+// proving that the client holds mID's private key. mIDs and client
+// IPs that keep failing are locked out by lockout, and mIDs that keep
+// succeeding are rate limited by idLimiter.
+func challengeLogin(w http.ResponseWriter, req *http.Request, m Store, tokenTTL time.Duration, blocklist *Blocklist, idLimiter *RateLimiter, encryptErrors bool, cs *ChallengeStore, serverKeys *ServerKeys, lockout *LoginLockout, audit *AuditLog, mID, ip, nonce string) {
+	keypair, err := minilockKeypair(mID)
+	if err != nil {
+		audit.Failure(req, "login", mID, err.Error())
+		writeMinilockIDError(w, err)
+		return
+	}
+	sender := serverKeys.Current()
+	errKey := loginErrorKey(encryptErrors, sender, keypair)
+	if refuseBlocked(w, req, blocklist, audit, mID, errKey) {
+		return
+	}
+
+	keys := []string{"minilock_id:" + mID, "ip:" + ip}
+	if ok, retryAfter := lockout.Check(keys...); !ok {
+		log.Infof("Login: `%s` (%s) locked out for %v", mID, ip, retryAfter)
+		audit.Failure(req, "login", mID, ErrLockedOut.Error())
+		w.Header().Set("Retry-After",
+			strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		writeLoginError(w, errKey, "Error: too many failed logins; try"+
+			" again later", ErrLockedOut, http.StatusTooManyRequests)
+		return
+	}
+
+	if err = cs.Verify(mID, nonce, serverKeys); err != nil {
+		log.Infof("Login: `%s` failed challenge: %v", mID, err)
+		lockout.Fail(keys...)
+		audit.Failure(req, "login", mID, err.Error())
+		writeLoginError(w, errKey, "Error: "+err.Error(), err,
+			http.StatusUnauthorized)
+		return
+	}
+	lockout.Succeed(keys...)
+	if refuseRateLimited(w, req, idLimiter, audit, mID, errKey) {
+		return
+	}
+
+	log.Infof("Login: `%s` passed challenge; logging in", mID)
+
+	if err = issueAuthToken(w, m, tokenTTL, mID, sender, keypair, errKey); err != nil {
+		audit.Failure(req, "login", mID, "error issuing auth token")
+		return
+	}
+	audit.Success(req, "login", mID, "challenge")
+}
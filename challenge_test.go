@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	minilock "github.com/cathalgarvey/go-minilock"
+	"github.com/cathalgarvey/go-minilock/taber"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testChallenge requests a login challenge as keypair and returns the
+// decrypted nonce
+func testChallenge(t *testing.T, handler http.Handler, keypair *taber.Keys) string {
+	req := httptest.NewRequest("GET", "/api/challenge", nil)
+	req.Header.Set("X-Minilock-Id", testMinilockID(t, keypair))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	_, filename, nonce, err := minilock.DecryptFileContents(rec.Body.Bytes(),
+		keypair)
+	require.NoError(t, err)
+	assert.Equal(t, "type:challenge", filename)
+	return string(nonce)
+}
+
+func postChallengeLogin(t *testing.T, handler http.Handler, keypair *taber.Keys, nonce string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/login",
+		strings.NewReader(`{"nonce":"`+nonce+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Minilock-Id", testMinilockID(t, keypair))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// answerChallengeLogin logs in as keypair, answering its challenge
+// correctly, and returns the response whether or not it succeeded
+func answerChallengeLogin(t *testing.T, handler http.Handler, keypair *taber.Keys) *httptest.ResponseRecorder {
+	nonce := testChallenge(t, handler, keypair)
+	return postChallengeLogin(t, handler, keypair, nonce)
+}
+
+func TestChallengeLogin(t *testing.T) {
+	m := NewMapper()
+	handler := mustNewRouter(m)
+	keypair := newTestKeypair(t)
+
+	nonce := testChallenge(t, handler, keypair)
+
+	rec := postChallengeLogin(t, handler, keypair, nonce)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	authToken := decryptAuthToken(t, rec, keypair).Token
+
+	mID, err := m.GetMinilockID(authToken)
+	require.NoError(t, err)
+	assert.Equal(t, testMinilockID(t, keypair), mID)
+
+	// Replaying the same response must not mint another token
+	rec = postChallengeLogin(t, handler, keypair, nonce)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, 1, m.Len())
+}
+
+func TestChallengeLoginRejectsBadResponses(t *testing.T) {
+	m := NewMapper()
+	handler := mustNewRouter(m)
+	keypair := newTestKeypair(t)
+
+	// No challenge requested yet
+	rec := postChallengeLogin(t, handler, keypair, "deadbeef")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// Someone else's nonce doesn't work for this ID
+	nonce := testChallenge(t, handler, keypair)
+	other := newTestKeypair(t)
+	otherNonce := testChallenge(t, handler, other)
+	rec = postChallengeLogin(t, handler, keypair, otherNonce)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// A wrong nonce doesn't use up the pending challenge
+	rec = postChallengeLogin(t, handler, keypair, "deadbeef")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, 0, m.Len())
+
+	rec = postChallengeLogin(t, handler, keypair, nonce)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 1, m.Len())
+}
+
+func TestChallengeNotReplacedByAnother(t *testing.T) {
+	m := NewMapper()
+	handler := mustNewRouter(m)
+	keypair := newTestKeypair(t)
+
+	// Someone else asking for a challenge for this ID doesn't cancel
+	// the one its owner is answering
+	nonce := testChallenge(t, handler, keypair)
+	later := testChallenge(t, handler, keypair)
+
+	rec := postChallengeLogin(t, handler, keypair, nonce)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = postChallengeLogin(t, handler, keypair, later)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 2, m.Len())
+}
+
+// decryptLoginError decrypts and parses a failed login's response to
+// keypair
+func decryptLoginError(t *testing.T, rec *httptest.ResponseRecorder, keypair *taber.Keys) errorResponse {
+	assert.Equal(t, contentTypeLoginError, rec.Header().Get("Content-Type"))
+
+	_, filename, contents, err := minilock.DecryptFileContents(rec.Body.Bytes(),
+		keypair)
+	require.NoError(t, err)
+	assert.Equal(t, "type:error+json", filename)
+
+	var resp errorResponse
+	require.NoError(t, json.Unmarshal(contents, &resp))
+	return resp
+}
+
+func TestLoginEncryptErrors(t *testing.T) {
+	cfg := testConfig()
+	cfg.LoginEncryptErrors = true
+	handler := mustNewRouterConfig(cfg, NewMapper())
+	keypair := newTestKeypair(t)
+
+	testChallenge(t, handler, keypair)
+	rec := postChallengeLogin(t, handler, keypair, "deadbeef")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.NotContains(t, rec.Body.String(), ErrChallengeMismatch.Error())
+	resp := decryptLoginError(t, rec, keypair)
+	assert.Equal(t, "Error: "+ErrChallengeMismatch.Error(), resp.Error)
+	assert.Equal(t, http.StatusUnauthorized, resp.Status)
+
+	// Only the client can read it
+	_, _, _, err := minilock.DecryptFileContents(rec.Body.Bytes(),
+		newTestKeypair(t))
+	assert.Error(t, err)
+
+	// Successes are still told apart by Content-Type and filename
+	nonce := testChallenge(t, handler, keypair)
+	rec = postChallengeLogin(t, handler, keypair, nonce)
+	require.Equal(t, http.StatusOK, rec.Code)
+	decryptAuthToken(t, rec, keypair)
+
+	// With no valid miniLock ID to encrypt to, errors are plaintext
+	rec = postLogin(handler, "application/json", `{"minilock_id":"short","nonce":"deadbeef"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, contentTypeJSON, rec.Header().Get("Content-Type"))
+}
+
+func TestLoginPlaintextErrors(t *testing.T) {
+	handler := mustNewRouter(NewMapper())
+	keypair := newTestKeypair(t)
+	testChallenge(t, handler, keypair)
+	rec := postChallengeLogin(t, handler, keypair, "deadbeef")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, contentTypeJSON, rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), ErrChallengeMismatch.Error())
+}
+
+func TestChallengeStoreExpiry(t *testing.T) {
+	now := time.Now()
+	cs := NewChallengeStore(time.Minute)
+	cs.now = func() time.Time { return now }
+
+	nonce, err := cs.New("someID", testServerKeys.Current())
+	require.NoError(t, err)
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, ErrChallengeExpired, cs.Verify("someID", nonce, testServerKeys))
+	assert.Equal(t, ErrChallengeNotFound, cs.Verify("someID", nonce, testServerKeys))
+
+	nonce, err = cs.New("someID", testServerKeys.Current())
+	require.NoError(t, err)
+	assert.Equal(t, ErrChallengeMismatch, cs.Verify("someID", "deadbeef", testServerKeys))
+	assert.NoError(t, cs.Verify("someID", nonce, testServerKeys))
+	assert.Equal(t, ErrChallengeNotFound, cs.Verify("someID", nonce, testServerKeys))
+}
+
+func TestChallengeStoreSweep(t *testing.T) {
+	now := time.Now()
+	cs := NewChallengeStore(time.Minute)
+	cs.now = func() time.Time { return now }
+	newChallenge := func(mID string, after time.Duration) {
+		now = now.Add(after)
+		_, err := cs.New(mID, testServerKeys.Current())
+		require.NoError(t, err)
+	}
+
+	newChallenge("oldID", 0)
+	newChallenge("newID", 30*time.Second)
+	newChallenge("otherID", 30*time.Second)
+	assert.NotContains(t, cs.challenges, "oldID")
+	assert.Contains(t, cs.challenges, "newID")
+
+	// newID has expired, but it's too soon to sweep again
+	newChallenge("otherID", 40*time.Second)
+	assert.Contains(t, cs.challenges, "newID")
+
+	newChallenge("otherID", 20*time.Second)
+	assert.NotContains(t, cs.challenges, "newID")
+	// Only otherID's live challenges are kept
+	assert.Len(t, cs.challenges["otherID"], 2)
+}
+
+func TestChallengeStoreCapsPending(t *testing.T) {
+	cs := NewChallengeStore(time.Minute)
+
+	first, err := cs.New("someID", testServerKeys.Current())
+	require.NoError(t, err)
+	var last string
+	for i := 0; i < maxPendingChallenges; i++ {
+		last, err = cs.New("someID", testServerKeys.Current())
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, ErrChallengeMismatch, cs.Verify("someID", first, testServerKeys))
+	assert.NoError(t, cs.Verify("someID", last, testServerKeys))
+}
+
+func TestChallengeLoginInvalidBody(t *testing.T) {
+	keypair := newTestKeypair(t)
+
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader("nope"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Minilock-Id", testMinilockID(t, keypair))
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
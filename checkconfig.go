@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// CheckConfig looks for problems in cfg that would otherwise only turn
+// up once the server starts (or crashes on startup), by running the
+// same constructors the server does at startup: for the session
+// store, PostgREST proxy, CORS, tracing, and TLS, and for the files
+// cfg names (the CSP config, IP lists, login blocklist, client CAs,
+// and server keys), along with the Basic Auth checks. Nothing is
+// created, connected to, or started; a missing server key, which would
+// be generated, is fine. Returns the first problem found, along with
+// any warnings.
+func CheckConfig(cfg *Config) (warnings []string, err error) {
+	warnings, err = cfg.CheckBasicAuth()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Prod && len(cfg.Domains()) == 0 {
+		return nil, errors.New("You must specify a -domain when using the -prod flag.")
+	}
+
+	// Redis is only dialed once a connection is needed
+	if _, err := newSessionStore(cfg); err != nil {
+		return nil, err
+	}
+	if _, err := parsePostgrestUpstreams(cfg.PostgrestBaseURL); err != nil {
+		return nil, err
+	}
+	if err := checkPostgrestJWTSecret(cfg); err != nil {
+		return nil, err
+	}
+	if _, err := newCORS(cfg); err != nil {
+		return nil, err
+	}
+	if _, err := newTraceExporter(cfg); err != nil {
+		return nil, err
+	}
+	if _, err := newSampler(cfg); err != nil {
+		return nil, err
+	}
+	if _, err := tlsVersion(cfg.TLSMinVersion); err != nil {
+		return nil, err
+	}
+	if _, err := LoadCSPConfig(cfg.CSPConfigFile, cfg.Domains()); err != nil {
+		return nil, err
+	}
+	if _, err := NewIPFilter(cfg); err != nil {
+		return nil, err
+	}
+	if _, err := LoadBlocklist(cfg.LoginBlocklistFile); err != nil {
+		return nil, err
+	}
+	if _, err := loadClientCAs(cfg.ClientCAFile); err != nil {
+		return nil, err
+	}
+	if cfg.ServerKeyFile != "" {
+		_, err := readServerKey(cfg.ServerKeyFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if cfg.ServerKeyPreviousFile != "" {
+		if _, err := readServerKey(cfg.ServerKeyPreviousFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Prod {
+		if _, err := newAutocertCache(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return warnings, nil
+}
+
+// runConfigCheck checks cfg (see CheckConfig) for -check-config,
+// writing to w either "OK" and the config, secrets redacted, or the
+// problem found, and returns the status to exit with.
+func runConfigCheck(cfg *Config, w io.Writer) int {
+	warnings, err := CheckConfig(cfg)
+	if err != nil {
+		fmt.Fprintf(w, "Error: %v\n", err)
+		return 1
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(w, "Warning: %s\n", warning)
+	}
+
+	fields, err := json.MarshalIndent(cfg.LogFields(), "", "  ")
+	if err != nil {
+		fmt.Fprintf(w, "Error: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(w, "OK\n%s\n", fields)
+	return 0
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunConfigCheck(t *testing.T) {
+	cfg, err := ParseConfig([]string{"-check-config"}, testEnv(map[string]string{
+		"INTERNAL_POSTGREST_BASE_URL":   "http://db:3000/, http://db2:3000/ weight=2",
+		"REACT_APP_BASIC_AUTH_USERNAME": "team",
+		"REACT_APP_BASIC_AUTH_PASSWORD": "correct horse battery staple",
+		"SERVER_KEY_FILE":               filepath.Join(t.TempDir(), "server.key"),
+	}))
+	require.NoError(t, err)
+	require.True(t, cfg.CheckConfig)
+
+	var out bytes.Buffer
+	assert.Equal(t, 0, runConfigCheck(cfg, &out))
+	assert.Regexp(t, `^OK\n\{\n`, out.String())
+	assert.Contains(t, out.String(), `"basic_auth_username": "team"`)
+	assert.Contains(t, out.String(), `"basic_auth_password": "[REDACTED]"`)
+	assert.NotContains(t, out.String(), "correct horse battery staple")
+}
+
+func TestRunConfigCheckInvalid(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	for _, tt := range []struct {
+		env map[string]string
+		err string
+	}{
+		{map[string]string{"INTERNAL_POSTGREST_BASE_URL": "db:3000"},
+			"PostgREST base URL `db:3000` must be http or https, not db"},
+		{map[string]string{"CSP_CONFIG_FILE": missing},
+			"Error reading CSP config: open " + missing +
+				": no such file or directory"},
+		{map[string]string{"CLIENT_CA_FILE": missing},
+			"Error reading client CA file: open " + missing +
+				": no such file or directory"},
+		{map[string]string{"SERVER_KEY_PREVIOUS_FILE": missing},
+			"open " + missing + ": no such file or directory"},
+		{map[string]string{"CORS_ALLOWED_ORIGINS": "*",
+			"CORS_ALLOW_CREDENTIALS": "true"},
+			ErrCORSWildcardCredentials.Error()},
+		{map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "ftp://x"},
+			"OTLP endpoint `ftp://x` must be an http(s) URL"},
+		{map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://x",
+			"OTEL_EXPORTER_OTLP_PROTOCOL": "grpc"},
+			"Unsupported OTLP protocol `grpc`; only http/json is supported"},
+		{map[string]string{"OTEL_TRACES_SAMPLER": "traceidratio",
+			"OTEL_TRACES_SAMPLER_ARG": "10%"},
+			"Trace sampler ratio `10%` must be from 0 to 1"},
+		{map[string]string{"SESSION_STORE": "redis", "REDIS_URL": "not a url"},
+			"Redis URL `not a url` must start with redis:// or rediss://"},
+	} {
+		cfg, err := ParseConfig([]string{"-check-config"}, testEnv(tt.env))
+		require.NoError(t, err)
+		cfg.ServerKeyFile = ""
+
+		var out bytes.Buffer
+		assert.Equal(t, 1, runConfigCheck(cfg, &out), tt.err)
+		assert.Equal(t, "Error: "+tt.err+"\n", out.String())
+	}
+
+	// Only a warning outside of production
+	cfg, err := ParseConfig([]string{"-check-config"}, testEnv(map[string]string{
+		"REACT_APP_BASIC_AUTH_USERNAME": "team",
+	}))
+	require.NoError(t, err)
+	cfg.ServerKeyFile = ""
+	var out bytes.Buffer
+	assert.Equal(t, 0, runConfigCheck(cfg, &out))
+	assert.Regexp(t, "^Warning: Basic Auth username is set.*\nOK\n", out.String())
+
+	// Errors parsing the config come before any checks
+	_, err = ParseConfig([]string{"-check-config"}, testEnv(map[string]string{
+		"AUTH_TOKEN_TTL": "a day",
+	}))
+	assert.EqualError(t, err, `Error parsing AUTH_TOKEN_TTL: time: invalid duration "a day"`)
+}
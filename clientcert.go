@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// loadClientCAs reads the PEM-encoded CA certs that client certs must
+// be issued by, or returns nil if path is empty.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No PEM-encoded certs found in client CA file %s",
+			path)
+	}
+	return pool, nil
+}
+
+// ClientCertAuth only lets through requests that came with a client
+// cert verified during the TLS handshake (see getTLSConfig) whose
+// subject is allowed. Since requiring certs of every connection would
+// lock everyone else out of the app, the handshake only verifies them
+// if given, and this checks them route by route.
+type ClientCertAuth struct {
+	subjects map[string]bool
+}
+
+// NewClientCertAuth returns a ClientCertAuth allowing certs whose
+// subject's common name or full distinguished name (e.g.,
+// "CN=admin,O=Effective") is one of subjects, or any cert from the
+// client CAs if subjects is empty.
+func NewClientCertAuth(subjects []string) *ClientCertAuth {
+	cca := &ClientCertAuth{subjects: map[string]bool{}}
+	for _, subject := range subjects {
+		if subject = strings.TrimSpace(subject); subject != "" {
+			cca.subjects[subject] = true
+		}
+	}
+	return cca
+}
+
+func (cca *ClientCertAuth) allowed(cert *x509.Certificate) bool {
+	return len(cca.subjects) == 0 || cca.subjects[cert.Subject.CommonName] ||
+		cca.subjects[cert.Subject.String()]
+}
+
+// Authenticate makes ClientCertAuth an Authenticator. The identity is
+// the cert's subject.
+func (cca *ClientCertAuth) Authenticate(req *http.Request) (string, bool, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return "", false, nil
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	if !cca.allowed(cert) {
+		log.Infof("Client cert `%s` not allowed to access %s",
+			cert.Subject, req.URL.Path)
+		return "", false, nil
+	}
+	return cert.Subject.String(), true, nil
+}
+
+// Middleware is like RequireAuth(cca), but responds with a 403, since
+// no WWW-Authenticate challenge could get the client in.
+func (cca *ClientCertAuth) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		identity, ok, _ := cca.Authenticate(req)
+		if !ok {
+			WriteErrorStatus(w, "Error: valid client certificate required",
+				nil, http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, withIdentity(req, identity))
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, der: der}
+}
+
+// issueClientCert returns a client cert for commonName signed by ca
+func (ca *testCA) issueClientCert(t *testing.T, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert,
+		&key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newClientCertServer serves the app over HTTPS, verifying client certs
+// against ca and allowing those for subjects into admin routes
+func newClientCertServer(t *testing.T, ca *testCA, subjects string) *httptest.Server {
+	cfg := testConfig()
+	cfg.ClientCertSubjects = subjects
+	return newClientCertServerConfig(t, cfg, ca)
+}
+
+// newClientCertServerConfig is like newClientCertServer, but
+// configured by cfg
+func newClientCertServerConfig(t *testing.T, cfg *Config, ca *testCA) *httptest.Server {
+	caFile := filepath.Join(t.TempDir(), "client-ca.pem")
+	require.NoError(t, os.WriteFile(caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der}),
+		0600))
+
+	cfg.ClientCAFile = caFile
+	srv, err := NewServer(cfg, NewMapper(), testServerKeys, nil)
+	require.NoError(t, err)
+
+	serverCert, err := newSelfSignedCert([]string{"localhost"},
+		[]net.IP{net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	clientCAs, err := loadClientCAs(caFile)
+	require.NoError(t, err)
+
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.TLS = getTLSConfig(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return serverCert, nil
+	}, clientCAs, tls.VersionTLS12)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// clientWithCert returns a client presenting certs (if any) whether or
+// not the server says it trusts their issuer
+func clientWithCert(certs ...tls.Certificate) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					if len(certs) == 0 {
+						return &tls.Certificate{}, nil
+					}
+					return &certs[0], nil
+				},
+			},
+		},
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ca := newTestCA(t, "Effective Test Admin CA")
+	ts := newClientCertServer(t, ca, "admin")
+
+	// Trusted and allowed
+	client := clientWithCert(ca.issueClientCert(t, "admin"))
+	for _, path := range []string{"/metrics", "/debug/pprof/cmdline"} {
+		resp, err := client.Get(ts.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+	}
+
+	// Trusted but not allowed
+	resp, err := clientWithCert(ca.issueClientCert(t, "intruder")).Get(
+		ts.URL + "/metrics")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// No cert: admin routes are refused, but the rest of the app works
+	resp, err = clientWithCert().Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = clientWithCert().Get(ts.URL + "/healthz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestClientCertAuthWithBasicAuth(t *testing.T) {
+	ca := newTestCA(t, "Effective Test Admin CA")
+	admin := ca.issueClientCert(t, "admin")
+
+	get := func(ts *httptest.Server, client *http.Client, password string) int {
+		req, err := http.NewRequest("GET", ts.URL+"/metrics", nil)
+		require.NoError(t, err)
+		if password != "" {
+			req.SetBasicAuth("admin", password)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, tt := range []struct {
+		mode                         string
+		certOnly, passwordOnly, both int
+	}{
+		{"all", http.StatusUnauthorized, http.StatusForbidden, http.StatusOK},
+		{"any", http.StatusOK, http.StatusOK, http.StatusOK},
+	} {
+		cfg := testConfig()
+		cfg.BasicAuthUsername = "admin"
+		cfg.BasicAuthPassword = "correct horse battery staple"
+		cfg.BasicAuthRoutes = "admin"
+		cfg.AdminAuthMode = tt.mode
+		ts := newClientCertServerConfig(t, cfg, ca)
+
+		assert.Equal(t, tt.certOnly, get(ts, clientWithCert(admin), ""), tt.mode)
+		assert.Equal(t, tt.passwordOnly, get(ts, clientWithCert(),
+			cfg.BasicAuthPassword), tt.mode)
+		assert.Equal(t, tt.both, get(ts, clientWithCert(admin),
+			cfg.BasicAuthPassword), tt.mode)
+		assert.NotEqual(t, http.StatusOK, get(ts, clientWithCert(), ""), tt.mode)
+		assert.NotEqual(t, http.StatusOK, get(ts, clientWithCert(),
+			"wrong password"), tt.mode)
+		if tt.mode == "all" {
+			assert.Equal(t, http.StatusUnauthorized, get(ts,
+				clientWithCert(admin), "wrong password"))
+		}
+	}
+}
+
+func TestClientCertAuthUntrusted(t *testing.T) {
+	ts := newClientCertServer(t, newTestCA(t, "Effective Test Admin CA"), "")
+
+	// Issued by some other CA, so the handshake fails
+	other := newTestCA(t, "Some Other CA")
+	resp, err := clientWithCert(other.issueClientCert(t, "admin")).Get(
+		ts.URL + "/metrics")
+	if err == nil {
+		resp.Body.Close()
+	}
+	assert.Error(t, err)
+}
+
+func TestLoadClientCAs(t *testing.T) {
+	pool, err := loadClientCAs("")
+	assert.NoError(t, err)
+	assert.Nil(t, pool)
+
+	path := filepath.Join(t.TempDir(), "empty.pem")
+	require.NoError(t, os.WriteFile(path, []byte("not a cert\n"), 0600))
+	_, err = loadClientCAs(path)
+	assert.Error(t, err)
+}
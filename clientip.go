@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP returns the IP address req came from. If req came through
+// any of trustedProxies, X-Forwarded-For is walked from right to left,
+// skipping the trusted hops, to find the first address that isn't a
+// trusted proxy; anything further left was sent by the client and
+// can't be believed.
+func clientIP(req *http.Request, trustedProxies []net.IPNet) string {
+	remoteIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteIP = req.RemoteAddr
+	}
+	if !isTrustedProxy(remoteIP, trustedProxies) {
+		return remoteIP
+	}
+
+	var hops []string
+	for _, xff := range req.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(xff, ",")...)
+	}
+
+	ip := remoteIP
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			// Garbage; the last good address is the best we have
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+func isTrustedProxy(ip string, trustedProxies []net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHTTPS reports whether req reached one of trustedProxies
+// over HTTPS, according to the X-Forwarded-Proto header it set.
+// Anyone else's X-Forwarded-Proto is ignored.
+func forwardedHTTPS(req *http.Request, trustedProxies []net.IPNet) bool {
+	remoteIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteIP = req.RemoteAddr
+	}
+	if !isTrustedProxy(remoteIP, trustedProxies) {
+		return false
+	}
+	proto := strings.SplitN(req.Header.Get("X-Forwarded-Proto"), ",", 2)[0]
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseIPNets("10.0.0.0/8, 192.168.1.1")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		trusted    []net.IPNet
+		want       string
+	}{
+		{"no XFF", "203.0.113.9:1234", nil, trusted, "203.0.113.9"},
+		{"no XFF via proxy", "10.0.0.1:1234", nil, trusted, "10.0.0.1"},
+		{"no trusted proxies", "10.0.0.1:1234", []string{"203.0.113.9"}, nil,
+			"10.0.0.1"},
+		{"spoofed XFF from untrusted source", "203.0.113.9:1234",
+			[]string{"1.2.3.4"}, trusted, "203.0.113.9"},
+		{"through trusted proxy", "10.0.0.1:1234", []string{"203.0.113.9"},
+			trusted, "203.0.113.9"},
+		{"spoofed prefix through trusted proxies", "10.0.0.1:1234",
+			[]string{"6.6.6.6, 203.0.113.9, 192.168.1.1"}, trusted,
+			"203.0.113.9"},
+		{"multiple XFF headers", "10.0.0.1:1234",
+			[]string{"6.6.6.6", "203.0.113.9, 10.2.3.4"}, trusted,
+			"203.0.113.9"},
+		{"all hops trusted", "10.0.0.1:1234", []string{"10.9.9.9, 10.0.0.2"},
+			trusted, "10.9.9.9"},
+		{"garbage hop", "10.0.0.1:1234", []string{"6.6.6.6, not-an-ip"},
+			trusted, "10.0.0.1"},
+		{"IPv6", "[::1]:1234", nil, trusted, "::1"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for _, xff := range tt.xff {
+			req.Header.Add("X-Forwarded-For", xff)
+		}
+		assert.Equal(t, tt.want, clientIP(req, tt.trusted), tt.name)
+	}
+}
+
+func TestParseIPNets(t *testing.T) {
+	nets, err := parseIPNets("10.0.0.0/8,192.168.1.1, ::1 ,fd00::/8")
+	require.NoError(t, err)
+	require.Len(t, nets, 4)
+	assert.Equal(t, "10.0.0.0/8", nets[0].String())
+	assert.Equal(t, "192.168.1.1/32", nets[1].String())
+	assert.Equal(t, "::1/128", nets[2].String())
+	assert.Equal(t, "fd00::/8", nets[3].String())
+
+	_, err = parseIPNets("10.0.0.0/33")
+	assert.Error(t, err)
+	_, err = parseIPNets("localhost")
+	assert.Error(t, err)
+}
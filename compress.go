@@ -0,0 +1,298 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Responses smaller than this aren't worth compressing
+const compressMinSize = 1024
+
+// incompressibleTypes are Content-Type prefixes of formats that are
+// already compressed
+var incompressibleTypes = []string{
+	"image/png", "image/jpeg", "image/gif", "image/webp", "video/",
+	"audio/", "font/woff", "application/zip", "application/gzip",
+	"application/x-gzip", "application/octet-stream",
+	// Encrypted
+	"application/x-minilock",
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}}
+	flateWriters = sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+)
+
+// Compress gzips or deflates h's responses for clients that accept it,
+// unless they're small, already compressed, or already have a
+// Content-Encoding (e.g., from PostgREST).
+func Compress(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		varyOn(w.Header(), "Accept-Encoding")
+
+		encoding := acceptedEncoding(req.Header.Get("Accept-Encoding"))
+		// Compressing part of a file would make the byte range wrong,
+		// and upgraded connections aren't HTTP responses at all
+		if encoding == "" || req.Method == "HEAD" || req.Header.Get("Range") != "" ||
+			upgradeType(req.Header) != "" {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		h.ServeHTTP(cw, req)
+	})
+}
+
+// varyOn adds field to h's Vary header unless it's already there,
+// e.g. from a handler that also picks an encoding.
+func varyOn(h http.Header, field string) {
+	for _, v := range h["Vary"] {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header allows
+// coding, either by name or via "*".
+func acceptsEncoding(acceptEncoding, coding string) bool {
+	wildcard := false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		c := strings.ToLower(strings.TrimSpace(fields[0]))
+		ok := true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				ok = err == nil && q > 0
+			}
+		}
+		switch c {
+		case coding:
+			// Naming it overrides "*", including to refuse it
+			return ok
+		case "*":
+			wildcard = ok
+		}
+	}
+	return wildcard
+}
+
+// acceptedEncoding returns "gzip" or "deflate", whichever the
+// Accept-Encoding header allows (preferring gzip), or "" if neither.
+func acceptedEncoding(acceptEncoding string) string {
+	var gzipOK, deflateOK bool
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		ok := true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				ok = err == nil && q > 0
+			}
+		}
+		switch coding {
+		case "gzip", "*":
+			gzipOK = gzipOK || ok
+		case "deflate":
+			deflateOK = deflateOK || ok
+		}
+	}
+
+	switch {
+	case gzipOK:
+		return "gzip"
+	case deflateOK:
+		return "deflate"
+	}
+	return ""
+}
+
+// compressWriter buffers the start of a response until it knows
+// whether it's worth compressing, then either compresses it or passes
+// it through untouched.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     io.WriteCloser // nil unless compressing
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided || cw.status != 0 {
+		return
+	}
+	cw.status = status
+
+	h := cw.Header()
+	if !bodyAllowed(status) || h.Get("Content-Encoding") != "" {
+		cw.decide(false)
+		return
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+		cw.decide(n >= compressMinSize)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < compressMinSize {
+			return len(b), nil
+		}
+		cw.decide(true)
+		return len(b), cw.flushBuf()
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// decide sends the headers, compressing the body if compress is true
+// and the Content-Type is worth compressing.
+func (cw *compressWriter) decide(compress bool) {
+	cw.decided = true
+
+	h := cw.Header()
+	if compress && h.Get("Content-Encoding") == "" {
+		if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+			// Sniff now, since the underlying ResponseWriter would
+			// otherwise sniff the compressed bytes
+			h.Set("Content-Type", http.DetectContentType(cw.buf))
+		}
+		if ct := h.Get("Content-Type"); ct != "" && compressible(ct) {
+			cw.startEncoder()
+		}
+	}
+
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+func (cw *compressWriter) startEncoder() {
+	h := cw.Header()
+	h.Set("Content-Encoding", cw.encoding)
+	h.Del("Content-Length")
+	// The compressed bytes differ from what a strong ETag promises
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag)
+	}
+
+	switch cw.encoding {
+	case "gzip":
+		gw := gzipWriters.Get().(*gzip.Writer)
+		gw.Reset(cw.ResponseWriter)
+		cw.enc = gw
+	case "deflate":
+		fw := flateWriters.Get().(*flate.Writer)
+		fw.Reset(cw.ResponseWriter)
+		cw.enc = fw
+	}
+}
+
+func (cw *compressWriter) flushBuf() error {
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if cw.enc != nil {
+		_, err := cw.enc.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+// Close writes out whatever is still buffered and finishes the
+// compressed stream.
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			// Nothing was written; let net/http send its default
+			return nil
+		}
+		cw.decide(false)
+	}
+	err := cw.flushBuf()
+	if cw.enc == nil {
+		return err
+	}
+
+	if cerr := cw.enc.Close(); err == nil {
+		err = cerr
+	}
+	switch enc := cw.enc.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(enc)
+	case *flate.Writer:
+		flateWriters.Put(enc)
+	}
+	cw.enc = nil
+	return err
+}
+
+// Flush sends what's been written so far. Streamed responses (which
+// httputil.ReverseProxy flushes as they arrive) are compressed
+// regardless of size, since their final size isn't known yet.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(true)
+	}
+	cw.flushBuf()
+	if gw, ok := cw.enc.(*gzip.Writer); ok {
+		gw.Flush()
+	} else if fw, ok := cw.enc.(*flate.Writer); ok {
+		fw.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func compressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent &&
+		status != http.StatusNotModified
+}
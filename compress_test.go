@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testLargeJSON = "[" + strings.Repeat(`{"title":"Do the thing","status":"New"},`, 100) + "{}]"
+
+func serveCompressed(h http.Handler, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/tasks", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rec := httptest.NewRecorder()
+	Compress(h).ServeHTTP(rec, req)
+	return rec
+}
+
+func jsonHandler(body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.Write([]byte(body))
+	})
+}
+
+func TestCompressLargeJSON(t *testing.T) {
+	rec := serveCompressed(jsonHandler(testLargeJSON), "deflate, gzip;q=0.9")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+	assert.Equal(t, contentTypeJSON, rec.Header().Get("Content-Type"))
+	assert.True(t, rec.Body.Len() < len(testLargeJSON))
+
+	zr, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, testLargeJSON, string(body))
+}
+
+func TestCompressDeflate(t *testing.T) {
+	rec := serveCompressed(jsonHandler(testLargeJSON), "gzip;q=0, deflate")
+	assert.Equal(t, "deflate", rec.Header().Get("Content-Encoding"))
+
+	body, err := ioutil.ReadAll(flate.NewReader(rec.Body))
+	require.NoError(t, err)
+	assert.Equal(t, testLargeJSON, string(body))
+}
+
+func TestCompressSkipsSmallBodies(t *testing.T) {
+	rec := serveCompressed(jsonHandler(`{"status":"ok"}`), "gzip")
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+	assert.Equal(t, `{"status":"ok"}`, rec.Body.String())
+}
+
+func TestCompressSkips(t *testing.T) {
+	// Client doesn't accept compression
+	rec := serveCompressed(jsonHandler(testLargeJSON), "")
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, testLargeJSON, rec.Body.String())
+
+	// Already compressed content type
+	png := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(bytes.Repeat([]byte{0}, 4*compressMinSize))
+	})
+	rec = serveCompressed(png, "gzip")
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, 4*compressMinSize, rec.Body.Len())
+
+	// Upstream already compressed it
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write([]byte(testLargeJSON))
+	zw.Close()
+	pregzipped := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipped.Bytes())
+	})
+	rec = serveCompressed(pregzipped, "gzip")
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, gzipped.Bytes(), rec.Body.Bytes())
+}
+
+func TestCompressPostgrestProxy(t *testing.T) {
+	upstream := httptest.NewServer(jsonHandler(testLargeJSON))
+	defer upstream.Close()
+
+	cfg := testConfig()
+	cfg.PostgrestBaseURL = upstream.URL
+	router := mustNewRouterConfig(cfg, nil)
+
+	headers := http.Header{"Accept-Encoding": []string{"gzip"}}
+	req := httptest.NewRequest("GET", "/postgrest/tasks", nil)
+	req.Header = headers
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Empty(t, rec.Header().Get("Content-Length"))
+
+	zr, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, testLargeJSON, string(body))
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		acceptEncoding, coding string
+		want                   bool
+	}{
+		{"gzip, deflate, br", "br", true},
+		{"gzip, deflate, br", "gzip", true},
+		{"gzip, deflate", "br", false},
+		{"BR;q=0.5", "br", true},
+		{"br;q=0", "br", false},
+		{"*", "br", true},
+		{"br;q=0, *", "br", false},
+		{"*;q=0, gzip", "br", false},
+		{"", "gzip", false},
+	} {
+		assert.Equal(t, tt.want, acceptsEncoding(tt.acceptEncoding, tt.coding),
+			"%q accepts %s", tt.acceptEncoding, tt.coding)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// How long clients turned away by ConcurrencyLimiter are told to wait
+const CONCURRENCY_RETRY_AFTER = 1 * time.Second
+
+// ConcurrencyLimiter caps how many requests are handled at once, so
+// that a traffic spike (especially of logins, with their miniLock
+// crypto) can't exhaust memory. Requests over the cap wait up to
+// queueWait for a slot, then get a 503.
+type ConcurrencyLimiter struct {
+	slots     chan struct{}
+	queueWait time.Duration
+
+	rejected uint64
+}
+
+func NewConcurrencyLimiter(max int, queueWait time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		slots:     make(chan struct{}, max),
+		queueWait: queueWait,
+	}
+}
+
+// Limit returns the most requests handled at once.
+func (cl *ConcurrencyLimiter) Limit() int {
+	return cap(cl.slots)
+}
+
+// InFlight returns how many requests hold a slot.
+func (cl *ConcurrencyLimiter) InFlight() int {
+	return len(cl.slots)
+}
+
+// Rejected returns how many requests have been turned away.
+func (cl *ConcurrencyLimiter) Rejected() uint64 {
+	return atomic.LoadUint64(&cl.rejected)
+}
+
+// acquire takes a slot, waiting up to cl.queueWait (or until req is
+// canceled) for one to free up, and reports whether it got one.
+func (cl *ConcurrencyLimiter) acquire(req *http.Request) bool {
+	select {
+	case cl.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if cl.queueWait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(cl.queueWait)
+	defer timer.Stop()
+	select {
+	case cl.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-req.Context().Done():
+	}
+	return false
+}
+
+func (cl *ConcurrencyLimiter) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// So that orchestrators don't restart us and the limit can
+		// be watched, and since upgraded connections would hold
+		// their slots for as long as they're open
+		if req.URL.Path == "/healthz" || req.URL.Path == "/metrics" ||
+			upgradeType(req.Header) != "" {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		if !cl.acquire(req) {
+			atomic.AddUint64(&cl.rejected, 1)
+			w.Header().Set("Retry-After",
+				strconv.Itoa(int(CONCURRENCY_RETRY_AFTER/time.Second)))
+			WriteErrorStatus(w, "Error: server busy; try again shortly",
+				nil, http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { <-cl.slots }()
+
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBlockingHandler returns a handler that signals on started, then
+// blocks until release is closed
+func newBlockingHandler() (h http.Handler, started chan struct{}, release chan struct{}) {
+	started, release = make(chan struct{}, 100), make(chan struct{})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+	}), started, release
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	const n = 3
+	cl := NewConcurrencyLimiter(n, 0)
+	blocking, started, release := newBlockingHandler()
+	h := cl.Middleware(blocking)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/whoami", nil))
+			codes <- rec.Code
+		}()
+	}
+	for i := 0; i < n; i++ {
+		<-started
+	}
+	assert.Equal(t, n, cl.InFlight())
+
+	// The N+1th is turned away while N are held...
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/whoami", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.Contains(t, rec.Body.String(), `"status":503`)
+	assert.Equal(t, uint64(1), cl.Rejected())
+
+	// ...but not liveness probes
+	rec = httptest.NewRecorder()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	cl.Middleware(ok).ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		assert.Equal(t, http.StatusOK, code)
+	}
+	assert.Equal(t, 0, cl.InFlight())
+
+	// Slots are given back
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/whoami", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestConcurrencyLimiterQueueWait(t *testing.T) {
+	cl := NewConcurrencyLimiter(1, time.Second)
+	blocking, started, release := newBlockingHandler()
+	h := cl.Middleware(blocking)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	<-started
+
+	// Waits for the slot to free up rather than failing
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, uint64(0), cl.Rejected())
+	<-done
+}
+
+func TestConcurrencyLimiterMetrics(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxConcurrentRequests = 7
+	srv, err := NewServer(cfg, NewMapper(), testServerKeys, nil)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	body := rec.Body.String()
+	assert.True(t, strings.Contains(body, "\neffective_http_requests_in_flight_limit 7\n"), body)
+	assert.True(t, strings.Contains(body, "\neffective_http_requests_rejected_total 0\n"), body)
+}
@@ -0,0 +1,1310 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Config is everything the server can be configured with. Each field
+// can be set with a command-line flag, which defaults to the value of
+// the corresponding env var if that's set.
+type Config struct {
+	HTTPAddr  string
+	HTTPSAddr string
+	Domain    string // Comma-separated if there's more than one
+	Prod      bool
+	DevTLS    bool
+	// Validate the config and exit rather than serve; see
+	// runConfigCheck
+	CheckConfig bool
+	// Oldest TLS version served: "1.2" or "1.3"
+	TLSMinVersion string
+
+	// How GETs and HEADs to HTTP are redirected to HTTPS in
+	// production: 301 or 308. Other methods always get a 308, which
+	// keeps their method and body.
+	HTTPSRedirectStatus int
+	// Send Strict-Transport-Security on those redirects, too
+	HSTSOnRedirect bool
+
+	// Strict-Transport-Security sent in production; see HSTSHeader
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubDomains bool
+	HSTSPreload           bool
+
+	// Reverse proxies whose X-Forwarded-For headers are believed
+	TrustedProxies []net.IPNet
+	// Load balancers whose PROXY protocol headers are believed; see
+	// ProxyProtocolListener
+	ProxyProtocolFrom []net.IPNet
+
+	// Who may reach PostgREST and the admin endpoints; see IPFilter
+	IPAllowlist     []net.IPNet
+	IPDenylist      []net.IPNet
+	IPAllowlistFile string
+	IPDenylistFile  string
+
+	// Comma-separated, to balance across several; see
+	// parsePostgrestUpstreams
+	PostgrestBaseURL               string
+	PostgrestPathPrefix            string // Where we mount PostgREST; see PostgrestPrefix
+	PostgrestJWTSecret             string
+	PostgrestDialTimeout           time.Duration
+	PostgrestResponseHeaderTimeout time.Duration
+	PostgrestRetries               int
+	// Replaces WriteTimeout for proxied requests, which may be large
+	PostgrestWriteTimeout time.Duration
+	// Comma-separated headers removed from PostgREST's responses
+	PostgrestStripResponseHeaders string
+	// If set, drop every header from PostgREST's responses except the
+	// comma-separated PostgrestAllowResponseHeaders
+	PostgrestResponseHeaderAllowlist bool
+	PostgrestAllowResponseHeaders    string
+	// Point PostgREST's Location headers at our proxy, not at PostgREST
+	PostgrestRewriteLocation bool
+	// How long GET responses from PostgREST are cached; 0 disables
+	PostgrestCacheTTL time.Duration
+	// Keep-alive connections to PostgREST kept open between requests
+	PostgrestMaxIdleConns        int
+	PostgrestMaxIdleConnsPerHost int
+	PostgrestIdleConnTimeout     time.Duration
+	PostgrestDisableKeepAlives   bool
+	// Failures in a row (within the window) that open the circuit
+	// breaker, failing requests fast for the cooldown; 0 disables
+	PostgrestBreakerThreshold int
+	PostgrestBreakerWindow    time.Duration
+	PostgrestBreakerCooldown  time.Duration
+	// How often each PostgREST upstream is probed, at which path; 0
+	// disables, leaving /readyz to probe the first itself
+	PostgrestHealthCheckInterval time.Duration
+	PostgrestHealthCheckPath     string
+
+	// Requests with bigger bodies are rejected with a 413; those to
+	// PostgREST may have up to PostgrestMaxRequestBodySize instead, if
+	// set
+	MaxRequestBodySize          int64
+	PostgrestMaxRequestBodySize int64
+	// Requests whose headers take more bytes than MaxHeaderBytes, or
+	// number more than MaxRequestHeaders (0 for no limit), are
+	// rejected with a 431
+	MaxHeaderBytes    int
+	MaxRequestHeaders int
+
+	// Requests beyond MaxConcurrentRequests in flight (0 for no limit)
+	// wait up to ConcurrencyQueueWait, then get a 503
+	MaxConcurrentRequests int
+	ConcurrencyQueueWait  time.Duration
+
+	// Requests still in flight after this long are logged; 0 disables
+	SlowRequestThreshold time.Duration
+
+	// Where spans are exported (see Tracer), and which (see Sampler),
+	// named as OpenTelemetry SDKs name them; tracing is off unless
+	// OTLPEndpoint or OTLPTracesEndpoint is set
+	OTLPEndpoint         string
+	OTLPTracesEndpoint   string
+	OTLPHeaders          string
+	OTLPProtocol         string
+	OTELServiceName      string
+	OTELTracesSampler    string
+	OTELTracesSamplerArg string
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration // For both HTTP/1.1 and HTTP/2
+
+	HTTP2MaxConcurrentStreams int
+	HTTP2Push                 bool
+
+	// The document to serve for a request for a directory within the
+	// build that contains one; the app's index.html otherwise
+	DirectoryIndex string
+
+	// Serve a 503 maintenance page if Maintenance is set or
+	// MaintenanceFile exists
+	Maintenance           bool
+	MaintenanceFile       string
+	MaintenanceRetryAfter time.Duration
+
+	AuthTokenTTL          time.Duration
+	AuthTokenReapInterval time.Duration
+	// Each auth token's last-seen time is saved at most this often
+	LastSeenInterval    time.Duration
+	ShutdownGracePeriod time.Duration
+	// How long /readyz fails before shutting down starts, so that load
+	// balancers stop sending requests first
+	ShutdownDrainDelay time.Duration
+
+	// Most sessions each miniLock ID can have at once (0 means no
+	// limit); logins over it revoke the least recently used, or are
+	// rejected if MaxSessionsReject
+	MaxSessions       int
+	MaxSessionsReject bool
+
+	// "memory" (the default) or "redis"
+	SessionStore string
+	RedisURL     string
+
+	// Each client IP may log in LoginRateLimitBurst times in a row,
+	// then once per LoginRateLimitInterval
+	LoginRateLimitBurst    int
+	LoginRateLimitInterval time.Duration
+
+	// Likewise, each miniLock ID may log in LoginIDRateLimitBurst
+	// times in a row, from whatever IPs, then once per
+	// LoginIDRateLimitInterval; only logins that pass their
+	// challenge count. 0 disables this limit
+	LoginIDRateLimitBurst    int
+	LoginIDRateLimitInterval time.Duration
+
+	// After LoginLockoutThreshold failed challenge logins, a miniLock
+	// ID or IP is locked out for LoginLockoutBaseDelay, doubling with
+	// each further failure up to LoginLockoutMaxDelay. Failures are
+	// forgotten after LoginLockoutCooldown without any.
+	LoginLockoutThreshold int
+	LoginLockoutBaseDelay time.Duration
+	LoginLockoutMaxDelay  time.Duration
+	LoginLockoutCooldown  time.Duration
+
+	BasicAuthUsername string
+	BasicAuthPassword string
+	// Comma-separated route groups Basic Auth protects; see
+	// basicAuthGroups
+	BasicAuthRoutes string
+
+	// If set, admin routes (e.g., /metrics, /debug/pprof) require a
+	// TLS client cert issued by one of this file's CAs, and whose
+	// subject is one of the comma-separated ClientCertSubjects (if any)
+	ClientCAFile       string
+	ClientCertSubjects string
+	// When Basic Auth protects admin routes too, "all" (the default)
+	// requires both a client cert and the password, "any" either one
+	AdminAuthMode string
+
+	// Where logins, logouts, and revocations are audited, as JSON:
+	// "stdout", a file path, or "" not to
+	AuditLog string
+	// How many of the latest audit events to keep in memory for
+	// GET /internal/audit-tail; 0 not to
+	AuditTailSize int
+	// File of miniLock IDs that may not log in, one per line; reloaded
+	// on SIGHUP
+	LoginBlocklistFile string
+	// Encrypt login errors to the miniLock ID logging in, when it's
+	// valid, rather than sending them in plaintext
+	LoginEncryptErrors bool
+
+	CSPConfigFile string
+
+	// Comma-separated origins allowed to call /api/ and PostgREST
+	CORSAllowedOrigins   string
+	CORSAllowCredentials bool
+
+	// Sent on every HTTPS response; an empty value omits the header
+	PermissionsPolicy         string
+	CrossOriginOpenerPolicy   string
+	CrossOriginResourcePolicy string
+
+	// Where the server's miniLock key is kept, generated if missing; ""
+	// for a new one every restart. ServerKeyPreviousFile holds the key
+	// it replaced, if rotating.
+	ServerKeyFile         string
+	ServerKeyPreviousFile string
+
+	// "dir" (the default) or "postgrest", in which case
+	// AutocertCachePostgrestURL is a PostgREST serving only the
+	// autocert schema, never proxied
+	AutocertCache             string
+	AutocertCacheDir          string
+	AutocertCachePostgrestURL string
+	// Get certs for every domain at startup, rather than on the first
+	// request for each; see PrewarmCerts
+	AutocertPrewarm bool
+}
+
+// DefaultConfig returns the Config used when no flags or env vars are
+// set.
+func DefaultConfig() *Config {
+	return &Config{
+		HTTPAddr:  "127.0.0.1:8082",
+		HTTPSAddr: "127.0.0.1:8443",
+
+		TLSMinVersion: "1.2",
+
+		HTTPSRedirectStatus: http.StatusMovedPermanently,
+
+		HSTSMaxAge:            HSTS_PRELOAD_MIN_MAX_AGE,
+		HSTSIncludeSubDomains: true,
+		HSTSPreload:           true,
+
+		PostgrestBaseURL:               "http://localhost:3000/",
+		PostgrestPathPrefix:            "/postgrest",
+		PostgrestDialTimeout:           5 * time.Second,
+		PostgrestResponseHeaderTimeout: 30 * time.Second,
+		PostgrestRetries:               2,
+		PostgrestWriteTimeout:          10 * time.Minute,
+		PostgrestStripResponseHeaders:  "Server,X-Powered-By",
+		PostgrestAllowResponseHeaders: "Content-Type,Content-Length," +
+			"Content-Encoding,Content-Range,Content-Location,Location," +
+			"Range-Unit,Preference-Applied,Cache-Control,ETag," +
+			"Last-Modified,Vary",
+		// There's only the one host, so it may use them all, rather
+		// than http.DefaultMaxIdleConnsPerHost's 2
+		PostgrestMaxIdleConns:        100,
+		PostgrestMaxIdleConnsPerHost: 100,
+		PostgrestIdleConnTimeout:     90 * time.Second,
+		PostgrestBreakerThreshold:    5,
+		PostgrestBreakerWindow:       10 * time.Second,
+		PostgrestBreakerCooldown:     30 * time.Second,
+		PostgrestHealthCheckInterval: 10 * time.Second,
+		PostgrestHealthCheckPath:     "/",
+
+		MaxRequestBodySize: 1 << 20,
+		MaxHeaderBytes:     64 << 10,
+		MaxRequestHeaders:  100,
+
+		ConcurrencyQueueWait: 100 * time.Millisecond,
+
+		SlowRequestThreshold: 5 * time.Second,
+
+		OTELServiceName:   "effective",
+		OTELTracesSampler: "parentbased_always_on",
+
+		ReadHeaderTimeout: 15 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+
+		HTTP2MaxConcurrentStreams: 250,
+
+		DirectoryIndex: "index.html",
+
+		MaintenanceFile:       "./MAINTENANCE",
+		MaintenanceRetryAfter: 5 * time.Minute,
+
+		AuthTokenTTL:          24 * time.Hour,
+		AuthTokenReapInterval: 10 * time.Minute,
+		LastSeenInterval:      time.Minute,
+		ShutdownGracePeriod:   30 * time.Second,
+
+		MaxSessions: 10,
+
+		LoginRateLimitBurst:    10,
+		LoginRateLimitInterval: 6 * time.Second,
+
+		LoginIDRateLimitBurst:    10,
+		LoginIDRateLimitInterval: time.Minute,
+
+		LoginLockoutThreshold: 5,
+		LoginLockoutBaseDelay: 30 * time.Second,
+		LoginLockoutMaxDelay:  1 * time.Hour,
+		LoginLockoutCooldown:  15 * time.Minute,
+
+		PermissionsPolicy:         "geolocation=(), camera=(), microphone=()",
+		CrossOriginOpenerPolicy:   "same-origin",
+		CrossOriginResourcePolicy: "same-origin",
+
+		ServerKeyFile: "./server.key",
+
+		BasicAuthRoutes: "app,api,admin",
+		AdminAuthMode:   "all",
+	}
+}
+
+// BasicAuthEnabled reports whether HTTP Basic Auth credentials were
+// configured.
+func (cfg *Config) BasicAuthEnabled() bool {
+	return cfg.BasicAuthUsername != "" && cfg.BasicAuthPassword != ""
+}
+
+// The groups of routes Basic Auth can be enabled for separately: the
+// React app (the build dir), the PostgREST proxy, and admin routes
+// (/metrics, /debug/..., etc)
+const (
+	basicAuthApp   = "app"
+	basicAuthAPI   = "api"
+	basicAuthAdmin = "admin"
+)
+
+var basicAuthGroups = []string{basicAuthApp, basicAuthAPI, basicAuthAdmin}
+
+// BasicAuthProtects reports whether Basic Auth is enabled for the
+// route group named group.
+func (cfg *Config) BasicAuthProtects(group string) bool {
+	if !cfg.BasicAuthEnabled() {
+		return false
+	}
+	for _, g := range splitList(cfg.BasicAuthRoutes) {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Basic Auth passwords shorter than this are considered weak
+const MIN_BASIC_AUTH_PASSWORD_LEN = 12
+
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password123": true,
+	"password1234": true, "changeme": true, "letmein": true, "admin": true,
+	"secret": true, "qwerty": true, "123456": true, "123456789012": true,
+}
+
+// CheckBasicAuth looks for Basic Auth misconfigurations: only one of
+// the username and password set (which silently leaves auth off), a
+// weak password, or no Basic Auth while serving a public domain. The
+// first two are errors in production and warnings otherwise.
+func (cfg *Config) CheckBasicAuth() (warnings []string, err error) {
+	var problems []string
+
+	switch {
+	case cfg.BasicAuthUsername != "" && cfg.BasicAuthPassword == "":
+		problems = append(problems, "Basic Auth username is set but password"+
+			" isn't, so Basic Auth is disabled")
+	case cfg.BasicAuthUsername == "" && cfg.BasicAuthPassword != "":
+		problems = append(problems, "Basic Auth password is set but username"+
+			" isn't, so Basic Auth is disabled")
+	case cfg.BasicAuthEnabled():
+		if reason := weakPasswordReason(cfg.BasicAuthUsername,
+			cfg.BasicAuthPassword); reason != "" {
+			problems = append(problems, "Basic Auth password is weak: "+reason)
+		}
+	}
+
+	if cfg.Prod && len(problems) > 0 {
+		return nil, fmt.Errorf("Refusing to start in production: %s",
+			strings.Join(problems, "; "))
+	}
+	warnings = problems
+
+	if !cfg.BasicAuthEnabled() {
+		for _, domain := range cfg.Domains() {
+			if isPublicDomain(domain) {
+				warnings = append(warnings, fmt.Sprintf("Basic Auth is disabled"+
+					" but public domain %s is configured", domain))
+				break
+			}
+		}
+	}
+	return warnings, nil
+}
+
+func isBasicAuthGroup(group string) bool {
+	for _, g := range basicAuthGroups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+func weakPasswordReason(username, password string) string {
+	switch {
+	case len(password) < MIN_BASIC_AUTH_PASSWORD_LEN:
+		return fmt.Sprintf("shorter than %d characters", MIN_BASIC_AUTH_PASSWORD_LEN)
+	case strings.EqualFold(password, username):
+		return "same as the username"
+	case commonPasswords[strings.ToLower(password)]:
+		return "commonly used"
+	case strings.Count(password, password[:1]) == len(password):
+		return "one repeated character"
+	}
+	return ""
+}
+
+// isPublicDomain reports whether domain is reachable from the
+// internet, i.e., isn't localhost, a reserved TLD, or a private IP.
+func isPublicDomain(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if ip := net.ParseIP(domain); ip != nil {
+		return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+			ip.IsUnspecified())
+	}
+	if domain == "localhost" {
+		return false
+	}
+	for _, tld := range []string{".localhost", ".local", ".test", ".internal"} {
+		if strings.HasSuffix(domain, tld) {
+			return false
+		}
+	}
+	return true
+}
+
+// The shortest max-age the HSTS preload lists accept
+const HSTS_PRELOAD_MIN_MAX_AGE = 365 * 24 * time.Hour
+
+// CheckHSTS rejects HSTS settings that would have the header ask for
+// preloading that the preload lists (https://hstspreload.org) would
+// refuse: without includeSubDomains, or for less than a year.
+func (cfg *Config) CheckHSTS() error {
+	if cfg.HSTSMaxAge < 0 {
+		return fmt.Errorf("HSTS max-age can't be negative")
+	}
+	if !cfg.HSTSPreload {
+		return nil
+	}
+	if !cfg.HSTSIncludeSubDomains {
+		return fmt.Errorf("HSTS preload requires includeSubDomains;" +
+			" set HSTS_INCLUDE_SUBDOMAINS=true or HSTS_PRELOAD=false")
+	}
+	if cfg.HSTSMaxAge < HSTS_PRELOAD_MIN_MAX_AGE {
+		return fmt.Errorf("HSTS preload requires a max-age of at least"+
+			" %v, not %v; raise HSTS_MAX_AGE or set HSTS_PRELOAD=false",
+			HSTS_PRELOAD_MIN_MAX_AGE, cfg.HSTSMaxAge)
+	}
+	return nil
+}
+
+// HSTSHeader returns the Strict-Transport-Security header value that
+// cfg calls for, e.g. "max-age=31536000; includeSubDomains; preload".
+func (cfg *Config) HSTSHeader() string {
+	header := fmt.Sprintf("max-age=%d", int64(cfg.HSTSMaxAge/time.Second))
+	if cfg.HSTSIncludeSubDomains {
+		header += "; includeSubDomains"
+	}
+	if cfg.HSTSPreload {
+		header += "; preload"
+	}
+	return header
+}
+
+// PostgrestPrefix returns cfg.PostgrestPathPrefix with a leading
+// slash and no trailing one, e.g. "/api/db", or "" if PostgREST is
+// served from the root.
+func (cfg *Config) PostgrestPrefix() string {
+	prefix := strings.Trim(strings.TrimSpace(cfg.PostgrestPathPrefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// PostgrestPrimaryURL returns the first of the PostgREST base URLs in
+// cfg.PostgrestBaseURL, for things that only talk to one, like the
+// emailer.
+func (cfg *Config) PostgrestPrimaryURL() string {
+	for _, entry := range strings.Split(cfg.PostgrestBaseURL, ",") {
+		if fields := strings.Fields(entry); len(fields) > 0 {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+// Domains returns the domains in cfg.Domain.
+func (cfg *Config) Domains() []string {
+	return splitList(cfg.Domain)
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// CanonicalDomain returns the first of cfg.Domains(), or "" if there
+// are none.
+func (cfg *Config) CanonicalDomain() string {
+	domains := cfg.Domains()
+	if len(domains) == 0 {
+		return ""
+	}
+	return domains[0]
+}
+
+const redacted = "[REDACTED]"
+
+// LogFields returns the settings worth logging at startup, with
+// secrets redacted.
+func (cfg *Config) LogFields() log.Fields {
+	sessionStore := cfg.SessionStore
+	if sessionStore == "" {
+		sessionStore = "memory"
+	}
+	var trustedProxies []string
+	for _, ipNet := range cfg.TrustedProxies {
+		trustedProxies = append(trustedProxies, ipNet.String())
+	}
+	var proxyProtocolFrom []string
+	for _, ipNet := range cfg.ProxyProtocolFrom {
+		proxyProtocolFrom = append(proxyProtocolFrom, ipNet.String())
+	}
+
+	fields := log.Fields{
+		"version":              version,
+		"git_commit":           gitCommit,
+		"http_addr":            cfg.HTTPAddr,
+		"https_addr":           cfg.HTTPSAddr,
+		"domains":              cfg.Domains(),
+		"prod":                 cfg.Prod,
+		"dev_tls":              cfg.DevTLS,
+		"trusted_proxies":      trustedProxies,
+		"proxy_protocol_from":  proxyProtocolFrom,
+		"postgrest_url":        cfg.PostgrestBaseURL,
+		"postgrest_jwt_secret": redactSecret(cfg.PostgrestJWTSecret),
+		"basic_auth":           cfg.BasicAuthEnabled(),
+		"basic_auth_username":  cfg.BasicAuthUsername,
+		"basic_auth_password":  redactSecret(cfg.BasicAuthPassword),
+		"basic_auth_routes":    cfg.BasicAuthRoutes,
+		"session_store":        sessionStore,
+	}
+	if cfg.RedisURL != "" {
+		fields["redis_url"] = redactURL(cfg.RedisURL)
+	}
+	if cfg.AuditLog != "" {
+		fields["audit_log"] = cfg.AuditLog
+	}
+	if cfg.AuditTailSize > 0 {
+		fields["audit_tail_size"] = cfg.AuditTailSize
+	}
+	if cfg.OTLPEndpoint != "" {
+		fields["otlp_endpoint"] = cfg.OTLPEndpoint
+	}
+	if cfg.OTLPTracesEndpoint != "" {
+		fields["otlp_traces_endpoint"] = cfg.OTLPTracesEndpoint
+	}
+	if cfg.OTLPEndpoint != "" || cfg.OTLPTracesEndpoint != "" {
+		fields["otel_traces_sampler"] = cfg.OTELTracesSampler
+		if cfg.OTELTracesSamplerArg != "" {
+			fields["otel_traces_sampler_arg"] = cfg.OTELTracesSamplerArg
+		}
+	}
+	if cfg.ClientCAFile != "" {
+		fields["client_ca_file"] = cfg.ClientCAFile
+		fields["admin_auth_mode"] = cfg.AdminAuthMode
+	}
+	if cfg.Prod {
+		fields["autocert_cache"] = cfg.AutocertCache
+		if cfg.AutocertCache == "postgrest" {
+			fields["autocert_cache_postgrest_url"] = cfg.AutocertCachePostgrestURL
+		}
+	}
+	return fields
+}
+
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// redactURL returns rawURL with any password replaced, or redacted
+// entirely if it can't be parsed.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redacted
+	}
+	return u.Redacted()
+}
+
+// ParseConfig parses args (typically os.Args[1:]) into a Config,
+// falling back to the env vars looked up with getenv (typically
+// os.Getenv), then to DefaultConfig.
+func ParseConfig(args []string, getenv func(string) string) (*Config, error) {
+	cfg := DefaultConfig()
+	env := &envDefaults{getenv: getenv}
+
+	fs := flag.NewFlagSet("effective", flag.ContinueOnError)
+
+	fs.StringVar(&cfg.HTTPAddr, "http", cfg.HTTPAddr,
+		"Address to listen on HTTP")
+	fs.StringVar(&cfg.HTTPSAddr, "https", cfg.HTTPSAddr,
+		"Address to listen on HTTPS")
+	fs.StringVar(&cfg.Domain, "domain", cfg.Domain,
+		"Domain of this service; comma-separate several, canonical first")
+	fs.BoolVar(&cfg.Prod, "prod", cfg.Prod, "Run in Production mode.")
+	fs.BoolVar(&cfg.CheckConfig, "check-config", cfg.CheckConfig,
+		"Validate the config, print it, and exit rather than serve")
+	fs.BoolVar(&cfg.DevTLS, "dev-tls", env.bool("DEV_TLS", cfg.DevTLS),
+		"Serve HTTPS with a self-signed cert for localhost (env: DEV_TLS)")
+	fs.StringVar(&cfg.TLSMinVersion, "tls-min-version",
+		env.string("TLS_MIN_VERSION", cfg.TLSMinVersion),
+		"Oldest TLS version to accept: 1.2 or 1.3 (env: TLS_MIN_VERSION)")
+	fs.IntVar(&cfg.HTTPSRedirectStatus, "https-redirect-status",
+		env.int("HTTPS_REDIRECT_STATUS", cfg.HTTPSRedirectStatus),
+		"Status to redirect GETs from HTTP to HTTPS with: 301 or 308"+
+			" (env: HTTPS_REDIRECT_STATUS)")
+	fs.BoolVar(&cfg.HSTSOnRedirect, "hsts-on-redirect",
+		env.bool("HSTS_ON_REDIRECT", cfg.HSTSOnRedirect),
+		"Send Strict-Transport-Security on HTTP->HTTPS redirects too"+
+			" (env: HSTS_ON_REDIRECT)")
+	cfg.HSTSMaxAge = env.seconds("HSTS_MAX_AGE", cfg.HSTSMaxAge)
+	fs.Var((*secondsFlag)(&cfg.HSTSMaxAge), "hsts-max-age",
+		"How long browsers should only use HTTPS, in seconds as in the"+
+			" header, or as a duration, e.g. 24h (env: HSTS_MAX_AGE)")
+	fs.BoolVar(&cfg.HSTSIncludeSubDomains, "hsts-include-subdomains",
+		env.bool("HSTS_INCLUDE_SUBDOMAINS", cfg.HSTSIncludeSubDomains),
+		"Apply HSTS to subdomains, too (env: HSTS_INCLUDE_SUBDOMAINS)")
+	fs.BoolVar(&cfg.HSTSPreload, "hsts-preload",
+		env.bool("HSTS_PRELOAD", cfg.HSTSPreload),
+		"Ask to be on browsers' HSTS preload lists (env: HSTS_PRELOAD)")
+	cfg.TrustedProxies = env.ipNets("TRUSTED_PROXIES", cfg.TrustedProxies)
+	fs.Var((*ipNetsFlag)(&cfg.TrustedProxies), "trusted-proxies",
+		"Comma-separated IPs/CIDRs of reverse proxies whose X-Forwarded-For"+
+			" to trust (env: TRUSTED_PROXIES)")
+	cfg.ProxyProtocolFrom = env.ipNets("PROXY_PROTOCOL_FROM", cfg.ProxyProtocolFrom)
+	fs.Var((*ipNetsFlag)(&cfg.ProxyProtocolFrom), "proxy-protocol-from",
+		"Comma-separated IPs/CIDRs of load balancers whose PROXY protocol"+
+			" headers to trust; empty disables the PROXY protocol"+
+			" (env: PROXY_PROTOCOL_FROM)")
+
+	cfg.IPAllowlist = env.ipNets("IP_ALLOWLIST", cfg.IPAllowlist)
+	fs.Var((*ipNetsFlag)(&cfg.IPAllowlist), "ip-allowlist",
+		"Comma-separated IPs/CIDRs allowed to reach PostgREST and admin"+
+			" endpoints; empty allows all (env: IP_ALLOWLIST)")
+	cfg.IPDenylist = env.ipNets("IP_DENYLIST", cfg.IPDenylist)
+	fs.Var((*ipNetsFlag)(&cfg.IPDenylist), "ip-denylist",
+		"Comma-separated IPs/CIDRs refused access to PostgREST and admin"+
+			" endpoints (env: IP_DENYLIST)")
+	fs.StringVar(&cfg.IPAllowlistFile, "ip-allowlist-file",
+		env.string("IP_ALLOWLIST_FILE", cfg.IPAllowlistFile),
+		"File of IPs/CIDRs to add to the allowlist, one per line"+
+			" (env: IP_ALLOWLIST_FILE)")
+	fs.StringVar(&cfg.IPDenylistFile, "ip-denylist-file",
+		env.string("IP_DENYLIST_FILE", cfg.IPDenylistFile),
+		"File of IPs/CIDRs to add to the denylist, one per line"+
+			" (env: IP_DENYLIST_FILE)")
+
+	fs.StringVar(&cfg.PostgrestBaseURL, "postgrest-url",
+		env.string("INTERNAL_POSTGREST_BASE_URL", cfg.PostgrestBaseURL),
+		"Base URL of PostgREST, or comma-separated URLs (each optionally"+
+			" followed by ` weight=N`) to balance across"+
+			" (env: INTERNAL_POSTGREST_BASE_URL)")
+	fs.StringVar(&cfg.PostgrestPathPrefix, "postgrest-path-prefix",
+		env.string("POSTGREST_PATH_PREFIX", cfg.PostgrestPathPrefix),
+		"Path to serve PostgREST under, e.g. /api/db, or / for the root"+
+			" (env: POSTGREST_PATH_PREFIX)")
+	fs.StringVar(&cfg.PostgrestJWTSecret, "postgrest-jwt-secret",
+		env.string("POSTGREST_JWT_SECRET", cfg.PostgrestJWTSecret),
+		"Secret PostgREST JWTs are signed with; required with -prod"+
+			" (env: POSTGREST_JWT_SECRET)")
+	fs.DurationVar(&cfg.PostgrestDialTimeout, "postgrest-dial-timeout",
+		env.duration("POSTGREST_DIAL_TIMEOUT", cfg.PostgrestDialTimeout),
+		"Timeout connecting to PostgREST (env: POSTGREST_DIAL_TIMEOUT)")
+	fs.DurationVar(&cfg.PostgrestResponseHeaderTimeout,
+		"postgrest-response-header-timeout",
+		env.duration("POSTGREST_RESPONSE_HEADER_TIMEOUT",
+			cfg.PostgrestResponseHeaderTimeout),
+		"Timeout waiting for PostgREST to respond"+
+			" (env: POSTGREST_RESPONSE_HEADER_TIMEOUT)")
+	fs.IntVar(&cfg.PostgrestRetries, "postgrest-retries",
+		env.int("POSTGREST_RETRIES", cfg.PostgrestRetries),
+		"Times to retry failed GETs to PostgREST (env: POSTGREST_RETRIES)")
+
+	fs.DurationVar(&cfg.PostgrestWriteTimeout, "postgrest-write-timeout",
+		env.duration("POSTGREST_WRITE_TIMEOUT", cfg.PostgrestWriteTimeout),
+		"Time allowed to read and write proxied PostgREST requests"+
+			" (env: POSTGREST_WRITE_TIMEOUT)")
+
+	fs.StringVar(&cfg.PostgrestStripResponseHeaders,
+		"postgrest-strip-response-headers",
+		env.string("POSTGREST_STRIP_RESPONSE_HEADERS",
+			cfg.PostgrestStripResponseHeaders),
+		"Comma-separated headers to remove from PostgREST's responses"+
+			" (env: POSTGREST_STRIP_RESPONSE_HEADERS)")
+	fs.BoolVar(&cfg.PostgrestResponseHeaderAllowlist,
+		"postgrest-response-header-allowlist",
+		env.bool("POSTGREST_RESPONSE_HEADER_ALLOWLIST",
+			cfg.PostgrestResponseHeaderAllowlist),
+		"Only pass through PostgREST's response headers that are in"+
+			" -postgrest-allow-response-headers"+
+			" (env: POSTGREST_RESPONSE_HEADER_ALLOWLIST)")
+	fs.StringVar(&cfg.PostgrestAllowResponseHeaders,
+		"postgrest-allow-response-headers",
+		env.string("POSTGREST_ALLOW_RESPONSE_HEADERS",
+			cfg.PostgrestAllowResponseHeaders),
+		"Comma-separated headers PostgREST's responses may keep in"+
+			" allowlist mode (env: POSTGREST_ALLOW_RESPONSE_HEADERS)")
+	fs.BoolVar(&cfg.PostgrestRewriteLocation, "postgrest-rewrite-location",
+		env.bool("POSTGREST_REWRITE_LOCATION", cfg.PostgrestRewriteLocation),
+		"Rewrite PostgREST's Location and Content-Location headers to"+
+			" point at our proxy (env: POSTGREST_REWRITE_LOCATION)")
+	fs.DurationVar(&cfg.PostgrestCacheTTL, "postgrest-cache-ttl",
+		env.duration("POSTGREST_CACHE_TTL", cfg.PostgrestCacheTTL),
+		"How long to cache GET responses from PostgREST; 0 disables"+
+			" (env: POSTGREST_CACHE_TTL)")
+	fs.IntVar(&cfg.PostgrestMaxIdleConns, "postgrest-max-idle-conns",
+		env.int("POSTGREST_MAX_IDLE_CONNS", cfg.PostgrestMaxIdleConns),
+		"Most idle connections to PostgREST kept open; 0 means no limit"+
+			" (env: POSTGREST_MAX_IDLE_CONNS)")
+	fs.IntVar(&cfg.PostgrestMaxIdleConnsPerHost, "postgrest-max-idle-conns-per-host",
+		env.int("POSTGREST_MAX_IDLE_CONNS_PER_HOST", cfg.PostgrestMaxIdleConnsPerHost),
+		"Most idle connections kept open to each PostgREST host"+
+			" (env: POSTGREST_MAX_IDLE_CONNS_PER_HOST)")
+	fs.DurationVar(&cfg.PostgrestIdleConnTimeout, "postgrest-idle-conn-timeout",
+		env.duration("POSTGREST_IDLE_CONN_TIMEOUT", cfg.PostgrestIdleConnTimeout),
+		"How long idle connections to PostgREST are kept open; 0 means"+
+			" until PostgREST closes them (env: POSTGREST_IDLE_CONN_TIMEOUT)")
+	fs.BoolVar(&cfg.PostgrestDisableKeepAlives, "postgrest-disable-keep-alives",
+		env.bool("POSTGREST_DISABLE_KEEP_ALIVES", cfg.PostgrestDisableKeepAlives),
+		"Use a new connection to PostgREST for every request, e.g. for"+
+			" debugging (env: POSTGREST_DISABLE_KEEP_ALIVES)")
+	fs.IntVar(&cfg.PostgrestBreakerThreshold, "postgrest-breaker-threshold",
+		env.int("POSTGREST_BREAKER_THRESHOLD", cfg.PostgrestBreakerThreshold),
+		"Failed PostgREST requests in a row that open the circuit breaker;"+
+			" 0 disables it (env: POSTGREST_BREAKER_THRESHOLD)")
+	fs.DurationVar(&cfg.PostgrestBreakerWindow, "postgrest-breaker-window",
+		env.duration("POSTGREST_BREAKER_WINDOW", cfg.PostgrestBreakerWindow),
+		"Time within which those failures must happen"+
+			" (env: POSTGREST_BREAKER_WINDOW)")
+	fs.DurationVar(&cfg.PostgrestBreakerCooldown, "postgrest-breaker-cooldown",
+		env.duration("POSTGREST_BREAKER_COOLDOWN", cfg.PostgrestBreakerCooldown),
+		"How long the open circuit breaker fails requests before trying"+
+			" PostgREST again (env: POSTGREST_BREAKER_COOLDOWN)")
+	fs.DurationVar(&cfg.PostgrestHealthCheckInterval, "postgrest-health-check-interval",
+		env.duration("POSTGREST_HEALTH_CHECK_INTERVAL", cfg.PostgrestHealthCheckInterval),
+		"How often to check each PostgREST upstream's health; 0 disables"+
+			" (env: POSTGREST_HEALTH_CHECK_INTERVAL)")
+	fs.StringVar(&cfg.PostgrestHealthCheckPath, "postgrest-health-check-path",
+		env.string("POSTGREST_HEALTH_CHECK_PATH", cfg.PostgrestHealthCheckPath),
+		"Path on each PostgREST upstream to send health checks (HEADs) to"+
+			" (env: POSTGREST_HEALTH_CHECK_PATH)")
+
+	fs.Int64Var(&cfg.MaxRequestBodySize, "max-request-body-size",
+		env.int64("MAX_REQUEST_BODY_SIZE", cfg.MaxRequestBodySize),
+		"Largest request body accepted, in bytes (env: MAX_REQUEST_BODY_SIZE)")
+	fs.Int64Var(&cfg.PostgrestMaxRequestBodySize, "postgrest-max-request-body-size",
+		env.int64("POSTGREST_MAX_REQUEST_BODY_SIZE", cfg.PostgrestMaxRequestBodySize),
+		"Largest request body accepted for PostgREST, in bytes; 0 for the"+
+			" same as -max-request-body-size"+
+			" (env: POSTGREST_MAX_REQUEST_BODY_SIZE)")
+	fs.IntVar(&cfg.MaxHeaderBytes, "max-header-bytes",
+		env.int("MAX_HEADER_BYTES", cfg.MaxHeaderBytes),
+		"Most bytes of request headers (including the request line)"+
+			" accepted (env: MAX_HEADER_BYTES)")
+	fs.IntVar(&cfg.MaxRequestHeaders, "max-request-headers",
+		env.int("MAX_REQUEST_HEADERS", cfg.MaxRequestHeaders),
+		"Most request headers accepted; 0 for no limit"+
+			" (env: MAX_REQUEST_HEADERS)")
+
+	fs.IntVar(&cfg.MaxConcurrentRequests, "max-concurrent-requests",
+		env.int("MAX_CONCURRENT_REQUESTS", cfg.MaxConcurrentRequests),
+		"Most requests handled at once, beyond which clients get a 503;"+
+			" 0 for no limit (env: MAX_CONCURRENT_REQUESTS)")
+	fs.DurationVar(&cfg.ConcurrencyQueueWait, "concurrency-queue-wait",
+		env.duration("CONCURRENCY_QUEUE_WAIT", cfg.ConcurrencyQueueWait),
+		"How long requests over the limit wait for a slot before the 503"+
+			" (env: CONCURRENCY_QUEUE_WAIT)")
+
+	fs.DurationVar(&cfg.SlowRequestThreshold, "slow-request-threshold",
+		env.duration("SLOW_REQUEST_THRESHOLD", cfg.SlowRequestThreshold),
+		"Log a warning about requests still in flight after this long;"+
+			" 0 disables (env: SLOW_REQUEST_THRESHOLD)")
+
+	fs.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint",
+		env.string("OTEL_EXPORTER_OTLP_ENDPOINT", cfg.OTLPEndpoint),
+		"Base URL of the OpenTelemetry collector to send traces to over"+
+			" OTLP/HTTP; empty disables tracing"+
+			" (env: OTEL_EXPORTER_OTLP_ENDPOINT)")
+	fs.StringVar(&cfg.OTLPTracesEndpoint, "otlp-traces-endpoint",
+		env.string("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", cfg.OTLPTracesEndpoint),
+		"Full URL to POST traces to, overriding -otlp-endpoint"+
+			" (env: OTEL_EXPORTER_OTLP_TRACES_ENDPOINT)")
+	fs.StringVar(&cfg.OTLPHeaders, "otlp-headers",
+		env.string("OTEL_EXPORTER_OTLP_HEADERS", cfg.OTLPHeaders),
+		"Comma-separated key=value headers to send the collector, e.g."+
+			" for auth (env: OTEL_EXPORTER_OTLP_HEADERS)")
+	fs.StringVar(&cfg.OTLPProtocol, "otlp-protocol",
+		env.string("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL",
+			env.string("OTEL_EXPORTER_OTLP_PROTOCOL", cfg.OTLPProtocol)),
+		"OTLP protocol to export traces with; only http/json is supported"+
+			" (env: OTEL_EXPORTER_OTLP_TRACES_PROTOCOL or"+
+			" OTEL_EXPORTER_OTLP_PROTOCOL)")
+	fs.StringVar(&cfg.OTELServiceName, "otel-service-name",
+		env.string("OTEL_SERVICE_NAME", cfg.OTELServiceName),
+		"Service name traces are recorded under (env: OTEL_SERVICE_NAME)")
+	fs.StringVar(&cfg.OTELTracesSampler, "otel-traces-sampler",
+		env.string("OTEL_TRACES_SAMPLER", cfg.OTELTracesSampler),
+		"Which traces to record: always_on, always_off, traceidratio, or"+
+			" parentbased_ any of those to follow the caller's traceparent"+
+			" (env: OTEL_TRACES_SAMPLER)")
+	fs.StringVar(&cfg.OTELTracesSamplerArg, "otel-traces-sampler-arg",
+		env.string("OTEL_TRACES_SAMPLER_ARG", cfg.OTELTracesSamplerArg),
+		"Fraction of traces for traceidratio to record, from 0 to 1;"+
+			" default 1 (env: OTEL_TRACES_SAMPLER_ARG)")
+
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout",
+		env.duration("READ_HEADER_TIMEOUT", cfg.ReadHeaderTimeout),
+		"Time allowed to read request headers (env: READ_HEADER_TIMEOUT)")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout",
+		env.duration("READ_TIMEOUT", cfg.ReadTimeout),
+		"Time allowed to read a whole request (env: READ_TIMEOUT)")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout",
+		env.duration("WRITE_TIMEOUT", cfg.WriteTimeout),
+		"Time allowed to write a response (env: WRITE_TIMEOUT)")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout",
+		env.duration("IDLE_TIMEOUT", cfg.IdleTimeout),
+		"How long to keep idle HTTP/1.1 and HTTP/2 connections open"+
+			" (env: IDLE_TIMEOUT)")
+
+	fs.IntVar(&cfg.HTTP2MaxConcurrentStreams, "http2-max-concurrent-streams",
+		env.int("HTTP2_MAX_CONCURRENT_STREAMS", cfg.HTTP2MaxConcurrentStreams),
+		"Requests each HTTP/2 client may have in flight at once"+
+			" (env: HTTP2_MAX_CONCURRENT_STREAMS)")
+	fs.BoolVar(&cfg.HTTP2Push, "http2-push", env.bool("HTTP2_PUSH", cfg.HTTP2Push),
+		"Push the main JS and CSS bundles along with index.html over HTTP/2"+
+			" (env: HTTP2_PUSH)")
+	fs.StringVar(&cfg.DirectoryIndex, "directory-index",
+		env.string("DIRECTORY_INDEX", cfg.DirectoryIndex),
+		"Document to serve for a directory that has one, rather than the"+
+			" app's index.html; empty for always the app's (env: DIRECTORY_INDEX)")
+
+	fs.BoolVar(&cfg.Maintenance, "maintenance",
+		env.bool("MAINTENANCE_MODE", cfg.Maintenance),
+		"Serve a maintenance page for every route (env: MAINTENANCE_MODE)")
+	fs.StringVar(&cfg.MaintenanceFile, "maintenance-file",
+		env.string("MAINTENANCE_FILE", cfg.MaintenanceFile),
+		"Serve a maintenance page while this file exists (env: MAINTENANCE_FILE)")
+	fs.DurationVar(&cfg.MaintenanceRetryAfter, "maintenance-retry-after",
+		env.duration("MAINTENANCE_RETRY_AFTER", cfg.MaintenanceRetryAfter),
+		"Retry-After sent with the maintenance page (env: MAINTENANCE_RETRY_AFTER)")
+
+	fs.DurationVar(&cfg.AuthTokenTTL, "auth-token-ttl",
+		env.duration("AUTH_TOKEN_TTL", cfg.AuthTokenTTL),
+		"How long auth tokens are valid (env: AUTH_TOKEN_TTL)")
+	fs.DurationVar(&cfg.AuthTokenReapInterval, "auth-token-reap-interval",
+		env.duration("AUTH_TOKEN_REAP_INTERVAL", cfg.AuthTokenReapInterval),
+		"How often expired auth tokens are purged"+
+			" (env: AUTH_TOKEN_REAP_INTERVAL)")
+	fs.DurationVar(&cfg.LastSeenInterval, "last-seen-interval",
+		env.duration("LAST_SEEN_INTERVAL", cfg.LastSeenInterval),
+		"How often at most each auth token's last-seen time is saved;"+
+			" 0 saves it on every request (env: LAST_SEEN_INTERVAL)")
+	fs.IntVar(&cfg.MaxSessions, "max-sessions",
+		env.int("MAX_SESSIONS", cfg.MaxSessions),
+		"Most sessions each miniLock ID can have at once; 0 means no limit"+
+			" (env: MAX_SESSIONS)")
+	fs.BoolVar(&cfg.MaxSessionsReject, "max-sessions-reject",
+		env.bool("MAX_SESSIONS_REJECT", cfg.MaxSessionsReject),
+		"Reject logins over -max-sessions with a 429 rather than revoke"+
+			" the least recently used sessions (env: MAX_SESSIONS_REJECT)")
+	fs.DurationVar(&cfg.ShutdownGracePeriod, "shutdown-grace-period",
+		env.duration("SHUTDOWN_GRACE_PERIOD", cfg.ShutdownGracePeriod),
+		"How long to let requests finish when shutting down"+
+			" (env: SHUTDOWN_GRACE_PERIOD)")
+	fs.DurationVar(&cfg.ShutdownDrainDelay, "shutdown-drain-delay",
+		env.duration("SHUTDOWN_DRAIN_DELAY", cfg.ShutdownDrainDelay),
+		"How long to keep serving, with /readyz failing, before shutting"+
+			" down, so that load balancers stop sending requests"+
+			" (env: SHUTDOWN_DRAIN_DELAY)")
+
+	fs.StringVar(&cfg.SessionStore, "session-store",
+		env.string("SESSION_STORE", cfg.SessionStore),
+		"Where to keep auth tokens: memory or redis (env: SESSION_STORE)")
+	fs.StringVar(&cfg.RedisURL, "redis-url",
+		env.string("REDIS_URL", cfg.RedisURL),
+		"redis:// URL of the session store (env: REDIS_URL)")
+
+	fs.IntVar(&cfg.LoginRateLimitBurst, "login-rate-limit-burst",
+		env.int("LOGIN_RATE_LIMIT_BURST", cfg.LoginRateLimitBurst),
+		"Logins allowed per IP in a row (env: LOGIN_RATE_LIMIT_BURST)")
+	fs.DurationVar(&cfg.LoginRateLimitInterval, "login-rate-limit-interval",
+		env.duration("LOGIN_RATE_LIMIT_INTERVAL", cfg.LoginRateLimitInterval),
+		"Time per login allowed per IP after the burst"+
+			" (env: LOGIN_RATE_LIMIT_INTERVAL)")
+	fs.IntVar(&cfg.LoginIDRateLimitBurst, "login-id-rate-limit-burst",
+		env.int("LOGIN_ID_RATE_LIMIT_BURST", cfg.LoginIDRateLimitBurst),
+		"Logins allowed per miniLock ID in a row; 0 disables"+
+			" (env: LOGIN_ID_RATE_LIMIT_BURST)")
+	fs.DurationVar(&cfg.LoginIDRateLimitInterval, "login-id-rate-limit-interval",
+		env.duration("LOGIN_ID_RATE_LIMIT_INTERVAL", cfg.LoginIDRateLimitInterval),
+		"Time per login allowed per miniLock ID after the burst"+
+			" (env: LOGIN_ID_RATE_LIMIT_INTERVAL)")
+
+	fs.IntVar(&cfg.LoginLockoutThreshold, "login-lockout-threshold",
+		env.int("LOGIN_LOCKOUT_THRESHOLD", cfg.LoginLockoutThreshold),
+		"Failed challenge logins before a miniLock ID or IP is locked out; 0 disables"+
+			" (env: LOGIN_LOCKOUT_THRESHOLD)")
+	fs.DurationVar(&cfg.LoginLockoutBaseDelay, "login-lockout-base-delay",
+		env.duration("LOGIN_LOCKOUT_BASE_DELAY", cfg.LoginLockoutBaseDelay),
+		"Length of the first lockout, doubling each failure after"+
+			" (env: LOGIN_LOCKOUT_BASE_DELAY)")
+	fs.DurationVar(&cfg.LoginLockoutMaxDelay, "login-lockout-max-delay",
+		env.duration("LOGIN_LOCKOUT_MAX_DELAY", cfg.LoginLockoutMaxDelay),
+		"Longest lockout (env: LOGIN_LOCKOUT_MAX_DELAY)")
+	fs.DurationVar(&cfg.LoginLockoutCooldown, "login-lockout-cooldown",
+		env.duration("LOGIN_LOCKOUT_COOLDOWN", cfg.LoginLockoutCooldown),
+		"How long without failures before they're forgotten"+
+			" (env: LOGIN_LOCKOUT_COOLDOWN)")
+
+	fs.StringVar(&cfg.AuditLog, "audit-log",
+		env.string("AUDIT_LOG", cfg.AuditLog),
+		"Where to write the login audit log as JSON: stdout, or a file to"+
+			" append to; empty to disable (env: AUDIT_LOG)")
+	fs.IntVar(&cfg.AuditTailSize, "audit-tail-size",
+		env.int("AUDIT_TAIL_SIZE", cfg.AuditTailSize),
+		"How many of the latest audit events to keep in memory for"+
+			" /internal/audit-tail; 0 to disable (env: AUDIT_TAIL_SIZE)")
+	fs.StringVar(&cfg.LoginBlocklistFile, "login-blocklist-file",
+		env.string("LOGIN_BLOCKLIST_FILE", cfg.LoginBlocklistFile),
+		"File of miniLock IDs that may not log in, one per line; reloaded"+
+			" on SIGHUP (env: LOGIN_BLOCKLIST_FILE)")
+	fs.BoolVar(&cfg.LoginEncryptErrors, "login-encrypt-errors",
+		env.bool("LOGIN_ENCRYPT_ERRORS", cfg.LoginEncryptErrors),
+		"Encrypt login errors to the miniLock ID logging in, once it's"+
+			" known to be valid (env: LOGIN_ENCRYPT_ERRORS)")
+
+	fs.StringVar(&cfg.BasicAuthUsername, "basic-auth-username",
+		env.string("REACT_APP_BASIC_AUTH_USERNAME", cfg.BasicAuthUsername),
+		"HTTP Basic Auth username (env: REACT_APP_BASIC_AUTH_USERNAME)")
+	fs.StringVar(&cfg.BasicAuthPassword, "basic-auth-password",
+		env.string("REACT_APP_BASIC_AUTH_PASSWORD", cfg.BasicAuthPassword),
+		"HTTP Basic Auth password (env: REACT_APP_BASIC_AUTH_PASSWORD)")
+	fs.StringVar(&cfg.BasicAuthRoutes, "basic-auth-routes",
+		env.string("BASIC_AUTH_ROUTES", cfg.BasicAuthRoutes),
+		"Comma-separated route groups to require HTTP Basic Auth for, of"+
+			" app, api, and admin (env: BASIC_AUTH_ROUTES)")
+
+	fs.StringVar(&cfg.ClientCAFile, "client-ca-file",
+		env.string("CLIENT_CA_FILE", cfg.ClientCAFile),
+		"PEM file of CAs whose client certs may access admin routes over"+
+			" HTTPS (env: CLIENT_CA_FILE)")
+	fs.StringVar(&cfg.ClientCertSubjects, "client-cert-subjects",
+		env.string("CLIENT_CERT_SUBJECTS", cfg.ClientCertSubjects),
+		"Comma-separated common names (or full subjects) of the client"+
+			" certs allowed; empty allows any (env: CLIENT_CERT_SUBJECTS)")
+	fs.StringVar(&cfg.AdminAuthMode, "admin-auth-mode",
+		env.string("ADMIN_AUTH_MODE", cfg.AdminAuthMode),
+		"With both client certs and Basic Auth on admin routes, require"+
+			" all of them or any one (env: ADMIN_AUTH_MODE)")
+
+	fs.StringVar(&cfg.CSPConfigFile, "csp-config",
+		env.string("CSP_CONFIG_FILE", cfg.CSPConfigFile),
+		"JSON file of Content-Security-Policy directives (env: CSP_CONFIG_FILE)")
+
+	fs.StringVar(&cfg.CORSAllowedOrigins, "cors-allowed-origins",
+		env.string("CORS_ALLOWED_ORIGINS", cfg.CORSAllowedOrigins),
+		"Comma-separated origins allowed to make cross-origin API requests"+
+			" (env: CORS_ALLOWED_ORIGINS)")
+	fs.BoolVar(&cfg.CORSAllowCredentials, "cors-allow-credentials",
+		env.bool("CORS_ALLOW_CREDENTIALS", cfg.CORSAllowCredentials),
+		"Let allowed origins make credentialed requests"+
+			" (env: CORS_ALLOW_CREDENTIALS)")
+
+	fs.StringVar(&cfg.PermissionsPolicy, "permissions-policy",
+		env.string("PERMISSIONS_POLICY", cfg.PermissionsPolicy),
+		"Permissions-Policy header; empty to omit (env: PERMISSIONS_POLICY)")
+	fs.StringVar(&cfg.CrossOriginOpenerPolicy, "cross-origin-opener-policy",
+		env.string("CROSS_ORIGIN_OPENER_POLICY", cfg.CrossOriginOpenerPolicy),
+		"Cross-Origin-Opener-Policy header; empty to omit"+
+			" (env: CROSS_ORIGIN_OPENER_POLICY)")
+	fs.StringVar(&cfg.CrossOriginResourcePolicy, "cross-origin-resource-policy",
+		env.string("CROSS_ORIGIN_RESOURCE_POLICY", cfg.CrossOriginResourcePolicy),
+		"Cross-Origin-Resource-Policy header; empty to omit"+
+			" (env: CROSS_ORIGIN_RESOURCE_POLICY)")
+
+	fs.StringVar(&cfg.ServerKeyFile, "server-key-file",
+		env.string("SERVER_KEY_FILE", cfg.ServerKeyFile),
+		"File holding the server's miniLock key, generated if missing;"+
+			" empty for a new key every restart (env: SERVER_KEY_FILE)")
+	fs.StringVar(&cfg.ServerKeyPreviousFile, "server-key-previous-file",
+		env.string("SERVER_KEY_PREVIOUS_FILE", cfg.ServerKeyPreviousFile),
+		"File holding the server's previous miniLock key, while rotating"+
+			" (env: SERVER_KEY_PREVIOUS_FILE)")
+
+	fs.StringVar(&cfg.AutocertCache, "autocert-cache",
+		env.string("AUTOCERT_CACHE", cfg.AutocertCache),
+		"Where to cache TLS certs: dir or postgrest (env: AUTOCERT_CACHE)")
+	fs.StringVar(&cfg.AutocertCacheDir, "autocert-cache-dir",
+		env.string("AUTOCERT_CACHE_DIR", cfg.AutocertCacheDir),
+		"Directory to cache TLS certs in; defaults to ./<domain>"+
+			" (env: AUTOCERT_CACHE_DIR)")
+	fs.StringVar(&cfg.AutocertCachePostgrestURL, "autocert-cache-postgrest-url",
+		env.string("AUTOCERT_CACHE_POSTGREST_URL", cfg.AutocertCachePostgrestURL),
+		"PostgREST serving the autocert schema, for -autocert-cache=postgrest;"+
+			" must not be a -postgrest-url (env: AUTOCERT_CACHE_POSTGREST_URL)")
+	fs.BoolVar(&cfg.AutocertPrewarm, "autocert-prewarm",
+		env.bool("AUTOCERT_PREWARM", cfg.AutocertPrewarm),
+		"Get TLS certs for every domain at startup, retrying with backoff"+
+			" (env: AUTOCERT_PREWARM)")
+
+	if env.err != nil {
+		return nil, env.err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := cfg.CheckHSTS(); err != nil {
+		return nil, err
+	}
+	if _, port, err := net.SplitHostPort(cfg.HTTPSAddr); err != nil {
+		return nil, fmt.Errorf("Error parsing HTTPS address: %v", err)
+	} else if port == "" {
+		return nil, fmt.Errorf("HTTPS address %q has no port", cfg.HTTPSAddr)
+	}
+	if cfg.PostgrestMaxIdleConns < 0 || cfg.PostgrestMaxIdleConnsPerHost < 0 ||
+		cfg.PostgrestIdleConnTimeout < 0 {
+		return nil, fmt.Errorf("PostgREST idle connection limits can't be negative")
+	}
+	if cfg.PostgrestBreakerThreshold < 0 || cfg.PostgrestBreakerWindow < 0 ||
+		cfg.PostgrestBreakerCooldown < 0 {
+		return nil, fmt.Errorf("PostgREST circuit breaker settings can't be negative")
+	}
+	if cfg.MaxHeaderBytes <= 0 {
+		return nil, fmt.Errorf("Max header bytes must be positive")
+	}
+	if cfg.MaxRequestHeaders < 0 {
+		return nil, fmt.Errorf("Max request headers can't be negative")
+	}
+	if cfg.AuthTokenReapInterval <= 0 {
+		return nil, fmt.Errorf("Auth token reap interval must be positive")
+	}
+	if cfg.MaxSessions < 0 {
+		return nil, fmt.Errorf("Max sessions can't be negative")
+	}
+	if cfg.LastSeenInterval < 0 {
+		return nil, fmt.Errorf("Last-seen interval can't be negative")
+	}
+	if cfg.ShutdownDrainDelay < 0 {
+		return nil, fmt.Errorf("Shutdown drain delay can't be negative")
+	}
+	if cfg.PostgrestResponseHeaderAllowlist &&
+		len(splitList(cfg.PostgrestAllowResponseHeaders)) == 0 {
+		return nil, fmt.Errorf("PostgREST response header allowlist is empty;" +
+			" set POSTGREST_ALLOW_RESPONSE_HEADERS")
+	}
+	if cfg.AuditTailSize < 0 {
+		return nil, fmt.Errorf("Audit tail size can't be negative")
+	}
+	if cfg.LoginRateLimitBurst < 1 {
+		return nil, fmt.Errorf("Login rate limit burst must be positive")
+	}
+	if cfg.LoginRateLimitInterval <= 0 {
+		return nil, fmt.Errorf("Login rate limit interval must be positive")
+	}
+	if cfg.LoginIDRateLimitBurst < 0 || cfg.LoginIDRateLimitInterval < 0 {
+		return nil, fmt.Errorf("Per-miniLock ID login rate limit can't be negative")
+	}
+	if cfg.LoginIDRateLimitBurst > 0 && cfg.LoginIDRateLimitInterval == 0 {
+		return nil, fmt.Errorf("Per-miniLock ID login rate limit interval" +
+			" must be positive")
+	}
+	if cfg.PostgrestMaxRequestBodySize < 0 {
+		return nil, fmt.Errorf("PostgREST max request body size can't be negative")
+	}
+	if _, err := tlsVersion(cfg.TLSMinVersion); err != nil {
+		return nil, err
+	}
+	if cfg.HTTPSRedirectStatus != http.StatusMovedPermanently &&
+		cfg.HTTPSRedirectStatus != http.StatusPermanentRedirect {
+		return nil, fmt.Errorf("HTTPS redirect status must be 301 or 308, not %d",
+			cfg.HTTPSRedirectStatus)
+	}
+	for _, group := range splitList(cfg.BasicAuthRoutes) {
+		if !isBasicAuthGroup(group) {
+			return nil, fmt.Errorf("Unknown Basic Auth route group %q; must be"+
+				" one of %s", group, strings.Join(basicAuthGroups, ", "))
+		}
+	}
+	if cfg.AdminAuthMode != "all" && cfg.AdminAuthMode != "any" {
+		return nil, fmt.Errorf("Admin auth mode must be all or any, not %q",
+			cfg.AdminAuthMode)
+	}
+	if strings.Contains(cfg.DirectoryIndex, "/") {
+		return nil, fmt.Errorf("Directory index must be a file name, not %q",
+			cfg.DirectoryIndex)
+	}
+	return cfg, nil
+}
+
+// envDefaults looks up flag defaults from env vars, remembering the
+// first one that fails to parse.
+type envDefaults struct {
+	getenv func(string) string
+	err    error
+}
+
+func (env *envDefaults) string(envName, def string) string {
+	if val := env.getenv(envName); val != "" {
+		return val
+	}
+	return def
+}
+
+func (env *envDefaults) duration(envName string, def time.Duration) time.Duration {
+	val := env.getenv(envName)
+	if val == "" {
+		return def
+	}
+	dur, err := time.ParseDuration(val)
+	if err != nil {
+		env.fail(envName, err)
+		return def
+	}
+	return dur
+}
+
+func (env *envDefaults) seconds(envName string, def time.Duration) time.Duration {
+	val := env.getenv(envName)
+	if val == "" {
+		return def
+	}
+	dur, err := parseSeconds(val)
+	if err != nil {
+		env.fail(envName, err)
+		return def
+	}
+	return dur
+}
+
+func (env *envDefaults) int(envName string, def int) int {
+	val := env.getenv(envName)
+	if val == "" {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		env.fail(envName, err)
+		return def
+	}
+	return n
+}
+
+func (env *envDefaults) int64(envName string, def int64) int64 {
+	val := env.getenv(envName)
+	if val == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		env.fail(envName, err)
+		return def
+	}
+	return n
+}
+
+func (env *envDefaults) bool(envName string, def bool) bool {
+	val := env.getenv(envName)
+	if val == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		env.fail(envName, err)
+		return def
+	}
+	return b
+}
+
+func (env *envDefaults) ipNets(envName string, def []net.IPNet) []net.IPNet {
+	val := env.getenv(envName)
+	if val == "" {
+		return def
+	}
+	nets, err := parseIPNets(val)
+	if err != nil {
+		env.fail(envName, err)
+		return def
+	}
+	return nets
+}
+
+func (env *envDefaults) fail(envName string, err error) {
+	if env.err == nil {
+		env.err = fmt.Errorf("Error parsing %s: %v", envName, err)
+	}
+}
+
+// secondsFlag is a flag.Value of a duration given either as a whole
+// number of seconds or as a time.Duration string; see parseSeconds.
+type secondsFlag time.Duration
+
+func (f *secondsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strconv.FormatInt(int64(time.Duration(*f)/time.Second), 10)
+}
+
+func (f *secondsFlag) Set(val string) error {
+	dur, err := parseSeconds(val)
+	if err != nil {
+		return err
+	}
+	*f = secondsFlag(dur)
+	return nil
+}
+
+// parseSeconds parses a whole number of seconds (e.g., 31536000, as
+// in an HSTS header) or a duration (e.g., 8760h).
+func parseSeconds(s string) (time.Duration, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n < 0 || n > int64(math.MaxInt64/time.Second) {
+			return 0, fmt.Errorf("%d seconds is out of range", n)
+		}
+		return time.Duration(n) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// ipNetsFlag is a flag.Value of comma-separated IPs and CIDRs.
+type ipNetsFlag []net.IPNet
+
+func (f *ipNetsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	strs := make([]string, len(*f))
+	for i, ipNet := range *f {
+		strs[i] = ipNet.String()
+	}
+	return strings.Join(strs, ",")
+}
+
+func (f *ipNetsFlag) Set(val string) error {
+	nets, err := parseIPNets(val)
+	if err != nil {
+		return err
+	}
+	*f = nets
+	return nil
+}
+
+// parseIPNets parses comma-separated IPs and CIDRs; a lone IP is
+// treated as a network of just that address.
+func parseIPNets(s string) ([]net.IPNet, error) {
+	var nets []net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address `%s`", part)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, *ipNet)
+	}
+	return nets, nil
+}
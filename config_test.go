@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEnv(env map[string]string) func(string) string {
+	return func(name string) string { return env[name] }
+}
+
+func TestParseConfigDefaults(t *testing.T) {
+	cfg, err := ParseConfig(nil, testEnv(nil))
+	require.NoError(t, err)
+	assert.Equal(t, DefaultConfig(), cfg)
+}
+
+func TestParseConfigEnv(t *testing.T) {
+	cfg, err := ParseConfig(nil, testEnv(map[string]string{
+		"INTERNAL_POSTGREST_BASE_URL":   "http://db:3000/",
+		"AUTH_TOKEN_TTL":                "90m",
+		"POSTGREST_RETRIES":             "5",
+		"REACT_APP_BASIC_AUTH_USERNAME": "user",
+		"REACT_APP_BASIC_AUTH_PASSWORD": "pass",
+		"TRUSTED_PROXIES":               "192.168.0.0/16,172.16.0.1",
+	}))
+	require.NoError(t, err)
+
+	assert.Equal(t, "http://db:3000/", cfg.PostgrestBaseURL)
+	assert.Equal(t, 90*time.Minute, cfg.AuthTokenTTL)
+	assert.Equal(t, 5, cfg.PostgrestRetries)
+	assert.True(t, cfg.BasicAuthEnabled())
+	assert.Equal(t, "192.168.0.0/16,172.16.0.1/32",
+		(*ipNetsFlag)(&cfg.TrustedProxies).String())
+
+	_, err = ParseConfig(nil, testEnv(map[string]string{
+		"AUTH_TOKEN_TTL": "forever",
+	}))
+	assert.EqualError(t, err,
+		`Error parsing AUTH_TOKEN_TTL: time: invalid duration "forever"`)
+}
+
+func TestParseConfigFlagsOverrideEnv(t *testing.T) {
+	cfg, err := ParseConfig([]string{
+		"-postgrest-url", "http://flag:3000/",
+		"-auth-token-ttl", "1h",
+		"-login-rate-limit-burst", "3",
+		"-http", ":9000",
+		"-prod", "-domain", "example.com",
+		"-trusted-proxies", "10.0.0.0/8",
+	}, testEnv(map[string]string{
+		"TRUSTED_PROXIES":             "192.168.0.0/16,172.16.0.1",
+		"INTERNAL_POSTGREST_BASE_URL": "http://env:3000/",
+		"AUTH_TOKEN_TTL":              "90m",
+		"LOGIN_RATE_LIMIT_BURST":      "20",
+		"SHUTDOWN_GRACE_PERIOD":       "5s",
+	}))
+	require.NoError(t, err)
+
+	assert.Equal(t, "http://flag:3000/", cfg.PostgrestBaseURL)
+	assert.Equal(t, time.Hour, cfg.AuthTokenTTL)
+	assert.Equal(t, 3, cfg.LoginRateLimitBurst)
+	assert.Equal(t, ":9000", cfg.HTTPAddr)
+	assert.True(t, cfg.Prod)
+	assert.Equal(t, "example.com", cfg.Domain)
+	assert.Equal(t, "10.0.0.0/8", (*ipNetsFlag)(&cfg.TrustedProxies).String())
+
+	// Env still applies where no flag was given
+	assert.Equal(t, 5*time.Second, cfg.ShutdownGracePeriod)
+
+	_, err = ParseConfig([]string{"-auth-token-ttl", "forever"}, testEnv(nil))
+	assert.Error(t, err)
+}
+
+func TestParseConfigHTTPSRedirectStatus(t *testing.T) {
+	cfg, err := ParseConfig(nil, testEnv(map[string]string{
+		"HTTPS_REDIRECT_STATUS": "308",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 308, cfg.HTTPSRedirectStatus)
+
+	_, err = ParseConfig([]string{"-https-redirect-status", "302"}, testEnv(nil))
+	assert.EqualError(t, err, "HTTPS redirect status must be 301 or 308, not 302")
+}
+
+func TestParseConfigTLSMinVersion(t *testing.T) {
+	cfg, err := ParseConfig(nil, testEnv(map[string]string{
+		"TLS_MIN_VERSION": "1.3",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "1.3", cfg.TLSMinVersion)
+
+	_, err = ParseConfig([]string{"-tls-min-version", "1.1"}, testEnv(nil))
+	assert.EqualError(t, err, `TLS min version must be 1.2 or 1.3, not "1.1"`)
+}
+
+func TestParseConfigBasicAuthRoutes(t *testing.T) {
+	cfg, err := ParseConfig(nil, testEnv(map[string]string{
+		"BASIC_AUTH_ROUTES": "api,admin",
+	}))
+	require.NoError(t, err)
+	cfg.BasicAuthUsername = "team"
+	assert.False(t, cfg.BasicAuthProtects(basicAuthAPI))
+
+	cfg.BasicAuthPassword = "correct horse battery staple"
+	assert.True(t, cfg.BasicAuthProtects(basicAuthAPI))
+	assert.True(t, cfg.BasicAuthProtects(basicAuthAdmin))
+	assert.False(t, cfg.BasicAuthProtects(basicAuthApp))
+
+	_, err = ParseConfig([]string{"-basic-auth-routes", "app,postgrest"},
+		testEnv(nil))
+	assert.EqualError(t, err, `Unknown Basic Auth route group "postgrest";`+
+		` must be one of app, api, admin`)
+}
+
+func TestParseConfigDirectoryIndex(t *testing.T) {
+	cfg, err := ParseConfig(nil, testEnv(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "index.html", cfg.DirectoryIndex)
+
+	_, err = ParseConfig([]string{"-directory-index", "docs/index.html"},
+		testEnv(nil))
+	assert.EqualError(t, err,
+		`Directory index must be a file name, not "docs/index.html"`)
+}
+
+func TestParseConfigAdminAuthMode(t *testing.T) {
+	cfg, err := ParseConfig(nil, testEnv(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "all", cfg.AdminAuthMode)
+
+	_, err = ParseConfig(nil, testEnv(map[string]string{
+		"ADMIN_AUTH_MODE": "either",
+	}))
+	assert.EqualError(t, err, `Admin auth mode must be all or any, not "either"`)
+}
+
+func TestParseConfigResponseHeaderAllowlist(t *testing.T) {
+	cfg, err := ParseConfig(nil, testEnv(map[string]string{
+		"POSTGREST_RESPONSE_HEADER_ALLOWLIST": "true",
+	}))
+	require.NoError(t, err)
+	assert.True(t, cfg.PostgrestResponseHeaderAllowlist)
+	assert.Contains(t, splitList(cfg.PostgrestAllowResponseHeaders), "Content-Range")
+
+	_, err = ParseConfig([]string{"-postgrest-response-header-allowlist",
+		"-postgrest-allow-response-headers", " , "}, testEnv(nil))
+	assert.EqualError(t, err, "PostgREST response header allowlist is empty;"+
+		" set POSTGREST_ALLOW_RESPONSE_HEADERS")
+}
+
+func TestParseConfigAuthTokenReapInterval(t *testing.T) {
+	for _, interval := range []string{"0s", "-1m"} {
+		_, err := ParseConfig(nil, testEnv(map[string]string{
+			"AUTH_TOKEN_REAP_INTERVAL": interval,
+		}))
+		assert.EqualError(t, err, "Auth token reap interval must be positive",
+			interval)
+	}
+}
+
+func TestParseConfigHTTPSAddr(t *testing.T) {
+	cfg, err := ParseConfig([]string{"-https", ":443"}, testEnv(nil))
+	require.NoError(t, err)
+	assert.Equal(t, ":443", cfg.HTTPSAddr)
+
+	_, err = ParseConfig([]string{"-https", "127.0.0.1"}, testEnv(nil))
+	assert.Error(t, err)
+	_, err = ParseConfig([]string{"-https", "127.0.0.1:"}, testEnv(nil))
+	assert.EqualError(t, err, `HTTPS address "127.0.0.1:" has no port`)
+}
+
+func TestParseConfigLoginRateLimits(t *testing.T) {
+	tests := []struct {
+		env map[string]string
+		err string
+	}{
+		{map[string]string{"LOGIN_RATE_LIMIT_BURST": "0"},
+			"Login rate limit burst must be positive"},
+		{map[string]string{"LOGIN_RATE_LIMIT_INTERVAL": "0s"},
+			"Login rate limit interval must be positive"},
+		{map[string]string{"LOGIN_RATE_LIMIT_INTERVAL": "-1s"},
+			"Login rate limit interval must be positive"},
+		{map[string]string{"LOGIN_ID_RATE_LIMIT_INTERVAL": "0s"},
+			"Per-miniLock ID login rate limit interval must be positive"},
+		{map[string]string{"LOGIN_ID_RATE_LIMIT_BURST": "-1"},
+			"Per-miniLock ID login rate limit can't be negative"},
+	}
+	for _, tt := range tests {
+		_, err := ParseConfig(nil, testEnv(tt.env))
+		assert.EqualError(t, err, tt.err, "%v", tt.env)
+	}
+
+	// Without a burst, the per-ID limit is off, so needs no interval
+	_, err := ParseConfig(nil, testEnv(map[string]string{
+		"LOGIN_ID_RATE_LIMIT_BURST":    "0",
+		"LOGIN_ID_RATE_LIMIT_INTERVAL": "0s",
+	}))
+	assert.NoError(t, err)
+}
+
+func TestConfigHSTS(t *testing.T) {
+	year := HSTS_PRELOAD_MIN_MAX_AGE
+	for _, tt := range []struct {
+		maxAge              time.Duration
+		subdomains, preload bool
+		header              string
+		err                 string
+	}{
+		{year, true, true, "max-age=31536000; includeSubDomains; preload", ""},
+		{2 * year, true, true, "max-age=63072000; includeSubDomains; preload", ""},
+		{year, true, false, "max-age=31536000; includeSubDomains", ""},
+		{time.Hour, false, false, "max-age=3600", ""},
+		{0, false, false, "max-age=0", ""},
+		{year, false, true, "", "HSTS preload requires includeSubDomains"},
+		{year - time.Second, true, true, "", "HSTS preload requires a max-age"},
+		{-time.Second, false, false, "", "HSTS max-age can't be negative"},
+	} {
+		cfg := DefaultConfig()
+		cfg.HSTSMaxAge = tt.maxAge
+		cfg.HSTSIncludeSubDomains = tt.subdomains
+		cfg.HSTSPreload = tt.preload
+
+		err := cfg.CheckHSTS()
+		if tt.err != "" {
+			if assert.Error(t, err, "%+v", tt) {
+				assert.Contains(t, err.Error(), tt.err)
+			}
+			continue
+		}
+		assert.NoError(t, err, "%+v", tt)
+		assert.Equal(t, tt.header, cfg.HSTSHeader())
+	}
+
+	_, err := ParseConfig([]string{"-hsts-include-subdomains=false"}, testEnv(nil))
+	assert.Error(t, err)
+	cfg, err := ParseConfig(nil, testEnv(map[string]string{
+		"HSTS_PRELOAD":            "false",
+		"HSTS_INCLUDE_SUBDOMAINS": "false",
+		"HSTS_MAX_AGE":            "720h",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "max-age=2592000", cfg.HSTSHeader())
+
+	cfg, err = ParseConfig(nil, testEnv(map[string]string{
+		"HSTS_PRELOAD":            "false",
+		"HSTS_INCLUDE_SUBDOMAINS": "false",
+		"HSTS_MAX_AGE":            "2592000",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "max-age=2592000", cfg.HSTSHeader())
+
+	cfg, err = ParseConfig([]string{"-hsts-preload=false",
+		"-hsts-include-subdomains=false", "-hsts-max-age", "600"},
+		testEnv(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "max-age=600", cfg.HSTSHeader())
+
+	for _, val := range []string{"a year", "-1", "1.5"} {
+		_, err = ParseConfig(nil, testEnv(map[string]string{
+			"HSTS_MAX_AGE": val,
+		}))
+		assert.Error(t, err, val)
+		_, err = ParseConfig([]string{"-hsts-max-age", val}, testEnv(nil))
+		assert.Error(t, err, val)
+	}
+}
+
+func TestConfigDomains(t *testing.T) {
+	cfg := DefaultConfig()
+	assert.Empty(t, cfg.Domains())
+	assert.Equal(t, "", cfg.CanonicalDomain())
+
+	cfg.Domain = "example.com, www.example.com,,example.org "
+	assert.Equal(t, []string{"example.com", "www.example.com", "example.org"},
+		cfg.Domains())
+	assert.Equal(t, "example.com", cfg.CanonicalDomain())
+}
+
+func TestConfigLogFieldsRedactsSecrets(t *testing.T) {
+	cfg, err := ParseConfig([]string{
+		"-domain", "example.com,www.example.com",
+		"-basic-auth-username", "alice",
+		"-basic-auth-password", "hunter2",
+		"-postgrest-jwt-secret", "jwtsecret",
+		"-session-store", "redis",
+		"-redis-url", "redis://:redispass@cache:6379/0",
+	}, testEnv(nil))
+	require.NoError(t, err)
+
+	fields := cfg.LogFields()
+	assert.Equal(t, "127.0.0.1:8082", fields["http_addr"])
+	assert.Equal(t, "http://localhost:3000/", fields["postgrest_url"])
+	assert.Equal(t, []string{"example.com", "www.example.com"}, fields["domains"])
+	assert.Equal(t, true, fields["basic_auth"])
+	assert.Equal(t, "alice", fields["basic_auth_username"])
+	assert.Equal(t, "[REDACTED]", fields["basic_auth_password"])
+	assert.Equal(t, "[REDACTED]", fields["postgrest_jwt_secret"])
+	assert.Equal(t, "redis", fields["session_store"])
+	assert.Equal(t, "redis://:xxxxx@cache:6379/0", fields["redis_url"])
+
+	logged := fmt.Sprint(fields)
+	for _, secret := range []string{"hunter2", "jwtsecret", "redispass"} {
+		assert.NotContains(t, logged, secret)
+	}
+
+	// Unset secrets aren't reported as set
+	fields = testConfig().LogFields()
+	assert.Equal(t, "", fields["basic_auth_password"])
+	assert.Equal(t, false, fields["basic_auth"])
+	assert.Equal(t, "memory", fields["session_store"])
+}
+
+func TestCheckBasicAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		warnings []string
+		err      string
+	}{
+		{
+			name: "enabled with a strong password",
+			cfg: Config{Domain: "example.com", BasicAuthUsername: "team",
+				BasicAuthPassword: "correct horse battery staple"},
+		},
+		{
+			name: "disabled locally",
+			cfg:  Config{Domain: "localhost,127.0.0.1,effective.test"},
+		},
+		{
+			name: "username only",
+			cfg:  Config{BasicAuthUsername: "team"},
+			warnings: []string{"Basic Auth username is set but password isn't," +
+				" so Basic Auth is disabled"},
+		},
+		{
+			name: "password only",
+			cfg:  Config{BasicAuthPassword: "correct horse battery staple"},
+			warnings: []string{"Basic Auth password is set but username isn't," +
+				" so Basic Auth is disabled"},
+		},
+		{
+			name:     "short password",
+			cfg:      Config{BasicAuthUsername: "team", BasicAuthPassword: "hunter2"},
+			warnings: []string{"Basic Auth password is weak: shorter than 12 characters"},
+		},
+		{
+			name: "password same as username",
+			cfg: Config{BasicAuthUsername: "effective-team",
+				BasicAuthPassword: "Effective-Team"},
+			warnings: []string{"Basic Auth password is weak: same as the username"},
+		},
+		{
+			name:     "common password",
+			cfg:      Config{BasicAuthUsername: "team", BasicAuthPassword: "Password1234"},
+			warnings: []string{"Basic Auth password is weak: commonly used"},
+		},
+		{
+			name:     "repeated character",
+			cfg:      Config{BasicAuthUsername: "team", BasicAuthPassword: "xxxxxxxxxxxxxxxx"},
+			warnings: []string{"Basic Auth password is weak: one repeated character"},
+		},
+		{
+			name: "disabled with a public domain",
+			cfg:  Config{Domain: "localhost,pursuance.example.com"},
+			warnings: []string{"Basic Auth is disabled but public domain" +
+				" pursuance.example.com is configured"},
+		},
+		{
+			name: "disabled with a public domain in production",
+			cfg:  Config{Prod: true, Domain: "pursuance.example.com"},
+			warnings: []string{"Basic Auth is disabled but public domain" +
+				" pursuance.example.com is configured"},
+		},
+		{
+			name: "username only in production",
+			cfg:  Config{Prod: true, Domain: "example.com", BasicAuthUsername: "team"},
+			err: "Refusing to start in production: Basic Auth username is set" +
+				" but password isn't, so Basic Auth is disabled",
+		},
+		{
+			name: "weak password in production",
+			cfg: Config{Prod: true, Domain: "example.com",
+				BasicAuthUsername: "team", BasicAuthPassword: "changeme"},
+			err: "Refusing to start in production: Basic Auth password is weak:" +
+				" shorter than 12 characters",
+		},
+	}
+
+	for _, tt := range tests {
+		warnings, err := tt.cfg.CheckBasicAuth()
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err, tt.name)
+			continue
+		}
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.warnings, warnings, tt.name)
+	}
+}
+
+func TestPostgrestPrefix(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"/postgrest": "/postgrest",
+		"api/db/":    "/api/db",
+		" /db ":      "/db",
+		"/":          "",
+		"":           "",
+	} {
+		cfg := &Config{PostgrestPathPrefix: prefix}
+		assert.Equal(t, want, cfg.PostgrestPrefix(), prefix)
+	}
+}
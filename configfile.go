@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Where main looks for a config file unless CONFIG_FILE says otherwise
+const DEFAULT_CONFIG_FILE = "./effective.json"
+
+// LoadConfig reads the JSON config file at path, then lets env vars
+// override it, just as ParseConfig lets them override DefaultConfig.
+// The file is a single, flat object: its keys are the env var names
+// of the settings it sets, and its values are what those env vars
+// would be, or the JSON number, bool, or list equivalent, e.g.
+//
+//	{
+//	  "INTERNAL_POSTGREST_BASE_URL": "http://db:3000/",
+//	  "POSTGREST_RETRIES": 5,
+//	  "AUTH_TOKEN_TTL": "90m",
+//	  "TRUSTED_PROXIES": ["10.0.0.0/8", "172.16.0.1"]
+//	}
+//
+// The result is validated as ParseConfig's is, and an unknown key is
+// an error, as is a missing file. An empty path means no file.
+func LoadConfig(path string) (*Config, error) {
+	return loadConfig(path, nil, os.Getenv)
+}
+
+// loadConfig is LoadConfig with flags (args) overriding env vars.
+func loadConfig(path string, args []string, getenv func(string) string) (*Config, error) {
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	looked := map[string]bool{}
+	cfg, err := ParseConfig(args, func(name string) string {
+		looked[name] = true
+		if val := getenv(name); val != "" {
+			return val
+		}
+		return settings[name]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var unknown []string
+	for name := range settings {
+		if !looked[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("Unknown setting(s) in %s: %s", path,
+			strings.Join(unknown, ", "))
+	}
+	return cfg, nil
+}
+
+// configFile returns the config file main should load: wherever
+// CONFIG_FILE points, which must exist, or else DEFAULT_CONFIG_FILE if
+// it exists, or "" for none.
+func configFile(getenv func(string) string) string {
+	if path := getenv("CONFIG_FILE"); path != "" {
+		return path
+	}
+	if _, err := os.Stat(DEFAULT_CONFIG_FILE); os.IsNotExist(err) {
+		return ""
+	}
+	return DEFAULT_CONFIG_FILE
+}
+
+// readConfigFile reads the settings in the config file at path as the
+// strings their env vars would hold. Returns no settings if path is
+// empty.
+func readConfigFile(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading config file: %v", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	dec.UseNumber()
+	var raw map[string]interface{}
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("Error parsing config file %s: %v", path, err)
+	}
+
+	settings := make(map[string]string, len(raw))
+	for name, val := range raw {
+		str, err := configFileValue(val)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing %s in %s: %v", name, path, err)
+		}
+		settings[name] = str
+	}
+	return settings, nil
+}
+
+func configFileValue(val interface{}) (string, error) {
+	switch v := val.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		// Comma-separated, like the env var
+		items := make([]string, len(v))
+		for i, item := range v {
+			if _, ok := item.([]interface{}); ok {
+				return "", fmt.Errorf("lists can't be nested")
+			}
+			str, err := configFileValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = str
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("must be a string, number, bool, or list")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfigFile = `{
+  "INTERNAL_POSTGREST_BASE_URL": "http://db:3000/",
+  "POSTGREST_RETRIES": 5,
+  "AUTH_TOKEN_TTL": "90m",
+  "HTTP2_PUSH": true,
+  "TRUSTED_PROXIES": ["192.168.0.0/16", "172.16.0.1"],
+  "LOGIN_RATE_LIMIT_BURST": null
+}`
+
+func writeTestConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "effective.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := loadConfig(writeTestConfigFile(t, testConfigFile), nil,
+		testEnv(nil))
+	require.NoError(t, err)
+
+	assert.Equal(t, "http://db:3000/", cfg.PostgrestBaseURL)
+	assert.Equal(t, 5, cfg.PostgrestRetries)
+	assert.Equal(t, 90*time.Minute, cfg.AuthTokenTTL)
+	assert.True(t, cfg.HTTP2Push)
+	assert.Equal(t, "192.168.0.0/16,172.16.0.1/32",
+		(*ipNetsFlag)(&cfg.TrustedProxies).String())
+	assert.Equal(t, DefaultConfig().LoginRateLimitBurst, cfg.LoginRateLimitBurst)
+}
+
+func TestLoadConfigOverrides(t *testing.T) {
+	path := writeTestConfigFile(t, testConfigFile)
+
+	// Env vars beat the file...
+	cfg, err := loadConfig(path, nil, testEnv(map[string]string{
+		"POSTGREST_RETRIES": "7",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 7, cfg.PostgrestRetries)
+	assert.Equal(t, 90*time.Minute, cfg.AuthTokenTTL)
+
+	// ...and flags beat env vars
+	cfg, err = loadConfig(path, []string{"-postgrest-retries", "9"},
+		testEnv(map[string]string{"POSTGREST_RETRIES": "7"}))
+	require.NoError(t, err)
+	assert.Equal(t, 9, cfg.PostgrestRetries)
+}
+
+func TestLoadConfigNoFile(t *testing.T) {
+	cfg, err := loadConfig("", nil,
+		testEnv(map[string]string{"POSTGREST_RETRIES": "3"}))
+	require.NoError(t, err)
+
+	want := DefaultConfig()
+	want.PostgrestRetries = 3
+	assert.Equal(t, want, cfg)
+
+	// A file that was asked for has to be there
+	missing := filepath.Join(t.TempDir(), "nope.json")
+	_, err = loadConfig(missing, nil, testEnv(nil))
+	assert.EqualError(t, err, "Error reading config file: open "+missing+
+		": no such file or directory")
+}
+
+func TestConfigFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	// Only the default may be missing
+	assert.Equal(t, "", configFile(testEnv(nil)))
+	assert.Equal(t, "nope.json",
+		configFile(testEnv(map[string]string{"CONFIG_FILE": "nope.json"})))
+
+	require.NoError(t, ioutil.WriteFile(DEFAULT_CONFIG_FILE, []byte("{}"), 0644))
+	assert.Equal(t, DEFAULT_CONFIG_FILE, configFile(testEnv(nil)))
+	assert.Equal(t, "nope.json",
+		configFile(testEnv(map[string]string{"CONFIG_FILE": "nope.json"})))
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, tt := range []struct {
+		contents, err string
+	}{
+		// Validated like env vars and flags are
+		{`{"HTTPS_REDIRECT_STATUS": 302}`,
+			"HTTPS redirect status must be 301 or 308, not 302"},
+		{`{"AUTH_TOKEN_TTL": "a day"}`,
+			`Error parsing AUTH_TOKEN_TTL: time: invalid duration "a day"`},
+		{`{"POSTGREST_RETIRES": 5, "HTTP2_PUSH": true, "NOPE": 1}`,
+			"Unknown setting(s) in PATH: NOPE, POSTGREST_RETIRES"},
+		{`{"CORS_ALLOWED_ORIGINS": {"https://example.com": true}}`,
+			"Error parsing CORS_ALLOWED_ORIGINS in PATH: must be a string," +
+				" number, bool, or list"},
+	} {
+		path := writeTestConfigFile(t, tt.contents)
+		_, err := loadConfig(path, nil, testEnv(nil))
+		assert.EqualError(t, err, strings.Replace(tt.err, "PATH", path, 1),
+			tt.contents)
+	}
+
+	_, err := loadConfig(writeTestConfigFile(t, `{"HTTP2_PUSH": tru`), nil,
+		testEnv(nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const CORS_MAX_AGE = 10 * time.Minute
+
+var ErrCORSWildcardCredentials = errors.New(
+	"CORS can't allow credentials from any origin (*); list the origins instead")
+
+const (
+	corsAllowedMethods = "GET, HEAD, POST, PUT, PATCH, DELETE"
+	corsAllowedHeaders = "Authorization, Content-Type, Prefer, Range, X-Auth-Token, X-Minilock-Id"
+	corsExposedHeaders = "Content-Range, Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, X-Request-Id"
+)
+
+// CORS lets pages on other origins call the API and PostgREST routes.
+type CORS struct {
+	origins          map[string]bool
+	anyOrigin        bool
+	allowCredentials bool
+	postgrestPrefix  string
+}
+
+// NewCORS returns a CORS allowing the given origins (e.g.,
+// "https://app.example.com"), or any origin if one of them is "*",
+// which isn't allowed along with credentials. postgrestPrefix is
+// where PostgREST is mounted, as returned by Config.PostgrestPrefix.
+func NewCORS(origins []string, allowCredentials bool, postgrestPrefix string) (*CORS, error) {
+	c := &CORS{
+		origins:          map[string]bool{},
+		allowCredentials: allowCredentials,
+		postgrestPrefix:  postgrestPrefix,
+	}
+	for _, origin := range origins {
+		origin = strings.TrimSpace(origin)
+		switch origin {
+		case "":
+		case "*":
+			c.anyOrigin = true
+		default:
+			c.origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+		}
+	}
+	if c.anyOrigin && allowCredentials {
+		return nil, ErrCORSWildcardCredentials
+	}
+	return c, nil
+}
+
+// newCORS returns the CORS cfg calls for, or nil if it doesn't allow
+// any other origins.
+func newCORS(cfg *Config) (*CORS, error) {
+	if cfg.CORSAllowedOrigins == "" {
+		return nil, nil
+	}
+	return NewCORS(strings.Split(cfg.CORSAllowedOrigins, ","),
+		cfg.CORSAllowCredentials, cfg.PostgrestPrefix())
+}
+
+func (c *CORS) allowed(origin string) bool {
+	return c.anyOrigin || c.origins[strings.ToLower(origin)]
+}
+
+func (c *CORS) covers(path string) bool {
+	return strings.HasPrefix(path, "/api/") || path == c.postgrestPrefix ||
+		strings.HasPrefix(path, c.postgrestPrefix+"/")
+}
+
+// Middleware adds CORS headers to responses from /api/ and PostgREST
+// for allowed origins, and answers their preflight requests.
+func (c *CORS) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !c.covers(req.URL.Path) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		preflight := req.Method == "OPTIONS" &&
+			req.Header.Get("Access-Control-Request-Method") != ""
+		if !c.allowed(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			// Without CORS headers, the browser won't let the page
+			// see the response
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		if c.anyOrigin {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.allowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			w.Header().Set("Access-Control-Max-Age",
+				strconv.Itoa(int(CORS_MAX_AGE/time.Second)))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCORSTestServer(t *testing.T, origins string, allowCredentials bool) http.Handler {
+	cfg := testConfig()
+	cfg.CORSAllowedOrigins = origins
+	cfg.CORSAllowCredentials = allowCredentials
+	srv, err := NewServer(cfg, NewMapper(), testServerKeys, nil)
+	require.NoError(t, err)
+	return srv.Handler
+}
+
+func corsRequest(h http.Handler, method, url, origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, nil)
+	req.Header.Set("Origin", origin)
+	if method == "OPTIONS" {
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type")
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h := newCORSTestServer(t, "https://app.example.com, http://localhost:3001", true)
+
+	rec := corsRequest(h, "OPTIONS", "/api/login", "https://app.example.com")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "https://app.example.com",
+		rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Contains(t, rec.Header().Get("Access-Control-Allow-Methods"), "POST")
+	assert.Contains(t, rec.Header().Get("Access-Control-Allow-Headers"), "Content-Type")
+	assert.Contains(t, rec.Header()["Vary"], "Origin")
+
+	rec = corsRequest(h, "OPTIONS", "/postgrest/tasks", "http://localhost:3001")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "http://localhost:3001",
+		rec.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	h := newCORSTestServer(t, "https://app.example.com", true)
+
+	rec := corsRequest(h, "OPTIONS", "/api/login", "https://evil.example.com")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+
+	rec = corsRequest(h, "GET", "/api/sessions", "https://evil.example.com")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestCORSCredentialedRequest(t *testing.T) {
+	h := newCORSTestServer(t, "https://app.example.com", true)
+
+	rec := corsRequest(h, "GET", "/api/sessions", "https://app.example.com")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "https://app.example.com",
+		rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Contains(t, rec.Header().Get("Access-Control-Expose-Headers"), "X-Request-Id")
+
+	// Non-API routes are same-origin only
+	rec = corsRequest(h, "GET", "/healthz", "https://app.example.com")
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSWildcard(t *testing.T) {
+	h := newCORSTestServer(t, "*", false)
+	rec := corsRequest(h, "OPTIONS", "/api/login", "https://anywhere.example")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "*", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"))
+
+	cfg := testConfig()
+	cfg.CORSAllowedOrigins = "https://app.example.com,*"
+	cfg.CORSAllowCredentials = true
+	_, err := NewServer(cfg, NewMapper(), testServerKeys, nil)
+	assert.Equal(t, ErrCORSWildcardCredentials, err)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+const cspNonceKey contextKey = "csp_nonce"
+
+var ErrCSPEmpty = errors.New("CSP config has no directives")
+
+// cspNonceDirectives are the directives that get each response's
+// nonce added to them
+var cspNonceDirectives = []string{"script-src", "style-src"}
+
+// cspDirectiveOrder is the order directives appear in the header;
+// others come after, sorted by name.
+var cspDirectiveOrder = []string{
+	"default-src", "script-src", "style-src", "img-src", "font-src",
+	"media-src", "connect-src", "child-src",
+}
+
+// CSPConfig maps Content-Security-Policy directive names to their
+// sources, e.g. {"script-src": ["'self'"]}. Directives without sources,
+// like upgrade-insecure-requests, map to an empty list.
+type CSPConfig map[string][]string
+
+// DefaultCSPConfig returns the policy we've always served: everything
+// from our own domains, plus inline styles. Without any domains (e.g.,
+// in development over plain HTTP), everything from our own origin is
+// allowed instead.
+func DefaultCSPConfig(domains []string) CSPConfig {
+	var self, connect []string
+	for _, domain := range domains {
+		self = append(self, "https://"+domain+":*")
+	}
+	if len(domains) == 0 {
+		self = []string{"'self'"}
+	}
+	connect = append(connect, self...)
+	for _, domain := range domains {
+		connect = append(connect, "wss://"+domain+":*")
+	}
+
+	return CSPConfig{
+		"default-src": {"'none'"},
+		"script-src":  self,
+		"style-src":   append([]string{"'unsafe-inline'"}, self...),
+		"img-src":     self,
+		"font-src":    self,
+		"media-src":   self,
+		"connect-src": connect,
+		"child-src":   self,
+	}
+}
+
+// LoadCSPConfig reads a CSPConfig from the JSON file at path, or
+// returns DefaultCSPConfig for domains if path is empty.
+func LoadCSPConfig(path string, domains []string) (CSPConfig, error) {
+	if path == "" {
+		return DefaultCSPConfig(domains), nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CSP config: %v", err)
+	}
+
+	var cfg CSPConfig
+	if err = json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("Error parsing CSP config %s: %v", path, err)
+	}
+	if len(cfg) == 0 {
+		return nil, ErrCSPEmpty
+	}
+	return cfg, nil
+}
+
+// String renders cfg as a Content-Security-Policy header value.
+func (cfg CSPConfig) String() string {
+	names := make([]string, 0, len(cfg))
+	seen := map[string]bool{}
+	for _, name := range cspDirectiveOrder {
+		if _, ok := cfg[name]; ok {
+			names = append(names, name)
+			seen[name] = true
+		}
+	}
+	var rest []string
+	for name := range cfg {
+		if !seen[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	names = append(names, rest...)
+
+	directives := make([]string, len(names))
+	for i, name := range names {
+		directives[i] = strings.Join(append([]string{name}, cfg[name]...), " ")
+	}
+	return strings.Join(directives, "; ")
+}
+
+// withNonce returns a copy of cfg with nonce allowed by the
+// script-src and style-src directives. Directives that allow
+// 'unsafe-inline' are left alone, since browsers ignore
+// 'unsafe-inline' once a nonce is present, which would block inline
+// style attributes.
+func (cfg CSPConfig) withNonce(nonce string) CSPConfig {
+	out := make(CSPConfig, len(cfg))
+	for name, sources := range cfg {
+		out[name] = sources
+	}
+
+	for _, name := range cspNonceDirectives {
+		sources, ok := cfg[name]
+		if !ok || containsString(sources, "'unsafe-inline'") {
+			continue
+		}
+		out[name] = append(append([]string{}, sources...),
+			"'nonce-"+nonce+"'")
+	}
+	return out
+}
+
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+// withReporting returns a copy of cfg that has browsers report
+// violations to CSP_REPORT_PATH, unless cfg already says where to
+// report them.
+func (cfg CSPConfig) withReporting() CSPConfig {
+	out := make(CSPConfig, len(cfg)+2)
+	for name, sources := range cfg {
+		out[name] = sources
+	}
+
+	if _, ok := cfg["report-uri"]; !ok {
+		out["report-uri"] = []string{CSP_REPORT_PATH}
+	}
+	if _, ok := cfg["report-to"]; !ok {
+		out["report-to"] = []string{cspReportGroup}
+	}
+	return out
+}
+
+// CSPHolder holds the CSPConfig that CSPMiddleware serves, which can
+// be swapped (e.g., on SIGHUP) without restarting the server. Each
+// request uses whichever config was current when it arrived.
+type CSPHolder struct {
+	cfg atomic.Value // CSPConfig, with reporting added
+}
+
+func NewCSPHolder(cfg CSPConfig) *CSPHolder {
+	holder := &CSPHolder{}
+	holder.Store(cfg)
+	return holder
+}
+
+func (holder *CSPHolder) Load() CSPConfig {
+	return holder.cfg.Load().(CSPConfig)
+}
+
+// Store makes cfg the policy served from now on.
+func (holder *CSPHolder) Store(cfg CSPConfig) {
+	holder.cfg.Store(cfg.withReporting())
+}
+
+// Reload re-reads the config with LoadCSPConfig, keeping the current
+// one if that fails.
+func (holder *CSPHolder) Reload(path string, domains []string) error {
+	cfg, err := LoadCSPConfig(path, domains)
+	if err != nil {
+		return err
+	}
+	holder.Store(cfg)
+	return nil
+}
+
+// CSPMiddleware sets the Content-Security-Policy header held by
+// holder on every response, along with a fresh nonce that handlers can
+// get with cspNonce and put on inline <script> and <style> tags.
+// Violations are reported to CSPReport.
+func CSPMiddleware(holder *CSPHolder) func(http.Handler) http.Handler {
+	reportingEndpoints := cspReportGroup + `="` + CSP_REPORT_PATH + `"`
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			nonce, err := newCSPNonce()
+			if err != nil {
+				WriteError(w, "Error generating CSP nonce; sorry!", err)
+				return
+			}
+			w.Header().Set("Content-Security-Policy",
+				holder.Load().withNonce(nonce).String())
+			w.Header().Set("Reporting-Endpoints", reportingEndpoints)
+
+			ctx := context.WithValue(req.Context(), cspNonceKey, nonce)
+			h.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
+
+func newCSPNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// cspNonce returns the nonce CSPMiddleware generated for req, if any.
+func cspNonce(req *http.Request) string {
+	nonce, _ := req.Context().Value(cspNonceKey).(string)
+	return nonce
+}
+
+var (
+	inlineTagRegex = regexp.MustCompile(`(?i)<(script|style)(\s[^>]*)?>`)
+	srcAttrRegex   = regexp.MustCompile(`(?i)\ssrc\s*=`)
+)
+
+// injectCSPNonce adds nonce="<nonce>" to every inline <script> and
+// <style> tag in html.
+func injectCSPNonce(html []byte, nonce string) []byte {
+	attr := []byte(` nonce="` + nonce + `"`)
+	return inlineTagRegex.ReplaceAllFunc(html, func(tag []byte) []byte {
+		if srcAttrRegex.Match(tag) {
+			return tag
+		}
+		// Insert right after "<script" or "<style"
+		nameEnd := bytes.IndexAny(tag, " \t\r\n>")
+		out := make([]byte, 0, len(tag)+len(attr))
+		out = append(out, tag[:nameEnd]...)
+		out = append(out, attr...)
+		return append(out, tag[nameEnd:]...)
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cryptag/gosecure/csp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func cspHeader(mw func(http.Handler) http.Handler) string {
+	rec := httptest.NewRecorder()
+	mw(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	return rec.Header().Get("Content-Security-Policy")
+}
+
+func TestDefaultCSPMatchesLegacyPolicy(t *testing.T) {
+	cfg, err := LoadCSPConfig("", []string{"example.com"})
+	require.NoError(t, err)
+
+	// Same sources, minus the legacy policy's duplicate connect-src
+	// entries for the API domain
+	legacy := cspHeader(csp.GetCustomHandlerStyleUnsafeInline("example.com", "example.com"))
+	legacy = strings.Replace(legacy,
+		"connect-src https://example.com:* https://example.com:* wss://example.com:* wss://example.com:*",
+		"connect-src https://example.com:* wss://example.com:*", 1)
+	assert.Equal(t, legacy, cfg.String())
+}
+
+func TestDefaultCSPMultipleDomains(t *testing.T) {
+	cfg := DefaultCSPConfig([]string{"example.com", "www.example.com"})
+	assert.Equal(t, "default-src 'none'; "+
+		"script-src https://example.com:* https://www.example.com:*; "+
+		"style-src 'unsafe-inline' https://example.com:* https://www.example.com:*; "+
+		"img-src https://example.com:* https://www.example.com:*; "+
+		"font-src https://example.com:* https://www.example.com:*; "+
+		"media-src https://example.com:* https://www.example.com:*; "+
+		"connect-src https://example.com:* https://www.example.com:* "+
+		"wss://example.com:* wss://www.example.com:*; "+
+		"child-src https://example.com:* https://www.example.com:*",
+		cfg.String())
+}
+
+func TestCSPMiddlewareFromConfig(t *testing.T) {
+	cfg := CSPConfig{
+		"default-src":               {"'none'"},
+		"script-src":                {"'self'"},
+		"connect-src":               {"'self'", "https://db.example.com"},
+		"upgrade-insecure-requests": {},
+		"base-uri":                  {"'none'"},
+	}
+
+	assert.Equal(t, "default-src 'none'; script-src 'self'; "+
+		"connect-src 'self' https://db.example.com; base-uri 'none'; "+
+		"upgrade-insecure-requests",
+		cfg.String())
+
+	header := cspHeader(CSPMiddleware(NewCSPHolder(cfg)))
+	assert.Regexp(t, `^default-src 'none'; script-src 'self' 'nonce-[^']+'; `+
+		`connect-src 'self' https://db.example.com; base-uri 'none'; `+
+		`report-to csp-endpoint; report-uri /api/csp-report; `+
+		`upgrade-insecure-requests$`, header)
+	assert.NotEqual(t, header, cspHeader(CSPMiddleware(NewCSPHolder(cfg))),
+		"nonce should differ per response")
+}
+
+func TestCSPNonceSkipsUnsafeInline(t *testing.T) {
+	cfg := DefaultCSPConfig([]string{"example.com"})
+	header := cspHeader(CSPMiddleware(NewCSPHolder(cfg)))
+
+	assert.Contains(t, header, "script-src https://example.com:* 'nonce-")
+	assert.Contains(t, header, "style-src 'unsafe-inline' https://example.com:*;")
+}
+
+func TestIndexCSPNonce(t *testing.T) {
+	buildDir, cleanup := newTestBuildDir(t)
+	defer cleanup()
+
+	index := `<html><head><style>body{}</style>` +
+		`<script src="/static/js/main.js"></script></head>` +
+		`<body><SCRIPT type="text/javascript">window.x=1</SCRIPT></body></html>`
+	err := ioutil.WriteFile(filepath.Join(buildDir, "index.html"),
+		[]byte(index), 0644)
+	require.NoError(t, err)
+
+	cfg := CSPConfig{"script-src": {"'self'"}, "style-src": {"'self'"}}
+	handler := CSPMiddleware(NewCSPHolder(cfg))(NewSPAHandler(buildDir))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/dashboard", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	m := regexp.MustCompile(`script-src 'self' 'nonce-([^']+)'; ` +
+		`style-src 'self' 'nonce-([^']+)'`).
+		FindStringSubmatch(rec.Header().Get("Content-Security-Policy"))
+	require.Len(t, m, 3)
+	nonce := m[1]
+	assert.Equal(t, nonce, m[2])
+
+	assert.Equal(t, `<html><head><style nonce="`+nonce+`">body{}</style>`+
+		`<script src="/static/js/main.js"></script></head>`+
+		`<body><SCRIPT nonce="`+nonce+`" type="text/javascript">window.x=1</SCRIPT></body></html>`,
+		rec.Body.String())
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	assert.Empty(t, rec.Header().Get("ETag"))
+}
+
+func TestInjectCSPNonceNoInlineTags(t *testing.T) {
+	html := []byte(`<html><script src="/a.js"></script><p>hi</p></html>`)
+	assert.Equal(t, string(html), string(injectCSPNonce(html, "abc")))
+}
+
+func TestLoadCSPConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "effective-csp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "csp.json")
+	err = ioutil.WriteFile(path,
+		[]byte(`{"default-src": ["'self'"], "style-src": ["'self'"]}`), 0600)
+	require.NoError(t, err)
+
+	cfg, err := LoadCSPConfig(path, []string{"example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "default-src 'self'; style-src 'self'", cfg.String())
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{}`), 0600))
+	_, err = LoadCSPConfig(path, []string{"example.com"})
+	assert.Equal(t, ErrCSPEmpty, err)
+
+	_, err = LoadCSPConfig(filepath.Join(dir, "missing.json"),
+		[]string{"example.com"})
+	assert.Error(t, err)
+}
+
+func TestCSPHolderSwap(t *testing.T) {
+	holder := NewCSPHolder(CSPConfig{"default-src": {"'self'"}})
+	mw := CSPMiddleware(holder)
+	assert.True(t, strings.HasPrefix(cspHeader(mw), "default-src 'self'; "))
+
+	holder.Store(CSPConfig{"default-src": {"'none'"}})
+	assert.True(t, strings.HasPrefix(cspHeader(mw), "default-src 'none'; "))
+}
+
+func TestCSPHolderReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "effective-csp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "csp.json")
+
+	require.NoError(t, ioutil.WriteFile(path,
+		[]byte(`{"default-src": ["'self'"]}`), 0644))
+	holder := NewCSPHolder(CSPConfig{"default-src": {"'none'"}})
+	mw := CSPMiddleware(holder)
+
+	require.NoError(t, holder.Reload(path, nil))
+	assert.True(t, strings.HasPrefix(cspHeader(mw), "default-src 'self'; "))
+
+	// A broken file leaves the last good policy in place
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"default-src": [`), 0644))
+	assert.Error(t, holder.Reload(path, nil))
+	assert.True(t, strings.HasPrefix(cspHeader(mw), "default-src 'self'; "))
+}
+
+func TestOnSIGHUP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloads := make(chan struct{}, 1)
+	OnSIGHUP(ctx, func() { reloads <- struct{}{} })
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	select {
+	case <-reloads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload wasn't called")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	CSP_REPORT_PATH = "/api/csp-report"
+
+	// Name of the Reporting-Endpoints entry for CSP_REPORT_PATH
+	cspReportGroup = "csp-endpoint"
+
+	maxCSPReportSize = 64 << 10
+)
+
+var ErrCSPReportContentType = errors.New("unsupported CSP report Content-Type")
+
+// legacyCSPReport is what browsers send to a report-uri, as
+// application/csp-report.
+type legacyCSPReport struct {
+	Report struct {
+		DocumentURI       string `json:"document-uri"`
+		BlockedURI        string `json:"blocked-uri"`
+		ViolatedDirective string `json:"violated-directive"`
+	} `json:"csp-report"`
+}
+
+// reportingAPIReport is one of the reports browsers send to a
+// report-to endpoint, as application/reports+json.
+type reportingAPIReport struct {
+	Type string `json:"type"`
+	Body struct {
+		DocumentURL        string `json:"documentURL"`
+		BlockedURL         string `json:"blockedURL"`
+		EffectiveDirective string `json:"effectiveDirective"`
+	} `json:"body"`
+}
+
+type cspViolation struct {
+	DocumentURI       string
+	BlockedURI        string
+	ViolatedDirective string
+}
+
+// CSPReport logs the CSP violation reports POSTed to it by browsers.
+func CSPReport(trustedProxies []net.IPNet) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		req.Body = http.MaxBytesReader(w, req.Body, maxCSPReportSize)
+
+		violations, err := parseCSPReport(req)
+		if err == ErrCSPReportContentType {
+			WriteErrorStatus(w, "Error: "+err.Error(), err,
+				http.StatusUnsupportedMediaType)
+			return
+		}
+		if isBodyTooLarge(err) {
+			WriteErrorStatus(w, "Error: CSP report too large", err,
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			WriteErrorStatus(w, "Error: invalid CSP report", err,
+				http.StatusBadRequest)
+			return
+		}
+
+		for _, v := range violations {
+			log.WithFields(log.Fields{
+				"blocked_uri":        v.BlockedURI,
+				"violated_directive": v.ViolatedDirective,
+				"document_uri":       v.DocumentURI,
+				"remote_ip":          clientIP(req, trustedProxies),
+			}).Warn("CSP violation")
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func parseCSPReport(req *http.Request) ([]cspViolation, error) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "application/csp-report":
+		var report legacyCSPReport
+		if err := json.NewDecoder(req.Body).Decode(&report); err != nil {
+			return nil, err
+		}
+		r := report.Report
+		return []cspViolation{{
+			DocumentURI:       r.DocumentURI,
+			BlockedURI:        r.BlockedURI,
+			ViolatedDirective: r.ViolatedDirective,
+		}}, nil
+
+	case "application/reports+json":
+		var reports []reportingAPIReport
+		if err := json.NewDecoder(req.Body).Decode(&reports); err != nil {
+			return nil, err
+		}
+		var violations []cspViolation
+		for _, r := range reports {
+			if r.Type != "csp-violation" {
+				continue
+			}
+			violations = append(violations, cspViolation{
+				DocumentURI:       r.Body.DocumentURL,
+				BlockedURI:        r.Body.BlockedURL,
+				ViolatedDirective: r.Body.EffectiveDirective,
+			})
+		}
+		return violations, nil
+	}
+
+	return nil, ErrCSPReportContentType
+}
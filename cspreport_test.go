@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testLegacyCSPReport = `{"csp-report": {
+		"document-uri": "https://example.com/dashboard",
+		"referrer": "",
+		"violated-directive": "script-src-elem",
+		"effective-directive": "script-src-elem",
+		"original-policy": "default-src 'none'",
+		"blocked-uri": "https://evil.example.net/x.js",
+		"status-code": 200
+	}}`
+
+	testReportingAPIReports = `[{
+		"type": "csp-violation",
+		"age": 10,
+		"url": "https://example.com/dashboard",
+		"user_agent": "Mozilla/5.0",
+		"body": {
+			"documentURL": "https://example.com/dashboard",
+			"blockedURL": "inline",
+			"effectiveDirective": "style-src-elem",
+			"disposition": "enforce"
+		}
+	}, {
+		"type": "deprecation",
+		"url": "https://example.com/",
+		"body": {"id": "something"}
+	}]`
+)
+
+func newCSPReportRequest(contentType, body string) *http.Request {
+	req := httptest.NewRequest("POST", CSP_REPORT_PATH, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	return req
+}
+
+func TestParseLegacyCSPReport(t *testing.T) {
+	violations, err := parseCSPReport(newCSPReportRequest(
+		"application/csp-report", testLegacyCSPReport))
+	require.NoError(t, err)
+
+	assert.Equal(t, []cspViolation{{
+		DocumentURI:       "https://example.com/dashboard",
+		BlockedURI:        "https://evil.example.net/x.js",
+		ViolatedDirective: "script-src-elem",
+	}}, violations)
+}
+
+func TestParseReportingAPIReports(t *testing.T) {
+	violations, err := parseCSPReport(newCSPReportRequest(
+		"application/reports+json; charset=utf-8", testReportingAPIReports))
+	require.NoError(t, err)
+
+	// The deprecation report is skipped
+	assert.Equal(t, []cspViolation{{
+		DocumentURI:       "https://example.com/dashboard",
+		BlockedURI:        "inline",
+		ViolatedDirective: "style-src-elem",
+	}}, violations)
+}
+
+func TestCSPReportHandler(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, newCSPReportRequest("application/csp-report",
+		testLegacyCSPReport))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Contains(t, buf.String(), "CSP violation")
+	assert.Contains(t, buf.String(), "blocked_uri=")
+	assert.Contains(t, buf.String(), "https://evil.example.net/x.js")
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, newCSPReportRequest("text/plain", testLegacyCSPReport))
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, newCSPReportRequest("application/csp-report", "{"))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Oversized bodies are cut off rather than read into memory
+	huge := `{"csp-report": {"blocked-uri": "` +
+		strings.Repeat("a", maxCSPReportSize) + `"}}`
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, newCSPReportRequest("application/csp-report", huge))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
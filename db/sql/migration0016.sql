@@ -0,0 +1,19 @@
+/* Certs and private keys cached by the Go server's autocert manager
+   when run with AUTOCERT_CACHE=postgrest.  They're kept in a schema
+   of their own, which the public PostgREST (db-schema = "public")
+   doesn't serve, owned by a role that it doesn't log in as and that
+   no one else may use; point AUTOCERT_CACHE_POSTGREST_URL at a second
+   PostgREST configured like db/postgrest-autocert.conf, listening
+   where only the Go server can reach it */
+CREATE ROLE autocert_cache WITH LOGIN PASSWORD 'autocert_cache';
+
+CREATE SCHEMA autocert AUTHORIZATION autocert_cache;
+REVOKE ALL ON SCHEMA autocert FROM PUBLIC;
+
+CREATE TABLE autocert.autocert_cache (
+    key     text NOT NULL PRIMARY KEY,
+    data    text NOT NULL,
+    updated timestamp WITH time zone NOT NULL DEFAULT now()
+);
+ALTER TABLE autocert.autocert_cache OWNER TO autocert_cache;
+REVOKE ALL ON autocert.autocert_cache FROM PUBLIC;
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type routeInfo struct {
+	Path    string   `json:"path"`
+	Prefix  bool     `json:"prefix,omitempty"`
+	Methods []string `json:"methods,omitempty"`
+	Handler string   `json:"handler"`
+}
+
+type debugRoutesBody struct {
+	Routes []routeInfo `json:"routes"`
+}
+
+// DebugRoutes responds with r's routes in the order they're tried,
+// so that it's clear which one a request will end up at (e.g., why a
+// catch-all swallowed an API route). Handlers are only described by
+// the name of their type or function, never their contents.
+func DebugRoutes(r *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var body debugRoutesBody
+		r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+			tmpl, err := route.GetPathTemplate()
+			if err != nil {
+				return nil
+			}
+			info := routeInfo{Path: tmpl, Handler: handlerName(route.GetHandler())}
+			// Only exact paths are anchored at the end
+			if re, err := route.GetPathRegexp(); err == nil {
+				info.Prefix = !strings.HasSuffix(re, "$")
+			}
+			info.Methods, _ = route.GetMethods()
+			body.Routes = append(body.Routes, info)
+			return nil
+		})
+
+		out, err := json.Marshal(body)
+		if err != nil {
+			WriteError(w, "Error listing routes", err)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(out)
+	}
+}
+
+// handlerName returns e.g. "effective.Login.func1" for h.
+func handlerName(h http.Handler) string {
+	h = unwrapRoute(h)
+	if h == nil {
+		return ""
+	}
+	if f, ok := h.(http.HandlerFunc); ok {
+		if fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer()); fn != nil {
+			return path.Base(fn.Name())
+		}
+	}
+	return path.Base(fmt.Sprintf("%T", h))
+}
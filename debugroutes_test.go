@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugRoutes(t *testing.T) {
+	cfg := testConfig()
+	cfg.BasicAuthUsername = "admin"
+	cfg.BasicAuthPassword = "correct horse battery staple"
+	router, err := NewRouter(cfg, NewMapper(), testServerKeys, NewMetrics(nil), nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/debug/routes", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req.SetBasicAuth(cfg.BasicAuthUsername, cfg.BasicAuthPassword)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+	var body debugRoutesBody
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	index := map[string]int{}
+	for i, route := range body.Routes {
+		if _, ok := index[route.Path]; !ok {
+			index[route.Path] = i
+		}
+	}
+	find := func(path string) routeInfo {
+		i, ok := index[path]
+		require.True(t, ok, "%s missing from %+v", path, body.Routes)
+		return body.Routes[i]
+	}
+
+	login := find("/api/login")
+	assert.False(t, login.Prefix)
+	assert.Equal(t, []string{"POST"}, login.Methods)
+	// The outermost wrapper, i.e. what the router calls
+	assert.Equal(t, "effective.LimitByIP.func1", login.Handler)
+
+	postgrest := find("/postgrest")
+	assert.False(t, postgrest.Prefix)
+	assert.True(t, find("/postgrest/").Prefix)
+
+	catchAll := find("/")
+	assert.True(t, catchAll.Prefix)
+	assert.Equal(t, []string{"GET"}, catchAll.Methods)
+
+	// The catch-all is tried last, so it can't shadow anything
+	assert.Equal(t, len(body.Routes)-1, index["/"])
+	assert.True(t, index["/api/login"] < index["/"])
+	assert.True(t, index["/postgrest"] < index["/"])
+}
+
+func TestDebugRoutesDisabled(t *testing.T) {
+	router := mustNewRouter(NewMapper())
+	testURL(t, "GET", "/debug/routes", nil, router, http.StatusNotFound,
+		"404 page not found\n")
+}
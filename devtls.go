@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	devCert     *tls.Certificate
+	devCertErr  error
+	devCertOnce sync.Once
+)
+
+// DevTLSServer is like ProductionServer, but serves a self-signed
+// cert for localhost rather than getting one from Let's Encrypt, so
+// the HTTPS setup can be tried out locally.
+func DevTLSServer(cfg *Config, srv *http.Server) error {
+	cert, err := devCertificate()
+	if err != nil {
+		return err
+	}
+	return secureServer(cfg, srv, func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return cert, nil
+	})
+}
+
+// devCertificate returns a self-signed cert for localhost, 127.0.0.1,
+// and ::1, generated the first time it's called.
+func devCertificate() (*tls.Certificate, error) {
+	devCertOnce.Do(func() {
+		devCert, devCertErr = newSelfSignedCert([]string{"localhost"},
+			[]net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback})
+	})
+	return devCert, devCertErr
+}
+
+func newSelfSignedCert(dnsNames []string, ips []net.IP) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Effective dev"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(30 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
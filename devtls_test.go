@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDevCertificate(t *testing.T) {
+	cert, err := devCertificate()
+	require.NoError(t, err)
+
+	again, err := devCertificate()
+	require.NoError(t, err)
+	assert.True(t, cert == again, "cert should be generated once")
+
+	assert.NoError(t, cert.Leaf.VerifyHostname("localhost"))
+	assert.NoError(t, cert.Leaf.VerifyHostname("127.0.0.1"))
+	assert.Error(t, cert.Leaf.VerifyHostname("example.com"))
+}
+
+func TestDevTLSServer(t *testing.T) {
+	cfg := testConfig()
+	cfg.DevTLS = true
+
+	csp := NewCSPHolder(DefaultCSPConfig([]string{"localhost"}))
+	srv, err := NewServer(cfg, NewMapper(), testServerKeys, csp)
+	require.NoError(t, err)
+	require.NoError(t, DevTLSServer(cfg, srv))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, srv, ln, 5*time.Second)
+	}()
+	defer func() {
+		cancel()
+		assert.NoError(t, <-serveErr)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/healthz")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `{"status":"ok"}`, string(body))
+
+	require.NotNil(t, resp.TLS)
+	assert.True(t, resp.TLS.Version >= tls.VersionTLS12)
+	assert.Equal(t, "localhost", resp.TLS.PeerCertificates[0].DNSNames[0])
+
+	assert.NotEmpty(t, resp.Header.Get("Content-Security-Policy"))
+	assert.Empty(t, resp.Header.Get("Strict-Transport-Security"))
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	get := func(minVersion string, clientVersion uint16) (*http.Response, error) {
+		cfg := testConfig()
+		cfg.DevTLS = true
+		cfg.TLSMinVersion = minVersion
+		srv, err := NewServer(cfg, NewMapper(), testServerKeys, nil)
+		require.NoError(t, err)
+		require.NoError(t, DevTLSServer(cfg, srv))
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		serveErr := make(chan error, 1)
+		go func() {
+			serveErr <- serve(ctx, srv, ln, 5*time.Second)
+		}()
+		t.Cleanup(func() {
+			cancel()
+			assert.NoError(t, <-serveErr)
+		})
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				MinVersion:         clientVersion,
+				MaxVersion:         clientVersion,
+			},
+		}}
+		resp, err := client.Get("https://" + ln.Addr().String() + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	resp, err := get("1.2", tls.VersionTLS12)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), resp.TLS.Version)
+
+	_, err = get("1.3", tls.VersionTLS12)
+	assert.Error(t, err, "TLS 1.2 client should be refused")
+
+	resp, err = get("1.3", tls.VersionTLS13)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), resp.TLS.Version)
+}
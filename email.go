@@ -30,9 +30,14 @@ var (
 
 	// map[id]*Pursuance
 	pursuanceMap = map[int]*Pursuance{}
+
+	// Set by NewEmailer
+	emailPostgrestBaseURL string
 )
 
-func NewEmailer() {
+func NewEmailer(postgrestBaseURL string) {
+	emailPostgrestBaseURL = postgrestBaseURL
+
 	go func() {
 		now := Now()
 		tomorrow7amUTC := time.Date(now.Year(), now.Month(), now.Day()+1,
@@ -88,7 +93,7 @@ func NewEmailer() {
 
 func pgGetInto(urlPath string, obj interface{}) error {
 	log.Debugf("pgGetInto(%s)", urlPath)
-	resp, err := http.Get(POSTGREST_BASE_URL + urlPath)
+	resp, err := http.Get(emailPostgrestBaseURL + urlPath)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	READINESS_CHECK_TIMEOUT   = 2 * time.Second
+	READINESS_CHECK_CACHE_FOR = 2 * time.Second
+)
+
+// Healthz reports that the process is up, nothing more; see
+// ReadinessChecker for whether it can actually serve requests.
+func Healthz(w http.ResponseWriter, req *http.Request) {
+	writeHealthStatus(w, http.StatusOK, "")
+}
+
+type pingResponse struct {
+	Time string `json:"time"`
+	Unix int64  `json:"unix"`
+}
+
+// Ping responds with the server's current time, so that clients can
+// tell how far their clocks are off (e.g., from auth token expiries).
+// Like the probes, it's never behind basic auth.
+func Ping(w http.ResponseWriter, req *http.Request) {
+	now := time.Now().UTC()
+	body, _ := json.Marshal(pingResponse{
+		Time: now.Format(time.RFC3339),
+		Unix: now.Unix(),
+	})
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(body)
+}
+
+// ReadinessChecker serves /readyz, reporting whether PostgREST is
+// reachable and the auth token store is responsive. PostgREST is
+// considered reachable if the UpstreamHealthChecker, if any, last
+// found an upstream healthy; otherwise, it's checked directly, cached
+// for READINESS_CHECK_CACHE_FOR so that frequent probes don't hammer
+// it. Once the server starts shutting down, it fails regardless.
+type ReadinessChecker struct {
+	baseURL string
+	health  *UpstreamHealthChecker
+	store   Store
+	client  *http.Client
+
+	lock        sync.Mutex
+	checkedAt   time.Time
+	upstreamErr error
+
+	shuttingDown int32 // 1 once ShuttingDown is called
+}
+
+func NewReadinessChecker(postgrestBaseURL string, health *UpstreamHealthChecker, m Store) *ReadinessChecker {
+	return &ReadinessChecker{
+		baseURL: postgrestBaseURL,
+		health:  health,
+		store:   m,
+		client:  &http.Client{Timeout: READINESS_CHECK_TIMEOUT},
+	}
+}
+
+// ShuttingDown makes /readyz fail from now on, so that load balancers
+// stop sending us new requests while those in flight finish. /healthz
+// is unaffected.
+func (rc *ReadinessChecker) ShuttingDown() {
+	atomic.StoreInt32(&rc.shuttingDown, 1)
+}
+
+func (rc *ReadinessChecker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&rc.shuttingDown) == 1 {
+		writeHealthStatus(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	if err := rc.checkUpstream(); err != nil {
+		log.Debugf("Readiness check: PostgREST: %v", err)
+		writeHealthStatus(w, http.StatusServiceUnavailable,
+			"PostgREST unreachable")
+		return
+	}
+	if err := rc.checkStore(); err != nil {
+		log.Debugf("Readiness check: %v", err)
+		writeHealthStatus(w, http.StatusServiceUnavailable,
+			"auth token store unresponsive")
+		return
+	}
+	writeHealthStatus(w, http.StatusOK, "")
+}
+
+func (rc *ReadinessChecker) checkUpstream() error {
+	if rc.health != nil {
+		if !rc.health.Healthy() {
+			return fmt.Errorf("No PostgREST upstream passed its last health check")
+		}
+		return nil
+	}
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	if !rc.checkedAt.IsZero() && time.Since(rc.checkedAt) < READINESS_CHECK_CACHE_FOR {
+		return rc.upstreamErr
+	}
+
+	rc.upstreamErr = nil
+	resp, err := rc.client.Head(rc.baseURL)
+	if err != nil {
+		rc.upstreamErr = err
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			rc.upstreamErr = fmt.Errorf("HEAD %s returned %s", rc.baseURL,
+				resp.Status)
+		}
+	}
+	rc.checkedAt = time.Now()
+
+	return rc.upstreamErr
+}
+
+func (rc *ReadinessChecker) checkStore() error {
+	done := make(chan error, 1)
+	go func() {
+		done <- rc.store.Ping()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(READINESS_CHECK_TIMEOUT):
+		return fmt.Errorf("Timed out checking auth token store")
+	}
+}
+
+func writeHealthStatus(w http.ResponseWriter, status int, reason string) {
+	body := map[string]string{"status": "ok"}
+	if reason != "" {
+		body = map[string]string{"status": "unavailable", "reason": reason}
+	}
+	jsonBody, _ := json.Marshal(body)
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(jsonBody)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthz(t *testing.T) {
+	testURL(t, "GET", "/healthz", nil, router, http.StatusOK,
+		`{"status":"ok"}`)
+}
+
+func TestPing(t *testing.T) {
+	// Reachable without basic auth credentials, ahead of the
+	// catch-all
+	cfg := testConfig()
+	cfg.BasicAuthUsername = "team"
+	cfg.BasicAuthPassword = "correct horse battery staple"
+	r := mustNewRouterConfig(cfg, NewMapper())
+
+	before := time.Now().Unix()
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/api/ping", nil))
+	after := time.Now().Unix()
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, contentTypeJSON, rec.Header().Get("Content-Type"))
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+	var body struct {
+		Time string `json:"time"`
+		Unix int64  `json:"unix"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.True(t, body.Unix >= before && body.Unix <= after,
+		"unix %d not in [%d, %d]", body.Unix, before, after)
+
+	serverTime, err := time.Parse(time.RFC3339, body.Time)
+	require.NoError(t, err)
+	assert.Equal(t, body.Unix, serverTime.Unix())
+}
+
+func TestReadyzHealthyUpstream(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer upstream.Close()
+
+	rc := NewReadinessChecker(upstream.URL, nil, NewMapper())
+
+	testURL(t, "GET", "/readyz", nil, rc, http.StatusOK, `{"status":"ok"}`)
+
+	// Cached
+	testURL(t, "GET", "/readyz", nil, rc, http.StatusOK, `{"status":"ok"}`)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
+
+func TestReadyzUnhealthyUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	rc := NewReadinessChecker(upstream.URL, nil, NewMapper())
+	testURL(t, "GET", "/readyz", nil, rc, http.StatusServiceUnavailable,
+		`{"reason":"PostgREST unreachable","status":"unavailable"}`)
+
+	// Down entirely
+	upstream.Close()
+	rc = NewReadinessChecker(upstream.URL, nil, NewMapper())
+	testURL(t, "GET", "/readyz", nil, rc, http.StatusServiceUnavailable,
+		`{"reason":"PostgREST unreachable","status":"unavailable"}`)
+}
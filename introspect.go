@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cryptag/minishare/miniware"
+)
+
+// Plenty for {"token":"..."}
+const maxIntrospectBodySize = 4 << 10
+
+type introspectBody struct {
+	Token string `json:"token"`
+}
+
+// introspectResponse is modeled on RFC 7662's: an inactive token gets
+// only {"active":false}, so that callers can't learn anything else
+// about it. ExpiresAt is omitted if auth tokens don't expire.
+type introspectResponse struct {
+	Active     bool       `json:"active"`
+	MinilockID string     `json:"minilock_id,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+// Introspect tells internal services, which are handed a user's auth
+// token, whether it's active and whose it is, e.g. for POST
+// /internal/introspect {"token":"..."}. Being able to check arbitrary
+// tokens, it must only be reachable by them (see adminAuth in
+// NewRouter). Checking a token doesn't count as it being seen.
+func Introspect(m Store, ttl time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var body introspectBody
+		err := json.NewDecoder(http.MaxBytesReader(w, req.Body,
+			maxIntrospectBodySize)).Decode(&body)
+		if err != nil || body.Token == "" {
+			WriteErrorStatus(w, "Error: request body must be"+
+				` {"token":"..."}`, err, http.StatusBadRequest)
+			return
+		}
+
+		resp, err := introspect(m, ttl, body.Token)
+		if err != nil {
+			WriteError(w, "Error introspecting token; sorry!", err)
+			return
+		}
+		log.Debugf("Introspect: session %s active: %v",
+			tokenFingerprint(body.Token), resp.Active)
+
+		respBody, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(respBody)
+	}
+}
+
+func introspect(m Store, ttl time.Duration, authToken string) (*introspectResponse, error) {
+	mID, err := m.GetMinilockID(authToken)
+	if err == miniware.ErrAuthTokenNotFound || err == ErrAuthTokenExpired {
+		return &introspectResponse{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &introspectResponse{Active: true, MinilockID: mID}
+	if ttl <= 0 {
+		return resp, nil
+	}
+
+	// Expires TTL after it was issued
+	sessions, err := m.Sessions(mID)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sessions {
+		if secureCompare(authToken, s.AuthToken) {
+			expiresAt := s.Created.Add(ttl).UTC().Truncate(time.Second)
+			resp.ExpiresAt = &expiresAt
+			return resp, nil
+		}
+	}
+	// Expired (or was revoked) between the two lookups
+	return &introspectResponse{}, nil
+}
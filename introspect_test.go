@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testIntrospect(t *testing.T, handler http.Handler, token string) introspectResponse {
+	req := httptest.NewRequest("POST", "/internal/introspect",
+		strings.NewReader(`{"token":"`+token+`"}`))
+	req.SetBasicAuth("admin", "correct horse battery staple")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+	var resp introspectResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestIntrospect(t *testing.T) {
+	now := time.Now()
+	m := NewMapperWithTTL(time.Hour)
+	m.SetClock(func() time.Time { return now })
+
+	cfg := testConfig()
+	cfg.AuthTokenTTL = time.Hour
+	cfg.BasicAuthUsername = "admin"
+	cfg.BasicAuthPassword = "correct horse battery staple"
+	router := mustNewRouterConfig(cfg, m)
+
+	keypair := newTestKeypair(t)
+	token := testLogin(t, router, keypair)
+
+	// Active
+	resp := testIntrospect(t, router, token)
+	assert.True(t, resp.Active)
+	assert.Equal(t, testMinilockID(t, keypair), resp.MinilockID)
+	require.NotNil(t, resp.ExpiresAt)
+	assert.WithinDuration(t, now.Add(time.Hour), *resp.ExpiresAt, time.Second)
+
+	// Unknown
+	resp = testIntrospect(t, router, "not-a-real-token")
+	assert.Equal(t, introspectResponse{}, resp)
+
+	// Expired
+	now = now.Add(time.Hour)
+	resp = testIntrospect(t, router, token)
+	assert.Equal(t, introspectResponse{}, resp)
+}
+
+func TestIntrospectInternalOnly(t *testing.T) {
+	// Without basic auth (or client certs) it can't be protected, so
+	// it's absent
+	testURL(t, "POST", "/internal/introspect", nil, router,
+		http.StatusNotFound, "")
+
+	cfg := testConfig()
+	cfg.BasicAuthUsername = "admin"
+	cfg.BasicAuthPassword = "correct horse battery staple"
+	var err error
+	cfg.IPAllowlist, err = parseIPNets("10.0.0.0/8")
+	require.NoError(t, err)
+	r := mustNewRouterConfig(cfg, NewMapper())
+
+	// Right network, no credentials
+	req := httptest.NewRequest("POST", "/internal/introspect",
+		strings.NewReader(`{"token":"x"}`))
+	req.RemoteAddr = "10.1.2.3:50000"
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// Right credentials, wrong network
+	req = httptest.NewRequest("POST", "/internal/introspect",
+		strings.NewReader(`{"token":"x"}`))
+	req.SetBasicAuth(cfg.BasicAuthUsername, cfg.BasicAuthPassword)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
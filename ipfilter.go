@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// IPFilter restricts who can reach a route by client IP (as found by
+// clientIP, so it works behind trusted proxies). IPs in the denylist
+// are always refused; otherwise, if there's an allowlist, only IPs in
+// it get through. An empty allowlist allows everyone.
+type IPFilter struct {
+	allow          []net.IPNet
+	deny           []net.IPNet
+	trustedProxies []net.IPNet
+}
+
+// NewIPFilter returns an IPFilter combining the allow and deny lists
+// in cfg with those in the files it names, if any.
+func NewIPFilter(cfg *Config) (*IPFilter, error) {
+	f := &IPFilter{
+		allow:          cfg.IPAllowlist,
+		deny:           cfg.IPDenylist,
+		trustedProxies: cfg.TrustedProxies,
+	}
+	if cfg.IPAllowlistFile != "" {
+		nets, err := loadIPNetsFile(cfg.IPAllowlistFile)
+		if err != nil {
+			return nil, err
+		}
+		f.allow = append(f.allow[:len(f.allow):len(f.allow)], nets...)
+	}
+	if cfg.IPDenylistFile != "" {
+		nets, err := loadIPNetsFile(cfg.IPDenylistFile)
+		if err != nil {
+			return nil, err
+		}
+		f.deny = append(f.deny[:len(f.deny):len(f.deny)], nets...)
+	}
+	return f, nil
+}
+
+// loadIPNetsFile reads the IPs and CIDRs in the file at path, one or
+// more (comma-separated) per line. Blank lines and anything after a
+// # are ignored.
+func loadIPNetsFile(path string) ([]net.IPNet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var nets []net.IPNet
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		lineNets, err := parseIPNets(line)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing %s, line %d: %v", path,
+				lineNum, err)
+		}
+		nets = append(nets, lineNets...)
+	}
+	return nets, scanner.Err()
+}
+
+// Allowed reports whether ip may make requests.
+func (f *IPFilter) Allowed(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		// Can't tell; only OK if no one is being kept out
+		return len(f.allow) == 0 && len(f.deny) == 0
+	}
+	if ipInNets(parsed, f.deny) {
+		return false
+	}
+	return len(f.allow) == 0 || ipInNets(parsed, f.allow)
+}
+
+func (f *IPFilter) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip := clientIP(req, f.trustedProxies)
+		if !f.Allowed(ip) {
+			WriteErrorStatus(w, "Forbidden",
+				fmt.Errorf("%s isn't allowed to access %s", ip, req.URL.Path),
+				http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func ipInNets(ip net.IP, nets []net.IPNet) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
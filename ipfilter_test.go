@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testIPFilter(t *testing.T, allow, deny string) *IPFilter {
+	cfg := testConfig()
+	var err error
+	cfg.IPAllowlist, err = parseIPNets(allow)
+	require.NoError(t, err)
+	cfg.IPDenylist, err = parseIPNets(deny)
+	require.NoError(t, err)
+	f, err := NewIPFilter(cfg)
+	require.NoError(t, err)
+	return f
+}
+
+func TestIPFilter(t *testing.T) {
+	f := testIPFilter(t, "10.0.0.0/8, 192.168.1.0/24", "10.6.6.0/24")
+
+	// Allowed
+	assert.True(t, f.Allowed("10.1.2.3"))
+	assert.True(t, f.Allowed("192.168.1.50"))
+	// Denied, even though allowlisted
+	assert.False(t, f.Allowed("10.6.6.6"))
+	// Not in the allowlist
+	assert.False(t, f.Allowed("203.0.113.7"))
+	assert.False(t, f.Allowed("not an IP"))
+
+	// No allowlist means everyone but the denied
+	f = testIPFilter(t, "", "10.6.6.0/24")
+	assert.True(t, f.Allowed("203.0.113.7"))
+	assert.False(t, f.Allowed("10.6.6.6"))
+
+	f = testIPFilter(t, "", "")
+	assert.True(t, f.Allowed("203.0.113.7"))
+}
+
+func TestIPFilterMiddleware(t *testing.T) {
+	f := testIPFilter(t, "10.0.0.0/8", "10.6.6.0/24")
+	f.trustedProxies, _ = parseIPNets("172.16.0.1")
+	h := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	for _, tt := range []struct {
+		remoteAddr, xff string
+		status          int
+	}{
+		{"10.1.2.3:1234", "", http.StatusOK},
+		{"10.6.6.6:1234", "", http.StatusForbidden},
+		{"203.0.113.7:1234", "", http.StatusForbidden},
+		// Spoofed X-Forwarded-For from an untrusted client
+		{"203.0.113.7:1234", "10.1.2.3", http.StatusForbidden},
+		// Through our trusted proxy
+		{"172.16.0.1:1234", "10.1.2.3", http.StatusOK},
+		{"172.16.0.1:1234", "10.6.6.6", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("GET", "/postgrest/tasks", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, tt.status, rec.Code, tt.remoteAddr+" "+tt.xff)
+	}
+}
+
+func TestIPFilterFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "effective-ipfilter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	allowFile := filepath.Join(dir, "allow.txt")
+	require.NoError(t, ioutil.WriteFile(allowFile, []byte(
+		"# Office\n10.0.0.0/8\n\n192.168.1.1, 192.168.1.2  # VPN\n"), 0644))
+
+	cfg := testConfig()
+	cfg.IPAllowlistFile = allowFile
+	cfg.IPDenylist, _ = parseIPNets("10.6.6.6")
+	f, err := NewIPFilter(cfg)
+	require.NoError(t, err)
+	assert.True(t, f.Allowed("10.1.2.3"))
+	assert.True(t, f.Allowed("192.168.1.2"))
+	assert.False(t, f.Allowed("192.168.1.3"))
+	assert.False(t, f.Allowed("10.6.6.6"))
+
+	badFile := filepath.Join(dir, "bad.txt")
+	require.NoError(t, ioutil.WriteFile(badFile, []byte("10.0.0.0/8\nlocalhost\n"), 0644))
+	cfg.IPDenylistFile = badFile
+	_, err = NewIPFilter(cfg)
+	assert.EqualError(t, err, "Error parsing "+badFile+
+		", line 2: invalid IP address `localhost`")
+}
+
+func TestIPFilterRoutes(t *testing.T) {
+	cfg := testConfig()
+	cfg.IPAllowlist, _ = parseIPNets("10.0.0.0/8")
+	r := mustNewRouterConfig(cfg, NewMapper())
+
+	for path, status := range map[string]int{
+		"/postgrest/tasks": http.StatusForbidden,
+		// Everything else is unaffected
+		"/api/version": http.StatusOK,
+		"/healthz":     http.StatusOK,
+	} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "203.0.113.7:1234"
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, status, rec.Code, path)
+	}
+}
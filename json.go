@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -10,24 +11,50 @@ import (
 
 const contentTypeJSON = "application/json; charset=utf-8"
 
+// contentTypeAuthToken marks a login response: a miniLock-encrypted
+// authTokenResponse
+const contentTypeAuthToken = "application/x-minilock; payload=authtoken+json"
+
+// contentTypeLoginError marks a failed login's errorResponse,
+// miniLock-encrypted to the client (see writeLoginError)
+const contentTypeLoginError = "application/x-minilock; payload=error+json"
+
+// errorResponse is the body of every JSON error the server returns
+type errorResponse struct {
+	Error     string `json:"error"`
+	Status    int    `json:"status"`
+	RequestID string `json:"requestID,omitempty"`
+}
+
 func WriteError(w http.ResponseWriter, errStr string, secretErr error) error {
 	return WriteErrorStatus(w, errStr, secretErr, http.StatusInternalServerError)
 }
 
+// WriteErrorStatus responds with errStr and status as JSON, including
+// the request ID if AccessLog assigned one. secretErr is only logged.
 func WriteErrorStatus(w http.ResponseWriter, errStr string, secretErr error, status int) error {
 	log.Debugf("Real error: %v", secretErr)
 	log.Debugf("Returning HTTP %d w/error: %q", status, errStr)
 
+	body, err := json.Marshal(errorResponse{
+		Error:     errStr,
+		Status:    status,
+		RequestID: w.Header().Get("X-Request-Id"),
+	})
+	if err != nil {
+		return err
+	}
+
 	w.Header().Set("Content-Type", contentTypeJSON)
 	w.WriteHeader(status)
-	_, err := fmt.Fprintf(w, `{"error":%q}`, errStr)
+	_, err = w.Write(body)
 	return err
 }
 
 // WebSockets
 
 func WSWriteError(wsConn *websocket.Conn, errStr string, secretErr error) error {
-	log.Debugf("WebSocket error: " + secretErr.Error())
+	log.Debugf("WebSocket error: %v", secretErr)
 
 	wsErr := fmt.Sprintf(`{"error":%q}`, errStr)
 	err := wsConn.WriteMessage(websocket.TextMessage, []byte(wsErr))
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	require.NoError(t, WriteError(rec, "Something broke", errors.New("secret")))
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, contentTypeJSON, rec.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"error":"Something broke","status":500}`, rec.Body.String())
+	assert.NotContains(t, rec.Body.String(), "secret")
+}
+
+func TestWriteErrorStatus(t *testing.T) {
+	rec := httptest.NewRecorder()
+	require.NoError(t, WriteErrorStatus(rec, `Bad "input"`, nil, http.StatusBadRequest))
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, contentTypeJSON, rec.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"error":"Bad \"input\"","status":400}`, rec.Body.String())
+}
+
+func TestWriteErrorRequestID(t *testing.T) {
+	logger, _ := newTestLogger()
+	h := AccessLog(logger, nil)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		WriteErrorStatus(w, "Nope", nil, http.StatusForbidden)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	var body errorResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, "Nope", body.Error)
+	assert.Equal(t, http.StatusForbidden, body.Status)
+	assert.NotEmpty(t, body.RequestID)
+	assert.Equal(t, rec.Header().Get("X-Request-Id"), body.RequestID)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const POSTGREST_JWT_TTL = 5 * time.Minute
+
+const postgrestJWTKey contextKey = "postgrest_jwt"
+
+var jwtHeaderHS256 = base64.RawURLEncoding.EncodeToString(
+	[]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+type postgrestClaims struct {
+	MinilockID string `json:"minilock_id"`
+	IssuedAt   int64  `json:"iat"`
+	Expires    int64  `json:"exp"`
+}
+
+// newPostgrestJWT returns an HS256-signed JWT, valid for
+// POSTGREST_JWT_TTL, whose minilock_id claim lets Postgres' row-level
+// security policies know who's making the request.
+func newPostgrestJWT(secret []byte, mID string, now time.Time) (string, error) {
+	claims, err := json.Marshal(postgrestClaims{
+		MinilockID: mID,
+		IssuedAt:   now.Unix(),
+		Expires:    now.Add(POSTGREST_JWT_TTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := jwtHeaderHS256 + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	sig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	return signingInput + "." + sig, nil
+}
+
+// postgrestJWTAuth only lets through requests that one of
+// authenticators accepts (e.g., by auth token or API key), swapping
+// their credentials for a PostgREST JWT before passing the request on
+// to h.
+func postgrestJWTAuth(h http.Handler, secret []byte, authenticators ...Authenticator) http.Handler {
+	return RequireAuth(authenticators...)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mID := RequestIdentity(req)
+
+		jwt, err := newPostgrestJWT(secret, mID, time.Now())
+		if err != nil {
+			WriteError(w, "Error authorizing you to the database; sorry!", err)
+			return
+		}
+
+		// The proxy strips the client's own auth headers and sends
+		// this instead
+		ctx := context.WithValue(req.Context(), postgrestJWTKey, jwt)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	}))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostgrestJWTAuth(t *testing.T) {
+	authHeaders := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authHeaders <- req.Header.Get("Authorization")
+		w.Write([]byte("[]"))
+	}))
+	defer upstream.Close()
+
+	cfg := testConfig()
+	cfg.PostgrestBaseURL = upstream.URL
+	cfg.PostgrestJWTSecret = "test secret"
+
+	router := mustNewRouterConfig(cfg, NewMapper())
+
+	// Unauthenticated
+	testURL(t, "GET", "/postgrest/tasks", nil, router,
+		http.StatusUnauthorized, "")
+	headers := http.Header{"Authorization": []string{"bogus"}}
+	testURL(t, "GET", "/postgrest/tasks", headers, router,
+		http.StatusUnauthorized, "")
+
+	// Authenticated
+	keypair := newTestKeypair(t)
+	authToken := testLogin(t, router, keypair)
+
+	headers = http.Header{"Authorization": []string{"Bearer " + authToken}}
+	testURL(t, "GET", "/postgrest/tasks", headers, router, http.StatusOK, "[]")
+
+	authHeader := <-authHeaders
+	assert.NotContains(t, authHeader, authToken)
+	require.True(t, strings.HasPrefix(authHeader, "Bearer "), authHeader)
+
+	claims := verifyTestJWT(t, []byte(cfg.PostgrestJWTSecret),
+		strings.TrimPrefix(authHeader, "Bearer "))
+	assert.Equal(t, testMinilockID(t, keypair), claims.MinilockID)
+	assert.InDelta(t, time.Now().Add(POSTGREST_JWT_TTL).Unix(), claims.Expires, 5)
+}
+
+func verifyTestJWT(t *testing.T, secret []byte, jwt string) postgrestClaims {
+	parts := strings.Split(jwt, ".")
+	require.Len(t, parts, 3)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	require.True(t, hmac.Equal(mac.Sum(nil), sig), "bad JWT signature")
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+
+	var claims postgrestClaims
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	return claims
+}
+
+func TestPostgrestJWTSecretRequiredInProd(t *testing.T) {
+	cfg := testConfig()
+	cfg.Prod = true
+	_, err := NewRouter(cfg, NewMapper(), testServerKeys, nil, nil, nil, nil, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "POSTGREST_JWT_SECRET")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// LoginLockout locks out keys (miniLock IDs and client IPs) that fail
+// challenge logins too often. Once a key has failed `threshold` times,
+// each further failure locks it out for twice as long as the last,
+// starting at baseDelay and capped at maxDelay. A key's failures are
+// forgotten when it succeeds, or after cooldown without any.
+type LoginLockout struct {
+	lock     sync.Mutex
+	failures map[string]*loginFailures
+
+	threshold int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	cooldown  time.Duration
+	now       func() time.Time
+
+	lastSweep time.Time
+}
+
+type loginFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func NewLoginLockout(threshold int, baseDelay, maxDelay, cooldown time.Duration) *LoginLockout {
+	return &LoginLockout{
+		failures:  map[string]*loginFailures{},
+		threshold: threshold,
+		baseDelay: baseDelay,
+		maxDelay:  maxDelay,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Check reports whether none of keys are locked out, and if one is,
+// how long until it won't be.
+func (lo *LoginLockout) Check(keys ...string) (ok bool, retryAfter time.Duration) {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+
+	now := lo.now()
+	for _, key := range keys {
+		f := lo.get(key, now)
+		if f != nil && now.Before(f.lockedUntil) {
+			if wait := f.lockedUntil.Sub(now); wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+	return retryAfter == 0, retryAfter
+}
+
+// Fail records a failure by each of keys, locking out those that have
+// failed too often.
+func (lo *LoginLockout) Fail(keys ...string) {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+
+	now := lo.now()
+	lo.sweep(now)
+
+	for _, key := range keys {
+		f := lo.get(key, now)
+		if f == nil {
+			f = &loginFailures{}
+			lo.failures[key] = f
+		}
+		f.count++
+		f.lastFailure = now
+
+		if lo.threshold > 0 && f.count >= lo.threshold {
+			f.lockedUntil = now.Add(lo.delay(f.count - lo.threshold))
+		}
+	}
+}
+
+// Succeed forgets the failures of each of keys.
+func (lo *LoginLockout) Succeed(keys ...string) {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+
+	for _, key := range keys {
+		delete(lo.failures, key)
+	}
+}
+
+// delay returns how long the nth lockout (counting from 0) lasts.
+func (lo *LoginLockout) delay(n int) time.Duration {
+	delay := float64(lo.baseDelay) * math.Pow(2, float64(n))
+	if delay > float64(lo.maxDelay) {
+		return lo.maxDelay
+	}
+	return time.Duration(delay)
+}
+
+// get returns key's failures, or nil if it has none that are recent.
+// Must be called with lo.lock held.
+func (lo *LoginLockout) get(key string, now time.Time) *loginFailures {
+	f, ok := lo.failures[key]
+	if !ok {
+		return nil
+	}
+	if lo.cooledDown(f, now) {
+		delete(lo.failures, key)
+		return nil
+	}
+	return f
+}
+
+func (lo *LoginLockout) cooledDown(f *loginFailures, now time.Time) bool {
+	return !now.Before(f.lockedUntil) && now.Sub(f.lastFailure) >= lo.cooldown
+}
+
+// sweep forgets keys that have cooled down, so that the map doesn't
+// grow without bound. Must be called with lo.lock held.
+func (lo *LoginLockout) sweep(now time.Time) {
+	if now.Sub(lo.lastSweep) < lo.cooldown {
+		return
+	}
+	lo.lastSweep = now
+
+	for key, f := range lo.failures {
+		if lo.cooledDown(f, now) {
+			delete(lo.failures, key)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLoginLockout(now *time.Time) *LoginLockout {
+	lo := NewLoginLockout(3, time.Minute, 10*time.Minute, time.Hour)
+	lo.now = func() time.Time { return *now }
+	return lo
+}
+
+func TestLoginLockout(t *testing.T) {
+	now := time.Now()
+	lo := newTestLoginLockout(&now)
+
+	for i := 0; i < 2; i++ {
+		lo.Fail("ip:192.0.2.1")
+		ok, _ := lo.Check("ip:192.0.2.1")
+		require.True(t, ok, "locked out after %d failures", i+1)
+	}
+
+	lo.Fail("ip:192.0.2.1")
+	ok, retryAfter := lo.Check("ip:192.0.2.1")
+	assert.False(t, ok)
+	assert.Equal(t, time.Minute, retryAfter)
+
+	// Other keys aren't affected, but any locked key locks out the
+	// attempt
+	ok, _ = lo.Check("ip:192.0.2.2")
+	assert.True(t, ok)
+	ok, _ = lo.Check("ip:192.0.2.2", "ip:192.0.2.1")
+	assert.False(t, ok)
+
+	now = now.Add(time.Minute)
+	ok, _ = lo.Check("ip:192.0.2.1")
+	assert.True(t, ok)
+
+	// Each further failure doubles the lockout, up to maxDelay
+	for _, want := range []time.Duration{2 * time.Minute, 4 * time.Minute,
+		8 * time.Minute, 10 * time.Minute, 10 * time.Minute} {
+		lo.Fail("ip:192.0.2.1")
+		_, retryAfter = lo.Check("ip:192.0.2.1")
+		assert.Equal(t, want, retryAfter)
+	}
+}
+
+func TestLoginLockoutCooldown(t *testing.T) {
+	now := time.Now()
+	lo := newTestLoginLockout(&now)
+
+	for i := 0; i < 3; i++ {
+		lo.Fail("minilock_id:abc")
+	}
+	ok, _ := lo.Check("minilock_id:abc")
+	require.False(t, ok)
+
+	// Still remembered once the lockout is over...
+	now = now.Add(30 * time.Minute)
+	lo.Fail("minilock_id:abc")
+	ok, retryAfter := lo.Check("minilock_id:abc")
+	assert.False(t, ok)
+	assert.Equal(t, 2*time.Minute, retryAfter)
+
+	// ...but forgotten after the cooldown
+	now = now.Add(time.Hour)
+	ok, _ = lo.Check("minilock_id:abc")
+	assert.True(t, ok)
+	lo.Fail("minilock_id:abc")
+	ok, _ = lo.Check("minilock_id:abc")
+	assert.True(t, ok)
+}
+
+func TestLoginLockoutSucceed(t *testing.T) {
+	now := time.Now()
+	lo := newTestLoginLockout(&now)
+
+	lo.Fail("minilock_id:abc")
+	lo.Fail("minilock_id:abc")
+	lo.Succeed("minilock_id:abc")
+
+	lo.Fail("minilock_id:abc")
+	ok, _ := lo.Check("minilock_id:abc")
+	assert.True(t, ok)
+}
+
+func TestLoginLockoutSweep(t *testing.T) {
+	now := time.Now()
+	lo := newTestLoginLockout(&now)
+
+	lo.Fail("ip:192.0.2.1")
+	now = now.Add(2 * time.Hour)
+	lo.Fail("ip:192.0.2.2")
+
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+	assert.Len(t, lo.failures, 1)
+}
+
+func TestChallengeLoginLockout(t *testing.T) {
+	cfg := testConfig()
+	cfg.LoginLockoutThreshold = 2
+	handler := mustNewRouterConfig(cfg, NewMapper())
+	keypair := newTestKeypair(t)
+
+	for i := 0; i < 2; i++ {
+		testChallenge(t, handler, keypair)
+		rec := postChallengeLogin(t, handler, keypair, "deadbeef")
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+
+	// Even the right response is rejected while locked out
+	nonce := testChallenge(t, handler, keypair)
+	rec := postChallengeLogin(t, handler, keypair, nonce)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "30", rec.Header().Get("Retry-After"))
+
+	// Another miniLock ID from the same IP is locked out, too
+	rec = postChallengeLogin(t, handler, newTestKeypair(t), "deadbeef")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Log level changes are tiny
+const maxLogLevelBodySize = 1 << 10
+
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+// GetLogLevel responds with the current log level, e.g.
+// {"level":"info"}.
+func GetLogLevel(w http.ResponseWriter, req *http.Request) {
+	writeLogLevel(w)
+}
+
+// SetLogLevel changes the log level to the one in the request body,
+// e.g. {"level":"debug"}, so that production can be debugged without
+// a restart.
+func SetLogLevel(w http.ResponseWriter, req *http.Request) {
+	var body logLevelBody
+	err := json.NewDecoder(http.MaxBytesReader(w, req.Body,
+		maxLogLevelBodySize)).Decode(&body)
+	if err != nil {
+		WriteErrorStatus(w, "Error parsing request body", err,
+			http.StatusBadRequest)
+		return
+	}
+	level, err := log.ParseLevel(body.Level)
+	if err != nil {
+		WriteErrorStatus(w, "Error: level must be one of panic, fatal,"+
+			" error, warning, info, or debug", err, http.StatusBadRequest)
+		return
+	}
+
+	// Logged before and after so that it shows up whichever way the
+	// level changes
+	log.Warnf("Changing log level from %s to %s", log.GetLevel(), level)
+	log.SetLevel(level)
+	log.Warnf("Log level changed to %s", level)
+
+	writeLogLevel(w)
+}
+
+func writeLogLevel(w http.ResponseWriter) {
+	body, _ := json.Marshal(logLevelBody{Level: log.GetLevel().String()})
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(body)
+}
+
+// OnLogLevelSignals makes logging one level more verbose every time
+// the process gets a SIGUSR1, and resets it to base on SIGUSR2, until
+// ctx is done.
+func OnLogLevelSignals(ctx context.Context, base log.Level) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case sig := <-sigs:
+				level := base
+				if sig == syscall.SIGUSR1 {
+					level = log.GetLevel()
+					if level < log.DebugLevel {
+						level++
+					}
+				}
+				log.SetLevel(level)
+				log.Warnf("Log level changed to %s by %s", level, sig)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureStdLog has the standard logger write to the returned buffer
+// at level until the test ends
+func captureStdLog(t *testing.T, level log.Level) *bytes.Buffer {
+	std := log.StandardLogger()
+	out, oldLevel := std.Out, log.GetLevel()
+	t.Cleanup(func() {
+		log.SetOutput(out)
+		log.SetLevel(oldLevel)
+	})
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetLevel(level)
+	return &buf
+}
+
+func TestLogLevelEndpoint(t *testing.T) {
+	buf := captureStdLog(t, log.InfoLevel)
+
+	cfg := testConfig()
+	cfg.BasicAuthUsername = "admin"
+	cfg.BasicAuthPassword = "correct horse battery staple"
+	router := mustNewRouterConfig(cfg, NewMapper())
+	setLevel := func(body string, creds bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/loglevel", strings.NewReader(body))
+		if creds {
+			req.SetBasicAuth(cfg.BasicAuthUsername, cfg.BasicAuthPassword)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	log.Debug("before")
+	assert.NotContains(t, buf.String(), "before")
+
+	rec := setLevel(`{"level":"debug"}`, false)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, log.InfoLevel, log.GetLevel())
+
+	rec = setLevel(`{"level":"debug"}`, true)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"level":"debug"}`, rec.Body.String())
+	log.Debug("after")
+	assert.Contains(t, buf.String(), "after")
+
+	rec = setLevel(`{"level":"verbose"}`, true)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, log.DebugLevel, log.GetLevel())
+
+	req := httptest.NewRequest("GET", "/api/loglevel", nil)
+	req.SetBasicAuth(cfg.BasicAuthUsername, cfg.BasicAuthPassword)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"level":"debug"}`, rec.Body.String())
+}
+
+func TestLogLevelEndpointWithoutAdminAuth(t *testing.T) {
+	testURL(t, "GET", "/api/loglevel", nil, mustNewRouter(NewMapper()),
+		http.StatusNotFound, "")
+}
+
+func TestOnLogLevelSignals(t *testing.T) {
+	captureStdLog(t, log.WarnLevel)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	OnLogLevelSignals(ctx, log.WarnLevel)
+
+	waitForLevel := func(level log.Level) {
+		deadline := time.Now().Add(5 * time.Second)
+		for log.GetLevel() != level && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		assert.Equal(t, level, log.GetLevel())
+	}
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+	waitForLevel(log.InfoLevel)
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+	waitForLevel(log.DebugLevel)
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR2))
+	waitForLevel(log.WarnLevel)
+}
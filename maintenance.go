@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often MaintenanceMode stats its sentinel file
+const MAINTENANCE_CHECK_INTERVAL = 3 * time.Second
+
+const maintenancePage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Down for maintenance</title>
+<style>body { font-family: sans-serif; text-align: center; margin-top: 15%; color: #333; }</style>
+</head>
+<body>
+<h1>We'll be right back</h1>
+<p>Effective is down for maintenance. Please try again in a few minutes.</p>
+</body>
+</html>
+`
+
+// MaintenanceMode takes the app offline, serving a 503 and a
+// maintenance page in place of every route but /healthz, whenever
+// it's forced on by config or its sentinel file exists.
+type MaintenanceMode struct {
+	forced     bool
+	file       string
+	retryAfter time.Duration
+	now        func() time.Time
+
+	lock      sync.Mutex
+	checkedAt time.Time
+	fileFound bool
+}
+
+func NewMaintenanceMode(cfg *Config) *MaintenanceMode {
+	return &MaintenanceMode{
+		forced:     cfg.Maintenance,
+		file:       cfg.MaintenanceFile,
+		retryAfter: cfg.MaintenanceRetryAfter,
+		now:        time.Now,
+	}
+}
+
+// Active reports whether the app is in maintenance mode. The sentinel
+// file is only checked every MAINTENANCE_CHECK_INTERVAL.
+func (mm *MaintenanceMode) Active() bool {
+	if mm.forced {
+		return true
+	}
+	if mm.file == "" {
+		return false
+	}
+
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+
+	now := mm.now()
+	if mm.checkedAt.IsZero() || now.Sub(mm.checkedAt) >= MAINTENANCE_CHECK_INTERVAL {
+		_, err := os.Stat(mm.file)
+		mm.fileFound = err == nil
+		mm.checkedAt = now
+	}
+	return mm.fileFound
+}
+
+func (mm *MaintenanceMode) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// So orchestrators don't restart us
+		if req.URL.Path == "/healthz" || !mm.Active() {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Retry-After",
+			strconv.Itoa(int(mm.retryAfter/time.Second)))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if req.Method != "HEAD" {
+			w.Write([]byte(maintenancePage))
+		}
+	})
+}
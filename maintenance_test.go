@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceModeFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "effective-maintenance")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	cfg := testConfig()
+	cfg.MaintenanceFile = filepath.Join(tmpDir, "MAINTENANCE")
+	mm := NewMaintenanceMode(cfg)
+	now := time.Now()
+	mm.now = func() time.Time { return now }
+
+	h := mm.Middleware(mustNewRouterConfig(cfg, NewMapper()))
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, get("/api/sessions").Code)
+
+	// Going down for maintenance...
+	require.NoError(t, ioutil.WriteFile(cfg.MaintenanceFile, nil, 0644))
+
+	// ...isn't noticed until the file is checked again
+	assert.Equal(t, http.StatusUnauthorized, get("/api/sessions").Code)
+	now = now.Add(MAINTENANCE_CHECK_INTERVAL)
+
+	for _, url := range []string{"/api/sessions", "/dashboard", "/readyz"} {
+		rec := get(url)
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code, url)
+		assert.Equal(t, "300", rec.Header().Get("Retry-After"))
+		assert.Contains(t, rec.Body.String(), "down for maintenance")
+	}
+	assert.Equal(t, http.StatusOK, get("/healthz").Code)
+
+	// Back up
+	require.NoError(t, os.Remove(cfg.MaintenanceFile))
+	now = now.Add(MAINTENANCE_CHECK_INTERVAL)
+	assert.Equal(t, http.StatusUnauthorized, get("/api/sessions").Code)
+}
+
+func TestMaintenanceModeForced(t *testing.T) {
+	cfg, err := ParseConfig([]string{"-maintenance-retry-after", "1m"},
+		testEnv(map[string]string{"MAINTENANCE_MODE": "true"}))
+	require.NoError(t, err)
+
+	srv, err := NewServer(cfg, NewMapper(), testServerKeys, nil)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/dashboard", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+
+	rec = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Upper bounds, in seconds, of the request latency histogram buckets
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects request counts and latencies and serves them, along
+// with a few gauges, in the Prometheus text exposition format.
+type Metrics struct {
+	lock      sync.Mutex
+	requests  map[requestLabels]uint64
+	latencies map[requestLabels]*histogram
+
+	inFlight int64
+	store    Store
+	// If set, its limit and rejections are reported, too
+	concurrency *ConcurrencyLimiter
+}
+
+type requestLabels struct {
+	method, route, status string
+}
+
+type histogram struct {
+	counts []uint64 // counts[i] is the # of observations <= latencyBuckets[i]
+	count  uint64
+	sum    float64
+}
+
+func NewMetrics(m Store) *Metrics {
+	return &Metrics{
+		requests:  map[requestLabels]uint64{},
+		latencies: map[requestLabels]*histogram{},
+		store:     m,
+	}
+}
+
+const routeLabelKey contextKey = "route_label"
+
+// Middleware records the outcome of every request passing through
+// it. Requests that don't match any route instrumented by
+// labelRoutes are labeled with the route "unmatched".
+func (mt *Metrics) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&mt.inFlight, 1)
+		defer atomic.AddInt64(&mt.inFlight, -1)
+
+		start := time.Now()
+
+		route := new(string)
+		req = req.WithContext(context.WithValue(req.Context(),
+			routeLabelKey, route))
+
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, req)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if *route == "" {
+			*route = "unmatched"
+		}
+
+		mt.observe(requestLabels{req.Method, *route, strconv.Itoa(rec.status)},
+			time.Since(start))
+	})
+}
+
+func (mt *Metrics) observe(labels requestLabels, dur time.Duration) {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+
+	mt.requests[labels]++
+
+	hist := mt.latencies[labels]
+	if hist == nil {
+		hist = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		mt.latencies[labels] = hist
+	}
+	secs := dur.Seconds()
+	for i, bound := range latencyBuckets {
+		if secs <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += secs
+}
+
+// labelRoutes wraps the handler of every route registered on r so
+// that Metrics.Middleware can label requests by route template
+// (e.g. "/postgrest") rather than by raw path, which would make for
+// unbounded label cardinality.
+func labelRoutes(r *mux.Router) {
+	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if h := route.GetHandler(); h != nil {
+			route.Handler(routeLabeler(h))
+		}
+		return nil
+	})
+}
+
+func routeLabeler(h http.Handler) http.Handler {
+	return labeledRoute{h}
+}
+
+// labeledRoute is a route's handler as wrapped by labelRoutes.
+type labeledRoute struct {
+	h http.Handler
+}
+
+func (lr labeledRoute) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if label, ok := req.Context().Value(routeLabelKey).(*string); ok {
+		if route := mux.CurrentRoute(req); route != nil {
+			*label, _ = route.GetPathTemplate()
+		}
+	}
+	lr.h.ServeHTTP(w, req)
+}
+
+// unwrapRoute returns the handler a route was registered with, from
+// under labelRoutes' and auditRoutes' wrappers.
+func unwrapRoute(h http.Handler) http.Handler {
+	for {
+		switch wrapped := h.(type) {
+		case labeledRoute:
+			h = wrapped.h
+		case auditedRoute:
+			h = wrapped.h
+		default:
+			return h
+		}
+	}
+}
+
+func (mt *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	var b strings.Builder
+
+	mt.lock.Lock()
+	labelSets := make([]requestLabels, 0, len(mt.requests))
+	for labels := range mt.requests {
+		labelSets = append(labelSets, labels)
+	}
+	sort.Slice(labelSets, func(i, j int) bool {
+		return labelSets[i].String() < labelSets[j].String()
+	})
+
+	b.WriteString("# HELP effective_http_requests_total Number of HTTP requests handled.\n")
+	b.WriteString("# TYPE effective_http_requests_total counter\n")
+	for _, labels := range labelSets {
+		fmt.Fprintf(&b, "effective_http_requests_total{%s} %d\n", labels,
+			mt.requests[labels])
+	}
+
+	b.WriteString("# HELP effective_http_request_duration_seconds HTTP request latencies.\n")
+	b.WriteString("# TYPE effective_http_request_duration_seconds histogram\n")
+	for _, labels := range labelSets {
+		hist := mt.latencies[labels]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(&b, "effective_http_request_duration_seconds_bucket{%s,le=%q} %d\n",
+				labels, strconv.FormatFloat(bound, 'g', -1, 64), hist.counts[i])
+		}
+		fmt.Fprintf(&b, "effective_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n",
+			labels, hist.count)
+		fmt.Fprintf(&b, "effective_http_request_duration_seconds_sum{%s} %g\n",
+			labels, hist.sum)
+		fmt.Fprintf(&b, "effective_http_request_duration_seconds_count{%s} %d\n",
+			labels, hist.count)
+	}
+	mt.lock.Unlock()
+
+	b.WriteString("# HELP effective_http_requests_in_flight Number of HTTP requests currently being handled.\n")
+	b.WriteString("# TYPE effective_http_requests_in_flight gauge\n")
+	fmt.Fprintf(&b, "effective_http_requests_in_flight %d\n",
+		atomic.LoadInt64(&mt.inFlight))
+
+	if cl := mt.concurrency; cl != nil {
+		b.WriteString("# HELP effective_http_requests_in_flight_limit Most HTTP requests handled at once.\n")
+		b.WriteString("# TYPE effective_http_requests_in_flight_limit gauge\n")
+		fmt.Fprintf(&b, "effective_http_requests_in_flight_limit %d\n", cl.Limit())
+		b.WriteString("# HELP effective_http_requests_rejected_total Number of HTTP requests turned away for being over the limit.\n")
+		b.WriteString("# TYPE effective_http_requests_rejected_total counter\n")
+		fmt.Fprintf(&b, "effective_http_requests_rejected_total %d\n", cl.Rejected())
+	}
+
+	// Only the in-memory store can count its tokens cheaply
+	if counter, ok := mt.store.(interface{ Len() int }); ok {
+		b.WriteString("# HELP effective_auth_tokens_active Number of auth tokens currently mapped.\n")
+		b.WriteString("# TYPE effective_auth_tokens_active gauge\n")
+		fmt.Fprintf(&b, "effective_auth_tokens_active %d\n", counter.Len())
+	}
+
+	w.Write([]byte(b.String()))
+}
+
+func (labels requestLabels) String() string {
+	return fmt.Sprintf(`method="%s",route="%s",status="%s"`,
+		escapeLabel(labels.method), escapeLabel(labels.route),
+		escapeLabel(labels.status))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMapper()
+	srv, err := NewServer(testConfig(), m, testServerKeys, nil)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	testLogin(t, srv.Handler, newTestKeypair(t))
+	for _, path := range []string{"/api/challenge", "/api/challenge", "/api/logout",
+		"/pursuance/1", "/pursuance/2"} {
+		resp, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	metrics := string(body)
+
+	for _, line := range []string{
+		`effective_http_requests_total{method="GET",route="/api/challenge",status="200"} 1`,
+		`effective_http_requests_total{method="POST",route="/api/login",status="200"} 1`,
+		`effective_http_requests_total{method="GET",route="/api/challenge",status="400"} 2`,
+		`effective_http_requests_total{method="GET",route="/api/logout",status="401"} 1`,
+		// By route template, not raw path
+		`effective_http_requests_total{method="GET",route="/",status="200"} 2`,
+		`effective_http_request_duration_seconds_count{method="GET",route="/api/challenge",status="400"} 2`,
+		`effective_http_request_duration_seconds_bucket{method="GET",route="/api/challenge",status="400",le="+Inf"} 2`,
+		`effective_http_requests_in_flight 1`,
+		`effective_auth_tokens_active 1`,
+	} {
+		assert.Contains(t, metrics, line+"\n")
+	}
+	assert.False(t, strings.Contains(metrics, "/pursuance/1"))
+}
+
+func TestMetricsUnmatched(t *testing.T) {
+	metrics := NewMetrics(NewMapper())
+	h := metrics.Middleware(http.NotFoundHandler())
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/x", nil))
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rec.Body.String(),
+		`effective_http_requests_total{method="DELETE",route="unmatched",status="404"} 1`)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+type contextKey string
+
+const requestIDKey contextKey = "request_id"
+
+// statusRecorder wraps an http.ResponseWriter to remember the status
+// code and number of bytes written.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += n
+	return n, err
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets WebSocket upgrades through
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("ResponseWriter doesn't support hijacking")
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return hj.Hijack()
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// AccessLog returns middleware that logs every request to logger,
+// tagging each with a request ID that's also returned to the client
+// in the X-Request-Id header.
+//
+// If an AccessLog further out in the middleware chain has already
+// tagged the request, the request is passed through without being
+// logged twice.
+func AccessLog(logger *log.Logger, trustedProxies []net.IPNet) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if requestID(req) != "" {
+				h.ServeHTTP(w, req)
+				return
+			}
+
+			start := time.Now()
+
+			reqID := newRequestID()
+			w.Header().Set("X-Request-Id", reqID)
+			req = req.WithContext(context.WithValue(req.Context(),
+				requestIDKey, reqID))
+
+			rec := &statusRecorder{ResponseWriter: w}
+			h.ServeHTTP(rec, req)
+
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+
+			logger.WithFields(log.Fields{
+				"request_id": reqID,
+				"method":     req.Method,
+				"path":       req.URL.Path,
+				"status":     rec.status,
+				"size":       rec.size,
+				"duration":   time.Since(start).String(),
+				"remote_ip":  clientIP(req, trustedProxies),
+			}).Info("HTTP request")
+		})
+	}
+}
+
+// Recover returns middleware that turns a panic further in (e.g., in
+// the PostgREST proxy or one of its hooks) into a 500 with a JSON
+// body, logging the panic and its stack to logger, rather than letting
+// net/http drop the connection. It belongs outermost, so that it sees
+// the X-Request-Id an AccessLog inside it set.
+//
+// If the response was already under way there's no taking it back, so
+// the connection is aborted instead, lest the client mistake what it
+// got for the whole thing.
+func Recover(logger *log.Logger) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			rec := &statusRecorder{ResponseWriter: w}
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				// How handlers deliberately abort a response
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+
+				logger.WithFields(log.Fields{
+					"request_id": w.Header().Get("X-Request-Id"),
+					"method":     req.Method,
+					"path":       req.URL.Path,
+					"panic":      fmt.Sprint(p),
+					"stack":      string(debug.Stack()),
+				}).Error("Recovered from panic")
+
+				if rec.status != 0 {
+					panic(http.ErrAbortHandler)
+				}
+				// Describing the response we no longer have
+				for _, name := range []string{"Content-Length",
+					"Content-Encoding", "Content-Range", "Content-Disposition",
+					"ETag", "Last-Modified"} {
+					w.Header().Del(name)
+				}
+				w.Header().Set("Cache-Control", "no-store")
+				WriteError(w, "Internal server error; sorry!",
+					fmt.Errorf("panic: %v", p))
+			}()
+			h.ServeHTTP(rec, req)
+		})
+	}
+}
+
+// requestID returns the ID AccessLog assigned to req, if any.
+func requestID(req *http.Request) string {
+	reqID, _ := req.Context().Value(requestIDKey).(string)
+	return reqID
+}
+
+func newRequestID() string {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return id.String()
+}
+
+// SlowRequests returns middleware that warns, via logger, about
+// requests still in flight after threshold, e.g. because PostgREST is
+// hanging, and again once they finish, long before any timeout would
+// fire. Upgrade requests (e.g., WebSockets) are long-lived by design,
+// so they're left alone.
+func SlowRequests(logger *log.Logger, threshold time.Duration) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if upgradeType(req.Header) != "" {
+				h.ServeHTTP(w, req)
+				return
+			}
+
+			start := time.Now()
+			fields := func() log.Fields {
+				return log.Fields{
+					"request_id": requestID(req),
+					"method":     req.Method,
+					"path":       req.URL.Path,
+					"elapsed":    time.Since(start).String(),
+				}
+			}
+
+			fired := make(chan struct{})
+			timer := time.AfterFunc(threshold, func() {
+				defer close(fired)
+				logger.WithFields(fields()).Warn("Slow request still in flight")
+			})
+
+			rec := &statusRecorder{ResponseWriter: w}
+			h.ServeHTTP(rec, req)
+
+			if timer.Stop() {
+				return
+			}
+			<-fired
+
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			logger.WithFields(fields()).WithField("status", rec.status).
+				Warn("Slow request finished")
+		})
+	}
+}
+
+// ExtendDeadlines returns middleware that gives requests d to be read
+// and responded to, overriding the server's ReadTimeout and
+// WriteTimeout, e.g. for routes that transfer large bodies. Upgrade
+// requests (e.g., WebSockets) are long-lived, so their deadlines are
+// cleared instead.
+func ExtendDeadlines(d time.Duration) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			deadline := time.Now().Add(d)
+			if upgradeType(req.Header) != "" {
+				deadline = time.Time{}
+			}
+			rc := http.NewResponseController(w)
+			if err := rc.SetReadDeadline(deadline); err != nil {
+				log.Debugf("Error extending read deadline: %v", err)
+			}
+			if err := rc.SetWriteDeadline(deadline); err != nil {
+				log.Debugf("Error extending write deadline: %v", err)
+			}
+			h.ServeHTTP(w, req)
+		})
+	}
+}
+
+// PolicyHeaders returns middleware that sets the Permissions-Policy,
+// Cross-Origin-Opener-Policy, and Cross-Origin-Resource-Policy headers
+// configured in cfg, skipping any that are empty.
+func PolicyHeaders(cfg *Config) func(h http.Handler) http.Handler {
+	headers := map[string]string{
+		"Permissions-Policy":           cfg.PermissionsPolicy,
+		"Cross-Origin-Opener-Policy":   cfg.CrossOriginOpenerPolicy,
+		"Cross-Origin-Resource-Policy": cfg.CrossOriginResourcePolicy,
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			for name, val := range headers {
+				if val != "" {
+					w.Header().Set(name, val)
+				}
+			}
+			h.ServeHTTP(w, req)
+		})
+	}
+}
+
+const requestBodyKey contextKey = "request_body"
+
+// LimitRequestBody returns middleware that caps request bodies at max
+// bytes. Handlers reading past the cap, or reading at all if the
+// Content-Length is already too big, get an error for which
+// isBodyTooLarge is true, and should respond 413. Since nothing is
+// refused here, routes that need more can raise the cap with
+// RaiseRequestBodyLimit.
+func LimitRequestBody(max int64) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req = req.WithContext(context.WithValue(req.Context(),
+				requestBodyKey, req.Body))
+			req.Body = limitBody(w, req, req.Body, max)
+			h.ServeHTTP(w, req)
+		})
+	}
+}
+
+// limitBody caps body, that of req, at max bytes, failing on the first
+// read if req's Content-Length is already over.
+func limitBody(w http.ResponseWriter, req *http.Request, body io.ReadCloser, max int64) io.ReadCloser {
+	if req.ContentLength > max {
+		return tooLargeBody{body, &http.MaxBytesError{Limit: max}}
+	}
+	return http.MaxBytesReader(w, body, max)
+}
+
+// tooLargeBody is a request body known to be too large to read any of.
+type tooLargeBody struct {
+	io.Closer
+	err error
+}
+
+func (b tooLargeBody) Read([]byte) (int, error) {
+	return 0, b.err
+}
+
+// LimitRequestHeaders returns middleware that rejects requests with
+// more than max headers (counting each value of a repeated header)
+// with a 431, or lets everything through if max is 0. Their total size
+// is capped separately, by the server's MaxHeaderBytes.
+func LimitRequestHeaders(max int) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		if max <= 0 {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			n := 0
+			for _, vals := range req.Header {
+				n += len(vals)
+			}
+			if n > max {
+				WriteErrorStatus(w, "Error: too many request headers", nil,
+					http.StatusRequestHeaderFieldsTooLarge)
+				return
+			}
+			h.ServeHTTP(w, req)
+		})
+	}
+}
+
+// RaiseRequestBodyLimit returns middleware that replaces the cap set
+// by LimitRequestBody with max, e.g. for uploads, responding 413 up
+// front if the Content-Length is over even that.
+func RaiseRequestBodyLimit(max int64) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, ok := req.Context().Value(requestBodyKey).(io.ReadCloser)
+			if !ok {
+				body = req.Body
+			}
+			if req.ContentLength > max {
+				WriteErrorStatus(w, "Error: request body too large", nil,
+					http.StatusRequestEntityTooLarge)
+				return
+			}
+			req.Body = limitBody(w, req, body, max)
+			h.ServeHTTP(w, req)
+		})
+	}
+}
+
+// isBodyTooLarge reports whether err came from reading past a request
+// body size limit.
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
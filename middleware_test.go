@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLogger() (*log.Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.Out = &buf
+	logger.Formatter = &log.JSONFormatter{}
+	return logger, &buf
+}
+
+func TestAccessLog(t *testing.T) {
+	logger, buf := newTestLogger()
+
+	h := AccessLog(logger, nil)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.NotEmpty(t, requestID(req))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+
+	req := httptest.NewRequest("POST", "/api/things?x=1", nil)
+	req.RemoteAddr = "203.0.113.7:54321"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	reqID := rec.Header().Get("X-Request-Id")
+	require.NotEmpty(t, reqID)
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+
+	assert.Equal(t, reqID, entry["request_id"])
+	assert.Equal(t, "POST", entry["method"])
+	assert.Equal(t, "/api/things", entry["path"])
+	assert.Equal(t, float64(http.StatusCreated), entry["status"])
+	assert.Equal(t, float64(len("hello")), entry["size"])
+	assert.Equal(t, "203.0.113.7", entry["remote_ip"])
+	assert.NotEmpty(t, entry["duration"])
+}
+
+func TestAccessLogNested(t *testing.T) {
+	logger, buf := newTestLogger()
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	h := AccessLog(logger, nil)(AccessLog(logger, nil)(ok))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+	assert.Len(t, rec.Header()["X-Request-Id"], 1)
+}
+
+func TestSlowRequests(t *testing.T) {
+	logger, buf := newTestLogger()
+
+	release := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusAccepted)
+	})
+	accessLogger, _ := newTestLogger()
+	h := AccessLog(accessLogger, nil)(SlowRequests(logger, 20*time.Millisecond)(slow))
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/postgrest/tasks", nil))
+		done <- rec
+	}()
+
+	// Warned about while still in flight...
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	rec := <-done
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var inFlight, finished map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &inFlight))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &finished))
+
+	assert.Equal(t, "Slow request still in flight", inFlight["msg"])
+	assert.Equal(t, "warning", inFlight["level"])
+	assert.Equal(t, "GET", inFlight["method"])
+	assert.Equal(t, "/postgrest/tasks", inFlight["path"])
+	assert.Equal(t, rec.Header().Get("X-Request-Id"), inFlight["request_id"])
+	warnedAt, err := time.ParseDuration(inFlight["elapsed"].(string))
+	require.NoError(t, err)
+	assert.True(t, warnedAt >= 20*time.Millisecond, "elapsed %v", warnedAt)
+
+	// ...and again once finished
+	assert.Equal(t, "Slow request finished", finished["msg"])
+	assert.Equal(t, float64(http.StatusAccepted), finished["status"])
+	elapsed, err := time.ParseDuration(finished["elapsed"].(string))
+	require.NoError(t, err)
+	assert.True(t, elapsed > warnedAt, "elapsed %v", elapsed)
+
+	// Fast requests aren't logged
+	buf.Reset()
+	fast := SlowRequests(logger, time.Second)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	fast.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.Empty(t, buf.String())
+}
+
+func TestExtendDeadlines(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	get := func(h http.Handler) (string, error) {
+		ts := httptest.NewUnstartedServer(h)
+		ts.Config.WriteTimeout = 100 * time.Millisecond
+		ts.Start()
+		defer ts.Close()
+
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	// The server's WriteTimeout cuts off the response...
+	_, err := get(slow)
+	assert.Error(t, err)
+
+	// ...unless the route has been given longer
+	body, err := get(ExtendDeadlines(time.Second)(slow))
+	require.NoError(t, err)
+	assert.Equal(t, "done", body)
+}
+
+func TestPolicyHeaders(t *testing.T) {
+	get := func(cfg *Config) http.Header {
+		h := securityHeaders(cfg, NewCSPHolder(DefaultCSPConfig([]string{"localhost"}))).
+			ThenFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte("ok"))
+			})
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Header()
+	}
+
+	headers := get(testConfig())
+	assert.Equal(t, "geolocation=(), camera=(), microphone=()",
+		headers.Get("Permissions-Policy"))
+	assert.Equal(t, "same-origin", headers.Get("Cross-Origin-Opener-Policy"))
+	assert.Equal(t, "same-origin", headers.Get("Cross-Origin-Resource-Policy"))
+
+	cfg, err := ParseConfig([]string{
+		"-permissions-policy", "camera=(self)",
+		"-cross-origin-resource-policy", "cross-origin",
+		"-cross-origin-opener-policy", "",
+	}, testEnv(nil))
+	require.NoError(t, err)
+
+	headers = get(cfg)
+	assert.Equal(t, "camera=(self)", headers.Get("Permissions-Policy"))
+	assert.Equal(t, "cross-origin", headers.Get("Cross-Origin-Resource-Policy"))
+	_, ok := headers["Cross-Origin-Opener-Policy"]
+	assert.False(t, ok)
+}
+
+func TestSecurityHeadersDevServer(t *testing.T) {
+	srv, err := NewServer(testConfig(), NewMapper(), testServerKeys,
+		NewCSPHolder(DefaultCSPConfig(nil)))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	assert.Equal(t, "DENY", rec.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "nosniff", rec.Header().Get("X-Content-Type-Options"))
+	assert.Contains(t, rec.Header().Get("Content-Security-Policy"),
+		"script-src 'self'")
+	assert.Empty(t, rec.Header().Get("Strict-Transport-Security"))
+}
+
+func TestSecurityHeadersHSTS(t *testing.T) {
+	cfg := testConfig()
+	cfg.Prod = true
+	h := securityHeaders(cfg, nil).ThenFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	get := func(req *http.Request) http.Header {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Header()
+	}
+
+	// Only sent over TLS
+	headers := get(httptest.NewRequest("GET", "http://example.com/", nil))
+	assert.Empty(t, headers.Get("Strict-Transport-Security"))
+	assert.Equal(t, "DENY", headers.Get("X-Frame-Options"))
+	_, ok := headers["Content-Security-Policy"]
+	assert.False(t, ok)
+
+	headers = get(httptest.NewRequest("GET", "https://example.com/", nil))
+	assert.Equal(t, "max-age=31536000; includeSubDomains; preload",
+		headers.Get("Strict-Transport-Security"))
+
+	// Configured not to cover subdomains we don't control
+	cfg.HSTSIncludeSubDomains, cfg.HSTSPreload = false, false
+	cfg.HSTSMaxAge = 24 * time.Hour
+	h = securityHeaders(cfg, nil).ThenFunc(func(w http.ResponseWriter, req *http.Request) {})
+	headers = get(httptest.NewRequest("GET", "https://example.com/", nil))
+	assert.Equal(t, "max-age=86400", headers.Get("Strict-Transport-Security"))
+}
+
+func TestLimitRequestBody(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxRequestBodySize = 1024
+	srv, err := NewServer(cfg, NewMapper(), testServerKeys, nil)
+	require.NoError(t, err)
+
+	post := func(h http.Handler, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", CSP_REPORT_PATH, body)
+		req.Header.Set("Content-Type", "application/csp-report")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	report := `{"csp-report":{"document-uri":"https://example.com/","blocked-uri":"` +
+		strings.Repeat("a", 2048) + `"}}`
+
+	// Rejected up front by Content-Length...
+	rec := post(srv.Handler, strings.NewReader(report))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"status":413`)
+
+	// ...or once too much has been read, if the length isn't known
+	rec = post(srv.Handler, ioutil.NopCloser(strings.NewReader(report)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	// Routes can raise the limit, whether or not the length is known
+	echo := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, err := ioutil.ReadAll(req.Body)
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		fmt.Fprintf(w, "%d", len(b))
+	})
+	h := LimitRequestBody(1024)(RaiseRequestBodyLimit(4096)(echo))
+	for _, body := range []io.Reader{strings.NewReader(report),
+		ioutil.NopCloser(strings.NewReader(report))} {
+		rec = post(h, body)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, fmt.Sprint(len(report)), rec.Body.String())
+	}
+
+	// Past the raised limit, it's rejected up front
+	h = LimitRequestBody(1024)(RaiseRequestBodyLimit(2048)(echo))
+	rec = post(h, strings.NewReader(report))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"status":413`)
+
+	for _, body := range []io.Reader{strings.NewReader(report),
+		ioutil.NopCloser(strings.NewReader(report))} {
+		rec = post(LimitRequestBody(1024)(echo), body)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	}
+}
+
+func TestPostgrestMaxRequestBodySize(t *testing.T) {
+	var got int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		got = len(b)
+		w.Write([]byte("[]"))
+	}))
+	defer upstream.Close()
+
+	cfg := testConfig()
+	cfg.PostgrestBaseURL = upstream.URL
+	cfg.MaxRequestBodySize = 1024
+
+	post := func(cfg *Config, size int) int {
+		srv, err := NewServer(cfg, NewMapper(), testServerKeys, nil)
+		require.NoError(t, err)
+		req := httptest.NewRequest("POST", "/postgrest/tasks",
+			strings.NewReader(strings.Repeat("a", size)))
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(cfg, 2048))
+
+	cfg.PostgrestMaxRequestBodySize = 4096
+	assert.Equal(t, http.StatusOK, post(cfg, 2048))
+	assert.Equal(t, 2048, got)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(cfg, 8192))
+}
+
+func TestRecover(t *testing.T) {
+	logger, buf := newTestLogger()
+	accessLogger, _ := newTestLogger()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		panic("ModifyResponse blew up")
+	})
+	mux.HandleFunc("/partial", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte("half a resp"))
+		panic("mid-copy")
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("still up"))
+	})
+	ts := httptest.NewServer(Recover(logger)(AccessLog(accessLogger, nil)(mux)))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/panic")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, contentTypeJSON, resp.Header.Get("Content-Type"))
+
+	var errResp errorResponse
+	require.NoError(t, json.Unmarshal(body, &errResp))
+	assert.Equal(t, http.StatusInternalServerError, errResp.Status)
+	assert.NotContains(t, errResp.Error, "blew up")
+	reqID := resp.Header.Get("X-Request-Id")
+	require.NotEmpty(t, reqID)
+	assert.Equal(t, reqID, errResp.RequestID)
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, reqID, entry["request_id"])
+	assert.Equal(t, "/panic", entry["path"])
+	assert.Equal(t, "ModifyResponse blew up", entry["panic"])
+	assert.Contains(t, entry["stack"], "TestRecover")
+
+	// Too late for a 500, so the client sees the response cut short
+	resp, err = http.Get(ts.URL + "/partial")
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	assert.Error(t, err)
+
+	// The server carries on
+	for i := 0; i < 2; i++ {
+		resp, err = http.Get(ts.URL + "/ok")
+		require.NoError(t, err)
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "still up", string(body))
+	}
+}
+
+func TestLimitRequestHeaders(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxHeaderBytes = 4096
+	cfg.MaxRequestHeaders = 20
+	srv, err := NewServer(cfg, NewMapper(), testServerKeys, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 4096, srv.MaxHeaderBytes)
+
+	// Serve with srv itself, so that net/http enforces MaxHeaderBytes
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.Config = srv
+	ts.Start()
+	defer ts.Close()
+
+	get := func(header http.Header) int {
+		req, err := http.NewRequest("GET", ts.URL+"/api/ping", nil)
+		require.NoError(t, err)
+		req.Header = header
+		// net/http is laxer with requests on reused connections
+		req.Close = true
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, get(http.Header{"X-Small": {"ok"}}))
+
+	// Too big. (net/http allows 4096 bytes of slack on top.)
+	big := http.Header{"X-Big": {strings.Repeat("a", 10000)}}
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, get(big))
+
+	// Too many, even if small
+	many := http.Header{}
+	for i := 0; i < 25; i++ {
+		many.Add(fmt.Sprintf("X-Header-%d", i), "1")
+	}
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, get(many))
+
+	repeated := http.Header{"X-Repeated": strings.Split(strings.Repeat("1", 25), "")}
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, get(repeated))
+
+	// Unlimited
+	req := httptest.NewRequest("GET", "/api/ping", nil)
+	req.Header = many
+	rec := httptest.NewRecorder()
+	LimitRequestHeaders(0)(http.HandlerFunc(Ping)).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	OCSP_FETCH_TIMEOUT = 5 * time.Second
+	// Responses are refreshed once they're this close to expiring
+	OCSP_REFRESH_BEFORE = 24 * time.Hour
+	// How long to wait after a failed fetch before trying again
+	OCSP_RETRY_AFTER = 5 * time.Minute
+
+	maxOCSPResponseSize = 64 << 10
+)
+
+// ocspStapler wraps a GetCertificate function, stapling an OCSP
+// response to every cert that doesn't already have one. Responses are
+// fetched from the cert's OCSP responder and cached until shortly
+// before they expire.
+type ocspStapler struct {
+	getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	client  *http.Client
+	now     func() time.Time
+
+	lock    sync.Mutex
+	staples map[[32]byte]*ocspStaple // map[sha256(leaf)]*ocspStaple
+}
+
+type ocspStaple struct {
+	raw        []byte // nil if none could be fetched yet
+	nextUpdate time.Time
+	retryAt    time.Time
+	refreshing bool
+}
+
+func newOCSPStapler(getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *ocspStapler {
+	return &ocspStapler{
+		getCert: getCert,
+		client:  &http.Client{Timeout: OCSP_FETCH_TIMEOUT},
+		now:     time.Now,
+		staples: map[[32]byte]*ocspStaple{},
+	}
+}
+
+func (s *ocspStapler) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := s.getCert(hello)
+	if err != nil || cert == nil || len(cert.OCSPStaple) > 0 {
+		return cert, err
+	}
+
+	staple := s.staple(cert)
+	if staple == nil {
+		return cert, nil
+	}
+	// cert may be shared (e.g., cached by autocert), so staple a copy
+	stapled := *cert
+	stapled.OCSPStaple = staple
+	return &stapled, nil
+}
+
+// staple returns a valid OCSP response for cert, or nil if there isn't
+// one (yet). The first handshake using cert waits for the response to
+// be fetched; later ones get the cached response while it's refreshed
+// in the background.
+func (s *ocspStapler) staple(cert *tls.Certificate) []byte {
+	if len(cert.Certificate) < 2 {
+		// Self-signed, or no issuer to check the response against
+		return nil
+	}
+	key := sha256.Sum256(cert.Certificate[0])
+	now := s.now()
+
+	s.lock.Lock()
+	st, ok := s.staples[key]
+	if !ok {
+		st = &ocspStaple{}
+		s.staples[key] = st
+	}
+	valid := st.raw != nil && now.Before(st.nextUpdate)
+	due := !valid || now.After(st.nextUpdate.Add(-OCSP_REFRESH_BEFORE))
+	fetch := due && !st.refreshing && !now.Before(st.retryAt)
+	if fetch {
+		st.refreshing = true
+	}
+	raw := st.raw
+	s.lock.Unlock()
+
+	switch {
+	case fetch && !valid:
+		return s.refresh(st, cert)
+	case fetch:
+		go s.refresh(st, cert)
+	}
+	if !valid {
+		return nil
+	}
+	return raw
+}
+
+func (s *ocspStapler) refresh(st *ocspStaple, cert *tls.Certificate) []byte {
+	raw, nextUpdate, err := s.fetch(cert)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st.refreshing = false
+	if err != nil {
+		log.Warnf("Error fetching OCSP response to staple: %v", err)
+		st.retryAt = s.now().Add(OCSP_RETRY_AFTER)
+		if st.raw != nil && s.now().Before(st.nextUpdate) {
+			return st.raw
+		}
+		return nil
+	}
+	log.Infof("OCSP stapling: got response valid until %v", nextUpdate)
+	st.raw, st.nextUpdate = raw, nextUpdate
+	return raw
+}
+
+// fetch gets and verifies a fresh OCSP response for cert's leaf.
+func (s *ocspStapler) fetch(cert *tls.Certificate) ([]byte, time.Time, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, time.Time{}, fmt.Errorf("Cert for %v has no OCSP responder",
+			leaf.DNSNames)
+	}
+
+	reqBody, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	resp, err := s.client.Post(leaf.OCSPServer[0], "application/ocsp-request",
+		bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("OCSP responder %s returned %s",
+			leaf.OCSPServer[0], resp.Status)
+	}
+	raw, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	parsed, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if parsed.Status != ocsp.Good {
+		return nil, time.Time{}, fmt.Errorf("OCSP status of cert for %v is %d, not Good",
+			leaf.DNSNames, parsed.Status)
+	}
+	if !s.now().Before(parsed.NextUpdate) {
+		return nil, time.Time{}, fmt.Errorf("OCSP response already expired at %v",
+			parsed.NextUpdate)
+	}
+	return raw, parsed.NextUpdate, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+)
+
+// newTestCertWithOCSP returns a cert for localhost issued by a fresh
+// CA, whose OCSP responder (which counts its requests in hits) vouches
+// for it
+func newTestCertWithOCSP(t *testing.T) (cert *tls.Certificate, hits *int32) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate,
+		&caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	hits = new(int32)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(hits, 1)
+		body, _ := ioutil.ReadAll(req.Body)
+		ocspReq, err := ocsp.ParseRequest(body)
+		if !assert.NoError(t, err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: ocspReq.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(72 * time.Hour),
+		}, caKey)
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+	t.Cleanup(responder.Close)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		OCSPServer:   []string{responder.URL},
+	}, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+
+	return &tls.Certificate{
+		Certificate: [][]byte{leafDER, caDER},
+		PrivateKey:  key,
+	}, hits
+}
+
+func TestOCSPStapling(t *testing.T) {
+	cert, hits := newTestCertWithOCSP(t)
+	tlsConfig := getTLSConfig(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return cert, nil
+	}, nil, tls.VersionTLS12)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	handshake := func() tls.ConnectionState {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+		})
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.ConnectionState()
+	}
+
+	state := handshake()
+	require.NotEmpty(t, state.OCSPResponse, "no OCSP response stapled")
+
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	require.NoError(t, err)
+	resp, err := ocsp.ParseResponseForCert(state.OCSPResponse,
+		state.PeerCertificates[0], issuer)
+	require.NoError(t, err)
+	assert.Equal(t, ocsp.Good, resp.Status)
+
+	// Later handshakes reuse the cached response
+	assert.Equal(t, state.OCSPResponse, handshake().OCSPResponse)
+	assert.Equal(t, int32(1), atomic.LoadInt32(hits))
+
+	// The shared cert isn't modified
+	assert.Empty(t, cert.OCSPStaple)
+}
+
+func TestOCSPStaplerRefresh(t *testing.T) {
+	cert, hits := newTestCertWithOCSP(t)
+	now := time.Now()
+	s := newOCSPStapler(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return cert, nil
+	})
+	s.now = func() time.Time { return now }
+
+	stapled, err := s.GetCertificate(nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, stapled.OCSPStaple)
+
+	// Close to expiring, the cached response is still served while a
+	// fresh one is fetched in the background
+	now = now.Add(72*time.Hour - OCSP_REFRESH_BEFORE + time.Minute)
+	stapled, err = s.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.NotEmpty(t, stapled.OCSPStaple)
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(hits) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(hits))
+}
+
+func TestOCSPStaplerSkipsSelfSigned(t *testing.T) {
+	cert, err := newSelfSignedCert([]string{"localhost"}, []net.IP{net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+
+	s := newOCSPStapler(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return cert, nil
+	})
+	got, err := s.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.True(t, got == cert)
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// newPostgrestProxy returns a reverse proxy to the PostgREST server(s)
+// at cfg.PostgrestBaseURL, or an error if that isn't a usable list of
+// http(s) URLs (see parsePostgrestUpstreams). If health isn't nil,
+// its checks decide which upstreams are used.
+func newPostgrestProxy(cfg *Config, health *UpstreamHealthChecker) (http.Handler, error) {
+	var upstreams []*postgrestUpstream
+	if health != nil {
+		upstreams = health.upstreams
+	} else {
+		var err error
+		upstreams, err = parsePostgrestUpstreams(cfg.PostgrestBaseURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Addressed to the first upstream; with more than one, the
+	// transport readdresses each request to whichever it picks
+	proxy := httputil.NewSingleHostReverseProxy(upstreams[0].URL)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		cleanPostgrestHeaders(req, cfg.TrustedProxies)
+	}
+	proxy.Transport = newPostgrestTransport(cfg, upstreams, health)
+	proxy.ErrorHandler = postgrestErrorHandler
+
+	stripHeaders := splitList(cfg.PostgrestStripResponseHeaders)
+	var allowHeaders map[string]bool
+	if cfg.PostgrestResponseHeaderAllowlist {
+		allowHeaders = map[string]bool{}
+		for _, name := range splitList(cfg.PostgrestAllowResponseHeaders) {
+			allowHeaders[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		for _, name := range stripHeaders {
+			resp.Header.Del(name)
+		}
+		if allowHeaders != nil {
+			keepAllowedHeaders(resp, allowHeaders)
+		}
+		if cfg.PostgrestRewriteLocation {
+			for _, name := range []string{"Location", "Content-Location"} {
+				loc := resp.Header.Get(name)
+				if loc == "" {
+					continue
+				}
+				for _, upstream := range upstreams {
+					rewritten := rewritePostgrestLocation(loc,
+						upstream.URL, cfg.PostgrestPrefix())
+					if rewritten != loc {
+						resp.Header.Set(name, rewritten)
+						break
+					}
+				}
+			}
+		}
+		return nil
+	}
+	return proxy, nil
+}
+
+// keepAllowedHeaders drops every header from resp, a response from
+// PostgREST, that isn't in allow (keyed by canonical name). Only
+// PostgREST's own headers are in resp, so ours (security headers,
+// CORS, etc.) are untouched. A 101's Connection, Upgrade, and
+// Sec-WebSocket-* headers are kept too, as ReverseProxy needs the
+// first two to finish the upgrade and the client the rest to accept
+// it.
+func keepAllowedHeaders(resp *http.Response, allow map[string]bool) {
+	upgrading := resp.StatusCode == http.StatusSwitchingProtocols
+	for name := range resp.Header {
+		if allow[name] {
+			continue
+		}
+		if upgrading && (name == "Connection" || name == "Upgrade" ||
+			strings.HasPrefix(name, "Sec-Websocket-")) {
+			continue
+		}
+		delete(resp.Header, name)
+	}
+}
+
+// rewritePostgrestLocation maps loc, a URL or path on the PostgREST
+// server at upstream, to the corresponding path under our public
+// prefix. URLs pointing anywhere else are left alone.
+func rewritePostgrestLocation(loc string, upstream *url.URL, prefix string) string {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return loc
+	}
+	if u.IsAbs() || u.Host != "" {
+		if u.Scheme != upstream.Scheme || u.Host != upstream.Host {
+			return loc
+		}
+	} else if !strings.HasPrefix(u.Path, "/") {
+		// Relative to the current path, which stays correct
+		return loc
+	}
+
+	basePath := strings.TrimSuffix(upstream.Path, "/")
+	if u.Path != basePath && !strings.HasPrefix(u.Path, basePath+"/") {
+		return loc
+	}
+	path := prefix + strings.TrimPrefix(u.Path, basePath)
+	if path == "" {
+		path = "/"
+	}
+	rewritten := &url.URL{
+		Path:     path,
+		RawQuery: u.RawQuery,
+		Fragment: u.Fragment,
+	}
+	return rewritten.String()
+}
+
+// Hop-by-hop headers, which apply to a single connection and so
+// mustn't be forwarded (RFC 7230, section 6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Headers that could carry the client's credentials, or forge ours
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"X-Auth-Token",
+	"X-Api-Key",
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+// cleanPostgrestHeaders strips hop-by-hop headers and anything
+// identifying or authenticating the client from req, then adds the
+// PostgREST JWT (if postgrestJWTAuth minted one) and X-Forwarded-*
+// headers we vouch for.
+func cleanPostgrestHeaders(req *http.Request, trustedProxies []net.IPNet) {
+	ip := clientIP(req, trustedProxies)
+	proto := "http"
+	if req.TLS != nil || forwardedHTTPS(req, trustedProxies) {
+		proto = "https"
+	}
+
+	upgrade := upgradeType(req.Header)
+
+	for _, conn := range req.Header["Connection"] {
+		for _, name := range strings.Split(conn, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				req.Header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		req.Header.Del(name)
+	}
+	for _, name := range sensitiveHeaders {
+		req.Header.Del(name)
+	}
+
+	// ReverseProxy handles the rest of the upgrade (e.g., to a
+	// WebSocket) itself, then copies data both ways
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+
+	if jwt, ok := req.Context().Value(postgrestJWTKey).(string); ok {
+		req.Header.Set("Authorization", "Bearer "+jwt)
+	}
+
+	// ReverseProxy appends the immediate peer, so only say who that
+	// peer was forwarding for when it's trusted to tell us
+	remoteIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+	if ip != remoteIP {
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	req.Header.Set("X-Forwarded-Proto", proto)
+}
+
+// upgradeType returns the protocol that h asks to switch to, e.g.
+// "websocket", or "" if it isn't an upgrade request.
+func upgradeType(h http.Header) string {
+	for _, conn := range h["Connection"] {
+		for _, token := range strings.Split(conn, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+func parsePostgrestURL(baseURL string) (*url.URL, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("PostgREST base URL is empty")
+	}
+
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing PostgREST base URL `%s`: %v",
+			baseURL, err)
+	}
+	if u.Scheme == "" {
+		return nil, fmt.Errorf("PostgREST base URL `%s` has no scheme",
+			baseURL)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("PostgREST base URL `%s` must be http or https, not %s",
+			baseURL, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("PostgREST base URL `%s` has no host", baseURL)
+	}
+	return u, nil
+}
+
+// newPostgrestTransport returns a transport that gives up on a hung
+// PostgREST rather than tying up a connection until the server's
+// WriteTimeout, that retries idempotent requests whose connections
+// fail (on another upstream, if there are several), and that caches
+// GET responses if cfg.PostgrestCacheTTL is set. Idle connections are
+// kept and reaped as cfg says. Unless disabled, a circuit breaker
+// fails requests fast while PostgREST keeps failing. Each attempt to
+// reach PostgREST is traced, if the request is (see Tracer).
+func newPostgrestTransport(cfg *Config, upstreams []*postgrestUpstream, health *UpstreamHealthChecker) http.RoundTripper {
+	dialer := &net.Dialer{
+		Timeout:   cfg.PostgrestDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ResponseHeaderTimeout: cfg.PostgrestResponseHeaderTimeout,
+		MaxIdleConns:          cfg.PostgrestMaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.PostgrestMaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.PostgrestIdleConnTimeout,
+		DisableKeepAlives:     cfg.PostgrestDisableKeepAlives,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	transport = &tracingTransport{RoundTripper: transport}
+	if len(upstreams) > 1 {
+		transport = newBalancerTransport(transport, upstreams,
+			POSTGREST_UPSTREAM_COOLDOWN)
+	}
+	transport = &retryTransport{
+		RoundTripper: transport,
+		retries:      cfg.PostgrestRetries,
+		backoff:      100 * time.Millisecond,
+	}
+	if cfg.PostgrestBreakerThreshold > 0 {
+		// Outside the retries, so that each request counts once
+		transport = &breakerTransport{
+			RoundTripper: transport,
+			breaker: NewCircuitBreaker(cfg.PostgrestBreakerThreshold,
+				cfg.PostgrestBreakerWindow, cfg.PostgrestBreakerCooldown,
+				health),
+		}
+	}
+	if cfg.PostgrestCacheTTL > 0 {
+		transport = newCacheTransport(transport, cfg.PostgrestCacheTTL)
+	}
+	return transport
+}
+
+// retryTransport retries GET and HEAD requests (which have no body
+// to re-send, and are safe to repeat) up to `retries` times when the
+// connection to the upstream fails, doubling the backoff each time.
+// Timeouts aren't retried, since a hung upstream would likely just
+// hang again.
+type retryTransport struct {
+	http.RoundTripper
+	retries int
+	backoff time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+
+	backoff := t.backoff
+	for i := 0; i < t.retries && shouldRetry(req, err); i++ {
+		log.Debugf("Retrying %s %s in %v after error: %v", req.Method,
+			req.URL, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+
+		resp, err = t.RoundTripper.RoundTrip(req)
+	}
+	return resp, err
+}
+
+func shouldRetry(req *http.Request, err error) bool {
+	if err == nil || req.Context().Err() != nil {
+		return false
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return false
+	}
+	return true
+}
+
+func postgrestErrorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	var open *ErrCircuitOpen
+	if errors.As(err, &open) {
+		secs := int(math.Ceil(open.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+		WriteErrorStatus(w, "Error: the database is unavailable; try again shortly",
+			err, http.StatusServiceUnavailable)
+		return
+	}
+	if isBodyTooLarge(err) {
+		WriteErrorStatus(w, "Error: request body too large", err,
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	WriteErrorStatus(w, "Error reaching the database; sorry!", err,
+		http.StatusBadGateway)
+}
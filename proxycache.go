@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bodies bigger than this aren't cached, nor shared between
+// coalesced requests
+const MAX_CACHED_RESPONSE_SIZE = 1 << 20
+
+// Request headers that can change PostgREST's response, and so are
+// part of a cached response's key, along with who's asking (see
+// cacheKey).
+var cacheKeyHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Accept-Profile",
+	"Prefer",
+	"Range",
+}
+
+// cacheTransport caches successful GET responses from PostgREST for
+// ttl, unless they say not to (Cache-Control: no-store), and has
+// concurrent identical GETs share one upstream request, so that a
+// crowd of dashboards polling the same query costs one trip to the
+// database.
+type cacheTransport struct {
+	http.RoundTripper
+	ttl time.Duration
+	now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]*cachedResponse
+	calls     map[string]*cacheCall
+	lastSweep time.Time
+}
+
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	fetched time.Time
+	store   bool // Whether it may be kept after it's shared
+}
+
+// cacheCall is an upstream request that identical requests wait on
+type cacheCall struct {
+	done chan struct{}
+	resp *cachedResponse // nil if it couldn't be shared
+}
+
+func newCacheTransport(rt http.RoundTripper, ttl time.Duration) *cacheTransport {
+	return &cacheTransport{
+		RoundTripper: rt,
+		ttl:          ttl,
+		now:          time.Now,
+		entries:      map[string]*cachedResponse{},
+		calls:        map[string]*cacheCall{},
+	}
+}
+
+// cacheKey keys responses by the requester's identity, so users never
+// see each other's cached rows, rather than by their Authorization
+// header: the PostgREST JWT sent there is minted anew (with a new iat
+// and exp) every second.
+func cacheKey(req *http.Request) string {
+	var key strings.Builder
+	key.WriteString(req.URL.String())
+	key.WriteString("\nIdentity: " + RequestIdentity(req))
+	for _, name := range cacheKeyHeaders {
+		key.WriteString("\n" + name + ": ")
+		key.WriteString(strings.Join(req.Header[name], ", "))
+	}
+	return key.String()
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" || upgradeType(req.Header) != "" ||
+		hasCacheDirective(req.Header, "no-store") {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	key := cacheKey(req)
+	now := t.now()
+
+	t.mu.Lock()
+	if entry, ok := t.entries[key]; ok {
+		if now.Sub(entry.fetched) < t.ttl {
+			t.mu.Unlock()
+			return entry.response(req, now), nil
+		}
+		delete(t.entries, key)
+	}
+	if call, ok := t.calls[key]; ok {
+		t.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if call.resp != nil {
+			return call.resp.response(req, t.now()), nil
+		}
+		// The request we waited on failed or was too big to share
+		return t.RoundTripper.RoundTrip(req)
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	t.calls[key] = call
+	t.mu.Unlock()
+
+	resp, entry, err := t.fetch(req)
+
+	t.mu.Lock()
+	delete(t.calls, key)
+	if entry != nil && entry.store {
+		t.sweep(entry.fetched)
+		t.entries[key] = entry
+	}
+	t.mu.Unlock()
+	call.resp = entry
+	close(call.done)
+
+	return resp, err
+}
+
+// fetch makes req upstream, buffering the response so that it can be
+// shared unless it's too big.
+func (t *cacheTransport) fetch(req *http.Request) (*http.Response, *cachedResponse, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body,
+		MAX_CACHED_RESPONSE_SIZE+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	if len(body) > MAX_CACHED_RESPONSE_SIZE {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil, nil
+	}
+	resp.Body.Close()
+
+	entry := &cachedResponse{
+		status:  resp.StatusCode,
+		header:  resp.Header,
+		body:    body,
+		fetched: t.now(),
+		store: resp.StatusCode == http.StatusOK &&
+			!hasCacheDirective(resp.Header, "no-store") &&
+			resp.Header.Get("Set-Cookie") == "",
+	}
+	return entry.response(req, entry.fetched), entry, nil
+}
+
+// sweep forgets expired responses, at most once per ttl. t.mu must
+// be held.
+func (t *cacheTransport) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.ttl {
+		return
+	}
+	t.lastSweep = now
+	for key, entry := range t.entries {
+		if now.Sub(entry.fetched) >= t.ttl {
+			delete(t.entries, key)
+		}
+	}
+}
+
+func (entry *cachedResponse) response(req *http.Request, now time.Time) *http.Response {
+	header := entry.header.Clone()
+	if age := now.Sub(entry.fetched); age >= time.Second {
+		header.Set("Age", strconv.Itoa(int(age/time.Second)))
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(entry.status) + " " + http.StatusText(entry.status),
+		StatusCode:    entry.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.body)),
+		ContentLength: int64(len(entry.body)),
+		Request:       req,
+	}
+}
+
+// hasCacheDirective reports whether h's Cache-Control includes
+// directive, e.g. "no-store".
+func hasCacheDirective(h http.Header, directive string) bool {
+	for _, cc := range h["Cache-Control"] {
+		for _, d := range strings.Split(cc, ",") {
+			if strings.EqualFold(strings.TrimSpace(d), directive) {
+				return true
+			}
+		}
+	}
+	return false
+}
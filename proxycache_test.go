@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cathalgarvey/go-minilock/taber"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCountingUpstream returns a server that counts the requests it
+// gets, responding to each with `[]` and the given Cache-Control
+func newCountingUpstream(t *testing.T, cacheControl string) (upstream *httptest.Server, hits *int32) {
+	hits = new(int32)
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(hits, 1)
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		w.Write([]byte("[]"))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, hits
+}
+
+func newCachingProxy(t *testing.T, upstreamURL string) http.Handler {
+	cfg := testConfig()
+	cfg.PostgrestBaseURL = upstreamURL
+	cfg.PostgrestCacheTTL = time.Minute
+	proxy, err := newPostgrestProxy(cfg, nil)
+	require.NoError(t, err)
+	return proxy
+}
+
+func TestPostgrestCacheCoalescesConcurrentGETs(t *testing.T) {
+	var hits int32
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		started <- struct{}{}
+		<-release
+		w.Write([]byte(`[{"id":1}]`))
+	}))
+	defer upstream.Close()
+	proxy := newCachingProxy(t, upstream.URL)
+
+	var wg sync.WaitGroup
+	recs := []*httptest.ResponseRecorder{httptest.NewRecorder(),
+		httptest.NewRecorder()}
+	get := func(rec *httptest.ResponseRecorder) {
+		defer wg.Done()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/tasks?done=eq.false", nil))
+	}
+	wg.Add(2)
+	go get(recs[0])
+	<-started
+	go get(recs[1])
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+	for _, rec := range recs {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, `[{"id":1}]`, rec.Body.String())
+	}
+}
+
+func TestPostgrestCache(t *testing.T) {
+	upstream, hits := newCountingUpstream(t, "")
+	proxy := newCachingProxy(t, upstream.URL)
+
+	testURL(t, "GET", "/tasks", nil, proxy, http.StatusOK, "[]")
+	testURL(t, "GET", "/tasks", nil, proxy, http.StatusOK, "[]")
+	assert.Equal(t, int32(1), atomic.LoadInt32(hits))
+
+	// Different query, or different representation
+	testURL(t, "GET", "/tasks?id=eq.1", nil, proxy, http.StatusOK, "[]")
+	testURL(t, "GET", "/tasks", http.Header{"Accept": {"text/csv"}},
+		proxy, http.StatusOK, "[]")
+	assert.Equal(t, int32(3), atomic.LoadInt32(hits))
+
+	// Writes are never cached
+	testURL(t, "POST", "/tasks", nil, proxy, http.StatusOK, "[]")
+	testURL(t, "POST", "/tasks", nil, proxy, http.StatusOK, "[]")
+	assert.Equal(t, int32(5), atomic.LoadInt32(hits))
+}
+
+func TestPostgrestCacheNoStore(t *testing.T) {
+	upstream, hits := newCountingUpstream(t, "private, no-store")
+	proxy := newCachingProxy(t, upstream.URL)
+
+	testURL(t, "GET", "/tasks", nil, proxy, http.StatusOK, "[]")
+	testURL(t, "GET", "/tasks", nil, proxy, http.StatusOK, "[]")
+	assert.Equal(t, int32(2), atomic.LoadInt32(hits))
+}
+
+func TestCacheTransportExpiry(t *testing.T) {
+	upstream, hits := newCountingUpstream(t, "")
+	now := time.Now()
+	ct := newCacheTransport(http.DefaultTransport, time.Second)
+	ct.now = func() time.Time { return now }
+
+	get := func() *http.Response {
+		req, err := http.NewRequest("GET", upstream.URL+"/tasks", nil)
+		require.NoError(t, err)
+		resp, err := ct.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	get()
+	now = now.Add(999 * time.Millisecond)
+	assert.Equal(t, "", get().Header.Get("Age"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(hits))
+
+	now = now.Add(time.Millisecond)
+	get()
+	assert.Equal(t, int32(2), atomic.LoadInt32(hits))
+}
+
+func TestPostgrestCacheWithJWT(t *testing.T) {
+	var hits int32
+	started, release := make(chan struct{}, 3), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		started <- struct{}{}
+		<-release
+		w.Write([]byte(`[{"id":1}]`))
+	}))
+	defer upstream.Close()
+
+	cfg := testConfig()
+	cfg.PostgrestBaseURL = upstream.URL
+	cfg.PostgrestCacheTTL = time.Minute
+	cfg.PostgrestJWTSecret = "test secret"
+	router := mustNewRouterConfig(cfg, NewMapper())
+
+	authHeaders := func(keypair *taber.Keys) http.Header {
+		authToken := testLogin(t, router, keypair)
+		return http.Header{"Authorization": {"Bearer " + authToken}}
+	}
+	alice := authHeaders(newTestKeypair(t))
+
+	var wg sync.WaitGroup
+	get := func(headers http.Header) {
+		defer wg.Done()
+		testURL(t, "GET", "/postgrest/tasks", headers, router,
+			http.StatusOK, `[{"id":1}]`)
+	}
+	wg.Add(2)
+	go get(alice)
+	<-started
+	// Into the next second, so that the second request's JWT differs
+	time.Sleep(1100 * time.Millisecond)
+	go get(alice)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	// Cached for the same user, but not shared with others
+	wg.Add(1)
+	get(alice)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+	wg.Add(1)
+	get(authHeaders(newTestKeypair(t)))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// How long a proxy gets to send its PROXY protocol header
+const PROXY_HEADER_TIMEOUT = 10 * time.Second
+
+// Longest possible PROXY protocol v1 header, CRLF included
+const proxyV1MaxLen = 107
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrBadProxyHeader = errors.New("Malformed PROXY protocol header")
+
+// ProxyProtocolListener wraps ln so that connections from trustedFrom
+// (e.g., an AWS NLB or HAProxy) that start with a PROXY protocol (v1
+// or v2) header have that header stripped, and RemoteAddr return the
+// client address it names, so that everything keyed on the client's IP
+// sees the real one. Connections from anywhere else are left alone; a
+// PROXY header from them is just a bad request. Returns ln if
+// trustedFrom is empty.
+func ProxyProtocolListener(ln net.Listener, trustedFrom []net.IPNet) net.Listener {
+	if len(trustedFrom) == 0 {
+		return ln
+	}
+	return &proxyProtocolListener{Listener: ln, trustedFrom: trustedFrom}
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	trustedFrom []net.IPNet
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !ipInNets(addr.IP, l.trustedFrom) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, br: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn reads its PROXY header the first time it's read from or
+// asked for its RemoteAddr, rather than in Accept, so that a slow
+// proxy only holds up its own connection.
+type proxyConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (pc *proxyConn) readHeader() {
+	pc.once.Do(func() {
+		pc.Conn.SetReadDeadline(time.Now().Add(PROXY_HEADER_TIMEOUT))
+		pc.remote, pc.err = readProxyHeader(pc.br)
+		pc.Conn.SetReadDeadline(time.Time{})
+		if pc.err != nil {
+			log.Debugf("PROXY protocol header from %v: %v",
+				pc.Conn.RemoteAddr(), pc.err)
+		}
+	})
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	pc.readHeader()
+	if pc.err != nil {
+		return 0, pc.err
+	}
+	return pc.br.Read(b)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.readHeader()
+	if pc.remote != nil {
+		return pc.remote
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+// readProxyHeader consumes the PROXY protocol header at the start of
+// br, if there is one, and returns the client address it names. It
+// returns a nil address if there's no header, or if the header doesn't
+// name a TCP client (e.g., a v2 LOCAL health check from the proxy
+// itself).
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	start, _ := br.Peek(len(proxyV2Signature))
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyHeaderV2(br)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyHeaderV1(br)
+	}
+	// Not proxied; any error reading is for the caller's next Read
+	return nil, nil
+}
+
+// readProxyHeaderV1 reads a header like
+// "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n".
+func readProxyHeaderV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, ErrBadProxyHeader
+		}
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrBadProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrBadProxyHeader
+	}
+	if (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, ErrBadProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads the binary header: the signature, a
+// version/command byte, an address family/protocol byte, the length of
+// what follows, then the addresses.
+func readProxyHeaderV2(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	verCmd, famProto := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("Unsupported PROXY protocol version %d",
+			verCmd>>4)
+	}
+	switch verCmd & 0xf {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, ErrBadProxyHeader
+	}
+
+	var ipLen int
+	switch famProto {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// UDP or Unix sockets; nothing we can use
+		return nil, nil
+	}
+	// Source and destination addresses, then ports; anything after
+	// that is TLVs we don't need
+	if len(body) < 2*ipLen+4 {
+		return nil, ErrBadProxyHeader
+	}
+	ip := net.IP(append([]byte{}, body[:ipLen]...))
+	port := binary.BigEndian.Uint16(body[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveRemoteAddr serves, behind ProxyProtocolListener, a handler that
+// responds with each request's RemoteAddr, and returns its address.
+func serveRemoteAddr(t *testing.T, trustedFrom string) string {
+	trusted, err := parseIPNets(trustedFrom)
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.RemoteAddr))
+	})}
+	go srv.Serve(ProxyProtocolListener(ln, trusted))
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// rawGet sends preamble, then a GET, on a new connection to addr.
+func rawGet(t *testing.T, addr string, preamble []byte) (int, string) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write(append(preamble,
+		"GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"...))
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func proxyV2Header(cmd byte, src net.IP, port uint16) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|cmd, 0x11, 0, 12)
+	header = append(header, src.To4()...)
+	header = append(header, 10, 0, 0, 1)
+	header = binary.BigEndian.AppendUint16(header, port)
+	return binary.BigEndian.AppendUint16(header, 443)
+}
+
+func TestProxyProtocolV1(t *testing.T) {
+	addr := serveRemoteAddr(t, "127.0.0.0/8")
+
+	status, body := rawGet(t, addr,
+		[]byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n"))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "203.0.113.7:56324", body)
+
+	status, body = rawGet(t, addr,
+		[]byte("PROXY TCP6 2001:db8::7 2001:db8::1 56324 443\r\n"))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "[2001:db8::7]:56324", body)
+
+	// The proxy talking for itself
+	_, body = rawGet(t, addr, []byte("PROXY UNKNOWN\r\n"))
+	assert.Contains(t, body, "127.0.0.1:")
+
+	// No header at all is fine, too
+	_, body = rawGet(t, addr, nil)
+	assert.Contains(t, body, "127.0.0.1:")
+
+	status, _ = rawGet(t, addr,
+		[]byte("PROXY TCP4 not-an-ip 10.0.0.1 56324 443\r\n"))
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	addr := serveRemoteAddr(t, "127.0.0.1")
+
+	status, body := rawGet(t, addr,
+		proxyV2Header(0x1, net.ParseIP("198.51.100.9"), 40000))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "198.51.100.9:40000", body)
+
+	// LOCAL, e.g. a health check
+	_, body = rawGet(t, addr, proxyV2Header(0x0, net.ParseIP("198.51.100.9"), 40000))
+	assert.Contains(t, body, "127.0.0.1:")
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	addr := serveRemoteAddr(t, "10.0.0.0/8")
+
+	// Anyone else can't claim to be someone else
+	status, _ := rawGet(t, addr,
+		[]byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n"))
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	_, body := rawGet(t, addr, nil)
+	assert.Contains(t, body, "127.0.0.1:")
+}
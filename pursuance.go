@@ -1,68 +1,188 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"strings"
-
-	"github.com/cryptag/minishare/miniware"
+	"os"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/cathalgarvey/go-minilock/taber"
 )
 
-var (
-	randomServerKey      *taber.Keys
-	THIS_DOMAIN_BASE_URL string
-)
+var THIS_DOMAIN_BASE_URL string
 
-func init() {
-	k, err := taber.RandomKey()
+func main() {
+	cfg, err := loadConfig(configFile(os.Getenv), os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
 	if err != nil {
-		log.Fatalf("Error generating random server key: %v", err)
+		log.Fatal(err)
+	}
+	if cfg.CheckConfig {
+		os.Exit(runConfigCheck(cfg, os.Stdout))
 	}
 
-	// Setting global var
-	randomServerKey = k
-}
+	log.WithFields(cfg.LogFields()).Info("Starting with config")
 
-func main() {
-	httpAddr := flag.String("http", "127.0.0.1:8082",
-		"Address to listen on HTTP")
-	httpsAddr := flag.String("https", "127.0.0.1:8443",
-		"Address to listen on HTTPS")
-	domain := flag.String("domain", "", "Domain of this service")
-	prod := flag.Bool("prod", false, "Run in Production mode.")
-	flag.Parse()
+	warnings, err := cfg.CheckBasicAuth()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, warning := range warnings {
+		log.Warn(warning)
+	}
 
-	m := miniware.NewMapper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	srv := NewServer(m, *httpAddr)
+	keys := mustLoadServerKeys(ctx, cfg.ServerKeyFile, cfg.ServerKeyPreviousFile)
 
-	go NewEmailer()
+	m, err := newSessionStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Redis expires tokens itself
+	if mapper, ok := m.(*Mapper); ok {
+		StartTokenReaper(ctx, mapper, cfg.AuthTokenReapInterval)
+	}
 
-	if *prod {
+	// Its sources depend on where we're served from
+	var cspDomains []string
+	switch {
+	case cfg.Prod:
+		cspDomains = cfg.Domains()
+	case cfg.DevTLS:
+		cspDomains = []string{"localhost"}
+	}
+	csp := mustLoadCSP(ctx, cfg.CSPConfigFile, cspDomains)
+
+	srv, err := NewServer(cfg, m, keys, csp)
+	if err != nil {
+		log.Fatalf("Error creating server: %v", err)
+	}
+
+	NewEmailer(cfg.PostgrestPrimaryURL())
+
+	if cfg.Prod {
 		log.SetLevel(log.FatalLevel)
+		OnLogLevelSignals(ctx, log.FatalLevel)
 
-		if *domain == "" {
+		domains := cfg.Domains()
+		if len(domains) == 0 {
 			log.Fatal("You must specify a -domain when using the -prod flag.")
 		}
 
-		THIS_DOMAIN_BASE_URL = "https://" + *domain
+		THIS_DOMAIN_BASE_URL = "https://" + cfg.CanonicalDomain()
 
-		manager := getAutocertManager(*domain)
+		cache, err := newAutocertCache(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		manager := getAutocertManager(domains, cache)
 
-		// Setup http->https redirection
-		httpsPort := strings.SplitN(*httpsAddr, ":", 2)[1]
-		go redirectToHTTPS(*httpAddr, httpsPort, manager)
 		// Production modifications to server
-		ProductionServer(srv, *httpsAddr, *domain, manager)
-		log.Infof("Listening on %v", *httpsAddr)
-		log.Fatal(srv.ListenAndServeTLS("", ""))
+		if err := ProductionServer(cfg, srv, manager); err != nil {
+			log.Fatal(err)
+		}
+
+		// Listen on both ports before getting any certs, so that
+		// the ACME challenge can be answered
+		ln, err := listen(srv, cfg.ProxyProtocolFrom)
+		if err != nil {
+			log.Fatal(err)
+		}
+		redirectSrv := newRedirectServer(cfg, srv.Handler)
+		redirectLn, err := listen(redirectSrv, cfg.ProxyProtocolFrom)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Setup http->https redirection
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := serve(ctx, redirectSrv, redirectLn, cfg.ShutdownGracePeriod)
+			if err != nil {
+				log.Errorf("Error from HTTP->HTTPS redirect server: %v", err)
+			}
+		}()
+
+		if cfg.AutocertPrewarm {
+			// Logged whatever the log level, which in production
+			// hides everything short of fatal errors
+			prewarmLog := log.New()
+			prewarmLog.Formatter = log.StandardLogger().Formatter
+			PrewarmCerts(ctx, prewarmLog, manager.GetCertificate, domains)
+		}
+
+		err = serve(ctx, srv, ln, cfg.ShutdownGracePeriod)
+
+		// Stop everything else, too
+		cancel()
+		wg.Wait()
+		if err != nil {
+			log.Fatal(err)
+		}
 	} else {
 		log.SetLevel(log.DebugLevel)
+		OnLogLevelSignals(ctx, log.DebugLevel)
+
+		THIS_DOMAIN_BASE_URL = "http://" + cfg.HTTPAddr
+
+		if cfg.DevTLS {
+			if err := DevTLSServer(cfg, srv); err != nil {
+				log.Fatalf("Error generating self-signed cert: %v", err)
+			}
+			THIS_DOMAIN_BASE_URL = "https://" + cfg.HTTPSAddr
+		}
+
+		if err := Run(ctx, srv, cfg.ShutdownGracePeriod, cfg.ProxyProtocolFrom); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// mustLoadCSP loads the CSP config at path (or the default one for
+// domains), then reloads it on every SIGHUP.
+func mustLoadCSP(ctx context.Context, path string, domains []string) *CSPHolder {
+	cspConfig, err := LoadCSPConfig(path, domains)
+	if err != nil {
+		log.Fatal(err)
+	}
+	csp := NewCSPHolder(cspConfig)
+
+	OnSIGHUP(ctx, func() {
+		if err := csp.Reload(path, domains); err != nil {
+			log.Errorf("Error reloading CSP config; keeping the old one: %v", err)
+			return
+		}
+		log.Infof("Reloaded CSP config: %s", csp.Load())
+	})
+	return csp
+}
 
-		THIS_DOMAIN_BASE_URL = "http://" + *httpAddr
-		log.Infof("Listening on %v", *httpAddr)
-		log.Fatal(srv.ListenAndServe())
+// mustLoadServerKeys loads the server keys from path and previousPath
+// (see LoadServerKeys), then reloads them on every SIGHUP, so that
+// they can be rotated without losing pending challenges.
+func mustLoadServerKeys(ctx context.Context, path, previousPath string) *ServerKeys {
+	keys, err := LoadServerKeys(path, previousPath)
+	if err != nil {
+		log.Fatalf("Error loading server key: %v", err)
+	}
+	if ids, err := keys.IDs(); err == nil {
+		log.Infof("Server miniLock IDs (current first): %v", ids)
 	}
+
+	OnSIGHUP(ctx, func() {
+		if err := keys.Reload(); err != nil {
+			log.Errorf("Error reloading server keys; keeping the old ones: %v", err)
+			return
+		}
+		if ids, err := keys.IDs(); err == nil {
+			log.Infof("Reloaded server keys; miniLock IDs (current first): %v", ids)
+		}
+	})
+	return keys
 }
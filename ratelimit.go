@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// Retry-After is stretched by up to this fraction of the actual wait,
+// at random, so that clients limited at the same moment don't all
+// retry at the same moment, too
+const RATE_LIMIT_JITTER = 0.5
+
+// RateLimiter is a set of token buckets, one per key, each holding up
+// to burst tokens and regaining one every interval.
+type RateLimiter struct {
+	lock    sync.Mutex
+	buckets map[string]*bucket
+
+	burst    float64
+	interval time.Duration
+	now      func() time.Time
+	jitter   func(max time.Duration) time.Duration
+
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(burst int, interval time.Duration) *RateLimiter {
+	return &RateLimiter{
+		buckets:  map[string]*bucket{},
+		burst:    float64(burst),
+		interval: interval,
+		now:      time.Now,
+		jitter:   randDuration,
+	}
+}
+
+// RateLimitStatus is what Take found in a bucket.
+type RateLimitStatus struct {
+	Allowed    bool
+	Limit      int           // The bucket's size
+	Remaining  int           // Whole tokens left, after this request's
+	RetryAfter time.Duration // Until the next token, if !Allowed
+	Reset      time.Duration // Until the bucket is full again
+}
+
+// Allow takes a token from key's bucket. If the bucket is empty, it
+// returns false and how long until a token will be available.
+func (rl *RateLimiter) Allow(key string) (ok bool, retryAfter time.Duration) {
+	status := rl.Take(key)
+	return status.Allowed, status.RetryAfter
+}
+
+// Take is Allow, but reports how full key's bucket is, too.
+func (rl *RateLimiter) Take(key string) RateLimitStatus {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(rl.burst, b.tokens+rl.refilled(now.Sub(b.last)))
+	b.last = now
+
+	status := RateLimitStatus{Limit: int(rl.burst)}
+	if b.tokens < 1 {
+		status.RetryAfter = time.Duration((1 - b.tokens) * float64(rl.interval))
+	} else {
+		status.Allowed = true
+		b.tokens--
+	}
+	status.Remaining = int(b.tokens)
+	status.Reset = time.Duration((rl.burst - b.tokens) * float64(rl.interval))
+	return status
+}
+
+func (rl *RateLimiter) refilled(elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(elapsed) / float64(rl.interval)
+}
+
+// sweep forgets buckets that have refilled completely, since they're
+// indistinguishable from new ones. Must be called with rl.lock held.
+func (rl *RateLimiter) sweep(now time.Time) {
+	full := time.Duration(rl.burst * float64(rl.interval))
+	if now.Sub(rl.lastSweep) < full {
+		return
+	}
+	rl.lastSweep = now
+
+	for key, b := range rl.buckets {
+		if b.tokens+rl.refilled(now.Sub(b.last)) >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+func randDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+// LimitByIP wraps h so that each client IP (see clientIP) is limited
+// by rl, responding with 429 Too Many Requests once its bucket is
+// empty. Every response says how much of the limit is left in
+// X-RateLimit-Limit, X-RateLimit-Remaining, and X-RateLimit-Reset
+// (seconds until the bucket is full again); 429s add a jittered
+// Retry-After.
+func LimitByIP(h http.Handler, rl *RateLimiter, trustedProxies []net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := rl.Take(clientIP(req, trustedProxies))
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(status.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+		w.Header().Set("X-RateLimit-Reset", ceilSeconds(status.Reset))
+		if !status.Allowed {
+			retryAfter := status.RetryAfter + rl.jitter(time.Duration(
+				float64(status.RetryAfter)*RATE_LIMIT_JITTER))
+			w.Header().Set("Retry-After", ceilSeconds(retryAfter))
+			WriteErrorStatus(w, "Error: too many requests; try again later",
+				ErrRateLimited, http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterRefill(t *testing.T) {
+	now := time.Now()
+	rl := NewRateLimiter(3, 10*time.Second)
+	rl.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := rl.Allow("1.2.3.4")
+		assert.True(t, ok, "request %d", i)
+	}
+
+	ok, retryAfter := rl.Allow("1.2.3.4")
+	assert.False(t, ok)
+	assert.Equal(t, 10*time.Second, retryAfter)
+
+	// Other IPs have their own bucket
+	ok, _ = rl.Allow("5.6.7.8")
+	assert.True(t, ok)
+
+	now = now.Add(5 * time.Second)
+	ok, retryAfter = rl.Allow("1.2.3.4")
+	assert.False(t, ok)
+	assert.Equal(t, 5*time.Second, retryAfter)
+
+	now = now.Add(5 * time.Second)
+	ok, _ = rl.Allow("1.2.3.4")
+	assert.True(t, ok)
+	ok, _ = rl.Allow("1.2.3.4")
+	assert.False(t, ok)
+
+	// Refills to burst, no further
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ := rl.Allow("1.2.3.4")
+		assert.True(t, ok, "request %d", i)
+	}
+	ok, _ = rl.Allow("1.2.3.4")
+	assert.False(t, ok)
+}
+
+func TestLimitByIPLogin(t *testing.T) {
+	now := time.Now()
+	rl := NewRateLimiter(2, time.Minute)
+	rl.now = func() time.Time { return now }
+	rl.jitter = func(time.Duration) time.Duration { return 0 }
+
+	cs := NewChallengeStore(time.Minute)
+	lockout := NewLoginLockout(5, time.Second, time.Minute, time.Minute)
+	handler := LimitByIP(http.HandlerFunc(LoginPost(NewMapper(), 0, nil, nil,
+		false, cs, testServerKeys, lockout, nil, nil)), rl, nil)
+	mID := testMinilockID(t, newTestKeypair(t))
+
+	login := func(remoteAddr, xff string) *httptest.ResponseRecorder {
+		nonce, err := cs.New(mID, testServerKeys.Current())
+		require.NoError(t, err)
+		req := httptest.NewRequest("POST", "/api/login", strings.NewReader(
+			`{"minilock_id":"`+mID+`","nonce":"`+nonce+`"}`))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Content-Type", "application/json")
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, login("10.0.0.1:1111", "").Code)
+	assert.Equal(t, http.StatusOK, login("10.0.0.1:2222", "").Code)
+
+	rec := login("10.0.0.1:3333", "")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+
+	// X-Forwarded-For isn't trusted by default
+	rec = login("10.0.0.1:4444", "192.0.2.99")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, http.StatusOK, login("10.0.0.1:5555", "").Code)
+}
+
+func TestLoginIDRateLimit(t *testing.T) {
+	now := time.Now()
+	ipLimiter := NewRateLimiter(2, time.Minute)
+	idLimiter := NewRateLimiter(2, time.Minute)
+	for _, rl := range []*RateLimiter{ipLimiter, idLimiter} {
+		rl.now = func() time.Time { return now }
+		rl.jitter = func(time.Duration) time.Duration { return 0 }
+	}
+
+	cs := NewChallengeStore(time.Minute)
+	lockout := NewLoginLockout(5, time.Second, time.Minute, time.Minute)
+	handler := LimitByIP(http.HandlerFunc(LoginPost(NewMapper(), 0, nil,
+		idLimiter, false, cs, testServerKeys, lockout, nil, nil)), ipLimiter, nil)
+	mID := testMinilockID(t, newTestKeypair(t))
+
+	login := func(remoteAddr, mID string) *httptest.ResponseRecorder {
+		nonce, err := cs.New(mID, testServerKeys.Current())
+		require.NoError(t, err)
+		req := httptest.NewRequest("POST", "/api/login", strings.NewReader(
+			`{"minilock_id":"`+mID+`","nonce":"`+nonce+`"}`))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Spreading logins across IPs doesn't get around the per-ID limit
+	assert.Equal(t, http.StatusOK, login("10.0.0.1:1111", mID).Code)
+	assert.Equal(t, http.StatusOK, login("10.0.0.2:1111", mID).Code)
+	rec := login("10.0.0.3:1111", mID)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+	assert.Contains(t, rec.Body.String(), "too many logins for this miniLock ID")
+
+	// Other IDs have their own bucket...
+	otherID := testMinilockID(t, newTestKeypair(t))
+	assert.Equal(t, http.StatusOK, login("10.0.0.3:2222", otherID).Code)
+
+	// ...but the per-IP limit still applies to them
+	assert.Equal(t, http.StatusOK, login("10.0.0.1:2222", otherID).Code)
+	assert.Equal(t, http.StatusTooManyRequests,
+		login("10.0.0.1:3333", otherID).Code)
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, http.StatusOK, login("10.0.0.4:1111", mID).Code)
+}
+
+func TestLoginIDRateLimitRouter(t *testing.T) {
+	cfg := testConfig()
+	cfg.LoginIDRateLimitBurst = 1
+	router := mustNewRouterConfig(cfg, NewMapper())
+	keypair := newTestKeypair(t)
+	mID := testMinilockID(t, keypair)
+
+	login := func(remoteAddr string) *httptest.ResponseRecorder {
+		nonce := testChallenge(t, router, keypair)
+		req := httptest.NewRequest("POST", "/api/login", strings.NewReader(
+			`{"minilock_id":"`+mID+`","nonce":"`+nonce+`"}`))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Anyone can name this miniLock ID, but without its key, they
+	// can't use up its logins
+	for i := 0; i < 3; i++ {
+		testChallenge(t, router, keypair)
+		req := httptest.NewRequest("POST", "/api/login", strings.NewReader(
+			`{"minilock_id":"`+mID+`","nonce":"deadbeef"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+		rec = postLogin(router, "application/json", `{"minilock_id":"`+mID+`"}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+
+	assert.Equal(t, http.StatusOK, login("10.0.0.1:1111").Code)
+	rec := login("10.0.0.2:1111")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+
+	// 0 disables it
+	cfg = testConfig()
+	cfg.LoginIDRateLimitBurst = 0
+	router = mustNewRouterConfig(cfg, NewMapper())
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, login(fmt.Sprintf("10.0.0.%d:1111", i)).Code)
+	}
+}
+
+func TestLimitByIPHeaders(t *testing.T) {
+	now := time.Now()
+	rl := NewRateLimiter(3, 10*time.Second)
+	rl.now = func() time.Time { return now }
+
+	handler := LimitByIP(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+		rl, nil)
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec
+	}
+
+	for _, remaining := range []string{"2", "1", "0"} {
+		rec := get()
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "3", rec.Header().Get("X-RateLimit-Limit"))
+		assert.Equal(t, remaining, rec.Header().Get("X-RateLimit-Remaining"))
+		assert.Empty(t, rec.Header().Get("Retry-After"))
+	}
+	// Empty, so 30s until it's full again
+	rec := get()
+	assert.Equal(t, "30", rec.Header().Get("X-RateLimit-Reset"))
+
+	// Clients limited together are told to retry at different times,
+	// but never before a token is actually available
+	seen := map[int]bool{}
+	for i := 0; i < 50; i++ {
+		rec := get()
+		require.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "0", rec.Header().Get("X-RateLimit-Remaining"))
+		assert.Equal(t, "30", rec.Header().Get("X-RateLimit-Reset"))
+		secs, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+		require.NoError(t, err)
+		assert.True(t, secs >= 10 && secs <= 15, "Retry-After %d", secs)
+		seen[secs] = true
+	}
+	assert.True(t, len(seen) > 1, "Retry-After never varied")
+
+	now = now.Add(5 * time.Second)
+	rec = get()
+	assert.Equal(t, "25", rec.Header().Get("X-RateLimit-Reset"))
+	secs, _ := strconv.Atoi(rec.Header().Get("Retry-After"))
+	assert.True(t, secs >= 5 && secs <= 8, "Retry-After %d", secs)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	REDIS_DIAL_TIMEOUT = 5 * time.Second
+	REDIS_IO_TIMEOUT   = 5 * time.Second
+	redisMaxIdleConns  = 8
+	redisIdleTimeout   = 4 * time.Minute
+)
+
+// newRedisPool returns a pool of connections to the Redis server at
+// rawURL, of the form redis[s]://[[user]:password@]host[:port][/db].
+// The URL is checked up front, but nothing is dialed until the pool is
+// first used.
+func newRedisPool(rawURL string) (*redis.Pool, error) {
+	if err := checkRedisURL(rawURL); err != nil {
+		return nil, err
+	}
+	return &redis.Pool{
+		MaxIdle:     redisMaxIdleConns,
+		IdleTimeout: redisIdleTimeout,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(rawURL,
+				redis.DialConnectTimeout(REDIS_DIAL_TIMEOUT),
+				redis.DialReadTimeout(REDIS_IO_TIMEOUT),
+				redis.DialWriteTimeout(REDIS_IO_TIMEOUT))
+		},
+	}, nil
+}
+
+// checkRedisURL returns an error if rawURL isn't one redis.DialURL can
+// use, so that a bad REDIS_URL is caught at startup rather than on the
+// first login.
+func checkRedisURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("Error parsing Redis URL: %v", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return fmt.Errorf("Redis URL `%s` must start with redis:// or rediss://",
+			rawURL)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("Redis URL `%s` has no host", rawURL)
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err := strconv.Atoi(db); err != nil {
+			return fmt.Errorf("Invalid Redis database `%s`", db)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cryptag/minishare/miniware"
+	"github.com/gomodule/redigo/redis"
+)
+
+const redisKeyPrefix = "effective:"
+
+// How long Redis keeps an auth token around after it expires, so that
+// using it gets ErrAuthTokenExpired (as with the Mapper until it's
+// reaped) rather than looking like a token that never existed
+const REDIS_EXPIRED_TOKEN_GRACE = 10 * time.Minute
+
+// redisRevokeAllScript deletes every token in the set KEYS[1] (whose
+// keys are ARGV[1] + token) and then the set itself, atomically.
+var redisRevokeAllScript = redis.NewScript(1, `
+local n = 0
+for _, token in ipairs(redis.call('SMEMBERS', KEYS[1])) do
+	n = n + redis.call('DEL', ARGV[1] .. token)
+end
+redis.call('DEL', KEYS[1])
+return n`)
+
+// redisSetLastSeenScript sets the last_seen field of the hash KEYS[1]
+// to ARGV[1] if that's later, returning 0 if there's no such hash
+// (e.g., the token was just revoked) or it was created no later than
+// ARGV[2] (i.e., it's expired) rather than touching it.
+var redisSetLastSeenScript = redis.NewScript(1, `
+local created = tonumber(redis.call('HGET', KEYS[1], 'created'))
+if not created or created <= tonumber(ARGV[2]) then
+	return 0
+end
+local last = tonumber(redis.call('HGET', KEYS[1], 'last_seen'))
+if not last or last < tonumber(ARGV[1]) then
+	redis.call('HSET', KEYS[1], 'last_seen', ARGV[1])
+end
+return 1`)
+
+// newSessionStore returns the auth token store cfg asks for: in
+// memory (the default), or Redis so that sessions survive restarts
+// and are shared between replicas.
+func newSessionStore(cfg *Config) (Store, error) {
+	switch cfg.SessionStore {
+	case "", "memory":
+		return NewMapperWithTTL(cfg.AuthTokenTTL), nil
+	case "redis":
+		if cfg.RedisURL == "" {
+			return nil, fmt.Errorf("REDIS_URL must be set to use the redis session store")
+		}
+		return NewRedisStore(cfg.RedisURL, cfg.AuthTokenTTL)
+	}
+	return nil, fmt.Errorf("Unknown session store `%s`; must be `memory` or `redis`",
+		cfg.SessionStore)
+}
+
+// RedisStore is a Store backed by Redis. Each auth token is a hash,
+// and each miniLock ID has a set of its tokens for listing and
+// revoking them. Like the Mapper, tokens expire ttl after they're set;
+// Redis itself deletes them REDIS_EXPIRED_TOKEN_GRACE after that.
+type RedisStore struct {
+	pool *redis.Pool
+	ttl  time.Duration // 0 means auth tokens never expire
+	now  func() time.Time
+}
+
+func NewRedisStore(redisURL string, ttl time.Duration) (*RedisStore, error) {
+	pool, err := newRedisPool(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisStore{pool: pool, ttl: ttl, now: time.Now}, nil
+}
+
+func redisTokenKey(authToken string) string {
+	return redisKeyPrefix + "token:" + authToken
+}
+
+func redisMinilockIDKey(mID string) string {
+	return redisKeyPrefix + "minilock_id:" + mID
+}
+
+func (rs *RedisStore) expired(created time.Time) bool {
+	return rs.ttl > 0 && rs.now().Sub(created) >= rs.ttl
+}
+
+// GetMinilockID returns the miniLock ID that authToken maps to.
+// Expired tokens are deleted as they're encountered, returning
+// ErrAuthTokenExpired.
+func (rs *RedisStore) GetMinilockID(authToken string) (string, error) {
+	fields, err := redis.Strings(rs.do("HMGET", redisTokenKey(authToken),
+		"minilock_id", "created"))
+	if err != nil {
+		return "", err
+	}
+	mID := fields[0]
+	if mID == "" {
+		return "", miniware.ErrAuthTokenNotFound
+	}
+	if rs.expired(parseRedisMillis(fields[1])) {
+		rs.revoke(authToken, mID)
+		return "", ErrAuthTokenExpired
+	}
+	return mID, nil
+}
+
+func (rs *RedisStore) SetMinilockID(authToken, mID string) error {
+	tokenKey, idKey := redisTokenKey(authToken), redisMinilockIDKey(mID)
+
+	cmds := [][]interface{}{
+		{"HSET", tokenKey, "minilock_id", mID,
+			"created", formatRedisMillis(rs.now())},
+		{"SADD", idKey, authToken},
+	}
+	if rs.ttl > 0 {
+		// The set outlives each of its tokens since it's refreshed
+		// by every login
+		keep := int64((rs.ttl + REDIS_EXPIRED_TOKEN_GRACE) / time.Millisecond)
+		cmds = append(cmds, []interface{}{"PEXPIRE", tokenKey, keep},
+			[]interface{}{"PEXPIRE", idKey, keep})
+	}
+
+	_, err := rs.exec(cmds)
+	return err
+}
+
+func (rs *RedisStore) DeleteMinilockID(authToken string) error {
+	// Expired or not, as the Mapper does
+	mID, err := redis.String(rs.do("HGET", redisTokenKey(authToken),
+		"minilock_id"))
+	if err == redis.ErrNil {
+		return miniware.ErrAuthTokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := rs.revoke(authToken, mID)
+	if err != nil {
+		return err
+	}
+	// Revoked since we looked it up
+	if n == 0 {
+		return miniware.ErrAuthTokenNotFound
+	}
+	return nil
+}
+
+// revoke deletes authToken, which maps to mID, returning how many
+// tokens were deleted (0 if it already was).
+func (rs *RedisStore) revoke(authToken, mID string) (int64, error) {
+	results, err := rs.exec([][]interface{}{
+		{"DEL", redisTokenKey(authToken)},
+		{"SREM", redisMinilockIDKey(mID), authToken},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int64(results[0], nil)
+}
+
+func (rs *RedisStore) SetLastSeen(authToken string, at time.Time) error {
+	cutoff := "0"
+	if rs.ttl > 0 {
+		cutoff = formatRedisMillis(rs.now().Add(-rs.ttl))
+	}
+
+	conn := rs.pool.Get()
+	defer conn.Close()
+	n, err := redis.Int(redisSetLastSeenScript.Do(conn,
+		redisTokenKey(authToken), formatRedisMillis(at), cutoff))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return miniware.ErrAuthTokenNotFound
+	}
+	return nil
+}
+
+func (rs *RedisStore) Sessions(mID string) ([]Session, error) {
+	idKey := redisMinilockIDKey(mID)
+	tokens, err := redis.Strings(rs.do("SMEMBERS", idKey))
+	if err != nil || len(tokens) == 0 {
+		return nil, err
+	}
+
+	var cmds [][]interface{}
+	for _, authToken := range tokens {
+		cmds = append(cmds, []interface{}{"HMGET", redisTokenKey(authToken),
+			"created", "last_seen"})
+	}
+	replies, err := rs.pipeline(cmds)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []Session
+	var gone []interface{}
+	for i, reply := range replies {
+		fields, err := redis.Strings(reply, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) != 2 || fields[0] == "" {
+			gone = append(gone, tokens[i])
+			continue
+		}
+		created := parseRedisMillis(fields[0])
+		if rs.expired(created) {
+			continue
+		}
+		sessions = append(sessions, Session{
+			AuthToken: tokens[i],
+			Created:   created,
+			LastSeen:  parseRedisMillis(fields[1]),
+		})
+	}
+	if len(gone) > 0 {
+		rs.do("SREM", append([]interface{}{idKey}, gone...)...)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+	return sessions, nil
+}
+
+func (rs *RedisStore) DeleteAllForMinilockID(mID string) (int, error) {
+	conn := rs.pool.Get()
+	defer conn.Close()
+	return redis.Int(redisRevokeAllScript.Do(conn, redisMinilockIDKey(mID),
+		redisKeyPrefix+"token:"))
+}
+
+func (rs *RedisStore) Ping() error {
+	_, err := rs.do("PING")
+	return err
+}
+
+// do sends a single command and returns its reply.
+func (rs *RedisStore) do(cmd string, args ...interface{}) (interface{}, error) {
+	conn := rs.pool.Get()
+	defer conn.Close()
+	return conn.Do(cmd, args...)
+}
+
+// pipeline sends cmds (each a command name followed by its args) over
+// one connection and returns each of their replies, or the first error
+// reply as err.
+func (rs *RedisStore) pipeline(cmds [][]interface{}) ([]interface{}, error) {
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	for _, cmd := range cmds {
+		if err := conn.Send(cmd[0].(string), cmd[1:]...); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	for i := range cmds {
+		reply, err := conn.Receive()
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// exec runs cmds (as for pipeline) in a MULTI ... EXEC transaction,
+// returning their replies.
+func (rs *RedisStore) exec(cmds [][]interface{}) ([]interface{}, error) {
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		if err := conn.Send(cmd[0].(string), cmd[1:]...); err != nil {
+			return nil, err
+		}
+	}
+	results, err := redis.Values(conn.Do("EXEC"))
+	if err == redis.ErrNil {
+		return nil, fmt.Errorf("Redis transaction aborted")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		if rerr, ok := result.(redis.Error); ok {
+			return nil, rerr
+		}
+	}
+	return results, nil
+}
+
+func parseRedisMillis(field string) time.Time {
+	if field == "" {
+		return time.Time{}
+	}
+	ms, _ := strconv.ParseInt(field, 10, 64)
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// API keys (see APIKeyStore) are hashes under their secret's hash,
+// expiring with the key if it does, and each miniLock ID has a set of
+// its keys' hashes.
+
+func redisAPIKeyKey(keyHash string) string {
+	return redisKeyPrefix + "apikey:" + keyHash
+}
+
+func redisAPIKeysKey(mID string) string {
+	return redisKeyPrefix + "apikeys:" + mID
+}
+
+var redisAPIKeyFields = []interface{}{"minilock_id", "id", "name", "created",
+	"expires_at"}
+
+func (rs *RedisStore) AddAPIKey(keyHash string, key APIKey) error {
+	expiresAt := ""
+	if key.ExpiresAt != nil {
+		expiresAt = formatRedisMillis(*key.ExpiresAt)
+	}
+	keyKey := redisAPIKeyKey(keyHash)
+
+	cmds := [][]interface{}{
+		{"HSET", keyKey, "minilock_id", key.MinilockID, "id", key.ID,
+			"name", key.Name, "created", formatRedisMillis(key.Created),
+			"expires_at", expiresAt},
+		{"SADD", redisAPIKeysKey(key.MinilockID), keyHash},
+	}
+	if expiresAt != "" {
+		cmds = append(cmds, []interface{}{"PEXPIREAT", keyKey, expiresAt})
+	}
+
+	_, err := rs.exec(cmds)
+	return err
+}
+
+func (rs *RedisStore) GetAPIKey(keyHash string) (*APIKey, error) {
+	fields, err := redis.Strings(rs.do("HMGET", append([]interface{}{
+		redisAPIKeyKey(keyHash)}, redisAPIKeyFields...)...))
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parseRedisAPIKey(fields)
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	return key, nil
+}
+
+func (rs *RedisStore) APIKeys(mID string) ([]APIKey, error) {
+	hashes, err := rs.apiKeyHashes(mID)
+	if err != nil || len(hashes) == 0 {
+		return nil, err
+	}
+
+	var cmds [][]interface{}
+	for _, keyHash := range hashes {
+		cmds = append(cmds, append([]interface{}{"HMGET",
+			redisAPIKeyKey(keyHash)}, redisAPIKeyFields...))
+	}
+	replies, err := rs.pipeline(cmds)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []APIKey
+	var expired []interface{}
+	for i, reply := range replies {
+		fields, err := redis.Strings(reply, nil)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := parseRedisAPIKey(fields)
+		if !ok {
+			expired = append(expired, hashes[i])
+			continue
+		}
+		keys = append(keys, *key)
+	}
+	if len(expired) > 0 {
+		rs.do("SREM", append([]interface{}{redisAPIKeysKey(mID)}, expired...)...)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	return keys, nil
+}
+
+func (rs *RedisStore) DeleteAPIKey(mID, id string) error {
+	hashes, err := rs.apiKeyHashes(mID)
+	if err != nil {
+		return err
+	}
+	for _, keyHash := range hashes {
+		if keyHash[:apiKeyIDLen] != id {
+			continue
+		}
+		results, err := rs.exec([][]interface{}{
+			{"DEL", redisAPIKeyKey(keyHash)},
+			{"SREM", redisAPIKeysKey(mID), keyHash},
+		})
+		if err != nil {
+			return err
+		}
+		// Expired since it was listed
+		if n, _ := results[0].(int64); n == 0 {
+			return ErrAPIKeyNotFound
+		}
+		return nil
+	}
+	return ErrAPIKeyNotFound
+}
+
+func (rs *RedisStore) apiKeyHashes(mID string) ([]string, error) {
+	members, err := redis.Strings(rs.do("SMEMBERS", redisAPIKeysKey(mID)))
+	if err != nil {
+		return nil, err
+	}
+	var hashes []string
+	for _, keyHash := range members {
+		if len(keyHash) >= apiKeyIDLen {
+			hashes = append(hashes, keyHash)
+		}
+	}
+	return hashes, nil
+}
+
+// parseRedisAPIKey parses the reply to an HMGET of redisAPIKeyFields,
+// reporting false if the key doesn't exist (anymore).
+func parseRedisAPIKey(fields []string) (*APIKey, bool) {
+	if len(fields) != len(redisAPIKeyFields) || fields[0] == "" {
+		return nil, false
+	}
+	key := &APIKey{
+		MinilockID: fields[0],
+		ID:         fields[1],
+		Name:       fields[2],
+		Created:    parseRedisMillis(fields[3]).UTC(),
+	}
+	if fields[4] != "" {
+		expiresAt := parseRedisMillis(fields[4]).UTC()
+		key.ExpiresAt = &expiresAt
+	}
+	return key, true
+}
+
+func formatRedisMillis(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
@@ -0,0 +1,138 @@
+//go:build redis
+// +build redis
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cryptag/minishare/miniware"
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run with: REDIS_URL=redis://localhost:6379/15 go test -tags redis
+func newTestRedisStore(t *testing.T, ttl time.Duration) *RedisStore {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		t.Skip("REDIS_URL not set")
+	}
+	rs, err := NewRedisStore(redisURL, ttl)
+	require.NoError(t, err)
+	require.NoError(t, rs.Ping())
+	return rs
+}
+
+func TestRedisStore(t *testing.T) {
+	rs := newTestRedisStore(t, time.Hour)
+	mID := testMinilockID(t, newTestKeypair(t))
+
+	require.NoError(t, rs.SetMinilockID("redis-token-1", mID))
+	require.NoError(t, rs.SetMinilockID("redis-token-2", mID))
+
+	got, err := rs.GetMinilockID("redis-token-1")
+	require.NoError(t, err)
+	assert.Equal(t, mID, got)
+
+	sessions, err := rs.Sessions(mID)
+	require.NoError(t, err)
+	assert.Len(t, sessions, 2)
+
+	seen := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	require.NoError(t, rs.SetLastSeen("redis-token-1", seen))
+	require.NoError(t, rs.SetLastSeen("redis-token-1", seen.Add(-time.Hour)))
+	sessions, err = rs.Sessions(mID)
+	require.NoError(t, err)
+	for _, s := range sessions {
+		assert.Equal(t, s.AuthToken == "redis-token-1", seen.Equal(s.LastSeen))
+	}
+
+	require.NoError(t, rs.DeleteMinilockID("redis-token-1"))
+	assert.Equal(t, miniware.ErrAuthTokenNotFound, rs.DeleteMinilockID("redis-token-1"))
+	assert.Equal(t, miniware.ErrAuthTokenNotFound,
+		rs.SetLastSeen("redis-token-1", seen))
+	_, err = rs.GetMinilockID("redis-token-1")
+	assert.Equal(t, miniware.ErrAuthTokenNotFound, err)
+
+	n, err := rs.DeleteAllForMinilockID(mID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = rs.GetMinilockID("redis-token-2")
+	assert.Equal(t, miniware.ErrAuthTokenNotFound, err)
+}
+
+func TestRedisStoreTTL(t *testing.T) {
+	rs := newTestRedisStore(t, time.Hour)
+	now := time.Now()
+	rs.now = func() time.Time { return now }
+	mID := testMinilockID(t, newTestKeypair(t))
+
+	require.NoError(t, rs.SetMinilockID("redis-expiring", mID))
+
+	// Redis itself must be expiring the key, a while after it expires
+	pttl, err := redis.Int64(rs.do("PTTL", redisTokenKey("redis-expiring")))
+	require.NoError(t, err)
+	keep := int64((time.Hour + REDIS_EXPIRED_TOKEN_GRACE) / time.Millisecond)
+	assert.True(t, pttl > 0 && pttl <= keep, "PTTL = %v", pttl)
+
+	now = now.Add(time.Hour)
+	sessions, err := rs.Sessions(mID)
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+	assert.Equal(t, miniware.ErrAuthTokenNotFound,
+		rs.SetLastSeen("redis-expiring", now))
+
+	// Reported as expired, like the Mapper does, then gone
+	_, err = rs.GetMinilockID("redis-expiring")
+	assert.Equal(t, ErrAuthTokenExpired, err)
+	_, err = rs.GetMinilockID("redis-expiring")
+	assert.Equal(t, miniware.ErrAuthTokenNotFound, err)
+}
+
+func TestRedisStoreRouter(t *testing.T) {
+	rs := newTestRedisStore(t, time.Hour)
+	router := mustNewRouter(rs)
+	keypair := newTestKeypair(t)
+
+	authToken := testLogin(t, router, keypair)
+	testLogin(t, router, keypair)
+	assert.Len(t, testSessions(t, router, authToken), 2)
+
+	testURL(t, "POST", "/api/sessions/revoke-all",
+		http.Header{"Authorization": []string{authToken}}, router,
+		http.StatusOK, `{"revoked":2}`)
+}
+
+func TestRedisStoreAPIKeys(t *testing.T) {
+	rs := newTestRedisStore(t, time.Hour)
+	mID := testMinilockID(t, newTestKeypair(t))
+	keyHash := hashAPIKey("redis-api-key")
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	require.NoError(t, rs.AddAPIKey(keyHash, APIKey{
+		ID:         keyHash[:apiKeyIDLen],
+		MinilockID: mID,
+		Name:       "backups",
+		Created:    time.Now().UTC().Truncate(time.Second),
+		ExpiresAt:  &expiresAt,
+	}))
+
+	key, err := rs.GetAPIKey(keyHash)
+	require.NoError(t, err)
+	assert.Equal(t, mID, key.MinilockID)
+	assert.Equal(t, expiresAt, *key.ExpiresAt)
+
+	keys, err := rs.APIKeys(mID)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, "backups", keys[0].Name)
+
+	require.NoError(t, rs.DeleteAPIKey(mID, keyHash[:apiKeyIDLen]))
+	assert.Equal(t, ErrAPIKeyNotFound, rs.DeleteAPIKey(mID, keyHash[:apiKeyIDLen]))
+	_, err = rs.GetAPIKey(keyHash)
+	assert.Equal(t, ErrAPIKeyNotFound, err)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSessionStore(t *testing.T) {
+	cfg := testConfig()
+	store, err := newSessionStore(cfg)
+	require.NoError(t, err)
+	assert.IsType(t, &Mapper{}, store)
+
+	cfg.SessionStore = "redis"
+	_, err = newSessionStore(cfg)
+	assert.Error(t, err, "REDIS_URL is required")
+
+	// Nothing's dialed until it's used
+	cfg.RedisURL = "redis://:secret@cache.internal/2"
+	store, err = newSessionStore(cfg)
+	require.NoError(t, err)
+	assert.IsType(t, &RedisStore{}, store)
+
+	for redisURL, want := range map[string]string{
+		"http://cache.internal":    "Redis URL `http://cache.internal` must start with redis:// or rediss://",
+		"rediss:///2":              "Redis URL `rediss:///2` has no host",
+		"redis://cache.internal/a": "Invalid Redis database `a`",
+		"not a url":                "Redis URL `not a url` must start with redis:// or rediss://",
+	} {
+		cfg.RedisURL = redisURL
+		_, err = newSessionStore(cfg)
+		assert.EqualError(t, err, want, redisURL)
+	}
+
+	cfg.SessionStore = "memcached"
+	_, err = newSessionStore(cfg)
+	assert.Error(t, err)
+}
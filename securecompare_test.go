@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecureCompare(t *testing.T) {
+	assert.True(t, secureCompare("s3cret-token", "s3cret-token"))
+	assert.True(t, secureCompare("", ""))
+
+	assert.False(t, secureCompare("s3cret-tokem", "s3cret-token"))
+	assert.False(t, secureCompare("s3cret", "s3cret-token"))
+	assert.False(t, secureCompare("s3cret-token-and-more", "s3cret-token"))
+	assert.False(t, secureCompare("", "s3cret-token"))
+	assert.False(t, secureCompare("S3CRET-TOKEN", "s3cret-token"))
+}
+
+func TestBasicAuth(t *testing.T) {
+	h := basicAuth("team", "correct horse battery staple")(
+		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+
+	for _, creds := range []struct {
+		user, pass string
+		status     int
+	}{
+		{"team", "correct horse battery staple", http.StatusOK},
+		{"team", "correct horse battery stapler", http.StatusUnauthorized},
+		{"tea", "correct horse battery staple", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(creds.user, creds.pass)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, creds.status, rec.Code, creds.user+":"+creds.pass)
+	}
+}
+
+func TestSessionsCurrentNeedsExactToken(t *testing.T) {
+	m := NewMapper()
+	router := mustNewRouter(m)
+	keypair := newTestKeypair(t)
+
+	authToken := testLogin(t, router, keypair)
+	mID, err := keypair.EncodeID()
+	require.NoError(t, err)
+	// A token sharing all but its last character with authToken
+	similar := authToken[:len(authToken)-1] + "x"
+	if similar == authToken {
+		similar = authToken[:len(authToken)-1] + "y"
+	}
+	require.NoError(t, m.SetMinilockID(similar, mID))
+	// ...and one the same length with nothing in common
+	different := strings.Repeat("0", len(authToken))
+	require.NoError(t, m.SetMinilockID(different, mID))
+
+	for _, token := range []string{authToken, similar, different} {
+		current := 0
+		for _, s := range testSessions(t, router, token) {
+			if s.Current {
+				current++
+				assert.Equal(t, tokenFingerprint(token), s.Fingerprint)
+			}
+		}
+		assert.Equal(t, 1, current, token)
+	}
+}
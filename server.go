@@ -1,25 +1,29 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"net/http/pprof"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/cryptag/gosecure/canary"
 	"github.com/cryptag/gosecure/content"
-	"github.com/cryptag/gosecure/csp"
 	"github.com/cryptag/gosecure/frame"
-	"github.com/cryptag/gosecure/hsts"
 	"github.com/cryptag/gosecure/referrer"
+	"github.com/cryptag/gosecure/set"
 	"github.com/cryptag/gosecure/xss"
 	"github.com/cryptag/minishare/miniware"
-	"github.com/goji/httpauth"
 
 	log "github.com/Sirupsen/logrus"
 	minilock "github.com/cathalgarvey/go-minilock"
@@ -32,183 +36,966 @@ import (
 
 const (
 	MINILOCK_ID_KEY = "minilock_id"
+
+	// miniLock IDs are a base58-encoded 32-byte public key plus a
+	// 1-byte checksum, which is at most 46 characters
+	MINILOCK_ID_MIN_LEN = 40
+	MINILOCK_ID_MAX_LEN = 46
+
+	base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
 )
 
 var (
-	DEFAULT_POSTGREST_BASE_URL = "http://localhost:3000/"
-	POSTGREST_BASE_URL         = os.Getenv("INTERNAL_POSTGREST_BASE_URL")
-
-	basicAuthUsername = os.Getenv("REACT_APP_BASIC_AUTH_USERNAME")
-	basicAuthPassword = os.Getenv("REACT_APP_BASIC_AUTH_PASSWORD")
-	basicAuthWrapper  = httpauth.SimpleBasicAuth(
-		basicAuthUsername,
-		basicAuthPassword,
-	)
+	ErrMinilockIDEmpty   = errors.New("miniLock ID is empty")
+	ErrMinilockIDLength  = fmt.Errorf("miniLock ID must be %d-%d characters long", MINILOCK_ID_MIN_LEN, MINILOCK_ID_MAX_LEN)
+	ErrMinilockIDCharset = errors.New("miniLock ID must be base58-encoded")
 )
 
-func init() {
-	if POSTGREST_BASE_URL == "" {
-		POSTGREST_BASE_URL = DEFAULT_POSTGREST_BASE_URL
+// NewRouter returns the app's router, sending challenges and auth
+// tokens from keys. If metrics isn't nil, it's served at /metrics and
+// its routes are labeled for it. If health isn't nil, its checks
+// decide which PostgREST upstreams are used and whether we're ready.
+// readiness serves /readyz; if it's nil, the router makes its own.
+// Logins, logouts, and the like are recorded in audit, if it isn't nil.
+func NewRouter(cfg *Config, m Store, keys *ServerKeys, metrics *Metrics, health *UpstreamHealthChecker, readiness *ReadinessChecker, audit *AuditLog, blocklist *Blocklist) (*mux.Router, error) {
+	r := mux.NewRouter()
+
+	if readiness == nil {
+		readiness = NewReadinessChecker(cfg.PostgrestPrimaryURL(), health, m)
 	}
-}
 
-func NewRouter(m *miniware.Mapper) *mux.Router {
-	r := mux.NewRouter()
+	// Probes; never behind basic auth
+	r.HandleFunc("/healthz", Healthz).Methods("GET", "HEAD")
+	r.Handle("/readyz", readiness).Methods("GET", "HEAD")
+	r.HandleFunc("/api/version", Version).Methods("GET", "HEAD")
+	r.HandleFunc("/api/ping", Ping).Methods("GET", "HEAD")
+	// Public, so never behind basic auth either
+	r.HandleFunc("/api/server-key", ServerKey(keys)).Methods("GET", "HEAD")
+
+	// Look for API keys alongside the sessions, then have every
+	// authenticated request note when its session was last seen
+	apiKeys := newAPIKeyStore(m)
+	m = NewLastSeenTracker(m, cfg.LastSeenInterval)
+
+	// Logins can only add up to so many sessions
+	capped := NewSessionCap(m, cfg.MaxSessions, cfg.MaxSessionsReject)
+
+	challenges := NewChallengeStore(CHALLENGE_TTL)
+	lockout := NewLoginLockout(cfg.LoginLockoutThreshold,
+		cfg.LoginLockoutBaseDelay, cfg.LoginLockoutMaxDelay,
+		cfg.LoginLockoutCooldown)
+
+	// Each of these does a miniLock encryption, so throttle them
+	loginLimiter := NewRateLimiter(cfg.LoginRateLimitBurst,
+		cfg.LoginRateLimitInterval)
+	limit := func(h http.HandlerFunc) http.Handler {
+		return LimitByIP(h, loginLimiter, cfg.TrustedProxies)
+	}
+	// ...and per miniLock ID too, however many IPs it's spread across
+	var idLimiter *RateLimiter
+	if cfg.LoginIDRateLimitBurst > 0 {
+		idLimiter = NewRateLimiter(cfg.LoginIDRateLimitBurst,
+			cfg.LoginIDRateLimitInterval)
+	}
+
+	r.Handle("/api/challenge", limit(Challenge(challenges, keys))).Methods("GET")
+	r.Handle("/api/login", limit(LoginPost(capped, cfg.AuthTokenTTL, blocklist,
+		idLimiter, cfg.LoginEncryptErrors, challenges, keys, lockout, audit,
+		cfg.TrustedProxies))).Methods("POST")
+	r.HandleFunc("/api/logout", Logout(m, audit)).Methods("GET", "POST")
+	r.HandleFunc("/api/whoami", Whoami(m)).Methods("GET")
+	r.HandleFunc("/api/sessions", Sessions(m)).Methods("GET")
+	r.HandleFunc("/api/sessions/revoke-all", RevokeAllSessions(m, audit)).Methods("POST")
+
+	r.HandleFunc("/api/apikeys", CreateAPIKey(m, apiKeys, audit)).Methods("POST")
+	r.HandleFunc("/api/apikeys", ListAPIKeys(m, apiKeys)).Methods("GET")
+	r.HandleFunc("/api/apikeys/{id}", RevokeAPIKey(m, apiKeys, audit)).Methods("DELETE")
+
+	r.HandleFunc(CSP_REPORT_PATH, CSPReport(cfg.TrustedProxies)).Methods("POST")
 
-	r.HandleFunc("/api/login", Login(m)).Methods("GET")
+	postgrestProxy, err := newPostgrestProxy(cfg, health)
+	if err != nil {
+		return nil, err
+	}
 
-	// Hack to make up for the fact that
-	//   r.NotFoundHandler = http.HandlerFunc(GetIndex)
-	// doesn't do anything, since the below
-	//   r.PathPrefix("/").Handler(...)
-	// call returns its own 404, ignoring the value of
-	//   r.NotFoundHandler
-	for i := 0; i < 10; i++ {
-		r.PathPrefix("/" + fmt.Sprintf("%d", i)).HandlerFunc(GetIndex)
+	postgrestPrefix := cfg.PostgrestPrefix()
+	handlePostgrest := ExtendDeadlines(cfg.PostgrestWriteTimeout)(
+		Compress(http.StripPrefix(postgrestPrefix, postgrestProxy)))
+	if cfg.PostgrestMaxRequestBodySize > 0 {
+		handlePostgrest = RaiseRequestBodyLimit(
+			cfg.PostgrestMaxRequestBodySize)(handlePostgrest)
 	}
-	r.PathPrefix("/dashboard").HandlerFunc(GetIndex)
-	r.PathPrefix("/pursuance").HandlerFunc(GetIndex)
 
-	postgrestAPI, _ := url.Parse(POSTGREST_BASE_URL)
+	if cfg.PostgrestJWTSecret != "" {
+		handlePostgrest = postgrestJWTAuth(handlePostgrest,
+			[]byte(cfg.PostgrestJWTSecret), NewTokenAuthenticator(m),
+			NewAPIKeyAuthenticator(apiKeys))
+	} else if err := checkPostgrestJWTSecret(cfg); err != nil {
+		return nil, err
+	} else {
+		log.Warn("POSTGREST_JWT_SECRET not set; requests to PostgREST" +
+			" will NOT be authenticated")
+	}
 
-	handlePostgrest := http.StripPrefix("/postgrest",
-		httputil.NewSingleHostReverseProxy(postgrestAPI))
-	handleBuildDir := http.FileServer(http.Dir("./build"))
+	ipFilter, err := NewIPFilter(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	if basicAuthUsername != "" && basicAuthPassword != "" {
-		log.Println("HTTP Basic Auth: enabled")
-		handlePostgrest = basicAuthWrapper(handlePostgrest)
-		handleBuildDir = basicAuthWrapper(handleBuildDir)
+	spa := buildFSHandler()
+	spa.Push = cfg.HTTP2Push
+	spa.DirIndex = cfg.DirectoryIndex
+	if err := spa.LoadIndex(); err != nil {
+		if cfg.Prod {
+			return nil, fmt.Errorf("Error loading %s/index.html; run `npm run build`"+
+				" before starting in production: %v", BUILD_DIR, err)
+		}
+		log.Warnf("**************************************************************")
+		log.Warnf("Error loading %s/index.html: %v", BUILD_DIR, err)
+		log.Warnf("Serving a placeholder page until you run `npm run build`")
+		log.Warnf("**************************************************************")
+		spa.Placeholder = true
 	}
+	handleBuildDir := Compress(spa)
+
+	var handleMetrics http.Handler = metrics
+
+	// Wraps admin routes; nil unless they can be protected
+	var adminAuth func(http.Handler) http.Handler
 
-	r.PathPrefix("/postgrest").Handler(handlePostgrest)
+	if cfg.BasicAuthEnabled() {
+		log.Printf("HTTP Basic Auth: enabled for %s", cfg.BasicAuthRoutes)
+		basicAuthWrapper := basicAuth(cfg.BasicAuthUsername, cfg.BasicAuthPassword)
+		if cfg.BasicAuthProtects(basicAuthAPI) {
+			handlePostgrest = basicAuthWrapper(handlePostgrest)
+		}
+		if cfg.BasicAuthProtects(basicAuthApp) {
+			handleBuildDir = basicAuthWrapper(handleBuildDir)
+		}
+		if cfg.BasicAuthProtects(basicAuthAdmin) {
+			adminAuth = basicAuthWrapper
+		}
+	}
+
+	if cfg.ClientCAFile != "" {
+		clientCertAuth := NewClientCertAuth(splitList(cfg.ClientCertSubjects))
+		switch {
+		case adminAuth == nil:
+			log.Println("TLS client cert auth for admin routes: enabled")
+			adminAuth = clientCertAuth.Middleware
+		case cfg.AdminAuthMode == "any":
+			log.Println("TLS client cert auth for admin routes: enabled," +
+				" as an alternative to Basic Auth")
+			adminAuth = RequireAuth(clientCertAuth, NewBasicAuthenticator(
+				cfg.BasicAuthUsername, cfg.BasicAuthPassword))
+		default:
+			log.Println("TLS client cert auth for admin routes: enabled," +
+				" along with Basic Auth")
+			basicAuthWrapper := adminAuth
+			adminAuth = func(h http.Handler) http.Handler {
+				return clientCertAuth.Middleware(basicAuthWrapper(h))
+			}
+		}
+	}
+	if adminAuth != nil {
+		handleMetrics = adminAuth(handleMetrics)
+	}
+
+	if adminAuth != nil {
+		// Only exposed when it can be protected
+		wrap := adminAuth
+		adminAuth = func(h http.Handler) http.Handler {
+			return ipFilter.Middleware(wrap(h))
+		}
+		r.Handle("/internal/reload",
+			adminAuth(http.HandlerFunc(ReloadIndex(spa)))).Methods("POST")
+		r.Handle("/api/loglevel",
+			adminAuth(http.HandlerFunc(GetLogLevel))).Methods("GET")
+		r.Handle("/api/loglevel",
+			adminAuth(http.HandlerFunc(SetLogLevel))).Methods("PUT")
+		r.Handle("/internal/introspect",
+			adminAuth(Introspect(m, cfg.AuthTokenTTL))).Methods("POST")
+		r.Handle("/internal/audit-tail",
+			adminAuth(AuditTail(audit))).Methods("GET")
+		r.Handle("/debug/routes", adminAuth(DebugRoutes(r))).Methods("GET")
+		handlePprof(r, adminAuth)
+	} else {
+		// Rather than fall through to the build dir
+		r.Path("/internal/introspect").Handler(http.NotFoundHandler())
+		r.Path("/internal/audit-tail").Handler(http.NotFoundHandler())
+		r.Path("/debug/routes").Handler(http.NotFoundHandler())
+		r.PathPrefix("/debug/pprof").Handler(http.NotFoundHandler())
+	}
+
+	// Checked before basic auth so that outsiders don't even get to
+	// try passwords
+	handlePostgrest = ipFilter.Middleware(handlePostgrest)
+	handleMetrics = ipFilter.Middleware(handleMetrics)
+
+	if metrics != nil {
+		r.Handle("/metrics", handleMetrics).Methods("GET")
+	}
+
+	// Holds TLS private keys
+	r.PathPrefix(postgrestPrefix + "/" + AUTOCERT_CACHE_TABLE).Handler(
+		http.NotFoundHandler())
+	// Unknown API routes get a JSON 404 rather than index.html (or
+	// PostgREST, if it's mounted at /), unless PostgREST is mounted
+	// under /api/ itself
+	r.PathPrefix("/api/").MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+		return postgrestPrefix == "" || (req.URL.Path != postgrestPrefix &&
+			!strings.HasPrefix(req.URL.Path, postgrestPrefix+"/"))
+	}).HandlerFunc(APINotFound(r)).Name(apiNotFoundRoute)
+	// Registered before the build dir so the catch-all below can't
+	// shadow it, but only matching whole path segments, so that
+	// e.g. /postgrest-docs isn't proxied
+	if postgrestPrefix != "" {
+		r.Path(postgrestPrefix).Handler(handlePostgrest)
+	}
+	r.PathPrefix(postgrestPrefix + "/").Handler(handlePostgrest)
 	r.PathPrefix("/").Handler(handleBuildDir).Methods("GET")
 
-	http.Handle("/", r)
-	return r
+	// Paths that only have routes for other methods (e.g., a POST to a
+	// static file)
+	r.MethodNotAllowedHandler = MethodNotAllowed(r)
+
+	if audit != nil {
+		auditRoutes(r, audit)
+	}
+	if metrics != nil {
+		labelRoutes(r)
+	}
+
+	return r, nil
 }
 
-func NewServer(m *miniware.Mapper, httpAddr string) *http.Server {
-	r := NewRouter(m)
+// The name of the route that catches unknown API routes
+const apiNotFoundRoute = "api_not_found"
 
-	return &http.Server{
-		Addr:         httpAddr,
-		ReadTimeout:  1000 * time.Second,
-		WriteTimeout: 1000 * time.Second,
-		IdleTimeout:  120 * time.Second,
-		Handler:      r,
+// APINotFound responds to requests for unknown API routes with a JSON
+// 404, or a 405 if r has routes for the path, just not for the
+// request's method.
+func APINotFound(r *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if allowed := allowedMethods(r, req); len(allowed) > 0 {
+			writeMethodNotAllowed(w, allowed)
+			return
+		}
+		WriteErrorStatus(w, "not found", nil, http.StatusNotFound)
+	}
+}
+
+// MethodNotAllowed responds with a JSON 405 and an Allow header
+// listing the methods r does have routes for at the request's path.
+func MethodNotAllowed(r *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		writeMethodNotAllowed(w, allowedMethods(r, req))
+	}
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed []string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	WriteErrorStatus(w, "method not allowed", nil,
+		http.StatusMethodNotAllowed)
+}
+
+// allowedMethods returns the methods, other than req's, that r would
+// route req's URL to a real handler for (i.e., not APINotFound), in
+// the order they're registered.
+func allowedMethods(r *mux.Router, req *http.Request) []string {
+	var methods []string
+	seen := map[string]bool{req.Method: true}
+	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		routeMethods, _ := route.GetMethods()
+		for _, method := range routeMethods {
+			if !seen[method] {
+				seen[method] = true
+				methods = append(methods, method)
+			}
+		}
+		return nil
+	})
+
+	var allowed []string
+	for _, method := range methods {
+		as := *req
+		as.Method = method
+		var match mux.RouteMatch
+		if r.Match(&as, &match) && match.MatchErr == nil &&
+			match.Route != nil && match.Route.GetName() != apiNotFoundRoute {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+// handlePprof registers the net/http/pprof handlers under
+// /debug/pprof/, each wrapped by auth.
+func handlePprof(r *mux.Router, auth func(http.Handler) http.Handler) {
+	r.Handle("/debug/pprof/cmdline", auth(http.HandlerFunc(pprof.Cmdline)))
+	r.Handle("/debug/pprof/profile", auth(http.HandlerFunc(pprof.Profile)))
+	r.Handle("/debug/pprof/symbol", auth(http.HandlerFunc(pprof.Symbol)))
+	r.Handle("/debug/pprof/trace", auth(http.HandlerFunc(pprof.Trace)))
+	// Serves the index and the named profiles (heap, goroutine, etc)
+	r.PathPrefix("/debug/pprof").Handler(auth(http.HandlerFunc(pprof.Index)))
+}
+
+// NewServer returns the app's server, adding our security headers
+// (with csp's Content-Security-Policy, unless csp is nil) to every
+// response, whether or not it's in production. PostgREST's health is
+// checked in the background, if enabled, and the login blocklist is
+// reloaded on every SIGHUP, until the server is shut down.
+func NewServer(cfg *Config, m Store, keys *ServerKeys, csp *CSPHolder) (*http.Server, error) {
+	metrics := NewMetrics(m)
+
+	health, err := NewUpstreamHealthChecker(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	blocklist, err := LoadBlocklist(cfg.LoginBlocklistFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Kept so that draining can fail /readyz; see OnDrain below
+	readiness := NewReadinessChecker(cfg.PostgrestPrimaryURL(), health, m)
+
+	audit, err := NewAuditLog(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewRouter(cfg, m, keys, metrics, health, readiness, audit,
+		blocklist)
+	if err != nil {
+		return nil, err
+	}
+
+	tracer, err := newTracer(cfg)
+	if err != nil {
+		return nil, err
 	}
+
+	chain, err := newServerChain(cfg, metrics, tracer, csp, r)
+	if err != nil {
+		return nil, err
+	}
+	chain.OnClose(tracer.Close)
+	chain.OnClose(audit.Close)
+
+	srv := &http.Server{
+		Addr:              cfg.HTTPAddr,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		HTTP2: &http.HTTP2Config{
+			MaxConcurrentStreams: cfg.HTTP2MaxConcurrentStreams,
+		},
+		Handler: chain,
+	}
+
+	// Turn load balancers away before we stop taking requests
+	chain.OnDrain(func() {
+		readiness.ShuttingDown()
+		if cfg.ShutdownDrainDelay > 0 {
+			log.Infof("Failing /readyz for %v before shutting down",
+				cfg.ShutdownDrainDelay)
+			time.Sleep(cfg.ShutdownDrainDelay)
+		}
+	})
+
+	if health != nil {
+		ctx, stop := context.WithCancel(context.Background())
+		health.Start(ctx)
+		srv.RegisterOnShutdown(stop)
+	}
+	if blocklist != nil {
+		ctx, stop := context.WithCancel(context.Background())
+		OnSIGHUP(ctx, func() {
+			if err := blocklist.Reload(); err != nil {
+				log.Errorf("Error reloading miniLock ID blocklist; keeping"+
+					" the old one: %v", err)
+				return
+			}
+			log.Infof("Reloaded miniLock ID blocklist: %d blocked",
+				blocklist.Len())
+		})
+		srv.RegisterOnShutdown(stop)
+	}
+	return srv, nil
+}
+
+// checkPostgrestJWTSecret refuses to run in production without
+// cfg.PostgrestJWTSecret, which would leave PostgREST unauthenticated.
+func checkPostgrestJWTSecret(cfg *Config) error {
+	if cfg.Prod && cfg.PostgrestJWTSecret == "" {
+		return fmt.Errorf("POSTGREST_JWT_SECRET must be set in" +
+			" production, or requests to PostgREST won't be authenticated")
+	}
+	return nil
 }
 
-func ProductionServer(srv *http.Server, httpsAddr string, domain string, manager *autocert.Manager) {
+// newServerChain puts h behind the middleware cfg calls for, in
+// middlewareOrder.
+func newServerChain(cfg *Config, metrics *Metrics, tracer *Tracer, csp *CSPHolder, h http.Handler) (*MiddlewareChain, error) {
+	chain := NewMiddlewareChain(h)
+	chain.Set(stageRecover, Recover(log.StandardLogger()))
+	chain.Set(stageAccessLog, AccessLog(log.StandardLogger(),
+		cfg.TrustedProxies))
+	chain.Set(stageMetrics, metrics.Middleware)
+	if tracer != nil {
+		chain.Set(stageTracing, tracer.Middleware)
+	}
+
+	if cfg.SlowRequestThreshold > 0 {
+		chain.Set(stageSlowRequests, SlowRequests(log.StandardLogger(),
+			cfg.SlowRequestThreshold))
+	}
+
+	chain.Set(stageSecurityHeaders, securityHeaders(cfg, csp).Then)
+
+	if cfg.MaxConcurrentRequests > 0 {
+		limiter := NewConcurrencyLimiter(cfg.MaxConcurrentRequests,
+			cfg.ConcurrencyQueueWait)
+		metrics.concurrency = limiter
+		chain.Set(stageConcurrency, limiter.Middleware)
+	}
+
+	chain.Set(stageMaintenance, NewMaintenanceMode(cfg).Middleware)
+	chain.Set(stageHeaderLimit, LimitRequestHeaders(cfg.MaxRequestHeaders))
+	chain.Set(stageBodyLimit, LimitRequestBody(cfg.MaxRequestBodySize))
+
+	cors, err := newCORS(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cors != nil {
+		chain.Set(stageCORS, cors.Middleware)
+	}
+	return chain, nil
+}
+
+// securityHeaders returns the middleware that adds our security
+// headers to every response, including csp's Content-Security-Policy
+// unless csp is nil. HSTS is only sent over TLS, and only in
+// production, since browsers would remember it for localhost, too.
+func securityHeaders(cfg *Config, csp *CSPHolder) alice.Chain {
 	gotWarrant := false
-	middleware := alice.New(canary.GetHandler(&gotWarrant),
-		csp.GetCustomHandlerStyleUnsafeInline(domain, domain),
-		hsts.PreloadHandler, frame.DenyHandler, content.GetHandler,
-		xss.GetHandler, referrer.NoHandler)
+	middleware := alice.New(canary.GetHandler(&gotWarrant))
+	if csp != nil {
+		middleware = middleware.Append(CSPMiddleware(csp))
+	}
+	if cfg.Prod {
+		middleware = middleware.Append(overTLS(hstsHandler(cfg)))
+	}
+	return middleware.Append(frame.DenyHandler, content.GetHandler,
+		xss.GetHandler, referrer.NoHandler, PolicyHeaders(cfg))
+}
+
+// hstsHandler returns middleware adding the Strict-Transport-Security
+// header cfg calls for.
+func hstsHandler(cfg *Config) func(http.Handler) http.Handler {
+	header := cfg.HSTSHeader()
+	return func(h http.Handler) http.Handler {
+		return set.Header(h, "Strict-Transport-Security", header)
+	}
+}
 
-	srv.Handler = middleware.Then(manager.HTTPHandler(srv.Handler))
+// overTLS returns middleware that applies mw only to requests that
+// came in over TLS.
+func overTLS(mw func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		secured := mw(h)
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.TLS != nil {
+				secured.ServeHTTP(w, req)
+				return
+			}
+			h.ServeHTTP(w, req)
+		})
+	}
+}
 
-	srv.Addr = httpsAddr
-	srv.TLSConfig = getTLSConfig(domain, manager)
+// ProductionServer has srv, from NewServer, answer ACME challenges and
+// serve HTTPS with certs from manager.
+func ProductionServer(cfg *Config, srv *http.Server, manager *autocert.Manager) error {
+	chain, ok := srv.Handler.(*MiddlewareChain)
+	if !ok {
+		return fmt.Errorf("ProductionServer needs a server from NewServer")
+	}
+	chain.Set(stageACME, manager.HTTPHandler)
+	return secureServer(cfg, srv, manager.GetCertificate)
 }
 
-func GetIndex(w http.ResponseWriter, req *http.Request) {
-	contents, err := ioutil.ReadFile("build/index.html")
+// secureServer has srv serve HTTPS on cfg.HTTPSAddr with certs from
+// getCert, verifying client certs from cfg.ClientCAFile's CAs if set.
+func secureServer(cfg *Config, srv *http.Server, getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)) error {
+	clientCAs, err := loadClientCAs(cfg.ClientCAFile)
 	if err != nil {
-		log.Errorf("Error serving index.html: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Error: couldn't serve you index.html!"))
-		return
+		return err
+	}
+	minVersion, err := tlsVersion(cfg.TLSMinVersion)
+	if err != nil {
+		return err
 	}
-	w.Write(contents)
+	srv.Addr = cfg.HTTPSAddr
+	srv.TLSConfig = getTLSConfig(getCert, clientCAs, minVersion)
+	return nil
 }
 
-func Login(m *miniware.Mapper) func(w http.ResponseWriter, req *http.Request) {
-	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		mID, keypair, err := parseMinilockID(req)
-		if err != nil {
-			WriteErrorStatus(w, "Error: invalid miniLock ID",
-				err, http.StatusBadRequest)
+type loginRequest struct {
+	MinilockID string `json:"minilock_id"`
+	// The decrypted response from Challenge
+	Nonce string `json:"nonce"`
+}
+
+// LoginPost issues an auth token, encrypted to the miniLock ID in a
+// JSON body, `{"minilock_id":"...","nonce":"..."}`, which keeps it
+// out of access logs and caches, but only if the nonce answers one
+// of the miniLock ID's pending challenges. For older clients, the ID
+// may still be sent in the X-Minilock-Id header.
+func LoginPost(m Store, tokenTTL time.Duration, blocklist *Blocklist, idLimiter *RateLimiter, encryptErrors bool, cs *ChallengeStore, keys *ServerKeys, lockout *LoginLockout, audit *AuditLog, trustedProxies []net.IPNet) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mediaType != "application/json" {
+			audit.Failure(req, "login", req.Header.Get("X-Minilock-Id"),
+				"unsupported Content-Type")
+			WriteErrorStatus(w, "Error: Content-Type must be application/json",
+				nil, http.StatusUnsupportedMediaType)
 			return
 		}
 
-		log.Infof("Login: `%s` is trying to log in", mID)
-
-		newUUID, err := uuid.NewV4()
+		var body loginRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxLoginBodySize)).Decode(&body)
 		if err != nil {
-			WriteError(w, "Error generating new auth token; sorry!", err)
+			audit.Failure(req, "login", req.Header.Get("X-Minilock-Id"),
+				"invalid login request")
+			if isBodyTooLarge(err) {
+				WriteErrorStatus(w, "Error: login request too large", err,
+					http.StatusRequestEntityTooLarge)
+				return
+			}
+			WriteErrorStatus(w, "Error: invalid login request", err,
+				http.StatusBadRequest)
 			return
 		}
 
-		authToken := newUUID.String()
+		mID := body.MinilockID
+		if mID == "" {
+			mID = req.Header.Get("X-Minilock-Id")
+		}
 
-		err = m.SetMinilockID(authToken, mID)
-		if err != nil {
-			WriteError(w, "Error saving new auth token; sorry!", err)
+		if body.Nonce == "" {
+			audit.Failure(req, "login", mID, ErrChallengeResponseMissing.Error())
+			WriteErrorStatus(w, "Error: "+ErrChallengeResponseMissing.Error(),
+				nil, http.StatusBadRequest)
 			return
 		}
 
-		filename := "type:authtoken"
-		contents := []byte(authToken)
-		sender := randomServerKey
-		recipient := keypair
+		challengeLogin(w, req, m, tokenTTL, blocklist, idLimiter,
+			encryptErrors, cs, keys, lockout, audit, mID,
+			clientIP(req, trustedProxies), body.Nonce)
+	}
+}
+
+// authTokenResponse is what issueAuthToken encrypts to the client.
+// ExpiresAt is omitted if auth tokens don't expire.
+type authTokenResponse struct {
+	Token     string     `json:"token"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// issueAuthToken mints a new auth token for mID, expiring after
+// tokenTTL (if non-zero), and responds with it and its expiry as JSON,
+// encrypted from sender to keypair. If that fails, it responds with an
+// error (encrypted with errKey, if not nil) and returns it.
+func issueAuthToken(w http.ResponseWriter, m Store, tokenTTL time.Duration, mID string, sender, keypair *taber.Keys, errKey *loginErrorKeys) error {
+	newUUID, err := uuid.NewV4()
+	if err != nil {
+		writeLoginError(w, errKey, "Error generating new auth token; sorry!",
+			err, http.StatusInternalServerError)
+		return err
+	}
+
+	authToken := newUUID.String()
+
+	resp := authTokenResponse{Token: authToken}
+	if tokenTTL > 0 {
+		expiresAt := time.Now().Add(tokenTTL).UTC().Truncate(time.Second)
+		resp.ExpiresAt = &expiresAt
+	}
+	contents, err := json.Marshal(resp)
+	if err != nil {
+		writeLoginError(w, errKey, "Error encoding auth token; sorry!", err,
+			http.StatusInternalServerError)
+		return err
+	}
+
+	filename := "type:authtoken+json"
+	recipient := keypair
+
+	encAuthToken, err := minilock.EncryptFileContents(filename, contents,
+		sender, recipient)
+	if err != nil {
+		writeLoginError(w, errKey, "Error encrypting auth token to you;"+
+			" sorry!", err, http.StatusInternalServerError)
+		return err
+	}
+
+	// Only saved once it can be sent, so that a failure doesn't leave
+	// behind a token the client never got (nor, with a SessionCap,
+	// evict another session to make room for it)
+	err = m.SetMinilockID(authToken, mID)
+	if err == ErrTooManySessions {
+		writeLoginError(w, errKey, "Error: too many active sessions; log"+
+			" out elsewhere (or revoke your sessions) first", err,
+			http.StatusTooManyRequests)
+		return err
+	}
+	if err != nil {
+		setStoreUnavailable(w, err)
+		writeLoginError(w, errKey, "Error saving new auth token; try again"+
+			" shortly", err, http.StatusServiceUnavailable)
+		return err
+	}
+
+	w.Header().Set("Content-Type", contentTypeAuthToken)
+	w.Write(encAuthToken)
+	return nil
+}
 
-		encAuthToken, err := minilock.EncryptFileContents(filename, contents,
-			sender, recipient)
+// loginErrorKeys are the keys login errors are encrypted from and to.
+type loginErrorKeys struct {
+	sender    *taber.Keys
+	recipient *taber.Keys
+}
+
+// loginErrorKey returns the keys to encrypt login errors from sender
+// to keypair with, or nil if they're to be sent in plaintext.
+func loginErrorKey(encryptErrors bool, sender, keypair *taber.Keys) *loginErrorKeys {
+	if !encryptErrors {
+		return nil
+	}
+	return &loginErrorKeys{sender: sender, recipient: keypair}
+}
+
+// writeLoginError is WriteErrorStatus for logins that fail once we
+// know who to encrypt to. If errKey isn't nil, the JSON error is
+// encrypted with it the way auth tokens are, but named
+// "type:error+json" and sent with contentTypeLoginError, so that no
+// one in between learns why the login failed (though the status code
+// still hints). If encrypting fails, the error is sent in plaintext.
+func writeLoginError(w http.ResponseWriter, errKey *loginErrorKeys, errStr string, secretErr error, status int) {
+	if errKey == nil {
+		WriteErrorStatus(w, errStr, secretErr, status)
+		return
+	}
+	log.Debugf("Real error: %v", secretErr)
+	log.Debugf("Returning encrypted HTTP %d w/error: %q", status, errStr)
+
+	body, err := json.Marshal(errorResponse{
+		Error:     errStr,
+		Status:    status,
+		RequestID: w.Header().Get("X-Request-Id"),
+	})
+	if err == nil {
+		body, err = minilock.EncryptFileContents("type:error+json", body,
+			errKey.sender, errKey.recipient)
+	}
+	if err != nil {
+		log.Errorf("Error encrypting login error; sending it in plaintext: %v", err)
+		WriteErrorStatus(w, errStr, secretErr, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeLoginError)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// refuseBlocked responds with a 403 (encrypted with errKey, if not nil),
+// and returns true, if mID is on blocklist.
+func refuseBlocked(w http.ResponseWriter, req *http.Request, blocklist *Blocklist, audit *AuditLog, mID string, errKey *loginErrorKeys) bool {
+	if !blocklist.Blocked(mID) {
+		return false
+	}
+	log.Infof("Login: `%s` is blocked", mID)
+	audit.Failure(req, "login", mID, ErrMinilockIDBlocked.Error())
+	writeLoginError(w, errKey, "Error: this miniLock ID may not log in",
+		ErrMinilockIDBlocked, http.StatusForbidden)
+	return true
+}
+
+// refuseRateLimited responds with a 429 (encrypted with errKey, if not
+// nil), and returns true, if mID has used up its logins in idLimiter,
+// no matter which IPs they came from. A nil idLimiter never refuses.
+func refuseRateLimited(w http.ResponseWriter, req *http.Request, idLimiter *RateLimiter, audit *AuditLog, mID string, errKey *loginErrorKeys) bool {
+	if idLimiter == nil {
+		return false
+	}
+	status := idLimiter.Take(mID)
+	if status.Allowed {
+		return false
+	}
+	log.Infof("Login: `%s` is rate limited", mID)
+	audit.Failure(req, "login", mID, ErrRateLimited.Error())
+	retryAfter := status.RetryAfter + idLimiter.jitter(time.Duration(
+		float64(status.RetryAfter)*RATE_LIMIT_JITTER))
+	w.Header().Set("Retry-After", ceilSeconds(retryAfter))
+	writeLoginError(w, errKey, "Error: too many logins for this miniLock"+
+		" ID; try again later", ErrRateLimited, http.StatusTooManyRequests)
+	return true
+}
+
+func writeMinilockIDError(w http.ResponseWriter, err error) {
+	errStr := "Error: invalid miniLock ID"
+	switch err {
+	case ErrMinilockIDEmpty, ErrMinilockIDLength, ErrMinilockIDCharset:
+		errStr += ": " + err.Error()
+	}
+	WriteErrorStatus(w, errStr, err, http.StatusBadRequest)
+}
+
+// Logout revokes the auth token sent in the Authorization header so
+// that it can no longer be used.
+func Logout(m Store, audit *AuditLog) func(w http.ResponseWriter, req *http.Request) {
+	return RequireAuth(NewTokenAuthenticator(m))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authToken := authTokenFromRequest(req)
+		mID := RequestIdentity(req)
+
+		// May have been revoked by a concurrent Logout since
+		// RequireAuth looked it up
+		err := m.DeleteMinilockID(authToken)
+		if err == miniware.ErrAuthTokenNotFound {
+			audit.Failure(req, "logout", mID, "auth token already revoked")
+			WriteErrorStatus(w, miniware.AuthError, err,
+				http.StatusUnauthorized)
+			return
+		}
 		if err != nil {
-			WriteError(w, "Error encrypting auth token to you; sorry!", err)
+			audit.Failure(req, "logout", mID, "error revoking auth token")
+			WriteError(w, "Error revoking auth token; sorry!", err)
 			return
 		}
 
-		w.Write(encAuthToken)
-	})
+		log.Infof("Logout: `%s` just logged out", mID)
+		audit.Success(req, "logout", mID, "auth token revoked")
+
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP
+}
+
+// Whoami responds with the miniLock ID that the caller's auth token
+// maps to, or a 401 if the token isn't valid (anymore).
+func Whoami(m Store) func(w http.ResponseWriter, req *http.Request) {
+	return RequireAuth(NewTokenAuthenticator(m))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := json.Marshal(map[string]string{
+			"minilock_id": RequestIdentity(req),
+		})
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(body)
+	})).ServeHTTP
 }
 
 func parseMinilockID(req *http.Request) (string, *taber.Keys, error) {
 	mID := req.Header.Get("X-Minilock-Id")
+	keypair, err := minilockKeypair(mID)
+	if err != nil {
+		return "", nil, err
+	}
+	return mID, keypair, nil
+}
+
+// minilockKeypair returns the public key mID encodes.
+func minilockKeypair(mID string) (*taber.Keys, error) {
+	// Cheap sanity checks before any crypto runs
+	if err := validateMinilockID(mID); err != nil {
+		return nil, err
+	}
 
 	// Validate miniLock ID by trying to generate public key from it
 	keypair, err := taber.FromID(mID)
 	if err != nil {
-		return "", nil, fmt.Errorf("Error validating miniLock ID: %v", err)
+		return nil, fmt.Errorf("Error validating miniLock ID: %v", err)
 	}
 
-	return mID, keypair, nil
+	return keypair, nil
 }
 
-func redirectToHTTPS(httpAddr, httpsPort string, manager *autocert.Manager) {
-	srv := &http.Server{
-		Addr:         httpAddr,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 5 * time.Second,
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			w.Header().Set("Connection", "close")
-			domain := strings.SplitN(req.Host, ":", 2)[0]
-			url := "https://" + domain + ":" + httpsPort + req.URL.String()
-			http.Redirect(w, req, url, http.StatusFound)
-		}),
+func validateMinilockID(mID string) error {
+	if mID == "" {
+		return ErrMinilockIDEmpty
+	}
+	if len(mID) < MINILOCK_ID_MIN_LEN || len(mID) > MINILOCK_ID_MAX_LEN {
+		return ErrMinilockIDLength
+	}
+	for _, c := range mID {
+		if !strings.ContainsRune(base58Alphabet, c) {
+			return ErrMinilockIDCharset
+		}
 	}
-	log.Infof("Listening on %v", httpAddr)
-	log.Fatal(srv.ListenAndServe())
+	return nil
 }
 
-func getAutocertManager(domain string) *autocert.Manager {
+// Run serves srv (over TLS if srv.TLSConfig is set) until ctx is done
+// or the process receives SIGINT or SIGTERM, then shuts srv down,
+// giving in-flight requests up to gracePeriod to finish. Returns once
+// they have. Connections from proxyProtocolFrom may start with a PROXY
+// protocol header; see ProxyProtocolListener.
+func Run(ctx context.Context, srv *http.Server, gracePeriod time.Duration, proxyProtocolFrom []net.IPNet) error {
+	ln, err := listen(srv, proxyProtocolFrom)
+	if err != nil {
+		return err
+	}
+	return serve(ctx, srv, ln, gracePeriod)
+}
+
+// listen listens on srv.Addr, accepting PROXY protocol headers from
+// proxyProtocolFrom. Connections made before it's served wait to be
+// accepted rather than being refused.
+func listen(srv *http.Server, proxyProtocolFrom []net.IPNet) (net.Listener, error) {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Listening on %v", srv.Addr)
+	return ProxyProtocolListener(ln, proxyProtocolFrom), nil
+}
+
+// OnSIGHUP calls reload every time the process gets a SIGHUP, until
+// ctx is done.
+func OnSIGHUP(ctx context.Context, reload func()) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sighup)
+		for {
+			select {
+			case <-sighup:
+				reload()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, gracePeriod time.Duration) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errc <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		errc <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	if d, ok := srv.Handler.(interface{ Drain() }); ok {
+		d.Drain()
+	}
+
+	log.Infof("Shutting down %v; waiting up to %v for requests to finish...",
+		ln.Addr(), gracePeriod)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(),
+		gracePeriod)
+	defer cancel()
+
+	err := srv.Shutdown(shutdownCtx)
+	if c, ok := srv.Handler.(interface{ Close() }); ok {
+		c.Close()
+	}
+	return err
+}
+
+// newRedirectServer returns a server that redirects HTTP requests to
+// the same path on cfg.CanonicalDomain() over HTTPS. Requests that a
+// trusted proxy (e.g., a load balancer terminating TLS) says arrived
+// over HTTPS are served by app instead.
+func newRedirectServer(cfg *Config, app http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.HTTPAddr,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		Handler:           Recover(log.StandardLogger())(httpsRedirectHandler(cfg, app)),
+	}
+}
+
+// httpsRedirectHandler redirects plain HTTP requests to HTTPS on our
+// canonical domain, passing those that a trusted proxy says came over
+// HTTPS on to app. GETs and HEADs get cfg.HTTPSRedirectStatus;
+// anything else gets a 308 so that API clients that hit HTTP by
+// mistake don't have their POSTs turned into GETs.
+func httpsRedirectHandler(cfg *Config, app http.Handler) http.Handler {
+	// ParseConfig made sure there's a port
+	_, httpsPort, _ := net.SplitHostPort(cfg.HTTPSAddr)
+	domain := cfg.CanonicalDomain()
+
+	var redirect http.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Connection", "close")
+		url := "https://" + domain + ":" + httpsPort + req.URL.RequestURI()
+		status := cfg.HTTPSRedirectStatus
+		if req.Method != "GET" && req.Method != "HEAD" {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, req, url, status)
+	})
+	// Browsers ignore HSTS sent over plain HTTP, but compliance
+	// scanners look for it on every response
+	if cfg.HSTSOnRedirect {
+		redirect = hstsHandler(cfg)(redirect)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if forwardedHTTPS(req, cfg.TrustedProxies) {
+			app.ServeHTTP(w, req)
+			return
+		}
+		redirect.ServeHTTP(w, req)
+	})
+}
+
+// getAutocertManager returns a manager that gets certificates for any
+// of domains, caching them in cache.
+func getAutocertManager(domains []string, cache autocert.Cache) *autocert.Manager {
 	return &autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(domain),
-		Cache:      autocert.DirCache("./" + domain),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      cache,
 	}
 }
 
-func getTLSConfig(domain string, manager *autocert.Manager) *tls.Config {
-	return &tls.Config{
+// getTLSConfig returns our TLS config, accepting minVersion (e.g.,
+// tls.VersionTLS13) and up. If clientCAs is non-nil, client
+// certs are verified against it when given; they can't be required of
+// every connection without locking the public out, so ClientCertAuth
+// requires them on the routes that need them.
+func getTLSConfig(getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error), clientCAs *x509.CertPool, minVersion uint16) *tls.Config {
+	tlsConfig := &tls.Config{
 		PreferServerCipherSuites: true,
 		CurvePreferences: []tls.CurveID{
 			tls.CurveP256,
 			tls.X25519,
 		},
-		MinVersion: tls.VersionTLS12,
+		MinVersion: minVersion,
+		// Only used by TLS 1.2; 1.3's suites are all fine and can't be
+		// configured
 		CipherSuites: []uint16{
 			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
@@ -217,6 +1004,27 @@ func getTLSConfig(domain string, manager *autocert.Manager) *tls.Config {
 			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
 			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
 		},
-		GetCertificate: manager.GetCertificate,
+		GetCertificate: newOCSPStapler(getCert).GetCertificate,
+	}
+	if minVersion >= tls.VersionTLS13 {
+		tlsConfig.CipherSuites = nil
+	}
+	if clientCAs != nil {
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig
+}
+
+// tlsVersion returns the crypto/tls constant for version, which must
+// be "1.2" or "1.3".
+func tlsVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
 	}
+	return 0, fmt.Errorf("TLS min version must be 1.2 or 1.3, not %q",
+		version)
 }
@@ -4,26 +4,506 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	minilock "github.com/cathalgarvey/go-minilock"
+	"github.com/cathalgarvey/go-minilock/taber"
 	"github.com/cryptag/minishare/miniware"
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-var router = NewRouter(miniware.NewMapper())
+var router *mux.Router
+
+func init() {
+	router = mustNewRouter(NewMapper())
+}
 
 func TestLogin(t *testing.T) {
-	testURL(t, "GET", "/api/login", nil, router,
-		http.StatusBadRequest, `{"error":"Error: invalid miniLock ID"}`)
+	testURL(t, "GET", "/api/challenge", nil, router,
+		http.StatusBadRequest, `{"error":"Error: invalid miniLock ID: miniLock ID is empty","status":400}`)
+
+	// Well-formed, but bad checksum
+	headers := http.Header{"X-Minilock-Id": []string{
+		"22222222222222222222222222222222222222222222"}}
+	testURL(t, "GET", "/api/challenge", headers, router,
+		http.StatusBadRequest, `{"error":"Error: invalid miniLock ID","status":400}`)
+
+	// Tokens are only issued to those who answer a challenge, not for
+	// just naming a miniLock ID
+	keypair := newTestKeypair(t)
+	req := httptest.NewRequest("GET", "/api/login", nil)
+	req.Header.Set("X-Minilock-Id", testMinilockID(t, keypair))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func postLogin(handler http.Handler, contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLoginPost(t *testing.T) {
+	m := NewMapper()
+	router := mustNewRouter(m)
+	keypair := newTestKeypair(t)
+	mID := testMinilockID(t, keypair)
+
+	// The miniLock ID may be in the body instead of X-Minilock-Id
+	nonce := testChallenge(t, router, keypair)
+	rec := postLogin(router, "application/json; charset=utf-8",
+		`{"minilock_id":"`+mID+`","nonce":"`+nonce+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	authToken := decryptAuthToken(t, rec, keypair).Token
+
+	got, err := m.GetMinilockID(authToken)
+	require.NoError(t, err)
+	assert.Equal(t, mID, got)
+}
+
+func TestLoginPostRejectsBadRequests(t *testing.T) {
+	mID := testMinilockID(t, newTestKeypair(t))
+
+	rec := postLogin(router, "text/plain", `{"minilock_id":"`+mID+`"}`)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+
+	rec = postLogin(router, "application/json",
+		`{"minilock_id":"`+mID+`","padding":"`+strings.Repeat("a", maxLoginBodySize)+`"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	rec = postLogin(router, "application/json", `{"minilock_id":`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = postLogin(router, "application/json",
+		`{"minilock_id":"short","nonce":"deadbeef"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, `{"error":"Error: invalid miniLock ID: miniLock ID must be 40-46 characters long","status":400}`,
+		rec.Body.String())
+}
+
+func TestLoginPostRequiresNonce(t *testing.T) {
+	m := NewMapper()
+	router := mustNewRouter(m)
+	keypair := newTestKeypair(t)
+	mID := testMinilockID(t, keypair)
+
+	// Naming a miniLock ID isn't enough, even with a challenge pending
+	nonce := testChallenge(t, router, keypair)
+	rec := postLogin(router, "application/json", `{"minilock_id":"`+mID+`"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), ErrChallengeResponseMissing.Error())
+	assert.Equal(t, 0, m.Len())
+
+	rec = postChallengeLogin(t, router, keypair, nonce)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestValidateMinilockID(t *testing.T) {
+	validID := testMinilockID(t, newTestKeypair(t))
+
+	tests := []struct {
+		name string
+		mID  string
+		err  error
+	}{
+		{"empty", "", ErrMinilockIDEmpty},
+		{"too short", validID[:20], ErrMinilockIDLength},
+		{"too long", validID + validID, ErrMinilockIDLength},
+		{"huge", strings.Repeat("a", 1<<16), ErrMinilockIDLength},
+		{"bad charset (0)", "0" + validID[1:], ErrMinilockIDCharset},
+		{"bad charset (l)", "l" + validID[1:], ErrMinilockIDCharset},
+		{"bad charset (space)", " " + validID[1:], ErrMinilockIDCharset},
+		{"bad charset (unicode)", "é" + validID[2:], ErrMinilockIDCharset},
+		{"valid", validID, nil},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.err, validateMinilockID(tt.mID), tt.name)
+	}
+
+	headers := http.Header{"X-Minilock-Id": []string{validID[:20]}}
+	testURL(t, "GET", "/api/challenge", headers, router, http.StatusBadRequest,
+		`{"error":"Error: invalid miniLock ID: miniLock ID must be 40-46 characters long","status":400}`)
 }
 
 func TestRouting(t *testing.T) {
-	for _, url := range []string{"/dashboard", "/pursuance", "/123"} {
+	for _, url := range []string{"/dashboard", "/pursuance", "/123",
+		"/somethingelse/client/route"} {
 		testURL(t, "GET", url, nil, router, http.StatusOK, "")
 	}
-	testURL(t, "GET", "/somethingelse/should404", nil, router, http.StatusNotFound, "")
+}
+
+func TestLogout(t *testing.T) {
+	router := mustNewRouter(NewMapper())
+
+	authToken := testLogin(t, router, newTestKeypair(t))
+
+	headers := http.Header{"Authorization": []string{authToken}}
+	testURL(t, "POST", "/api/logout", headers, router, http.StatusOK, "")
+
+	// Token mustn't be reusable
+	testURL(t, "POST", "/api/logout", headers, router,
+		http.StatusUnauthorized, "")
+	testURL(t, "GET", "/api/logout", headers, router,
+		http.StatusUnauthorized, "")
+
+	// Bearer-prefixed tokens work, too
+	authToken = testLogin(t, router, newTestKeypair(t))
+	headers = http.Header{"Authorization": []string{"Bearer " + authToken}}
+	testURL(t, "GET", "/api/logout", headers, router, http.StatusOK, "")
+}
+
+func TestLogoutMissingOrUnknownToken(t *testing.T) {
+	testURL(t, "POST", "/api/logout", nil, router, http.StatusUnauthorized, "")
+
+	headers := http.Header{"Authorization": []string{"not-a-real-token"}}
+	testURL(t, "POST", "/api/logout", headers, router,
+		http.StatusUnauthorized, "")
+}
+
+func TestWhoami(t *testing.T) {
+	router := mustNewRouter(NewMapper())
+	keypair := newTestKeypair(t)
+	mID, err := keypair.EncodeID()
+	require.NoError(t, err)
+
+	authToken := testLogin(t, router, keypair)
+	headers := http.Header{"Authorization": []string{authToken}}
+	testURL(t, "GET", "/api/whoami", headers, router, http.StatusOK,
+		`{"minilock_id":"`+mID+`"}`)
+
+	// Stops working once logged out
+	testURL(t, "POST", "/api/logout", headers, router, http.StatusOK, "")
+	testURL(t, "GET", "/api/whoami", headers, router,
+		http.StatusUnauthorized, "")
+}
+
+func TestWhoamiUnauthorized(t *testing.T) {
+	testURL(t, "GET", "/api/whoami", nil, router, http.StatusUnauthorized, "")
+
+	headers := http.Header{"Authorization": []string{"not-a-real-token"}}
+	testURL(t, "GET", "/api/whoami", headers, router,
+		http.StatusUnauthorized, "")
+}
+
+func TestLogoutConcurrentWithLogin(t *testing.T) {
+	m := NewMapper()
+	router := mustNewRouter(m)
+	keypair := newTestKeypair(t)
+
+	authToken := testLogin(t, router, keypair)
+	headers := http.Header{"Authorization": []string{authToken}}
+
+	// Hammer the same token with logouts while other logins happen;
+	// exactly one logout may succeed. Run with -race.
+	var wg sync.WaitGroup
+	statuses := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/api/logout", nil)
+			req.Header = headers
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			statuses <- rec.Code
+		}()
+		go func() {
+			defer wg.Done()
+			answerChallengeLogin(t, router, keypair)
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	var ok int
+	for status := range statuses {
+		if status == http.StatusOK {
+			ok++
+			continue
+		}
+		assert.Equal(t, http.StatusUnauthorized, status)
+	}
+	assert.Equal(t, 1, ok)
+
+	_, err := m.GetMinilockID(authToken)
+	assert.Equal(t, miniware.ErrAuthTokenNotFound, err)
+}
+
+func TestAuthTokenExpiry(t *testing.T) {
+	m := NewMapperWithTTL(time.Hour)
+	now := time.Now()
+	m.SetClock(func() time.Time { return now })
+	router := mustNewRouter(m)
+
+	authToken := testLogin(t, router, newTestKeypair(t))
+	headers := http.Header{"Authorization": []string{authToken}}
+
+	// Still valid just shy of the TTL...
+	now = now.Add(time.Hour - time.Second)
+	_, err := m.GetMinilockID(authToken)
+	assert.NoError(t, err)
+
+	// ...but not once it's passed
+	now = now.Add(time.Second)
+	testURL(t, "POST", "/api/logout", headers, router,
+		http.StatusUnauthorized, "")
+
+	// Lazily purged on access
+	_, err = m.GetMinilockID(authToken)
+	assert.Equal(t, miniware.ErrAuthTokenNotFound, err)
+}
+
+func TestRunGracefulShutdown(t *testing.T) {
+	started := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("finished"))
+	})
+
+	ts := httptest.NewUnstartedServer(slow)
+	srv := &http.Server{Handler: slow}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, srv, ts.Listener, 5*time.Second)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ts.Listener.Addr().String())
+		if err != nil {
+			resc <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		resc <- result{string(body), err}
+	}()
+
+	// Shut down while the request is in flight
+	<-started
+	cancel()
+
+	res := <-resc
+	require.NoError(t, res.err)
+	assert.Equal(t, "finished", res.body)
+	assert.NoError(t, <-serveErr)
+
+	// No new connections accepted
+	_, err := http.Get("http://" + ts.Listener.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestShutdownFailsReadyz(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+
+	cfg := testConfig()
+	cfg.PostgrestBaseURL = upstream.URL
+	cfg.ShutdownDrainDelay = 300 * time.Millisecond
+	srv, err := NewServer(cfg, NewMapper(), testServerKeys, nil)
+	require.NoError(t, err)
+
+	ts := httptest.NewUnstartedServer(nil)
+	base := "http://" + ts.Listener.Addr().String()
+	get := func(path string) (int, string) {
+		resp, err := http.Get(base + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, srv, ts.Listener, 5*time.Second)
+	}()
+
+	status, _ := get("/readyz")
+	assert.Equal(t, http.StatusOK, status)
+
+	cancel()
+
+	// Still serving during the drain delay, but no longer ready
+	deadline := time.Now().Add(cfg.ShutdownDrainDelay)
+	for {
+		status, body := get("/readyz")
+		if status == http.StatusServiceUnavailable {
+			assert.JSONEq(t, `{"reason":"shutting down","status":"unavailable"}`, body)
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "/readyz never failed")
+		time.Sleep(10 * time.Millisecond)
+	}
+	status, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, status)
+
+	assert.NoError(t, <-serveErr)
+	_, err = http.Get(base + "/healthz")
+	assert.Error(t, err)
+}
+
+// testConfig returns the default config, minus anything that gets in
+// the way of tests
+func testConfig() *Config {
+	cfg := DefaultConfig()
+	// Every test request comes from the same IP
+	cfg.LoginRateLimitBurst = 1000
+	cfg.LoginIDRateLimitBurst = 1000
+	// Tests that want them start their own
+	cfg.PostgrestHealthCheckInterval = 0
+	return cfg
+}
+
+// testServerKeys are the server keys tests send challenges and auth
+// tokens from
+var testServerKeys = func() *ServerKeys {
+	keys, err := LoadServerKeys("", "")
+	if err != nil {
+		panic(err)
+	}
+	return keys
+}()
+
+func mustNewRouter(m Store) *mux.Router {
+	return mustNewRouterConfig(testConfig(), m)
+}
+
+func mustNewRouterConfig(cfg *Config, m Store) *mux.Router {
+	audit, err := NewAuditLog(cfg)
+	if err != nil {
+		panic(err)
+	}
+	r, err := NewRouter(cfg, m, testServerKeys, nil, nil, nil, audit, nil)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func newTestKeypair(t *testing.T) *taber.Keys {
+	for {
+		keypair, err := taber.RandomKey()
+		require.NoError(t, err)
+
+		// A small fraction of keys encode to IDs that taber can't
+		// decode again, which would make tests flaky
+		mID, err := keypair.EncodeID()
+		require.NoError(t, err)
+		if _, err = taber.FromID(mID); err == nil {
+			return keypair
+		}
+	}
+}
+
+func testMinilockID(t *testing.T, keypair *taber.Keys) string {
+	mID, err := keypair.EncodeID()
+	require.NoError(t, err)
+	return mID
+}
+
+// testLogin logs in as keypair and returns the decrypted auth token
+func testLogin(t *testing.T, handler http.Handler, keypair *taber.Keys) string {
+	nonce := testChallenge(t, handler, keypair)
+	rec := postChallengeLogin(t, handler, keypair, nonce)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	return decryptAuthToken(t, rec, keypair).Token
+}
+
+// decryptAuthToken decrypts and parses a login response to keypair
+func decryptAuthToken(t *testing.T, rec *httptest.ResponseRecorder, keypair *taber.Keys) authTokenResponse {
+	assert.Equal(t, contentTypeAuthToken, rec.Header().Get("Content-Type"))
+
+	_, filename, contents, err := minilock.DecryptFileContents(rec.Body.Bytes(),
+		keypair)
+	require.NoError(t, err)
+	assert.Equal(t, "type:authtoken+json", filename)
+
+	var resp authTokenResponse
+	require.NoError(t, json.Unmarshal(contents, &resp))
+	require.NotEmpty(t, resp.Token)
+	return resp
+}
+
+func TestLoginTokenExpiry(t *testing.T) {
+	cfg := testConfig()
+	cfg.AuthTokenTTL = time.Hour
+	m := NewMapperWithTTL(cfg.AuthTokenTTL)
+	router := mustNewRouterConfig(cfg, m)
+	keypair := newTestKeypair(t)
+
+	rec := answerChallengeLogin(t, router, keypair)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	_, _, contents, err := minilock.DecryptFileContents(rec.Body.Bytes(),
+		keypair)
+	require.NoError(t, err)
+	var fields map[string]string
+	require.NoError(t, json.Unmarshal(contents, &fields))
+	assert.Len(t, fields, 2)
+
+	mID, err := m.GetMinilockID(fields["token"])
+	require.NoError(t, err)
+	assert.Equal(t, testMinilockID(t, keypair), mID)
+
+	expiresAt, err := time.Parse(time.RFC3339, fields["expires_at"])
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute)
+
+	// Tokens that never expire have no expiry
+	cfg.AuthTokenTTL = 0
+	router = mustNewRouterConfig(cfg, NewMapper())
+	resp := decryptAuthToken(t, answerChallengeLogin(t, router, keypair),
+		keypair)
+	assert.Nil(t, resp.ExpiresAt)
+}
+
+func TestIssueAuthTokenUnsentNotSaved(t *testing.T) {
+	m := NewMapper()
+	keypair := newTestKeypair(t)
+	mID := testMinilockID(t, keypair)
+
+	// A recipient with no key can't be encrypted to
+	rec := httptest.NewRecorder()
+	err := issueAuthToken(rec, m, 0, mID, testServerKeys.Current(),
+		&taber.Keys{}, nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, 0, m.Len())
+
+	rec = httptest.NewRecorder()
+	require.NoError(t, issueAuthToken(rec, m, 0, mID,
+		testServerKeys.Current(), keypair, nil))
+	assert.Equal(t, 1, m.Len())
 }
 
 func testURL(t *testing.T, httpMethod string, url string, headers http.Header, handler http.Handler, wantedStatusCode int, wantedResponse string) {
@@ -50,3 +530,264 @@ func testURL(t *testing.T, httpMethod string, url string, headers http.Header, h
 		assert.Equal(t, wantedResponse, rec.Body.String())
 	}
 }
+
+func TestAutocertHostPolicy(t *testing.T) {
+	manager := getAutocertManager([]string{"example.com", "www.example.com",
+		"vanity.example.org"}, nil)
+
+	for _, host := range []string{"example.com", "www.example.com",
+		"vanity.example.org"} {
+		assert.NoError(t, manager.HostPolicy(context.Background(), host), host)
+	}
+	for _, host := range []string{"evil.com", "example.com.evil.com",
+		"sub.example.com", ""} {
+		assert.Error(t, manager.HostPolicy(context.Background(), host), host)
+	}
+}
+
+func TestHTTPSRedirectCanonicalDomain(t *testing.T) {
+	cfg := testConfig()
+	cfg.Domain = "example.com,www.example.com"
+	cfg.HTTPSAddr = ":443"
+
+	req := httptest.NewRequest("GET", "http://www.example.com/dashboard?x=1", nil)
+	rec := httptest.NewRecorder()
+	httpsRedirectHandler(cfg, http.NotFoundHandler()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "https://example.com:443/dashboard?x=1",
+		rec.Header().Get("Location"))
+}
+
+func TestHTTPSRedirectStatus(t *testing.T) {
+	cfg := testConfig()
+	cfg.Domain = "example.com"
+	cfg.HTTPSAddr = ":443"
+
+	redirect := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method,
+			"http://example.com/api/login?next=%2Ftasks&x=1",
+			strings.NewReader(`{"minilock_id":"x"}`))
+		rec := httptest.NewRecorder()
+		httpsRedirectHandler(cfg, http.NotFoundHandler()).ServeHTTP(rec, req)
+		assert.Equal(t, "https://example.com:443/api/login?next=%2Ftasks&x=1",
+			rec.Header().Get("Location"), method)
+		return rec
+	}
+
+	for _, method := range []string{"POST", "PUT", "PATCH", "DELETE"} {
+		assert.Equal(t, http.StatusPermanentRedirect, redirect(method).Code, method)
+	}
+	assert.Equal(t, http.StatusMovedPermanently, redirect("GET").Code)
+	assert.Equal(t, http.StatusMovedPermanently, redirect("HEAD").Code)
+
+	cfg.HTTPSRedirectStatus = http.StatusPermanentRedirect
+	assert.Equal(t, http.StatusPermanentRedirect, redirect("GET").Code)
+	assert.Equal(t, http.StatusPermanentRedirect, redirect("POST").Code)
+}
+
+func TestHTTPSRedirectHSTS(t *testing.T) {
+	cfg := testConfig()
+	cfg.Domain = "example.com"
+	cfg.HTTPSAddr = ":443"
+
+	redirect := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		httpsRedirectHandler(cfg, http.NotFoundHandler()).ServeHTTP(rec,
+			httptest.NewRequest("GET", "http://example.com/", nil))
+		require.Equal(t, http.StatusMovedPermanently, rec.Code)
+		return rec
+	}
+
+	assert.Equal(t, "", redirect().Header().Get("Strict-Transport-Security"))
+
+	cfg.HSTSOnRedirect = true
+	assert.Equal(t, "max-age=31536000; includeSubDomains; preload",
+		redirect().Header().Get("Strict-Transport-Security"))
+}
+
+func TestHTTPSRedirectForwardedProto(t *testing.T) {
+	cfg := testConfig()
+	cfg.Domain = "example.com"
+	cfg.HTTPSAddr = ":443"
+	cfg.TrustedProxies, _ = parseIPNets("10.0.0.1")
+
+	app := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("app"))
+	})
+	h := httpsRedirectHandler(cfg, app)
+
+	get := func(remoteAddr, proto string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/dashboard", nil)
+		req.RemoteAddr = remoteAddr
+		if proto != "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Plain HTTP straight from a client
+	rec := get("198.51.100.7:50000", "")
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "https://example.com:443/dashboard", rec.Header().Get("Location"))
+
+	// TLS terminated by our load balancer
+	rec = get("10.0.0.1:50000", "https")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "app", rec.Body.String())
+
+	// Plain HTTP through our load balancer
+	rec = get("10.0.0.1:50000", "http")
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+
+	// A client claiming to have used HTTPS
+	rec = get("198.51.100.7:50000", "https")
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "https://example.com:443/dashboard", rec.Header().Get("Location"))
+}
+
+func TestPprof(t *testing.T) {
+	// Without basic auth there's no way to protect it, so it's absent
+	for _, url := range []string{"/debug/pprof/", "/debug/pprof/heap",
+		"/debug/pprof/cmdline"} {
+		testURL(t, "GET", url, nil, router, http.StatusNotFound, "")
+	}
+
+	cfg := testConfig()
+	cfg.BasicAuthUsername = "admin"
+	cfg.BasicAuthPassword = "hunter2"
+	router := mustNewRouterConfig(cfg, NewMapper())
+
+	creds := func(username, password string) http.Header {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(username, password)
+		return req.Header
+	}
+
+	for _, url := range []string{"/debug/pprof/", "/debug/pprof/heap",
+		"/debug/pprof/cmdline"} {
+		testURL(t, "GET", url, nil, router, http.StatusUnauthorized, "")
+		testURL(t, "GET", url, creds("admin", "wrong"), router,
+			http.StatusUnauthorized, "")
+		testURL(t, "GET", url, creds("admin", "hunter2"), router,
+			http.StatusOK, "")
+	}
+}
+
+func TestBasicAuthRoutes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer upstream.Close()
+
+	newRouter := func(routes string) http.Handler {
+		cfg := testConfig()
+		cfg.PostgrestBaseURL = upstream.URL
+		cfg.BasicAuthUsername = "team"
+		cfg.BasicAuthPassword = "correct horse battery staple"
+		cfg.BasicAuthRoutes = routes
+		return mustNewRouterConfig(cfg, NewMapper())
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("team", "correct horse battery staple")
+	creds := req.Header
+
+	// Protect the API, leave the app open
+	r := newRouter("api")
+	testURL(t, "GET", "/postgrest/todos", nil, r, http.StatusUnauthorized, "")
+	testURL(t, "GET", "/postgrest/todos", creds, r, http.StatusOK, "[]")
+	testURL(t, "GET", "/", nil, r, http.StatusOK, "")
+	testURL(t, "GET", "/dashboard", nil, r, http.StatusOK, "")
+	// Admin routes aren't protected, so aren't there at all
+	testURL(t, "GET", "/debug/routes", creds, r, http.StatusNotFound, "")
+
+	// ...or vice versa
+	r = newRouter("app, admin")
+	testURL(t, "GET", "/postgrest/todos", nil, r, http.StatusOK, "[]")
+	testURL(t, "GET", "/", nil, r, http.StatusUnauthorized, "")
+	testURL(t, "GET", "/debug/routes", nil, r, http.StatusUnauthorized, "")
+	testURL(t, "GET", "/debug/routes", creds, r, http.StatusOK, "")
+}
+
+func TestNewServerHTTP2(t *testing.T) {
+	srv, err := NewServer(testConfig(), NewMapper(), testServerKeys, nil)
+	require.NoError(t, err)
+	require.NotNil(t, srv.HTTP2)
+	assert.Equal(t, 250, srv.HTTP2.MaxConcurrentStreams)
+
+	cfg := testConfig()
+	cfg.HTTP2MaxConcurrentStreams = 32
+	cfg.IdleTimeout = 200 * time.Millisecond
+	srv, err = NewServer(cfg, NewMapper(), testServerKeys, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 32, srv.HTTP2.MaxConcurrentStreams)
+	assert.Equal(t, 200*time.Millisecond, srv.IdleTimeout)
+
+	// And HTTP/2 is actually negotiated over TLS
+	require.NoError(t, DevTLSServer(cfg, srv))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, srv, ln, 5*time.Second)
+	}()
+	defer func() {
+		cancel()
+		assert.NoError(t, <-serveErr)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	// get reports whether the request reused a connection
+	get := func() bool {
+		var reused bool
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+			reused = info.Reused
+		}}
+		req, err := http.NewRequest("GET", "https://"+ln.Addr().String()+"/healthz", nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req.WithContext(
+			httptrace.WithClientTrace(req.Context(), trace)))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, 2, resp.ProtoMajor)
+		return reused
+	}
+	assert.False(t, get())
+	assert.True(t, get())
+
+	// The server hangs up on idle HTTP/2 connections after IdleTimeout
+	time.Sleep(600 * time.Millisecond)
+	assert.False(t, get())
+	client.CloseIdleConnections()
+}
+
+func TestNewServerTimeouts(t *testing.T) {
+	srv, err := NewServer(testConfig(), NewMapper(), testServerKeys, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, 15*time.Second, srv.ReadHeaderTimeout)
+	assert.Equal(t, 30*time.Second, srv.ReadTimeout)
+	assert.Equal(t, 60*time.Second, srv.WriteTimeout)
+	assert.Equal(t, 120*time.Second, srv.IdleTimeout)
+
+	cfg := testConfig()
+	cfg.ReadHeaderTimeout = 1 * time.Second
+	cfg.ReadTimeout = 2 * time.Second
+	cfg.WriteTimeout = 3 * time.Second
+	cfg.IdleTimeout = 4 * time.Second
+
+	srv, err = NewServer(cfg, NewMapper(), testServerKeys, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1*time.Second, srv.ReadHeaderTimeout)
+	assert.Equal(t, 2*time.Second, srv.ReadTimeout)
+	assert.Equal(t, 3*time.Second, srv.WriteTimeout)
+	assert.Equal(t, 4*time.Second, srv.IdleTimeout)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cathalgarvey/go-minilock/taber"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// ServerKeys are the keypairs the server encrypts challenges and auth
+// tokens from. The current key is the sender of everything new; the
+// previous one, if set, is the key it replaced, kept so that clients
+// that pin the server's miniLock ID can still trust it while rotating,
+// and so that challenges it sent can still be answered. Like a
+// Blocklist, they can be reloaded without restarting the server.
+type ServerKeys struct {
+	path         string
+	previousPath string
+	keys         atomic.Value // serverKeyPair
+}
+
+type serverKeyPair struct {
+	current  *taber.Keys
+	previous *taber.Keys
+}
+
+// Current returns the key everything new is encrypted from.
+func (sk *ServerKeys) Current() *taber.Keys {
+	return sk.keys.Load().(serverKeyPair).current
+}
+
+// Previous returns the key the current one replaced, or nil.
+func (sk *ServerKeys) Previous() *taber.Keys {
+	return sk.keys.Load().(serverKeyPair).previous
+}
+
+// Trusts reports whether public is the public key of the current or
+// previous server key, i.e., whether what it was used to send is
+// still ours.
+func (sk *ServerKeys) Trusts(public []byte) bool {
+	keys := sk.keys.Load().(serverKeyPair)
+	for _, k := range []*taber.Keys{keys.current, keys.previous} {
+		if k != nil && bytes.Equal(k.Public, public) {
+			return true
+		}
+	}
+	return false
+}
+
+// IDs returns the miniLock IDs of the current key and, if set, the
+// previous one.
+func (sk *ServerKeys) IDs() ([]string, error) {
+	keys := sk.keys.Load().(serverKeyPair)
+	var ids []string
+	for _, k := range []*taber.Keys{keys.current, keys.previous} {
+		if k == nil {
+			continue
+		}
+		id, err := k.EncodeID()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+type serverKeyResponse struct {
+	MinilockID         string `json:"minilock_id"`
+	PreviousMinilockID string `json:"previous_minilock_id,omitempty"`
+}
+
+// ServerKey responds with the miniLock ID keys sends challenges and
+// auth tokens from (and the one it replaced, if any), so that clients
+// can pin it and check who encrypted what they receive.
+func ServerKey(keys *ServerKeys) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ids, err := keys.IDs()
+		if err != nil {
+			WriteError(w, "Error encoding server key; sorry!", err)
+			return
+		}
+
+		resp := serverKeyResponse{MinilockID: ids[0]}
+		if len(ids) > 1 {
+			resp.PreviousMinilockID = ids[1]
+		}
+		body, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(body)
+	}
+}
+
+// LoadServerKeys loads the current server key from path, generating
+// and saving one there first if it doesn't exist, and the previous one
+// from previousPath, which must exist if set. An empty path means a
+// throwaway key that changes on every restart.
+func LoadServerKeys(path, previousPath string) (*ServerKeys, error) {
+	sk := &ServerKeys{path: path, previousPath: previousPath}
+	if path == "" {
+		current, err := generateServerKey()
+		if err != nil {
+			return nil, err
+		}
+		sk.keys.Store(serverKeyPair{current: current})
+	}
+	if err := sk.Reload(); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+// Reload re-reads the key files, keeping the keys in use if that
+// fails. To rotate, move the current key to where the previous one is
+// kept first; a new current key is then generated. A throwaway current
+// key is kept as is.
+func (sk *ServerKeys) Reload() error {
+	var keys serverKeyPair
+	var err error
+
+	if sk.path == "" {
+		keys.current = sk.Current()
+	} else if keys.current, err = loadOrCreateServerKey(sk.path); err != nil {
+		return err
+	}
+
+	if sk.previousPath != "" {
+		keys.previous, err = readServerKey(sk.previousPath)
+		if err != nil {
+			return err
+		}
+	}
+	sk.keys.Store(keys)
+	return nil
+}
+
+// generateServerKey returns a random keypair whose miniLock ID can be
+// decoded again; a small fraction of them can't be, and clients would
+// fail to decrypt anything sent from one.
+func generateServerKey() (*taber.Keys, error) {
+	for {
+		k, err := taber.RandomKey()
+		if err != nil {
+			return nil, err
+		}
+		id, err := k.EncodeID()
+		if err != nil {
+			return nil, err
+		}
+		if _, err = taber.FromID(id); err == nil {
+			return k, nil
+		}
+	}
+}
+
+func loadOrCreateServerKey(path string) (*taber.Keys, error) {
+	k, err := readServerKey(path)
+	if !os.IsNotExist(err) {
+		return k, err
+	}
+
+	k, err = generateServerKey()
+	if err != nil {
+		return nil, err
+	}
+	if err = writeServerKey(path, k); err != nil {
+		return nil, err
+	}
+	log.Infof("Generated new server key; saved to %s", path)
+	return k, nil
+}
+
+// readServerKey reads a private key saved by writeServerKey, as hex,
+// and derives its public key.
+func readServerKey(path string) (*taber.Keys, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	private, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil || len(private) != 32 {
+		return nil, fmt.Errorf("Server key file %s must hold a hex-encoded, 32-byte private key",
+			path)
+	}
+
+	public, priv, err := box.GenerateKey(bytes.NewReader(private))
+	if err != nil {
+		return nil, err
+	}
+	return &taber.Keys{Private: priv[:], Public: public[:]}, nil
+}
+
+// writeServerKey saves k's private key to path, readable only by us.
+// It's written to a temp file first so that a crash can't leave a
+// truncated key behind.
+func writeServerKey(path string, k *taber.Keys) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".server-key-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = tmp.Chmod(0600); err == nil {
+		_, err = tmp.WriteString(hex.EncodeToString(k.Private) + "\n")
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
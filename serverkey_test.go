@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cathalgarvey/go-minilock/taber"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadServerKeysGeneratesOnFirstRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.key")
+
+	sk, err := LoadServerKeys(path, "")
+	require.NoError(t, err)
+	require.True(t, sk.Current().HasPrivate())
+	assert.Nil(t, sk.Previous())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The next run gets the same key
+	again, err := LoadServerKeys(path, "")
+	require.NoError(t, err)
+	assert.Equal(t, sk.Current().Private, again.Current().Private)
+	assert.Equal(t, sk.Current().Public, again.Current().Public)
+
+	// Its ID can be decoded again, or clients couldn't decrypt
+	// anything from it
+	ids, err := sk.IDs()
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+	_, err = taber.FromID(ids[0])
+	assert.NoError(t, err)
+}
+
+func TestLoadServerKeysExisting(t *testing.T) {
+	dir := t.TempDir()
+	current, previous := newTestKeypair(t), newTestKeypair(t)
+	for name, k := range map[string]*taber.Keys{"current.key": current, "previous.key": previous} {
+		err := ioutil.WriteFile(filepath.Join(dir, name),
+			[]byte(hex.EncodeToString(k.Private)+"\n"), 0600)
+		require.NoError(t, err)
+	}
+
+	sk, err := LoadServerKeys(filepath.Join(dir, "current.key"),
+		filepath.Join(dir, "previous.key"))
+	require.NoError(t, err)
+	assert.Equal(t, current.Public, sk.Current().Public)
+	assert.Equal(t, previous.Public, sk.Previous().Public)
+
+	ids, err := sk.IDs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{testMinilockID(t, current),
+		testMinilockID(t, previous)}, ids)
+}
+
+func TestServerKeysRotate(t *testing.T) {
+	dir := t.TempDir()
+	path, previousPath := filepath.Join(dir, "server.key"),
+		filepath.Join(dir, "previous.key")
+	require.NoError(t, ioutil.WriteFile(previousPath,
+		[]byte(hex.EncodeToString(newTestKeypair(t).Private)+"\n"), 0600))
+
+	sk, err := LoadServerKeys(path, previousPath)
+	require.NoError(t, err)
+	first := sk.Current()
+
+	cs := NewChallengeStore(time.Minute)
+	nonce, err := cs.New("someID", first)
+	require.NoError(t, err)
+	stale, err := cs.New("someID", first)
+	require.NoError(t, err)
+
+	// Challenges sent from the old key can still be answered
+	require.NoError(t, os.Rename(path, previousPath))
+	require.NoError(t, sk.Reload())
+	assert.NotEqual(t, first.Public, sk.Current().Public)
+	assert.Equal(t, first.Public, sk.Previous().Public)
+	assert.True(t, sk.Trusts(first.Public))
+	assert.NoError(t, cs.Verify("someID", nonce, sk))
+
+	// ...until it's rotated out
+	require.NoError(t, os.Rename(path, previousPath))
+	require.NoError(t, sk.Reload())
+	assert.False(t, sk.Trusts(first.Public))
+	assert.Equal(t, ErrChallengeKeyRetired, cs.Verify("someID", stale, sk))
+
+	// A bad key file leaves the keys alone
+	current := sk.Current()
+	require.NoError(t, ioutil.WriteFile(previousPath, []byte("nope\n"), 0600))
+	assert.Error(t, sk.Reload())
+	assert.Equal(t, current, sk.Current())
+}
+
+func TestLoadServerKeysErrors(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.key")
+	require.NoError(t, ioutil.WriteFile(bad, []byte("not a key\n"), 0600))
+
+	_, err := LoadServerKeys(bad, "")
+	assert.Error(t, err)
+
+	// Unlike the current key, the previous one is never generated
+	_, err = LoadServerKeys(filepath.Join(dir, "server.key"),
+		filepath.Join(dir, "missing.key"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLoadServerKeysThrowaway(t *testing.T) {
+	sk, err := LoadServerKeys("", "")
+	require.NoError(t, err)
+	other, err := LoadServerKeys("", "")
+	require.NoError(t, err)
+	assert.NotEqual(t, sk.Current().Public, other.Current().Public)
+}
+
+func TestServerKeyRoute(t *testing.T) {
+	// Readable without basic auth credentials
+	cfg := testConfig()
+	cfg.BasicAuthUsername = "team"
+	cfg.BasicAuthPassword = "correct horse battery staple"
+	r := mustNewRouterConfig(cfg, NewMapper())
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/api/server-key", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, contentTypeJSON, rec.Header().Get("Content-Type"))
+	assert.NotContains(t, rec.Body.String(),
+		hex.EncodeToString(testServerKeys.Current().Private))
+
+	var resp map[string]string
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Len(t, resp, 1)
+
+	// The ID round-trips to the key challenges and tokens are
+	// encrypted from
+	k, err := taber.FromID(resp["minilock_id"])
+	require.NoError(t, err)
+	assert.Equal(t, testServerKeys.Current().Public, k.Public)
+	assert.False(t, k.HasPrivate())
+}
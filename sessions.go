@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cryptag/minishare/miniware"
+)
+
+// sessionFingerprintLen is how many hex digits of an auth token's
+// SHA-256 identify it to the client; enough to tell sessions apart
+// without revealing anything usable.
+const sessionFingerprintLen = 12
+
+var ErrTooManySessions = errors.New("too many active sessions")
+
+// SessionCap is a Store that caps how many sessions (auth
+// tokens) each miniLock ID can have at once. When a login would go
+// over, SetMinilockID either revokes the least recently used sessions
+// to make room or, if reject is set, fails with ErrTooManySessions.
+//
+// The count is checked before the new token is saved, so replicas
+// logging in the same miniLock ID at once can briefly exceed it.
+type SessionCap struct {
+	Store
+	max    int
+	reject bool
+}
+
+// NewSessionCap caps m's sessions per miniLock ID at max, or returns m
+// as is if max is 0.
+func NewSessionCap(m Store, max int, reject bool) Store {
+	if max <= 0 {
+		return m
+	}
+	return &SessionCap{Store: m, max: max, reject: reject}
+}
+
+func (sc *SessionCap) SetMinilockID(authToken, mID string) error {
+	sessions, err := sc.Sessions(mID)
+	if err != nil {
+		return err
+	}
+
+	if excess := len(sessions) - sc.max + 1; excess > 0 {
+		if sc.reject {
+			return ErrTooManySessions
+		}
+		sort.Slice(sessions, func(i, j int) bool {
+			return sessions[i].LastSeen.Before(sessions[j].LastSeen)
+		})
+		for _, s := range sessions[:excess] {
+			err := sc.DeleteMinilockID(s.AuthToken)
+			if err != nil && err != miniware.ErrAuthTokenNotFound {
+				return err
+			}
+			log.Infof("Revoked least recently used session %s of `%s` to"+
+				" stay under %d", tokenFingerprint(s.AuthToken), mID, sc.max)
+		}
+	}
+
+	return sc.Store.SetMinilockID(authToken, mID)
+}
+
+// LastSeenTracker is a Store that TokenAuthenticator tells
+// about each use of an auth token (see Seen), and which saves when it
+// was last seen at most once per interval per token, rather than
+// writing to the store on every request.
+type LastSeenTracker struct {
+	Store
+	interval time.Duration
+	now      func() time.Time
+
+	lock  sync.Mutex
+	saved map[string]time.Time // When each token's last-seen time was saved
+	swept time.Time
+}
+
+func NewLastSeenTracker(m Store, interval time.Duration) *LastSeenTracker {
+	return &LastSeenTracker{
+		Store:    m,
+		interval: interval,
+		now:      time.Now,
+		saved:    map[string]time.Time{},
+	}
+}
+
+// Seen records that authToken was just used, unless that was already
+// saved within the last interval.
+func (lt *LastSeenTracker) Seen(authToken string) {
+	now := lt.now()
+	if !lt.due(authToken, now) {
+		return
+	}
+	err := lt.SetLastSeen(authToken, now)
+	if err != nil && err != miniware.ErrAuthTokenNotFound {
+		log.Warnf("Error saving last-seen time of session %s: %v",
+			tokenFingerprint(authToken), err)
+	}
+}
+
+// due reports whether authToken's last-seen time should be saved at
+// now, and if so, notes that it's being saved so that concurrent
+// requests with the same token don't save it too.
+func (lt *LastSeenTracker) due(authToken string, now time.Time) bool {
+	if lt.interval <= 0 {
+		return true
+	}
+
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+
+	if saved, ok := lt.saved[authToken]; ok && now.Sub(saved) < lt.interval {
+		return false
+	}
+	lt.saved[authToken] = now
+
+	// Forget tokens that are due again anyway, so that the map doesn't
+	// grow with every token ever used
+	if now.Sub(lt.swept) >= lt.interval {
+		for token, saved := range lt.saved {
+			if now.Sub(saved) >= lt.interval {
+				delete(lt.saved, token)
+			}
+		}
+		lt.swept = now
+	}
+	return true
+}
+
+type sessionInfo struct {
+	Fingerprint string     `json:"fingerprint"`
+	Created     time.Time  `json:"created"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"`
+	Current     bool       `json:"current"`
+}
+
+// Sessions lists the active sessions (auth tokens) belonging to the
+// caller's miniLock ID, identifying each by fingerprint only.
+func Sessions(m Store) func(w http.ResponseWriter, req *http.Request) {
+	return RequireAuth(NewTokenAuthenticator(m))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mID := RequestIdentity(req)
+		authToken := authTokenFromRequest(req)
+
+		active, err := m.Sessions(mID)
+		if err != nil {
+			WriteError(w, "Error listing sessions; sorry!", err)
+			return
+		}
+
+		sessions := []sessionInfo{}
+		for _, s := range active {
+			info := sessionInfo{
+				Fingerprint: tokenFingerprint(s.AuthToken),
+				Created:     s.Created.UTC(),
+				Current:     secureCompare(authToken, s.AuthToken),
+			}
+			if !s.LastSeen.IsZero() {
+				lastSeen := s.LastSeen.UTC()
+				info.LastSeen = &lastSeen
+			}
+			sessions = append(sessions, info)
+		}
+
+		body, err := json.Marshal(map[string]interface{}{"sessions": sessions})
+		if err != nil {
+			WriteError(w, "Error listing sessions; sorry!", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(body)
+	})).ServeHTTP
+}
+
+func tokenFingerprint(authToken string) string {
+	sum := sha256.Sum256([]byte(authToken))
+	return hex.EncodeToString(sum[:])[:sessionFingerprintLen]
+}
+
+// RevokeAllSessions revokes every auth token belonging to the caller's
+// miniLock ID, including the one used to make this request, e.g. after
+// a device is lost.
+func RevokeAllSessions(m Store, audit *AuditLog) func(w http.ResponseWriter, req *http.Request) {
+	return RequireAuth(NewTokenAuthenticator(m))(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mID := RequestIdentity(req)
+
+		n, err := m.DeleteAllForMinilockID(mID)
+		if err != nil {
+			audit.Failure(req, "revoke_all", mID, "error revoking sessions")
+			WriteError(w, "Error revoking sessions; sorry!", err)
+			return
+		}
+		log.Infof("RevokeAllSessions: revoked %d session(s) of `%s`", n, mID)
+		audit.Success(req, "revoke_all", mID,
+			fmt.Sprintf("revoked %d session(s)", n))
+
+		body, _ := json.Marshal(map[string]int{"revoked": n})
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(body)
+	})).ServeHTTP
+}
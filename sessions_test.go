@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cryptag/minishare/miniware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSessions(t *testing.T, handler http.Handler, authToken string) []sessionInfo {
+	req := httptest.NewRequest("GET", "/api/sessions", nil)
+	req.Header.Set("Authorization", authToken)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var body struct {
+		Sessions []sessionInfo `json:"sessions"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	return body.Sessions
+}
+
+func TestSessions(t *testing.T) {
+	m := NewMapper()
+	router := mustNewRouter(m)
+	keypair := newTestKeypair(t)
+
+	laptop := testLogin(t, router, keypair)
+	phone := testLogin(t, router, keypair)
+	other := testLogin(t, router, newTestKeypair(t))
+
+	sessions := testSessions(t, router, phone)
+	require.Len(t, sessions, 2)
+
+	fingerprints := map[string]bool{}
+	for _, s := range sessions {
+		assert.Len(t, s.Fingerprint, sessionFingerprintLen)
+		assert.NotContains(t, laptop, s.Fingerprint)
+		assert.NotContains(t, phone, s.Fingerprint)
+		assert.False(t, s.Created.IsZero())
+		// Only the one listing them has been used since logging in
+		assert.Equal(t, s.Current, s.LastSeen != nil)
+		fingerprints[s.Fingerprint] = s.Current
+	}
+	assert.Equal(t, map[string]bool{
+		tokenFingerprint(laptop): false,
+		tokenFingerprint(phone):  true,
+	}, fingerprints)
+	assert.NotContains(t, fingerprints, tokenFingerprint(other))
+
+	// Logging out removes the session from the list
+	testURL(t, "POST", "/api/logout",
+		http.Header{"Authorization": []string{laptop}}, router,
+		http.StatusOK, "")
+	sessions = testSessions(t, router, phone)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, tokenFingerprint(phone), sessions[0].Fingerprint)
+}
+
+func TestSessionsUnauthorized(t *testing.T) {
+	testURL(t, "GET", "/api/sessions", nil, router,
+		http.StatusUnauthorized, "")
+}
+
+func TestRevokeAllSessions(t *testing.T) {
+	m := NewMapper()
+	router := mustNewRouter(m)
+	keypair := newTestKeypair(t)
+
+	var tokens []string
+	for i := 0; i < 3; i++ {
+		tokens = append(tokens, testLogin(t, router, keypair))
+	}
+	other := testLogin(t, router, newTestKeypair(t))
+
+	testURL(t, "POST", "/api/sessions/revoke-all",
+		http.Header{"Authorization": []string{tokens[1]}}, router,
+		http.StatusOK, `{"revoked":3}`)
+
+	for _, authToken := range tokens {
+		testURL(t, "GET", "/api/sessions",
+			http.Header{"Authorization": []string{authToken}}, router,
+			http.StatusUnauthorized, "")
+	}
+	sessions, err := m.Sessions(testMinilockID(t, keypair))
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+
+	// Other users are unaffected
+	assert.Len(t, testSessions(t, router, other), 1)
+	assert.Equal(t, 1, m.Len())
+}
+
+func TestSessionCap(t *testing.T) {
+	m := NewMapper()
+	now := time.Now()
+	m.SetClock(func() time.Time { return now })
+
+	cfg := testConfig()
+	cfg.MaxSessions = 3
+	router := mustNewRouterConfig(cfg, m)
+	keypair := newTestKeypair(t)
+
+	var tokens []string
+	for i := 0; i < 4; i++ {
+		tokens = append(tokens, testLogin(t, router, keypair))
+		now = now.Add(time.Minute)
+	}
+
+	// The oldest made room for the newest
+	testURL(t, "GET", "/api/sessions",
+		http.Header{"Authorization": []string{tokens[0]}}, router,
+		http.StatusUnauthorized, "")
+	sessions := testSessions(t, router, tokens[3])
+	require.Len(t, sessions, 3)
+	for _, s := range sessions {
+		assert.NotEqual(t, tokenFingerprint(tokens[0]), s.Fingerprint)
+	}
+}
+
+func TestSessionCapReject(t *testing.T) {
+	m := NewMapper()
+	cfg := testConfig()
+	cfg.MaxSessions = 3
+	cfg.MaxSessionsReject = true
+	router := mustNewRouterConfig(cfg, m)
+	keypair := newTestKeypair(t)
+
+	var tokens []string
+	for i := 0; i < 3; i++ {
+		tokens = append(tokens, testLogin(t, router, keypair))
+	}
+
+	rec := answerChallengeLogin(t, router, keypair)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+
+	// Existing sessions are untouched
+	for _, authToken := range tokens {
+		assert.Len(t, testSessions(t, router, authToken), 3)
+	}
+
+	// Logging out frees up a slot
+	testURL(t, "POST", "/api/logout",
+		http.Header{"Authorization": []string{tokens[0]}}, router,
+		http.StatusOK, "")
+	testLogin(t, router, keypair)
+}
+
+// countingStore counts how often last-seen times are saved
+type countingStore struct {
+	*Mapper
+	writes int32
+}
+
+func (cs *countingStore) SetLastSeen(authToken string, at time.Time) error {
+	atomic.AddInt32(&cs.writes, 1)
+	return cs.Mapper.SetLastSeen(authToken, at)
+}
+
+func TestLastSeen(t *testing.T) {
+	m := &countingStore{Mapper: NewMapper()}
+	router := mustNewRouter(m)
+	keypair := newTestKeypair(t)
+	authToken := testLogin(t, router, keypair)
+
+	before := testSessions(t, router, authToken)
+	require.Len(t, before, 1)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&m.writes))
+
+	// Rapid requests, even concurrent ones, only save it once a minute
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testSessions(t, router, authToken)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&m.writes))
+
+	tracker := NewLastSeenTracker(m, time.Minute)
+	now := time.Now().Add(time.Hour)
+	tracker.now = func() time.Time { return now }
+	tracker.Seen(authToken)
+	tracker.Seen(authToken)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&m.writes))
+
+	after := testSessions(t, router, authToken)
+	require.Len(t, after, 1)
+	assert.Equal(t, before[0].Created, after[0].Created)
+	require.NotNil(t, after[0].LastSeen)
+	assert.True(t, now.Equal(*after[0].LastSeen))
+
+	// Due again once the interval's up
+	now = now.Add(time.Minute)
+	tracker.Seen(authToken)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&m.writes))
+
+	// Revoked tokens aren't brought back
+	require.NoError(t, m.DeleteMinilockID(authToken))
+	now = now.Add(time.Minute)
+	tracker.Seen(authToken)
+	_, err := m.GetMinilockID(authToken)
+	assert.Equal(t, miniware.ErrAuthTokenNotFound, err)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const BUILD_DIR = "./build"
+
+const (
+	cacheControlImmutable  = "public, max-age=31536000, immutable"
+	cacheControlRevalidate = "no-cache"
+)
+
+// fingerprintedRegex matches the content-hashed filenames that
+// create-react-app gives the JS, CSS, and media in build/static, such
+// as main.8d3f2a1c.js or 2.a1b2c3d4.chunk.css.map. Since their names
+// change whenever their contents do, they can be cached forever.
+var fingerprintedRegex = regexp.MustCompile(
+	`^/static/.+\.[0-9a-f]{8,}(\.chunk)?\.[a-z0-9]+(\.map)?$`)
+
+// mainBundleRegex finds the main JS and CSS bundles referenced by
+// index.html, which are worth pushing along with it.
+var mainBundleRegex = regexp.MustCompile(
+	`(?:src|href)="(/static/(?:js|css)/main\.[0-9a-f]{8,}(?:\.chunk)?\.(?:js|css))"`)
+
+// assetContentTypes are the Content-Types of the kinds of files a
+// build can contain, set explicitly rather than looked up in the
+// system's MIME database, which varies from host to host (and lacks
+// .wasm on many).
+var assetContentTypes = map[string]string{
+	".html":        "text/html; charset=utf-8",
+	".js":          "text/javascript; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".css":         "text/css; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".webmanifest": "application/manifest+json",
+	".txt":         "text/plain; charset=utf-8",
+	".xml":         "application/xml",
+	".wasm":        "application/wasm",
+	".svg":         "image/svg+xml",
+	".png":         "image/png",
+	".jpg":         "image/jpeg",
+	".jpeg":        "image/jpeg",
+	".gif":         "image/gif",
+	".webp":        "image/webp",
+	".avif":        "image/avif",
+	".ico":         "image/x-icon",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".ttf":         "font/ttf",
+	".otf":         "font/otf",
+	".eot":         "application/vnd.ms-fontobject",
+	".mp3":         "audio/mpeg",
+	".mp4":         "video/mp4",
+	".webm":        "video/webm",
+	".pdf":         "application/pdf",
+}
+
+// setAssetContentType sets the Content-Type of the file at upath by
+// its extension. Files of any other kind (or with no extension) are
+// downloaded rather than rendered, so that one the browser would
+// otherwise guess is HTML can't run scripts on our origin.
+func setAssetContentType(w http.ResponseWriter, upath string) {
+	ctype, ok := assetContentTypes[strings.ToLower(path.Ext(upath))]
+	if !ok {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment")
+		return
+	}
+	w.Header().Set("Content-Type", ctype)
+}
+
+// SPAHandler serves the static files in FS, falling back to FS's
+// index.html for any GET path that isn't a file so that the React
+// router can take over client-side routes (/dashboard,
+// /pursuance/..., etc). A directory is never listed; a request for one
+// gets the DirIndex within it, if there is one, and otherwise falls
+// back to index.html like any other path.
+//
+// index.html is served from memory; call LoadIndex to pick up a new
+// one from FS.
+type SPAHandler struct {
+	FS http.FileSystem
+	// Push the main JS and CSS bundles along with index.html to
+	// HTTP/2 clients that still support server push
+	Push bool
+	// Serve a placeholder page, rather than a 500, while index.html
+	// is missing, e.g. before the frontend has been built
+	Placeholder bool
+	// The document served for a directory that has one, e.g.
+	// /docs/index.html for /docs; empty to serve the app's index.html
+	// for every directory
+	DirIndex string
+
+	indexLock    sync.RWMutex
+	index        []byte
+	indexModTime time.Time
+	indexETag    string
+	indexBundles []string
+
+	// map[path]string of ETags of files without mod times
+	etags sync.Map
+}
+
+// NewSPAHandler returns an SPAHandler serving the directory dir from
+// disk.
+func NewSPAHandler(dir string) *SPAHandler {
+	return newSPAHandlerFS(http.Dir(dir))
+}
+
+func newSPAHandlerFS(fs http.FileSystem) *SPAHandler {
+	h := &SPAHandler{FS: fs, DirIndex: "index.html"}
+	// Retried on request if it fails; NewRouter reports it
+	h.LoadIndex()
+	return h
+}
+
+func (h *SPAHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Cleaning a rooted path removes any `..` elements, so the
+	// result can't climb out of h.FS
+	upath := path.Clean("/" + req.URL.Path)
+
+	f, err := h.FS.Open(upath)
+	if err != nil {
+		h.serveIndex(w, req)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err == nil && stat.IsDir() {
+		index, istat := h.openDirIndex(upath)
+		if index == nil {
+			h.serveIndex(w, req)
+			return
+		}
+		defer index.Close()
+		upath = path.Join(upath, h.DirIndex)
+		f, stat = index, istat
+	}
+	if err != nil {
+		h.serveIndex(w, req)
+		return
+	}
+
+	// Whether or not there's a precompressed variant, caches should
+	// assume there could be
+	varyOn(w.Header(), "Accept-Encoding")
+	servedPath := upath
+	pf, pstat, encoding := h.openPrecompressed(upath, req)
+	if pf != nil {
+		defer pf.Close()
+		f, stat = pf, pstat
+		servedPath += precompressedExts[encoding]
+		w.Header().Set("Content-Encoding", encoding)
+	}
+
+	if fingerprintedRegex.MatchString(upath) {
+		w.Header().Set("Cache-Control", cacheControlImmutable)
+	} else {
+		w.Header().Set("Cache-Control", cacheControlRevalidate)
+	}
+	// Before ServeContent, which would otherwise guess (from the
+	// .br's or .gz's name, if precompressed)
+	setAssetContentType(w, upath)
+
+	etag, err := h.fileETag(servedPath, stat, f)
+	if err != nil {
+		log.Errorf("Error generating ETag for %s: %v", servedPath, err)
+	} else {
+		if encoding != "" {
+			// Each encoding is a different representation
+			etag = strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+		}
+		w.Header().Set("ETag", etag)
+	}
+
+	http.ServeContent(w, req, stat.Name(), stat.ModTime(), f)
+}
+
+// precompressedEncodings are the encodings the build pipeline may
+// produce variants of files in, by the extension it gives them, in
+// order of preference
+var precompressedEncodings = []string{"br", "gzip"}
+
+var precompressedExts = map[string]string{"br": ".br", "gzip": ".gz"}
+
+// openPrecompressed opens the best precompressed variant of the file
+// at upath that req accepts, e.g. main.js.br alongside main.js,
+// returning its encoding, or nil if there's none.
+func (h *SPAHandler) openPrecompressed(upath string, req *http.Request) (http.File, os.FileInfo, string) {
+	acceptEncoding := req.Header.Get("Accept-Encoding")
+	for _, encoding := range precompressedEncodings {
+		if !acceptsEncoding(acceptEncoding, encoding) {
+			continue
+		}
+		f, err := h.FS.Open(upath + precompressedExts[encoding])
+		if err != nil {
+			continue
+		}
+		stat, err := f.Stat()
+		if err != nil || stat.IsDir() {
+			f.Close()
+			continue
+		}
+		return f, stat, encoding
+	}
+	return nil, nil, ""
+}
+
+// openDirIndex opens the DirIndex within the directory dir, or returns
+// nil if it has none. The app's own index.html, at the root, is left to
+// serveIndex.
+func (h *SPAHandler) openDirIndex(dir string) (http.File, os.FileInfo) {
+	if h.DirIndex == "" || dir == "/" {
+		return nil, nil
+	}
+	f, err := h.FS.Open(path.Join(dir, h.DirIndex))
+	if err != nil {
+		return nil, nil
+	}
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		f.Close()
+		return nil, nil
+	}
+	return f, stat
+}
+
+// fileETag returns an ETag for the file f at upath. Files on disk get
+// one based on their mod time and size; embedded files, which have no
+// mod time, get one based on their contents, computed once.
+func (h *SPAHandler) fileETag(upath string, stat os.FileInfo, f http.File) (string, error) {
+	if !stat.ModTime().IsZero() {
+		return fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size()), nil
+	}
+
+	if etag, ok := h.etags.Load(upath); ok {
+		return etag.(string), nil
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	etag := fmt.Sprintf(`"%x"`, hash.Sum(nil)[:16])
+	h.etags.Store(upath, etag)
+	return etag, nil
+}
+
+// LoadIndex (re)reads index.html from h.FS into memory.
+func (h *SPAHandler) LoadIndex() error {
+	f, err := h.FS.Open("/index.html")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	contents, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	// Embedded files have no mod time, so the ETag is based on the
+	// contents instead
+	sum := sha256.Sum256(contents)
+
+	h.indexLock.Lock()
+	defer h.indexLock.Unlock()
+
+	h.index = contents
+	h.indexModTime = stat.ModTime()
+	h.indexETag = fmt.Sprintf(`"%x"`, sum[:16])
+	h.indexBundles = nil
+	for _, match := range mainBundleRegex.FindAllSubmatch(contents, -1) {
+		h.indexBundles = append(h.indexBundles, string(match[1]))
+	}
+	return nil
+}
+
+func (h *SPAHandler) cachedIndex() (index []byte, modTime time.Time, etag string) {
+	h.indexLock.RLock()
+	defer h.indexLock.RUnlock()
+
+	return h.index, h.indexModTime, h.indexETag
+}
+
+// pushBundles pushes index.html's main bundles to the client, if it
+// supports HTTP/2 server push.
+func (h *SPAHandler) pushBundles(w http.ResponseWriter) {
+	pusher, ok := findPusher(w)
+	if !ok {
+		return
+	}
+
+	h.indexLock.RLock()
+	bundles := h.indexBundles
+	h.indexLock.RUnlock()
+
+	for _, bundle := range bundles {
+		if err := pusher.Push(bundle, nil); err != nil {
+			// E.g., the client disabled push
+			log.Debugf("Error pushing %s: %v", bundle, err)
+			return
+		}
+	}
+}
+
+// findPusher returns the http.Pusher w wraps, if any.
+func findPusher(w http.ResponseWriter) (http.Pusher, bool) {
+	for {
+		if pusher, ok := w.(http.Pusher); ok {
+			return pusher, true
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil, false
+		}
+		w = unwrapper.Unwrap()
+	}
+}
+
+func (h *SPAHandler) serveIndex(w http.ResponseWriter, req *http.Request) {
+	index, modTime, etag := h.cachedIndex()
+	if index == nil {
+		if err := h.LoadIndex(); err != nil {
+			if h.Placeholder {
+				writePlaceholderIndex(w, req)
+				return
+			}
+			writeIndexError(w, err)
+			return
+		}
+		index, modTime, etag = h.cachedIndex()
+	}
+
+	if h.Push && req.Method == "GET" {
+		h.pushBundles(w)
+	}
+
+	// Each response has its own CSP nonce, so it mustn't be cached
+	if nonce := cspNonce(req); nonce != "" {
+		w.Header().Set("Cache-Control", "no-store")
+		http.ServeContent(w, req, "index.html", time.Time{},
+			bytes.NewReader(injectCSPNonce(index, nonce)))
+		return
+	}
+
+	// Always check for a new deploy
+	w.Header().Set("Cache-Control", cacheControlRevalidate)
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, req, "index.html", modTime, bytes.NewReader(index))
+}
+
+func writeIndexError(w http.ResponseWriter, err error) {
+	log.Errorf("Error serving index.html: %v", err)
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte("Error: couldn't serve you index.html!"))
+}
+
+const placeholderIndex = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Frontend not built</title>
+<style>body { font-family: sans-serif; text-align: center; margin-top: 15%; color: #333; }</style>
+</head>
+<body>
+<h1>The frontend hasn't been built yet</h1>
+<p>Run <code>npm run build</code>, then reload this page.</p>
+</body>
+</html>
+`
+
+func writePlaceholderIndex(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if req.Method != "HEAD" {
+		w.Write([]byte(placeholderIndex))
+	}
+}
+
+// ReloadIndex has h re-read index.html, e.g. after a deploy.
+func ReloadIndex(h *SPAHandler) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := h.LoadIndex(); err != nil {
+			WriteError(w, "Error reloading index.html", err)
+			return
+		}
+		log.Info("Reloaded index.html")
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !embed
+
+package main
+
+// buildFSHandler serves the React app from BUILD_DIR on disk. Build
+// with `-tags embed` to compile the build dir into the binary instead.
+func buildFSHandler() *SPAHandler {
+	return NewSPAHandler(BUILD_DIR)
+}
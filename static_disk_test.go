@@ -0,0 +1,117 @@
+//go:build !embed
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRouterAPINotFound(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.MkdirAll(BUILD_DIR, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(BUILD_DIR, "index.html"),
+		[]byte(testIndexHTML), 0644))
+
+	cfg := testConfig()
+	r := mustNewRouterConfig(cfg, NewMapper())
+
+	for _, url := range []string{"/api/bogus", "/api/login/extra", "/api/"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code, url)
+		assert.Equal(t, contentTypeJSON, rec.Header().Get("Content-Type"), url)
+
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body), url)
+		assert.Equal(t, "not found", body["error"], url)
+	}
+
+	// Client-side routes still get index.html
+	for _, url := range []string{"/some/client/route", "/apiary", "/api"} {
+		testURL(t, "GET", url, nil, r, http.StatusOK, testIndexHTML)
+	}
+
+	// Even if PostgREST is mounted at / or under /api/
+	cfg.PostgrestPathPrefix = "/"
+	r = mustNewRouterConfig(cfg, NewMapper())
+	testURL(t, "GET", "/api/bogus", nil, r, http.StatusNotFound, "")
+
+	cfg.PostgrestPathPrefix = "/api/db"
+	cfg.PostgrestBaseURL = "http://127.0.0.1:1/"
+	r = mustNewRouterConfig(cfg, NewMapper())
+	testURL(t, "GET", "/api/bogus", nil, r, http.StatusNotFound, "")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/api/db/todos", nil))
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+}
+
+func TestNewRouterMissingIndex(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	cfg := testConfig()
+	cfg.Prod = true
+	cfg.PostgrestJWTSecret = "secret"
+	_, err := NewRouter(cfg, NewMapper(), testServerKeys, nil, nil, nil, nil, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "npm run build")
+
+	cfg.Prod = false
+	r, err := NewRouter(cfg, NewMapper(), testServerKeys, nil, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/dashboard", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.True(t, strings.Contains(rec.Body.String(), "npm run build"))
+
+	// Picked up as soon as it's built
+	require.NoError(t, os.MkdirAll(BUILD_DIR, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(BUILD_DIR, "index.html"),
+		[]byte(testIndexHTML), 0644))
+	testURL(t, "GET", "/dashboard", nil, r, http.StatusOK, testIndexHTML)
+}
+
+func TestNewRouterMethodNotAllowed(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.MkdirAll(BUILD_DIR, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(BUILD_DIR, "index.html"),
+		[]byte(testIndexHTML), 0644))
+
+	r := mustNewRouterConfig(testConfig(), NewMapper())
+
+	for _, tt := range []struct {
+		method, url, allow string
+	}{
+		// Static files and client-side routes are only ever GET
+		{"POST", "/", "GET"},
+		{"DELETE", "/some/client/route", "GET"},
+		// Existing API routes, rather than a 404 from the catch-all
+		{"PUT", "/api/login", "POST"},
+		{"POST", "/healthz", "GET, HEAD"},
+	} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.url, nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code, tt.url)
+		assert.Equal(t, tt.allow, rec.Header().Get("Allow"), tt.url)
+		assert.Equal(t, contentTypeJSON, rec.Header().Get("Content-Type"), tt.url)
+
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body), tt.url)
+		assert.Equal(t, "method not allowed", body["error"], tt.url)
+	}
+
+	// Unknown API routes are still unknown, whatever the method
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("PUT", "/api/bogus", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Empty(t, rec.Header().Get("Allow"))
+}
@@ -0,0 +1,24 @@
+//go:build embed
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//go:embed build
+var embeddedBuild embed.FS
+
+// buildFSHandler serves the React app from the copy of BUILD_DIR
+// compiled into this binary, so it can be deployed on its own.
+func buildFSHandler() *SPAHandler {
+	buildFS, err := fs.Sub(embeddedBuild, "build")
+	if err != nil {
+		log.Fatalf("Error loading embedded build dir: %v", err)
+	}
+	return newSPAHandlerFS(http.FS(buildFS))
+}
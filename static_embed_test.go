@@ -0,0 +1,20 @@
+//go:build embed
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestEmbeddedIndex(t *testing.T) {
+	index, err := embeddedBuild.ReadFile("build/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testURL(t, "GET", "/", nil, buildFSHandler(), http.StatusOK,
+		string(index))
+	testURL(t, "GET", "/dashboard", nil, buildFSHandler(), http.StatusOK,
+		string(index))
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testIndexHTML = `<!DOCTYPE html><html><body><div id="root"></div></body></html>`
+
+const testHashedAsset = "static/js/main.8d3f2a1c.js"
+
+// newTestBuildDir creates a temporary build dir alongside a file
+// outside of it that must never be served
+
+func newTestBuildDir(tb testing.TB) (buildDir string, cleanup func()) {
+	tmpDir, err := ioutil.TempDir("", "effective-build")
+	require.NoError(tb, err)
+
+	buildDir = filepath.Join(tmpDir, "build")
+	files := map[string]string{
+		filepath.Join(buildDir, "index.html"):             testIndexHTML,
+		filepath.Join(buildDir, "static/js/main.abc1.js"): "console.log('hi');",
+		filepath.Join(buildDir, testHashedAsset):          "console.log('hashed');",
+		filepath.Join(tmpDir, "secret.txt"):               "top secret",
+	}
+	for name, contents := range files {
+		require.NoError(tb, os.MkdirAll(filepath.Dir(name), 0755))
+		require.NoError(tb, ioutil.WriteFile(name, []byte(contents), 0644))
+	}
+
+	return buildDir, func() { os.RemoveAll(tmpDir) }
+}
+
+func TestSPAHandler(t *testing.T) {
+	buildDir, cleanup := newTestBuildDir(t)
+	defer cleanup()
+
+	h := NewSPAHandler(buildDir)
+
+	// Real asset
+	testURL(t, "GET", "/static/js/main.abc1.js", nil, h, http.StatusOK,
+		"console.log('hi');")
+
+	// Client-side routes fall back to index.html
+	for _, url := range []string{"/", "/dashboard", "/pursuance/1/tasks",
+		"/somethingelse/deep/client/route", "/static/js"} {
+		testURL(t, "GET", url, nil, h, http.StatusOK, testIndexHTML)
+	}
+}
+
+func TestSPAHandlerDirIndex(t *testing.T) {
+	docsHTML := `<html><body>docs</body></html>`
+	h := newSPAHandlerFS(http.FS(fstest.MapFS{
+		"index.html":             {Data: []byte(testIndexHTML)},
+		"docs/index.html":        {Data: []byte(docsHTML)},
+		"docs/guide.html":        {Data: []byte("guide")},
+		"static/js/main.abc1.js": {Data: []byte("console.log('hi');")},
+	}))
+
+	// A directory with its own index.html gets it, with or without
+	// the trailing slash, rather than a listing or a redirect
+	for _, url := range []string{"/docs", "/docs/", "/docs/index.html"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		assert.Equal(t, http.StatusOK, rec.Code, url)
+		assert.Equal(t, docsHTML, rec.Body.String(), url)
+		assert.Equal(t, "text/html; charset=utf-8",
+			rec.Header().Get("Content-Type"), url)
+	}
+
+	// One without falls back to the app's
+	for _, url := range []string{"/static", "/static/js/", "/"} {
+		testURL(t, "GET", url, nil, h, http.StatusOK, testIndexHTML)
+	}
+
+	h.DirIndex = ""
+	testURL(t, "GET", "/docs", nil, h, http.StatusOK, testIndexHTML)
+	testURL(t, "GET", "/docs/guide.html", nil, h, http.StatusOK, "guide")
+}
+
+func TestSPAHandlerTraversal(t *testing.T) {
+	buildDir, cleanup := newTestBuildDir(t)
+	defer cleanup()
+
+	h := NewSPAHandler(buildDir)
+
+	for _, upath := range []string{"/../secret.txt", "../secret.txt",
+		"/static/../../secret.txt"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.URL.Path = upath
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, testIndexHTML, rec.Body.String())
+	}
+}
+
+func TestSPAHandlerMissingIndex(t *testing.T) {
+	h := NewSPAHandler(filepath.Join(os.TempDir(), "effective-no-such-dir"))
+	testURL(t, "GET", "/dashboard", nil, h, http.StatusInternalServerError, "")
+}
+
+func TestSPAHandlerIndexCached(t *testing.T) {
+	buildDir, cleanup := newTestBuildDir(t)
+	defer cleanup()
+
+	h := NewSPAHandler(buildDir)
+
+	newIndex := `<html><body>new deploy</body></html>`
+	err := ioutil.WriteFile(filepath.Join(buildDir, "index.html"),
+		[]byte(newIndex), 0644)
+	require.NoError(t, err)
+
+	// Still serving the copy read at startup...
+	testURL(t, "GET", "/dashboard", nil, h, http.StatusOK, testIndexHTML)
+
+	// ...until told to reload
+	testURL(t, "POST", "/internal/reload", nil,
+		http.HandlerFunc(ReloadIndex(h)), http.StatusOK, "")
+	testURL(t, "GET", "/dashboard", nil, h, http.StatusOK, newIndex)
+}
+
+func TestSPAHandlerIndexETag(t *testing.T) {
+	buildDir, cleanup := newTestBuildDir(t)
+	defer cleanup()
+
+	h := NewSPAHandler(buildDir)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	etag := rec.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	headers := http.Header{"If-None-Match": []string{etag}}
+	testURL(t, "GET", "/dashboard", headers, h, http.StatusNotModified, "")
+}
+
+func TestSPAHandlerCacheControl(t *testing.T) {
+	buildDir, cleanup := newTestBuildDir(t)
+	defer cleanup()
+
+	h := NewSPAHandler(buildDir)
+
+	for url, want := range map[string]string{
+		"/":                            "no-cache",
+		"/dashboard":                   "no-cache",
+		"/" + testHashedAsset:          "public, max-age=31536000, immutable",
+		"/static/js/main.abc1.js":      "no-cache",
+		"/static/js/main.8d3f2a1c.zzz": "no-cache", // Falls back to index.html
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		assert.Equal(t, http.StatusOK, rec.Code, url)
+		assert.Equal(t, want, rec.Header().Get("Cache-Control"), url)
+		assert.NotEmpty(t, rec.Header().Get("ETag"), url)
+	}
+
+	assert.True(t, fingerprintedRegex.MatchString("/static/css/2.a1b2c3d4.chunk.css.map"))
+	assert.True(t, fingerprintedRegex.MatchString("/static/media/logo.5d5d9eef.svg"))
+	assert.False(t, fingerprintedRegex.MatchString("/favicon.ico"))
+}
+
+func TestSPAHandlerContentType(t *testing.T) {
+	h := newSPAHandlerFS(http.FS(fstest.MapFS{
+		"index.html":             {Data: []byte(testIndexHTML)},
+		"static/js/main.abc1.js": {Data: []byte("console.log('hi');")},
+		"static/wasm/app.wasm":   {Data: []byte("\x00asm\x01\x00\x00\x00")},
+		"static/media/LOGO.PNG":  {Data: []byte("\x89PNG\r\n\x1a\n")},
+		// Would be sniffed as HTML
+		"uploads/notes": {Data: []byte("<html><script>alert(1)</script>")},
+		"misc/data.xyz": {Data: []byte("<script>alert(1)</script>")},
+	}))
+
+	for _, tt := range []struct {
+		url, ctype, disposition string
+	}{
+		{"/static/js/main.abc1.js", "text/javascript; charset=utf-8", ""},
+		{"/static/wasm/app.wasm", "application/wasm", ""},
+		{"/static/media/LOGO.PNG", "image/png", ""},
+		{"/uploads/notes", "application/octet-stream", "attachment"},
+		{"/misc/data.xyz", "application/octet-stream", "attachment"},
+		{"/dashboard", "text/html; charset=utf-8", ""}, // index.html
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tt.url, nil))
+		require.Equal(t, http.StatusOK, rec.Code, tt.url)
+		assert.Equal(t, tt.ctype, rec.Header().Get("Content-Type"), tt.url)
+		assert.Equal(t, tt.disposition, rec.Header().Get("Content-Disposition"),
+			tt.url)
+	}
+}
+
+func TestSPAHandlerPrecompressed(t *testing.T) {
+	const (
+		plain  = "console.log('plain');"
+		brotli = "brotli bytes"
+		gzip   = "gzip bytes"
+	)
+	h := newSPAHandlerFS(http.FS(fstest.MapFS{
+		"index.html":                  {Data: []byte(testIndexHTML)},
+		testHashedAsset:               {Data: []byte(plain)},
+		testHashedAsset + ".br":       {Data: []byte(brotli)},
+		testHashedAsset + ".gz":       {Data: []byte(gzip)},
+		"static/css/main.abc1.css":    {Data: []byte("body{}")},
+		"static/css/main.abc1.css.gz": {Data: []byte(gzip)},
+	}))
+
+	serve := func(url, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		// As in NewRouter, which mustn't compress them again
+		Compress(h).ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, []string{"Accept-Encoding"}, rec.Header()["Vary"])
+		return rec
+	}
+
+	etags := map[string]bool{}
+	for _, tt := range []struct {
+		acceptEncoding, encoding, body string
+	}{
+		{"gzip, deflate, br", "br", brotli},
+		{"br;q=1.0, gzip;q=0.8", "br", brotli},
+		{"gzip, deflate", "gzip", gzip},
+		{"br;q=0, gzip", "gzip", gzip},
+		{"", "", plain},
+		{"identity", "", plain},
+		{"br;q=0, gzip;q=0", "", plain},
+	} {
+		rec := serve("/"+testHashedAsset, tt.acceptEncoding)
+		assert.Equal(t, tt.encoding, rec.Header().Get("Content-Encoding"),
+			tt.acceptEncoding)
+		assert.Equal(t, tt.body, rec.Body.String(), tt.acceptEncoding)
+		assert.Equal(t, "text/javascript; charset=utf-8",
+			rec.Header().Get("Content-Type"), tt.acceptEncoding)
+		assert.Equal(t, cacheControlImmutable, rec.Header().Get("Cache-Control"),
+			tt.acceptEncoding)
+		etags[rec.Header().Get("ETag")] = true
+	}
+	// One per representation
+	assert.Len(t, etags, 3)
+
+	// Falls back to the .gz if there's no .br
+	rec := serve("/static/css/main.abc1.css", "br, gzip")
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, gzip, rec.Body.String())
+	assert.Equal(t, "text/css; charset=utf-8", rec.Header().Get("Content-Type"))
+}
+
+func TestSPAHandlerFileETag(t *testing.T) {
+	buildDir, cleanup := newTestBuildDir(t)
+	defer cleanup()
+
+	// On disk and embedded
+	embedded := newSPAHandlerFS(http.FS(fstest.MapFS{
+		"index.html":    {Data: []byte(testIndexHTML)},
+		testHashedAsset: {Data: []byte("console.log('hashed');")},
+	}))
+	for _, h := range []*SPAHandler{NewSPAHandler(buildDir), embedded} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/"+testHashedAsset, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "console.log('hashed');", rec.Body.String())
+
+		etag := rec.Header().Get("ETag")
+		require.NotEmpty(t, etag)
+
+		headers := http.Header{"If-None-Match": []string{etag}}
+		testURL(t, "GET", "/"+testHashedAsset, headers, h,
+			http.StatusNotModified, "")
+
+		headers = http.Header{"If-None-Match": []string{`"stale"`}}
+		testURL(t, "GET", "/"+testHashedAsset, headers, h, http.StatusOK,
+			"console.log('hashed');")
+	}
+}
+
+// pushRecorder is an httptest.ResponseRecorder that records what's
+// pushed to it, as though it were an HTTP/2 connection
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (rec *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	rec.pushed = append(rec.pushed, target)
+	return nil
+}
+
+func TestSPAHandlerPush(t *testing.T) {
+	index := `<html><head>` +
+		`<link href="/static/css/main.1a2b3c4d.css" rel="stylesheet">` +
+		`</head><body>` +
+		`<script src="/static/js/2.aabbccdd.chunk.js"></script>` +
+		`<script src="/static/js/main.8d3f2a1c.chunk.js"></script>` +
+		`</body></html>`
+	h := newSPAHandlerFS(http.FS(fstest.MapFS{
+		"index.html": {Data: []byte(index)},
+	}))
+
+	get := func(url string) []string {
+		rec := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		// Pushers are found through middleware wrapping the writer
+		Compress(h).ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		return rec.pushed
+	}
+
+	// Off by default
+	assert.Empty(t, get("/"))
+
+	h.Push = true
+	assert.Equal(t, []string{"/static/css/main.1a2b3c4d.css",
+		"/static/js/main.8d3f2a1c.chunk.js"}, get("/dashboard"))
+}
+
+func BenchmarkIndexFromDisk(b *testing.B) {
+	buildDir, cleanup := newTestBuildDir(b)
+	defer cleanup()
+
+	indexPath := filepath.Join(buildDir, "index.html")
+
+	// How index.html used to be served
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		contents, err := ioutil.ReadFile(indexPath)
+		if err != nil {
+			writeIndexError(w, err)
+			return
+		}
+		w.Write(contents)
+	})
+	benchmarkHandler(b, h, "/dashboard")
+}
+
+func BenchmarkIndexCached(b *testing.B) {
+	buildDir, cleanup := newTestBuildDir(b)
+	defer cleanup()
+
+	benchmarkHandler(b, NewSPAHandler(buildDir), "/dashboard")
+}
+
+func benchmarkHandler(b *testing.B, h http.Handler, url string) {
+	req := httptest.NewRequest("GET", url, nil)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
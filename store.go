@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cryptag/minishare/miniware"
+)
+
+var ErrAuthTokenExpired = errors.New("Auth token expired")
+
+// Session describes one auth token issued to a miniLock ID.
+type Session struct {
+	AuthToken string
+	Created   time.Time
+	LastSeen  time.Time // Zero if it hasn't been used since it was issued
+}
+
+// Store maps auth tokens to the miniLock IDs they were issued to.
+// Implementations expire tokens after their configured TTL.
+type Store interface {
+	// GetMinilockID returns the miniLock ID authToken maps to, or
+	// miniware.ErrAuthTokenNotFound/ErrAuthTokenExpired
+	GetMinilockID(authToken string) (string, error)
+	SetMinilockID(authToken, mID string) error
+	// DeleteMinilockID revokes authToken, returning
+	// miniware.ErrAuthTokenNotFound if it wasn't mapped
+	DeleteMinilockID(authToken string) error
+	// SetLastSeen records that authToken was used at at (unless it was
+	// already seen later), returning miniware.ErrAuthTokenNotFound if
+	// it isn't mapped
+	SetLastSeen(authToken string, at time.Time) error
+
+	// Sessions returns the unexpired auth tokens mapped to mID,
+	// oldest first
+	Sessions(mID string) ([]Session, error)
+	// DeleteAllForMinilockID atomically revokes every auth token
+	// mapped to mID, returning how many there were
+	DeleteAllForMinilockID(mID string) (int, error)
+
+	// Ping reports whether the store is reachable and responsive
+	Ping() error
+}
+
+type tokenInfo struct {
+	mID      string
+	created  time.Time
+	lastSeen time.Time
+}
+
+// Mapper is the in-memory Store. It does what miniware.Mapper does,
+// plus expiry, revocation, and looking up tokens by miniLock ID.
+type Mapper struct {
+	lock sync.RWMutex
+	m    map[string]*tokenInfo          // map[authToken]*tokenInfo
+	byID map[string]map[string]struct{} // map[mID]set of authTokens
+
+	ttl time.Duration // 0 means auth tokens never expire
+	now func() time.Time
+}
+
+func NewMapper() *Mapper {
+	return NewMapperWithTTL(0)
+}
+
+// NewMapperWithTTL returns a Mapper whose auth tokens expire ttl
+// after they're set.
+func NewMapperWithTTL(ttl time.Duration) *Mapper {
+	return &Mapper{
+		m:    map[string]*tokenInfo{},
+		byID: map[string]map[string]struct{}{},
+		ttl:  ttl,
+		now:  time.Now,
+	}
+}
+
+// SetClock replaces the function used to tell the time; useful for
+// simulating token expiry in tests.
+func (m *Mapper) SetClock(now func() time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.now = now
+}
+
+func (m *Mapper) expired(info *tokenInfo) bool {
+	return m.ttl > 0 && m.now().Sub(info.created) >= m.ttl
+}
+
+// GetMinilockID returns the miniLock ID that authToken maps to.
+// Expired tokens are purged as they're encountered, returning
+// ErrAuthTokenExpired.
+func (m *Mapper) GetMinilockID(authToken string) (string, error) {
+	m.lock.RLock()
+	info, ok := m.m[authToken]
+	expired := ok && m.expired(info)
+	m.lock.RUnlock()
+
+	if !ok {
+		return "", miniware.ErrAuthTokenNotFound
+	}
+	if expired {
+		m.lock.Lock()
+		if m.m[authToken] == info {
+			m.remove(authToken)
+		}
+		m.lock.Unlock()
+		return "", ErrAuthTokenExpired
+	}
+	return info.mID, nil
+}
+
+func (m *Mapper) SetMinilockID(authToken, mID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.m[authToken]; ok {
+		m.remove(authToken)
+	}
+
+	m.m[authToken] = &tokenInfo{mID: mID, created: m.now()}
+	if m.byID[mID] == nil {
+		m.byID[mID] = map[string]struct{}{}
+	}
+	m.byID[mID][authToken] = struct{}{}
+	return nil
+}
+
+func (m *Mapper) SetLastSeen(authToken string, at time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	info, ok := m.m[authToken]
+	if !ok || m.expired(info) {
+		return miniware.ErrAuthTokenNotFound
+	}
+	if at.After(info.lastSeen) {
+		info.lastSeen = at
+	}
+	return nil
+}
+
+// remove deletes authToken from both the forward map and the reverse
+// index. m.lock must be held for writing.
+func (m *Mapper) remove(authToken string) {
+	info, ok := m.m[authToken]
+	if !ok {
+		return
+	}
+	delete(m.m, authToken)
+
+	tokens := m.byID[info.mID]
+	delete(tokens, authToken)
+	if len(tokens) == 0 {
+		delete(m.byID, info.mID)
+	}
+}
+
+func (m *Mapper) Sessions(mID string) ([]Session, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var sessions []Session
+	for authToken := range m.byID[mID] {
+		info := m.m[authToken]
+		if m.expired(info) {
+			continue
+		}
+		sessions = append(sessions, Session{
+			AuthToken: authToken,
+			Created:   info.created,
+			LastSeen:  info.lastSeen,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+	return sessions, nil
+}
+
+// DeleteExpired removes every expired auth token, returning how many
+// were removed.
+func (m *Mapper) DeleteExpired() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var n int
+	for authToken, info := range m.m {
+		if m.expired(info) {
+			m.remove(authToken)
+			n++
+		}
+	}
+	return n
+}
+
+// Len returns the number of auth tokens currently mapped, including
+// any expired ones not yet purged.
+func (m *Mapper) Len() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return len(m.m)
+}
+
+// DeleteMinilockID removes the mapping for authToken, thereby
+// revoking it. Returns miniware.ErrAuthTokenNotFound if authToken was
+// not mapped to begin with (e.g., it was already revoked).
+func (m *Mapper) DeleteMinilockID(authToken string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.m[authToken]; !ok {
+		return miniware.ErrAuthTokenNotFound
+	}
+	m.remove(authToken)
+	return nil
+}
+
+func (m *Mapper) DeleteAllForMinilockID(mID string) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var n int
+	for authToken := range m.byID[mID] {
+		m.remove(authToken)
+		n++
+	}
+	return n, nil
+}
+
+// Ping returns once m's lock can be acquired; a deadlocked Mapper
+// never returns.
+func (m *Mapper) Ping() error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// StartTokenReaper launches a goroutine that deletes expired auth
+// tokens from m every interval, since users who never log out would
+// otherwise leave them behind forever. Stops when ctx is done.
+func StartTokenReaper(ctx context.Context, m *Mapper, interval time.Duration) {
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				log.Debug("Token reaper: stopping")
+				return
+			case <-tick.C:
+				reapTokens(m)
+			}
+		}
+	}()
+}
+
+func reapTokens(m *Mapper) int {
+	n := m.DeleteExpired()
+	log.Debugf("Token reaper: reaped %d expired auth token(s)", n)
+	return n
+}
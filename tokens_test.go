@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cryptag/minishare/miniware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReapTokens(t *testing.T) {
+	m := NewMapperWithTTL(time.Hour)
+	now := time.Now()
+	m.SetClock(func() time.Time { return now })
+
+	m.SetMinilockID("stale1", "mID1")
+	m.SetMinilockID("stale2", "mID2")
+
+	now = now.Add(2 * time.Hour)
+	m.SetMinilockID("fresh", "mID3")
+
+	assert.Equal(t, 2, reapTokens(m))
+	assert.Equal(t, 1, m.Len())
+
+	_, err := m.GetMinilockID("stale1")
+	assert.Equal(t, miniware.ErrAuthTokenNotFound, err)
+
+	mID, err := m.GetMinilockID("fresh")
+	assert.NoError(t, err)
+	assert.Equal(t, "mID3", mID)
+}
+
+func TestStartTokenReaper(t *testing.T) {
+	m := NewMapperWithTTL(time.Hour)
+	m.SetClock(func() time.Time { return time.Now().Add(-2 * time.Hour) })
+	m.SetMinilockID("stale", "mID")
+	m.SetClock(time.Now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	StartTokenReaper(ctx, m, time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for m.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 0, m.Len())
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// Finished spans are exported this often, or sooner once
+	// TRACE_BATCH_SIZE of them are waiting
+	TRACE_EXPORT_INTERVAL = 5 * time.Second
+	TRACE_BATCH_SIZE      = 512
+	// Spans finished while this many are waiting are dropped
+	TRACE_MAX_QUEUE = 4 * TRACE_BATCH_SIZE
+
+	OTLP_EXPORT_TIMEOUT = 10 * time.Second
+)
+
+const spanKey contextKey = "span"
+
+// SpanKind is a span's OTLP kind
+type SpanKind int
+
+const (
+	SpanKindServer SpanKind = 2
+	SpanKindClient SpanKind = 3
+)
+
+// Span is one timed operation in a trace, e.g. serving a request.
+type Span struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte // All zero for a trace's root span
+	Name       string
+	Kind       SpanKind
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes map[string]interface{} // Strings and ints
+	Error      bool
+
+	// Unsampled spans are passed on, but not exported
+	sampled bool
+	tracer  *Tracer
+}
+
+// SetAttribute sets the attribute key to value, a string or int.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.Attributes[key] = value
+}
+
+// End finishes s and queues it to be exported.
+func (s *Span) End() {
+	s.EndTime = time.Now()
+	if s.sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// traceparent returns s's W3C Trace Context header value.
+func (s *Span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", s.TraceID, s.SpanID, flags)
+}
+
+// Sampler decides which traces are recorded, as the OpenTelemetry
+// sampler named by OTEL_TRACES_SAMPLER would (see newSampler).
+type Sampler struct {
+	// Fraction of traces recorded, chosen by trace ID so that services
+	// sampling at the same ratio record the same traces
+	Ratio float64
+	// Whether traces continued from a traceparent header are recorded
+	// if and only if the caller recorded them, rather than by Ratio
+	ParentBased bool
+}
+
+// AlwaysSample records every trace, whatever callers say.
+var AlwaysSample = Sampler{Ratio: 1}
+
+// sample says whether to record a trace, remote if it was continued
+// from a traceparent header, whose sampled flag is remoteSampled.
+func (s Sampler) sample(traceID [16]byte, remote, remoteSampled bool) bool {
+	if remote && s.ParentBased {
+		return remoteSampled
+	}
+	if s.Ratio >= 1 {
+		return true
+	}
+	// As OpenTelemetry SDKs' TraceIDRatioBased sampler does
+	x := binary.BigEndian.Uint64(traceID[8:]) >> 1
+	return x < uint64(s.Ratio*(1<<63))
+}
+
+// newSampler returns the sampler cfg names, e.g. traceidratio with a
+// ratio of 0.1, or parentbased_always_on.
+func newSampler(cfg *Config) (Sampler, error) {
+	name := cfg.OTELTracesSampler
+	s := Sampler{ParentBased: strings.HasPrefix(name, "parentbased_")}
+	switch strings.TrimPrefix(name, "parentbased_") {
+	case "always_on":
+		s.Ratio = 1
+	case "always_off":
+	case "traceidratio":
+		s.Ratio = 1
+		if arg := cfg.OTELTracesSamplerArg; arg != "" {
+			ratio, err := strconv.ParseFloat(arg, 64)
+			if err != nil || ratio < 0 || ratio > 1 {
+				return Sampler{}, fmt.Errorf("Trace sampler ratio `%s` must"+
+					" be from 0 to 1", arg)
+			}
+			s.Ratio = ratio
+		}
+	default:
+		return Sampler{}, fmt.Errorf("Unsupported trace sampler `%s`; must"+
+			" be always_on, always_off, or traceidratio, optionally"+
+			" prefixed with parentbased_", name)
+	}
+	return s, nil
+}
+
+// SpanExporter sends finished spans somewhere, e.g. to an OTLP
+// collector (see otlpExporter).
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+// Tracer records a span for every request that passes through its
+// Middleware, with a child span for each request made to PostgREST on
+// its behalf (see tracingTransport), and exports them in batches. A
+// request's trace is continued from its traceparent header, if any,
+// and passed on to PostgREST in the same header; whether it's recorded
+// is up to the Tracer's Sampler. A nil *Tracer traces nothing.
+type Tracer struct {
+	exporter SpanExporter
+	sampler  Sampler
+
+	lock  sync.Mutex
+	queue []*Span
+
+	full      chan struct{}
+	closed    chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewTracer returns a Tracer exporting the traces sampler picks to
+// exporter until it's closed.
+func NewTracer(exporter SpanExporter, sampler Sampler) *Tracer {
+	tr := &Tracer{
+		exporter: exporter,
+		sampler:  sampler,
+		full:     make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go tr.exportLoop()
+	return tr
+}
+
+// newTracer returns a Tracer exporting to the OTLP collector cfg
+// points at, or nil if it doesn't point at one.
+func newTracer(cfg *Config) (*Tracer, error) {
+	sampler, err := newSampler(cfg)
+	if err != nil {
+		return nil, err
+	}
+	exporter, err := newTraceExporter(cfg)
+	if exporter == nil || err != nil {
+		return nil, err
+	}
+	log.Infof("Tracing: exporting spans to %v", exporter.url)
+	return NewTracer(exporter, sampler), nil
+}
+
+// newTraceExporter returns an exporter to the OTLP collector cfg
+// points at, or nil if it doesn't point at one. Nothing is sent until
+// a Tracer is started with it.
+func newTraceExporter(cfg *Config) (*otlpExporter, error) {
+	endpoint, path := cfg.OTLPTracesEndpoint, ""
+	if endpoint == "" {
+		endpoint, path = cfg.OTLPEndpoint, "/v1/traces"
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+	// OTLP/HTTP with protobuf, the SDKs' default, and gRPC would need
+	// their libraries
+	if cfg.OTLPProtocol != "" && cfg.OTLPProtocol != "http/json" {
+		return nil, fmt.Errorf("Unsupported OTLP protocol `%s`; only"+
+			" http/json is supported", cfg.OTLPProtocol)
+	}
+	return newOTLPExporter(endpoint, path, cfg.OTLPHeaders,
+		cfg.OTELServiceName)
+}
+
+// Middleware records a server span for each request, named for the
+// route it matched (see labelRoutes).
+func (tr *Tracer) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		span := tr.startSpan(req.Header.Get("traceparent"),
+			"HTTP "+req.Method, SpanKindServer)
+		ctx := context.WithValue(req.Context(), spanKey, span)
+
+		// Shared with Metrics.Middleware, if it's further out
+		route, ok := ctx.Value(routeLabelKey).(*string)
+		if !ok {
+			route = new(string)
+			ctx = context.WithValue(ctx, routeLabelKey, route)
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, req.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttribute("http.request.method", req.Method)
+		span.SetAttribute("url.path", req.URL.Path)
+		span.SetAttribute("http.response.status_code", rec.status)
+		if *route != "" {
+			span.Name = req.Method + " " + *route
+			span.SetAttribute("http.route", *route)
+		}
+		span.Error = rec.status >= 500
+		span.End()
+	})
+}
+
+// startSpan starts a root span, or a child of the remote span named by
+// traceparent if it's valid.
+func (tr *Tracer) startSpan(traceparent, name string, kind SpanKind) *Span {
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		StartTime:  time.Now(),
+		Attributes: map[string]interface{}{},
+		tracer:     tr,
+	}
+	if traceID, parentID, sampled, ok := parseTraceparent(traceparent); ok {
+		span.TraceID, span.ParentID = traceID, parentID
+		span.sampled = tr.sampler.sample(traceID, true, sampled)
+	} else {
+		rand.Read(span.TraceID[:])
+		span.sampled = tr.sampler.sample(span.TraceID, false, false)
+	}
+	rand.Read(span.SpanID[:])
+	return span
+}
+
+// startChild starts a span within parent's trace.
+func (tr *Tracer) startChild(parent *Span, name string, kind SpanKind) *Span {
+	span := &Span{
+		TraceID:    parent.TraceID,
+		ParentID:   parent.SpanID,
+		Name:       name,
+		Kind:       kind,
+		StartTime:  time.Now(),
+		Attributes: map[string]interface{}{},
+		sampled:    parent.sampled,
+		tracer:     tr,
+	}
+	rand.Read(span.SpanID[:])
+	return span
+}
+
+func (tr *Tracer) enqueue(span *Span) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	if len(tr.queue) >= TRACE_MAX_QUEUE {
+		log.Debugf("Tracing: export queue full; dropping span %q", span.Name)
+		return
+	}
+	tr.queue = append(tr.queue, span)
+	if len(tr.queue) >= TRACE_BATCH_SIZE {
+		select {
+		case tr.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (tr *Tracer) exportLoop() {
+	defer close(tr.done)
+
+	ticker := time.NewTicker(TRACE_EXPORT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-tr.full:
+		case <-tr.closed:
+			tr.export()
+			return
+		}
+		tr.export()
+	}
+}
+
+func (tr *Tracer) export() {
+	for {
+		tr.lock.Lock()
+		batch := tr.queue
+		if len(batch) > TRACE_BATCH_SIZE {
+			batch = batch[:TRACE_BATCH_SIZE]
+		}
+		tr.queue = tr.queue[len(batch):]
+		tr.lock.Unlock()
+
+		if len(batch) == 0 {
+			return
+		}
+		if err := tr.exporter.ExportSpans(batch); err != nil {
+			log.Errorf("Tracing: error exporting %d spans: %v", len(batch), err)
+		}
+	}
+}
+
+// Close exports any spans still waiting, then stops exporting.
+func (tr *Tracer) Close() {
+	if tr == nil {
+		return
+	}
+	tr.closeOnce.Do(func() { close(tr.closed) })
+	<-tr.done
+}
+
+// parseTraceparent parses a W3C Trace Context traceparent header,
+// e.g. "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func parseTraceparent(header string) (traceID [16]byte, spanID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return
+	}
+	// Later versions may add fields, but not change these
+	if parts[0] == "00" && len(parts) != 4 {
+		return
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 ||
+		strings.ToLower(header) != header {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil {
+		return
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || traceID == [16]byte{} || spanID == [8]byte{} {
+		return
+	}
+	return traceID, spanID, flags[0]&1 == 1, true
+}
+
+// tracingTransport records a client span around each request to
+// PostgREST made while serving a traced request, passing the trace on
+// in a traceparent header. Requests that aren't being traced go
+// through untouched.
+type tracingTransport struct {
+	http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parent, ok := req.Context().Value(spanKey).(*Span)
+	if !ok {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	span := parent.tracer.startChild(parent, "HTTP "+req.Method,
+		SpanKindClient)
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("server.address", req.URL.Host)
+	span.SetAttribute("url.path", req.URL.Path)
+
+	// RoundTrippers mustn't modify the request they're given
+	req = req.Clone(req.Context())
+	req.Header.Set("traceparent", span.traceparent())
+	req.Header.Del("tracestate")
+
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		span.SetAttribute("error.type", fmt.Sprintf("%T", err))
+		span.Error = true
+	} else {
+		span.SetAttribute("http.response.status_code", resp.StatusCode)
+		span.Error = resp.StatusCode >= 500
+	}
+	span.End()
+	return resp, err
+}
+
+// otlpExporter sends spans to an OpenTelemetry collector using OTLP's
+// HTTP/JSON encoding.
+type otlpExporter struct {
+	url     string
+	headers http.Header
+	service string
+	client  *http.Client
+}
+
+// newOTLPExporter returns an exporter to the collector at endpoint
+// (traces are POSTed to it, plus path if given, e.g. /v1/traces),
+// sending headers, a comma-separated list of key=value pairs, with
+// each request.
+func newOTLPExporter(endpoint, path, headers, service string) (*otlpExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("OTLP endpoint `%s` must be an http(s) URL",
+			endpoint)
+	}
+	if path != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + path
+	}
+
+	exporter := &otlpExporter{
+		url:     u.String(),
+		headers: http.Header{},
+		service: service,
+		client:  &http.Client{Timeout: OTLP_EXPORT_TIMEOUT},
+	}
+	for _, pair := range splitList(headers) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("OTLP headers must be key=value pairs")
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding OTLP header %s: %v",
+				kv[0], err)
+		}
+		exporter.headers.Set(strings.TrimSpace(kv[0]), value)
+	}
+	return exporter, nil
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"` // int64s are strings in JSON
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Code int `json:"code,omitempty"` // 2 is an error
+	} `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case int:
+		s := strconv.Itoa(v)
+		kv.Value.IntValue = &s
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+func (e *otlpExporter) ExportSpans(spans []*Span) error {
+	var ss otlpScopeSpans
+	ss.Scope.Name = "github.com/EffectiveAF/effective"
+	ss.Scope.Version = version
+
+	for _, span := range spans {
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(span.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.SpanID[:]),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+		}
+		if span.ParentID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(span.ParentID[:])
+		}
+		for key, value := range span.Attributes {
+			out.Attributes = append(out.Attributes, otlpAttribute(key, value))
+		}
+		if span.Error {
+			out.Status.Code = 2
+		}
+		ss.Spans = append(ss.Spans, out)
+	}
+
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{ss}}
+	rs.Resource.Attributes = []otlpKeyValue{
+		otlpAttribute("service.name", e.service),
+		otlpAttribute("service.version", version),
+	}
+	payload, err := json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{rs},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	for name, values := range e.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP collector responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memorySpanExporter keeps every span exported to it
+type memorySpanExporter struct {
+	lock  sync.Mutex
+	spans []*Span
+}
+
+func (e *memorySpanExporter) ExportSpans(spans []*Span) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+// newTracedServer returns a server chain, tracing what sampler picks
+// to the returned exporter, in front of a PostgREST that records the
+// traceparent headers it's sent.
+func newTracedServer(t *testing.T, sampler Sampler) (*MiddlewareChain, *memorySpanExporter, *[]string) {
+	var traceparents []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparents = append(traceparents, req.Header.Get("traceparent"))
+		w.Write([]byte("[]"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	cfg := testConfig()
+	cfg.PostgrestBaseURL = upstream.URL
+	m := NewMapper()
+	metrics := NewMetrics(m)
+	r, err := NewRouter(cfg, m, testServerKeys, metrics, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	exporter := &memorySpanExporter{}
+	tracer := NewTracer(exporter, sampler)
+	chain, err := newServerChain(cfg, metrics, tracer, nil, r)
+	require.NoError(t, err)
+	chain.OnClose(tracer.Close)
+	return chain, exporter, &traceparents
+}
+
+func TestTracingProxiedRequest(t *testing.T) {
+	chain, exporter, traceparents := newTracedServer(t, AlwaysSample)
+
+	rec := httptest.NewRecorder()
+	chain.ServeHTTP(rec, httptest.NewRequest("GET", "/postgrest/todos", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	chain.Close()
+
+	require.Len(t, exporter.spans, 2)
+	client, server := exporter.spans[0], exporter.spans[1]
+
+	assert.Equal(t, "GET /postgrest/", server.Name)
+	assert.Equal(t, SpanKindServer, server.Kind)
+	assert.Equal(t, [8]byte{}, server.ParentID)
+	assert.Equal(t, "GET", server.Attributes["http.request.method"])
+	assert.Equal(t, "/postgrest/", server.Attributes["http.route"])
+	assert.Equal(t, http.StatusOK, server.Attributes["http.response.status_code"])
+	assert.False(t, server.Error)
+
+	assert.Equal(t, SpanKindClient, client.Kind)
+	assert.Equal(t, server.TraceID, client.TraceID)
+	assert.Equal(t, server.SpanID, client.ParentID)
+	assert.Equal(t, http.StatusOK, client.Attributes["http.response.status_code"])
+	assert.True(t, !client.StartTime.Before(server.StartTime) &&
+		!client.EndTime.After(server.EndTime), "child outside parent")
+
+	// PostgREST was told which span it's under
+	assert.Equal(t, []string{fmt.Sprintf("00-%x-%x-01", client.TraceID,
+		client.SpanID)}, *traceparents)
+}
+
+func TestTracingContinuesTrace(t *testing.T) {
+	chain, exporter, traceparents := newTracedServer(t,
+		Sampler{Ratio: 1, ParentBased: true})
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentID := "00f067aa0ba902b7"
+	req := httptest.NewRequest("GET", "/postgrest/todos", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	chain.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Not sampled upstream, so passed on but not recorded
+	req = httptest.NewRequest("GET", "/postgrest/todos", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-00")
+	chain.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Garbage starts a new trace
+	req = httptest.NewRequest("GET", "/healthz", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-0000000000000000-01")
+	chain.ServeHTTP(httptest.NewRecorder(), req)
+	chain.Close()
+
+	require.Len(t, exporter.spans, 3)
+	server := exporter.spans[1]
+	assert.Equal(t, traceID, hex.EncodeToString(server.TraceID[:]))
+	assert.Equal(t, parentID, hex.EncodeToString(server.ParentID[:]))
+	assert.Equal(t, server.TraceID, exporter.spans[0].TraceID)
+
+	require.Len(t, *traceparents, 2)
+	assert.Regexp(t, "^00-"+traceID+"-[0-9a-f]{16}-00$", (*traceparents)[1])
+
+	healthz := exporter.spans[2]
+	assert.Equal(t, "GET /healthz", healthz.Name)
+	assert.NotEqual(t, traceID, hex.EncodeToString(healthz.TraceID[:]))
+	assert.Equal(t, [8]byte{}, healthz.ParentID)
+}
+
+func TestTracingIgnoresCallersSampledFlag(t *testing.T) {
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-"
+
+	// Recorded though the caller didn't
+	chain, exporter, traceparents := newTracedServer(t, AlwaysSample)
+	req := httptest.NewRequest("GET", "/postgrest/todos", nil)
+	req.Header.Set("traceparent", traceparent+"00")
+	chain.ServeHTTP(httptest.NewRecorder(), req)
+	chain.Close()
+	assert.Len(t, exporter.spans, 2)
+	require.Len(t, *traceparents, 1)
+	assert.Regexp(t, "-01$", (*traceparents)[0])
+
+	// Not recorded though the caller did
+	chain, exporter, traceparents = newTracedServer(t, Sampler{})
+	req = httptest.NewRequest("GET", "/postgrest/todos", nil)
+	req.Header.Set("traceparent", traceparent+"01")
+	chain.ServeHTTP(httptest.NewRecorder(), req)
+	chain.Close()
+	assert.Empty(t, exporter.spans)
+	require.Len(t, *traceparents, 1)
+	assert.Regexp(t, "-00$", (*traceparents)[0])
+}
+
+func TestNewSampler(t *testing.T) {
+	for _, tt := range []struct {
+		sampler, arg string
+		want         Sampler
+	}{
+		{"always_on", "", Sampler{Ratio: 1}},
+		{"always_off", "", Sampler{}},
+		{"traceidratio", "", Sampler{Ratio: 1}},
+		{"traceidratio", "0.25", Sampler{Ratio: 0.25}},
+		{"parentbased_always_on", "", Sampler{Ratio: 1, ParentBased: true}},
+		{"parentbased_traceidratio", "0", Sampler{ParentBased: true}},
+	} {
+		cfg := testConfig()
+		cfg.OTELTracesSampler, cfg.OTELTracesSamplerArg = tt.sampler, tt.arg
+		s, err := newSampler(cfg)
+		if assert.NoError(t, err, tt.sampler) {
+			assert.Equal(t, tt.want, s, tt.sampler)
+		}
+	}
+
+	for _, tt := range []struct{ sampler, arg string }{
+		{"jaeger_remote", ""},
+		{"parentbased_", ""},
+		{"traceidratio", "1.5"},
+		{"traceidratio", "half"},
+	} {
+		cfg := testConfig()
+		cfg.OTELTracesSampler, cfg.OTELTracesSamplerArg = tt.sampler, tt.arg
+		_, err := newSampler(cfg)
+		assert.Error(t, err, tt.sampler)
+	}
+
+	// By the low 63 bits of the trace ID, as OpenTelemetry SDKs do
+	half := Sampler{Ratio: 0.5}
+	var traceID [16]byte
+	traceID[8] = 0x7f
+	assert.True(t, half.sample(traceID, false, false))
+	traceID[8] = 0x80
+	assert.False(t, half.sample(traceID, false, false))
+	assert.False(t, half.sample(traceID, true, true))
+	assert.False(t, Sampler{}.sample(traceID, false, false))
+	assert.True(t, Sampler{ParentBased: true}.sample(traceID, true, true))
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var got struct {
+		path, contentType, auth string
+		body                    otlpRequest
+	}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got.path = req.URL.Path
+		got.contentType = req.Header.Get("Content-Type")
+		got.auth = req.Header.Get("Authorization")
+		body, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(body, &got.body)
+	}))
+	defer collector.Close()
+
+	cfg := testConfig()
+	cfg.OTLPEndpoint = collector.URL + "/otlp/"
+	cfg.OTLPHeaders = "Authorization=Bearer%20s3cret"
+	tracer, err := newTracer(cfg)
+	require.NoError(t, err)
+
+	span := tracer.startSpan("", "GET /healthz", SpanKindServer)
+	span.SetAttribute("http.response.status_code", 503)
+	span.Error = true
+	span.End()
+	tracer.Close()
+
+	assert.Equal(t, "/otlp/v1/traces", got.path)
+	assert.Equal(t, "application/json", got.contentType)
+	assert.Equal(t, "Bearer s3cret", got.auth)
+
+	require.Len(t, got.body.ResourceSpans, 1)
+	rs := got.body.ResourceSpans[0]
+	assert.Equal(t, "service.name", rs.Resource.Attributes[0].Key)
+	assert.Equal(t, "effective", *rs.Resource.Attributes[0].Value.StringValue)
+	require.Len(t, rs.ScopeSpans, 1)
+	require.Len(t, rs.ScopeSpans[0].Spans, 1)
+
+	out := rs.ScopeSpans[0].Spans[0]
+	assert.Equal(t, hex.EncodeToString(span.TraceID[:]), out.TraceID)
+	assert.Equal(t, hex.EncodeToString(span.SpanID[:]), out.SpanID)
+	assert.Empty(t, out.ParentSpanID)
+	assert.Equal(t, "GET /healthz", out.Name)
+	assert.Equal(t, SpanKindServer, out.Kind)
+	assert.Equal(t, 2, out.Status.Code)
+	require.Len(t, out.Attributes, 1)
+	assert.Equal(t, "503", *out.Attributes[0].Value.IntValue)
+
+	// Disabled unless configured
+	tracer, err = newTracer(testConfig())
+	require.NoError(t, err)
+	assert.Nil(t, tracer)
+
+	cfg.OTLPEndpoint = "localhost:4318"
+	_, err = newTracer(cfg)
+	assert.Error(t, err)
+
+	// A traces endpoint is used as is, and overrides the base one
+	cfg.OTLPTracesEndpoint = collector.URL + "/traces"
+	tracer, err = newTracer(cfg)
+	require.NoError(t, err)
+	tracer.startSpan("", "GET /healthz", SpanKindServer).End()
+	tracer.Close()
+	assert.Equal(t, "/traces", got.path)
+
+	for protocol, ok := range map[string]bool{"http/json": true,
+		"http/protobuf": false, "grpc": false} {
+		cfg.OTLPProtocol = protocol
+		_, err = newTracer(cfg)
+		assert.Equal(t, ok, err == nil, protocol)
+	}
+}
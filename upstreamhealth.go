@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// UpstreamHealthChecker probes each PostgREST upstream in the
+// background, so that the balancer can skip unhealthy ones before
+// sending them requests, the circuit breaker can open (and close)
+// without waiting for requests to fail, and /readyz doesn't have to
+// probe PostgREST itself.
+type UpstreamHealthChecker struct {
+	upstreams []*postgrestUpstream
+	path      string
+	interval  time.Duration
+	client    *http.Client
+
+	// Unix nanoseconds when an upstream last became healthy while
+	// none were
+	recoveredAt int64
+}
+
+// NewUpstreamHealthChecker returns a checker for the upstreams in
+// cfg.PostgrestBaseURL, or nil if health checks are disabled. Call
+// Start to start checking.
+func NewUpstreamHealthChecker(cfg *Config) (*UpstreamHealthChecker, error) {
+	if cfg.PostgrestHealthCheckInterval <= 0 {
+		return nil, nil
+	}
+	upstreams, err := parsePostgrestUpstreams(cfg.PostgrestBaseURL)
+	if err != nil {
+		return nil, err
+	}
+	return &UpstreamHealthChecker{
+		upstreams: upstreams,
+		path:      "/" + strings.TrimPrefix(cfg.PostgrestHealthCheckPath, "/"),
+		interval:  cfg.PostgrestHealthCheckInterval,
+		client:    &http.Client{Timeout: READINESS_CHECK_TIMEOUT},
+	}, nil
+}
+
+// Start checks every upstream now, then every interval until ctx is
+// done.
+func (hc *UpstreamHealthChecker) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(hc.interval)
+		defer ticker.Stop()
+		for {
+			hc.CheckNow(ctx)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// CheckNow probes every upstream at once and records the results.
+func (hc *UpstreamHealthChecker) CheckNow(ctx context.Context) {
+	wasHealthy := hc.Healthy()
+
+	var wg sync.WaitGroup
+	for _, u := range hc.upstreams {
+		wg.Add(1)
+		go func(u *postgrestUpstream) {
+			defer wg.Done()
+			err := hc.probe(ctx, u)
+			if ctx.Err() != nil {
+				return
+			}
+			u.setHealthy(err)
+		}(u)
+	}
+	wg.Wait()
+
+	if !wasHealthy && hc.Healthy() {
+		atomic.StoreInt64(&hc.recoveredAt, time.Now().UnixNano())
+	}
+}
+
+func (hc *UpstreamHealthChecker) probe(ctx context.Context, u *postgrestUpstream) error {
+	probeURL := strings.TrimSuffix(u.URL.String(), "/") + hc.path
+	req, err := http.NewRequestWithContext(ctx, "HEAD", probeURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("HEAD %s returned %s", probeURL, resp.Status)
+	}
+	return nil
+}
+
+// Healthy reports whether any upstream passed its last check.
+func (hc *UpstreamHealthChecker) Healthy() bool {
+	for _, u := range hc.upstreams {
+		if u.healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// RecoveredAt returns when an upstream last became healthy after none
+// were, or the zero time if that hasn't happened.
+func (hc *UpstreamHealthChecker) RecoveredAt() time.Time {
+	nanos := atomic.LoadInt64(&hc.recoveredAt)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+func (u *postgrestUpstream) healthy() bool {
+	return atomic.LoadInt32(&u.unhealthy) == 0
+}
+
+// setHealthy records the result of a health check, err being nil if
+// it passed.
+func (u *postgrestUpstream) setHealthy(err error) {
+	var unhealthy int32
+	if err != nil {
+		unhealthy = 1
+	}
+	if atomic.SwapInt32(&u.unhealthy, unhealthy) == unhealthy {
+		return
+	}
+	if err != nil {
+		log.Warnf("PostgREST upstream %s failed its health check: %v",
+			u.URL.Host, err)
+	} else {
+		log.Infof("PostgREST upstream %s is healthy again", u.URL.Host)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSwitchableUpstream returns a PostgREST stand-in whose health
+// checks at /ready fail while *sick is 1
+func newSwitchableUpstream(t *testing.T, name string) (*httptest.Server, *int32) {
+	var sick int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/ready" && atomic.LoadInt32(&sick) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(name))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, &sick
+}
+
+func mustNewRouterHealth(cfg *Config, health *UpstreamHealthChecker) http.Handler {
+	r, err := NewRouter(cfg, NewMapper(), testServerKeys, nil, health, nil, nil, nil)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func TestUpstreamHealthChecker(t *testing.T) {
+	upstream1, sick1 := newSwitchableUpstream(t, "one")
+	upstream2, sick2 := newSwitchableUpstream(t, "two")
+
+	cfg := testConfig()
+	cfg.PostgrestBaseURL = upstream1.URL + "," + upstream2.URL
+	cfg.PostgrestHealthCheckInterval = 10 * time.Millisecond
+	cfg.PostgrestHealthCheckPath = "ready"
+	health, err := NewUpstreamHealthChecker(cfg)
+	require.NoError(t, err)
+	router := mustNewRouterHealth(cfg, health)
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	health.Start(ctx)
+
+	first, second := health.upstreams[0], health.upstreams[1]
+	waitForHealth := func(u *postgrestUpstream, healthy bool) {
+		deadline := time.Now().Add(time.Second)
+		for u.healthy() != healthy && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		require.Equal(t, healthy, u.healthy())
+	}
+
+	// One goes down, and stops getting requests
+	atomic.StoreInt32(sick2, 1)
+	waitForHealth(second, false)
+	assert.True(t, first.healthy())
+	for i := 0; i < 4; i++ {
+		testURL(t, "GET", "/postgrest/tasks", nil, router, http.StatusOK, "one")
+	}
+	// We can still serve requests
+	testURL(t, "GET", "/readyz", nil, router, http.StatusOK, "")
+
+	// Both go down
+	atomic.StoreInt32(sick1, 1)
+	waitForHealth(first, false)
+	assert.False(t, health.Healthy())
+	testURL(t, "GET", "/readyz", nil, router, http.StatusServiceUnavailable, "")
+	assert.True(t, health.RecoveredAt().IsZero())
+
+	// One comes back
+	atomic.StoreInt32(sick2, 0)
+	waitForHealth(second, true)
+	assert.False(t, health.RecoveredAt().IsZero())
+	testURL(t, "GET", "/readyz", nil, router, http.StatusOK, "")
+	testURL(t, "GET", "/postgrest/tasks", nil, router, http.StatusOK, "two")
+
+	// Stops on shutdown
+	stop()
+	time.Sleep(20 * time.Millisecond)
+	atomic.StoreInt32(sick2, 1)
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, second.healthy())
+}
+
+func TestCircuitBreakerHealth(t *testing.T) {
+	upstream, sick := newSwitchableUpstream(t, "one")
+
+	cfg := testConfig()
+	cfg.PostgrestBaseURL = upstream.URL
+	cfg.PostgrestHealthCheckInterval = 10 * time.Second // Not started
+	cfg.PostgrestHealthCheckPath = "/ready"
+	health, err := NewUpstreamHealthChecker(cfg)
+	require.NoError(t, err)
+
+	cb := NewCircuitBreaker(1, time.Second, time.Minute, health)
+	now := time.Now()
+	cb.now = func() time.Time { return now }
+
+	// Fails fast while nothing's healthy
+	atomic.StoreInt32(sick, 1)
+	health.CheckNow(context.Background())
+	ok, retryAfter := cb.Allow()
+	assert.False(t, ok)
+	assert.Equal(t, cfg.PostgrestHealthCheckInterval, retryAfter)
+
+	// Half-opens as soon as PostgREST is healthy again, rather than
+	// waiting out the cooldown
+	atomic.StoreInt32(sick, 0)
+	health.CheckNow(context.Background())
+	ok, _ = cb.Allow()
+	require.True(t, ok)
+	now = time.Now()
+	cb.Done(outcomeFailure)
+	require.Equal(t, "open", cb.State())
+
+	ok, _ = cb.Allow()
+	assert.False(t, ok)
+	atomic.StoreInt32(sick, 1)
+	health.CheckNow(context.Background())
+	atomic.StoreInt32(sick, 0)
+	health.CheckNow(context.Background())
+	ok, _ = cb.Allow()
+	assert.True(t, ok)
+	assert.Equal(t, "half-open", cb.State())
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersion(t *testing.T) {
+	testURL(t, "GET", "/api/version", nil, router, http.StatusOK,
+		`{"version":"dev","git_commit":"unknown","build_time":"unknown"}`)
+
+	// Readable without basic auth credentials
+	cfg := testConfig()
+	cfg.BasicAuthUsername = "team"
+	cfg.BasicAuthPassword = "correct horse battery staple"
+	r := mustNewRouterConfig(cfg, NewMapper())
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/api/version", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, contentTypeJSON, rec.Header().Get("Content-Type"))
+
+	var info map[string]string
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	assert.Equal(t, map[string]string{
+		"version":    "dev",
+		"git_commit": "unknown",
+		"build_time": "unknown",
+	}, info)
+}